@@ -10,6 +10,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,6 +20,90 @@ import (
 
 var version = "dev"
 
+// faultFlags collects repeated -fault flags.
+type faultFlags []mockbosh.FaultConfig
+
+func (f *faultFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *faultFlags) Set(value string) error {
+	fault, err := mockbosh.ParseFault(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fault)
+	return nil
+}
+
+// maintenanceFlags collects repeated -maintenance flags.
+type maintenanceFlags []mockbosh.MaintenanceWindow
+
+func (m *maintenanceFlags) String() string {
+	return fmt.Sprint(*m)
+}
+
+func (m *maintenanceFlags) Set(value string) error {
+	window, err := mockbosh.ParseMaintenanceWindow(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, window)
+	return nil
+}
+
+// sanFlags collects repeated -tls-san flags.
+type sanFlags []string
+
+func (f *sanFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *sanFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// durationsFlag collects -durations overrides, merging repeated flags.
+type durationsFlag mockbosh.TaskDurations
+
+func (d durationsFlag) String() string {
+	return mockbosh.TaskDurations(d).String()
+}
+
+func (d durationsFlag) Set(value string) error {
+	parsed, err := mockbosh.ParseTaskDurations(value)
+	if err != nil {
+		return err
+	}
+	for action, duration := range parsed {
+		d[action] = duration
+	}
+	return nil
+}
+
+// teamsFlag collects -teams user-to-team pairs, merging repeated flags.
+type teamsFlag mockbosh.UserTeams
+
+func (t teamsFlag) String() string {
+	return mockbosh.UserTeams(t).String()
+}
+
+func (t teamsFlag) Set(value string) error {
+	parsed, err := mockbosh.ParseUserTeams(value)
+	if err != nil {
+		return err
+	}
+	for user, teams := range parsed {
+		for _, team := range teams {
+			if !slices.Contains(t[user], team) {
+				t[user] = append(t[user], team)
+			}
+		}
+	}
+	return nil
+}
+
 func main() {
 	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "-v") {
 		fmt.Printf("mock-bosh-director %s\n", version)
@@ -30,11 +116,55 @@ func main() {
 	flag.StringVar(&config.Username, "username", config.Username, "Basic auth username")
 	flag.StringVar(&config.Password, "password", config.Password, "Basic auth password")
 	flag.BoolVar(&config.UseTLS, "tls", config.UseTLS, "Enable TLS with self-signed cert")
+	flag.StringVar(&config.TLSCertFile, "tls-cert", config.TLSCertFile, "PEM certificate file to serve instead of a self-signed cert (requires -tls-key)")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", config.TLSKeyFile, "PEM private key file for -tls-cert")
+	var sans sanFlags
+	flag.Var(&sans, "tls-san", "Extra DNS name or IP for the self-signed cert (repeatable)")
 	flag.Float64Var(&config.Speed, "speed", config.Speed, "Simulation speed multiplier (1.0 = normal)")
 	flag.BoolVar(&config.Debug, "debug", config.Debug, "Enable debug logging")
+	flag.StringVar(&config.StateFile, "state-file", config.StateFile, "JSON file to load state from and save state to on shutdown")
+	flag.StringVar(&config.FixturesDir, "fixtures-dir", config.FixturesDir, "Directory of deployments.yml, stemcells.yml, and tasks.yml replacing those fixtures")
+	flag.BoolVar(&config.Empty, "empty", config.Empty, "Start with no default fixtures")
+	flag.IntVar(&config.Deployments, "deployments", config.Deployments, "Add this many synthetic app-NNNN deployments to the fixtures when greater than 3")
+	flag.StringVar(&config.AuthMode, "auth-mode", config.AuthMode, "Authentication mode: basic or uaa")
+	flag.StringVar(&config.DirectorName, "director-name", config.DirectorName, "Director name reported by /info")
+	flag.StringVar(&config.DirectorUUID, "director-uuid", config.DirectorUUID, "Director UUID reported by /info")
+	flag.StringVar(&config.DirectorVersion, "director-version", config.DirectorVersion, "Director version reported by /info")
+	flag.BoolVar(&config.RequireDeleteConfirm, "require-delete-confirm", config.RequireDeleteConfirm, "Require ?confirm=<deployment> to delete a deployment")
+	flag.BoolVar(&config.Metrics, "metrics", config.Metrics, "Serve Prometheus-style request and task counters at /metrics (unauthenticated)")
+	flag.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Access log format: text (debug only) or json (one object per request)")
+	flag.StringVar(&config.CORSOrigin, "cors-origin", config.CORSOrigin, "Send CORS headers allowing this origin (* for any) and answer OPTIONS preflights without auth (empty = off)")
+	flag.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "Maximum requests per second across all clients; excess get 429 (0 = unlimited)")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "Maximum time to read a request (0 = no limit)")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "Maximum time to write a response, including streams (0 = no limit)")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "Maximum time to keep an idle keep-alive connection open (0 = no limit)")
+	flag.DurationVar(&config.StartupDelay, "startup-delay", config.StartupDelay, "Return 503 from everything but /info and /health for this long after start")
+	flag.DurationVar(&config.IPAssignDelay, "ip-assign-delay", config.IPAssignDelay, "Delay before newly deployed instances report IPs (scaled by -speed)")
+	flag.IntVar(&config.MaxConcurrentTasks, "max-concurrent-tasks", config.MaxConcurrentTasks, "Maximum tasks processing at once; others queue (0 = unlimited)")
+	flag.StringVar(&config.InstanceNaming, "instance-naming", config.InstanceNaming, "Instance name convention in responses and tasks: id (job/id) or index (job/index)")
+	flag.StringVar(&config.BoshVersionMode, "bosh-version-mode", config.BoshVersionMode, "Emulate an older (legacy) or newer (modern) director's routing, task responses, error bodies, and /info version")
+	var faults faultFlags
+	flag.Var(&faults, "fault", "Inject errors as [METHOD:]PATH:STATUS[@PROBABILITY] (repeatable)")
+	var maintenance maintenanceFlags
+	flag.Var(&maintenance, "maintenance", "Reject mutating requests during START/END (RFC 3339) or \"daily HH:MM-HH:MM\" UTC (repeatable)")
+	flag.Float64Var(&config.FailureRate, "failure-rate", config.FailureRate, "Chance (0-1) that each task fails at random")
+	flag.Float64Var(&config.Jitter, "jitter", config.Jitter, "Vary each task delay by up to this fraction either way, staggering concurrent tasks (0 = off)")
+	flag.Int64Var(&config.Seed, "seed", config.Seed, "Seed for random task failures so runs reproduce (0 = seed from the clock, logged at startup)")
+	durations := durationsFlag{}
+	flag.Var(durations, "durations", "Override task durations as ACTION=DURATION[,...] (delete, deploy, migrate, recreate, start, stop, restart)")
+	teams := teamsFlag{}
+	flag.Var(teams, "teams", "Scope users to their teams' deployments as USER:TEAM[,...]; team users log in with -password")
 	flag.Parse()
+	config.Faults = faults
+	config.TLSSANs = sans
+	config.MaintenanceWindows = maintenance
+	config.TaskDurations = mockbosh.TaskDurations(durations)
+	config.Teams = mockbosh.UserTeams(teams)
 
-	server := mockbosh.NewServer(config)
+	server, err := mockbosh.NewServer(config)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 
 	// Handle shutdown signals
 	shutdown := make(chan os.Signal, 1)
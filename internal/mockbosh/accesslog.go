@@ -0,0 +1,72 @@
+// ABOUTME: Pluggable access logging for completed requests, as text lines in
+// ABOUTME: debug mode or one JSON object per request for log tooling.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// AccessRecord describes one completed request.
+type AccessRecord struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	RemoteAddr string  `json:"remote_addr"`
+	User       string  `json:"user"`
+}
+
+// AccessLogger records completed requests.
+type AccessLogger interface {
+	Log(AccessRecord)
+}
+
+// newAccessLogger returns the logger for a format. Text lines are only
+// written in debug mode, so text without debug returns nil.
+func newAccessLogger(format string, debug bool, out io.Writer) (AccessLogger, error) {
+	switch format {
+	case "", LogFormatText:
+		if !debug {
+			return nil, nil
+		}
+		return textAccessLogger{}, nil
+	case LogFormatJSON:
+		return &jsonAccessLogger{out: out}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// textAccessLogger writes a short line per request to the standard logger.
+type textAccessLogger struct{}
+
+func (textAccessLogger) Log(rec AccessRecord) {
+	log.Printf("%s %s %d %v", rec.Method, rec.Path, rec.Status, time.Duration(rec.DurationMS*float64(time.Millisecond)))
+}
+
+// jsonAccessLogger writes one JSON object per line.
+type jsonAccessLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (l *jsonAccessLogger) Log(rec AccessRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
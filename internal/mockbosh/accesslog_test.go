@@ -0,0 +1,118 @@
+// ABOUTME: Tests for access logging.
+// ABOUTME: Verifies records captured per request and the JSON line format.
+
+package mockbosh
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger captures access records for assertions.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []AccessRecord
+}
+
+func (l *recordingLogger) Log(rec AccessRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, rec)
+}
+
+func TestAccessLogRecords(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	logger := &recordingLogger{}
+	server.accessLog = logger
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.loggingMiddleware(server.authMiddleware(mux))
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/missing", nil)
+	req.SetBasicAuth("admin", "admin")
+	req.RemoteAddr = "192.0.2.1:5000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(logger.records) != 1 {
+		t.Fatalf("Expected one access record, got %d", len(logger.records))
+	}
+	rec := logger.records[0]
+	if rec.Method != http.MethodGet || rec.Path != "/deployments/missing" || rec.Status != http.StatusNotFound {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+	if rec.User != "admin" || rec.RemoteAddr != "192.0.2.1:5000" || rec.DurationMS < 0 {
+		t.Errorf("Expected user, remote address, and duration, got %+v", rec)
+	}
+}
+
+func TestAccessLogRecordsUAAUser(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AuthMode = AuthModeUAA
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	logger := &recordingLogger{}
+	server.accessLog = logger
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.loggingMiddleware(server.authMiddleware(mux))
+
+	token, err := server.handlers.tokens.Issue("admin")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/deployments", nil))
+
+	if len(logger.records) != 2 {
+		t.Fatalf("Expected two access records, got %d", len(logger.records))
+	}
+	if rec := logger.records[0]; rec.Status != http.StatusOK || rec.User != "admin" {
+		t.Errorf("Expected the token's user on an authenticated request, got %+v", rec)
+	}
+	if rec := logger.records[1]; rec.Status != http.StatusUnauthorized || rec.User != "" {
+		t.Errorf("Expected no user on an unauthenticated request, got %+v", rec)
+	}
+}
+
+func TestJSONAccessLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newAccessLogger(LogFormatJSON, false, &out)
+	if err != nil {
+		t.Fatalf("newAccessLogger failed: %v", err)
+	}
+	logger.Log(AccessRecord{Method: "GET", Path: "/info", Status: 200, DurationMS: 1.5, RemoteAddr: "192.0.2.1:5000"})
+	logger.Log(AccessRecord{Method: "PUT", Path: "/deployments/cf", Status: 302, User: "admin"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per request, got %q", out.String())
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("Failed to unmarshal %q: %v", lines[0], err)
+	}
+	for _, key := range []string{"method", "path", "status", "duration_ms", "remote_addr", "user"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("Expected %s in %s", key, lines[0])
+		}
+	}
+
+	if logger, _ := newAccessLogger(LogFormatText, false, &out); logger != nil {
+		t.Error("Expected no text access log outside debug mode")
+	}
+	if _, err := newAccessLogger("xml", false, &out); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+}
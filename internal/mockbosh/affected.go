@@ -0,0 +1,102 @@
+// ABOUTME: Records the VMs and instances a task's steps changed by
+// ABOUTME: comparing a deployment's resources before and after each step.
+
+package mockbosh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// resourceSnapshot is a deployment's VM CIDs and a fingerprint of each
+// instance, keyed by instance name.
+type resourceSnapshot struct {
+	vmCIDs    map[string]bool
+	instances map[string]string
+}
+
+// snapshotResources captures a deployment's current VMs and instances.
+func (s *State) snapshotResources(deployment string) resourceSnapshot {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	snap := resourceSnapshot{vmCIDs: map[string]bool{}, instances: map[string]string{}}
+	for _, vm := range s.data.VMs[deployment] {
+		if vm.VMCID != "" {
+			snap.vmCIDs[vm.VMCID] = true
+		}
+	}
+	for _, inst := range s.data.Instances[deployment] {
+		name := s.naming.instanceName(inst.Job, inst.ID, inst.Index)
+		fingerprint := fmt.Sprintf("%s|%s|%s|%v|%s|%s", inst.VMCID, inst.AgentID, inst.AZ, inst.IPs, inst.State, inst.Disk)
+		for _, p := range inst.Processes {
+			fingerprint += "|" + p.Name + ":" + p.State
+		}
+		snap.instances[name] = fingerprint
+	}
+	return snap
+}
+
+// affectedSince lists what changed between two snapshots of a deployment.
+func affectedSince(before, after resourceSnapshot) AffectedResources {
+	var affected AffectedResources
+	for cid := range after.vmCIDs {
+		if !before.vmCIDs[cid] {
+			affected.VMsCreated = append(affected.VMsCreated, cid)
+		}
+	}
+	for cid := range before.vmCIDs {
+		if !after.vmCIDs[cid] {
+			affected.VMsDeleted = append(affected.VMsDeleted, cid)
+		}
+	}
+	for name, fingerprint := range after.instances {
+		if before.instances[name] != fingerprint {
+			affected.Instances = append(affected.Instances, name)
+		}
+	}
+	for name := range before.instances {
+		if _, ok := after.instances[name]; !ok {
+			affected.Instances = append(affected.Instances, name)
+		}
+	}
+	return affected
+}
+
+// RecordAffectedResources adds resources a task changed to those already
+// recorded on it, keeping each list sorted and free of duplicates.
+func (s *State) RecordAffectedResources(id int, affected AffectedResources) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	merged := AffectedResources{VMsCreated: []string{}, VMsDeleted: []string{}, Instances: []string{}}
+	if t.AffectedResources != nil {
+		merged = *t.AffectedResources
+	}
+	merged.VMsCreated = mergeNames(merged.VMsCreated, affected.VMsCreated)
+	merged.VMsDeleted = mergeNames(merged.VMsDeleted, affected.VMsDeleted)
+	merged.Instances = mergeNames(merged.Instances, affected.Instances)
+	// Replace rather than mutate, since task copies share the pointer
+	t.AffectedResources = &merged
+	return nil
+}
+
+// mergeNames returns the sorted union of two name lists.
+func mergeNames(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	result := []string{}
+	for _, list := range [][]string{a, b} {
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
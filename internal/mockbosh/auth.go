@@ -0,0 +1,158 @@
+// ABOUTME: UAA-style OAuth token issuing and validation.
+// ABOUTME: Issues HMAC-signed JWT-looking bearer tokens for client_credentials.
+
+package mockbosh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authentication modes.
+const (
+	AuthModeBasic = "basic"
+	AuthModeUAA   = "uaa"
+)
+
+// tokenTTL is how long issued access tokens remain valid.
+const tokenTTL = 1 * time.Hour
+
+// TokenResponse is the /oauth/token response body.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+	JTI         string `json:"jti"`
+}
+
+// OAuthError is a UAA-style error response.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// tokenClaims are the claims encoded in an access token.
+type tokenClaims struct {
+	JTI       string   `json:"jti"`
+	Subject   string   `json:"sub"`
+	ClientID  string   `json:"client_id"`
+	Issuer    string   `json:"iss"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Scope     []string `json:"scope"`
+	GrantType string   `json:"grant_type"`
+}
+
+// TokenIssuer signs and validates access tokens with a per-process secret.
+type TokenIssuer struct {
+	issuer string
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewTokenIssuer creates a token issuer with a random signing secret.
+func NewTokenIssuer(issuer string) (*TokenIssuer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate token secret: %w", err)
+	}
+	return &TokenIssuer{
+		issuer: issuer,
+		secret: secret,
+		ttl:    tokenTTL,
+		now:    time.Now,
+	}, nil
+}
+
+// withIssuer returns a copy of ti that names issuer in the tokens it issues
+// and validates the same tokens ti does.
+func (ti *TokenIssuer) withIssuer(issuer string) *TokenIssuer {
+	copied := *ti
+	copied.issuer = issuer
+	return &copied
+}
+
+// Issue creates a signed access token for a client.
+func (ti *TokenIssuer) Issue(clientID string) (TokenResponse, error) {
+	jtiBytes := make([]byte, 16)
+	if _, err := rand.Read(jtiBytes); err != nil {
+		return TokenResponse{}, err
+	}
+
+	now := ti.now()
+	claims := tokenClaims{
+		JTI:       hex.EncodeToString(jtiBytes),
+		Subject:   clientID,
+		ClientID:  clientID,
+		Issuer:    ti.issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ti.ttl).Unix(),
+		Scope:     []string{"bosh.admin"},
+		GrantType: "client_credentials",
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	token := signingInput + "." + encodeSegment(ti.sign(signingInput))
+
+	return TokenResponse{
+		AccessToken: token,
+		TokenType:   "bearer",
+		ExpiresIn:   int(ti.ttl.Seconds()),
+		Scope:       strings.Join(claims.Scope, " "),
+		JTI:         claims.JTI,
+	}, nil
+}
+
+// Validate checks that a token was signed by this issuer and has not expired.
+func (ti *TokenIssuer) Validate(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature")
+	}
+	if !hmac.Equal(sig, ti.sign(parts[0]+"."+parts[1])) {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token payload")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed token claims")
+	}
+	if ti.now().Unix() >= claims.ExpiresAt {
+		return fmt.Errorf("token expired")
+	}
+	return nil
+}
+
+func (ti *TokenIssuer) sign(input string) []byte {
+	mac := hmac.New(sha256.New, ti.secret)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
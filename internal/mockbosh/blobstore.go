@@ -0,0 +1,40 @@
+// ABOUTME: In-memory blobstore for artifacts tasks produce, such as reports.
+// ABOUTME: Blobs are addressed by ID and served from /resources/:id.
+
+package mockbosh
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// PutBlob stores content under id, replacing any existing blob.
+func (s *State) PutBlob(id, content string) *Blob {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	sum := sha1.Sum([]byte(content))
+	blob := &Blob{
+		ID:        id,
+		SHA1:      hex.EncodeToString(sum[:]),
+		Content:   content,
+		CreatedAt: time.Now().Unix(),
+	}
+	s.data.Blobs[id] = blob
+	return blob
+}
+
+// GetBlob returns a blob by ID.
+func (s *State) GetBlob(id string) (*Blob, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	blob, ok := s.data.Blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("blob '%s' not found", id)
+	}
+	copy := *blob
+	return &copy, nil
+}
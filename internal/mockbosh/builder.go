@@ -0,0 +1,125 @@
+// ABOUTME: Chainable builder for custom state, so Go tests embedding the mock
+// ABOUTME: can seed exactly the deployments, VMs, and tasks they need.
+
+package mockbosh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StateBuilder assembles StateData for NewServerWithState, starting from
+// empty fixtures.
+type StateBuilder struct {
+	data *StateData
+}
+
+// NewStateBuilder returns a builder with no deployments, VMs, or tasks.
+func NewStateBuilder() *StateBuilder {
+	return &StateBuilder{data: EmptyFixtures()}
+}
+
+// AddDeployment adds or replaces a deployment. Nil lists become empty.
+func (b *StateBuilder) AddDeployment(d Deployment) *StateBuilder {
+	if d.CloudConfig == "" {
+		d.CloudConfig = "latest"
+	}
+	if d.Releases == nil {
+		d.Releases = []NameVersion{}
+	}
+	if d.Stemcells == nil {
+		d.Stemcells = []NameVersion{}
+	}
+	if d.Teams == nil {
+		d.Teams = []string{}
+	}
+	b.data.Deployments[d.Name] = &d
+	return b
+}
+
+// AddVM adds a VM to its Deployment, adding the deployment if needed, along
+// with the instance running on it. Blank IDs, CIDs, and states are filled in
+// the way the default fixtures name them.
+func (b *StateBuilder) AddVM(vm VM) *StateBuilder {
+	if _, ok := b.data.Deployments[vm.Deployment]; !ok {
+		b.AddDeployment(Deployment{Name: vm.Deployment})
+	}
+	slug := strings.ReplaceAll(vm.Job, "_", "-")
+	if vm.ID == "" {
+		vm.ID = fmt.Sprintf("%s-%s-%d-id", vm.Deployment, slug, vm.Index)
+	}
+	if vm.VMCID == "" {
+		vm.VMCID = fmt.Sprintf("vm-%s-%s-%d", vm.Deployment, slug, vm.Index)
+	}
+	if vm.AgentID == "" {
+		vm.AgentID = agentID(vm.Deployment, vm.Job, vm.Index, 0)
+	}
+	if vm.State == "" {
+		vm.State = "started"
+	}
+	if vm.ProcessState == "" {
+		vm.ProcessState = "running"
+		if vm.State != "started" {
+			vm.ProcessState = "stopped"
+		}
+	}
+	if vm.Lifecycle == "" {
+		vm.Lifecycle = LifecycleService
+	}
+	if vm.IPs == nil {
+		vm.IPs = []string{}
+	}
+	vm.Active = vm.State == "started"
+	b.data.VMs[vm.Deployment] = append(b.data.VMs[vm.Deployment], vm)
+
+	state := "running"
+	if vm.State != "started" {
+		state = vm.State
+	}
+	b.data.Instances[vm.Deployment] = append(b.data.Instances[vm.Deployment], Instance{
+		AgentID:    vm.AgentID,
+		AZ:         vm.AZ,
+		Bootstrap:  vm.Bootstrap,
+		Deployment: vm.Deployment,
+		Expects:    true,
+		ID:         vm.ID,
+		IPs:        append([]string{}, vm.IPs...),
+		Job:        vm.Job,
+		Index:      vm.Index,
+		State:      state,
+		VMType:     vm.VMType,
+		VMCID:      vm.VMCID,
+		Lifecycle:  vm.Lifecycle,
+		Jobs:       vm.Jobs,
+		Ignore:     vm.Ignore,
+	})
+	return b
+}
+
+// AddTask adds a task, numbering it after the last one when ID is 0. Tasks
+// default to done, run by admin, now.
+func (b *StateBuilder) AddTask(task Task) *StateBuilder {
+	if task.ID == 0 {
+		task.ID = b.data.nextTaskID + 1
+	}
+	if task.ID > b.data.nextTaskID {
+		b.data.nextTaskID = task.ID
+	}
+	if task.State == "" {
+		task.State = "done"
+	}
+	if task.User == "" {
+		task.User = "admin"
+	}
+	if task.Timestamp == 0 {
+		task.Timestamp = time.Now().Unix()
+	}
+	b.data.Tasks[task.ID] = &task
+	return b
+}
+
+// Build returns the assembled state. The builder must not be used after.
+func (b *StateBuilder) Build() *StateData {
+	return b.data
+}
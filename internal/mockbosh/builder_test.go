@@ -0,0 +1,87 @@
+// ABOUTME: Tests for seeding a server with custom state.
+// ABOUTME: Verifies the builder's defaults and that tasks run against it.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ExampleNewServerWithState() {
+	data := NewStateBuilder().
+		AddDeployment(Deployment{Name: "web"}).
+		AddVM(VM{Deployment: "web", Job: "nginx", Index: 0, AZ: "z1", IPs: []string{"10.0.0.5"}}).
+		AddTask(Task{Description: "create deployment web", Deployment: "web"}).
+		Build()
+
+	config := DefaultServerConfig()
+	config.UseTLS = false
+	server, err := NewServerWithState(config, data)
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/web/vms", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var vms []VM
+	json.Unmarshal(w.Body.Bytes(), &vms)
+	for _, vm := range vms {
+		fmt.Println(vm.Job, vm.Index, vm.IPs[0], vm.VMCID)
+	}
+	// Output: nginx 0 10.0.0.5 vm-web-nginx-0
+}
+
+func TestNewServerWithState(t *testing.T) {
+	data := NewStateBuilder().
+		AddVM(VM{Deployment: "web", Job: "nginx", Index: 0}).
+		AddVM(VM{Deployment: "web", Job: "nginx", Index: 1, State: "stopped"}).
+		AddTask(Task{ID: 41, Description: "create deployment web", Deployment: "web"}).
+		Build()
+
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServerWithState(config, data)
+	if err != nil {
+		t.Fatalf("NewServerWithState failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/web/jobs/nginx?state=started", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); loc != "/tasks/42" {
+		t.Errorf("Expected the next task after the seeded one, got %s", loc)
+	}
+	if task := waitForTask(t, server.state, 42, 2*time.Second); task.State != "done" {
+		t.Fatalf("Expected task done, got %s", task.State)
+	}
+
+	instances, _ := server.state.GetInstances("web")
+	if len(instances) != 2 {
+		t.Fatalf("Expected an instance per VM, got %d", len(instances))
+	}
+	for _, inst := range instances {
+		if inst.State != "running" {
+			t.Errorf("Expected %s/%d running in the injected state, got %s", inst.Job, inst.Index, inst.State)
+		}
+	}
+
+	if data.Deployments["web"] == nil {
+		t.Error("Expected AddVM to add its deployment")
+	}
+}
@@ -0,0 +1,155 @@
+// ABOUTME: Exports the mock director state as a gzipped tarball bundle.
+// ABOUTME: Includes deployment manifests, configs, and the full state JSON.
+
+package mockbosh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleFile is a single file in an export bundle.
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+// ExportBundle assembles an in-memory .tgz containing a manifest per
+// deployment, the current configs, and the full state as state.json.
+func (s *State) ExportBundle() ([]byte, error) {
+	stateJSON, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize state: %w", err)
+	}
+
+	files := []bundleFile{{name: "state.json", content: stateJSON}}
+
+	deployments := s.GetDeployments()
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Name < deployments[j].Name
+	})
+	for _, summary := range deployments {
+		// Deployments deleted between listing and lookup are skipped
+		d, err := s.GetDeployment(summary.Name)
+		if err != nil {
+			continue
+		}
+		manifest := d.Manifest
+		if manifest == "" {
+			vms, err := s.GetVMs(d.Name)
+			if err != nil {
+				continue
+			}
+			manifest = renderManifest(*d, vms)
+		}
+		files = append(files, bundleFile{
+			name:    fmt.Sprintf("manifests/%s.yml", d.Name),
+			content: []byte(manifest),
+		})
+	}
+
+	if cc := s.GetCloudConfig(); cc != nil {
+		files = append(files, bundleFile{name: "configs/cloud.yml", content: []byte(cc.Properties)})
+	}
+	for _, rc := range s.GetRuntimeConfigs() {
+		files = append(files, bundleFile{name: fmt.Sprintf("configs/runtime-%s.yml", rc.Name), content: []byte(rc.Properties)})
+	}
+	if cpi := s.GetCPIConfig(); cpi != nil {
+		files = append(files, bundleFile{name: "configs/cpi.yml", content: []byte(cpi.Properties)})
+	}
+
+	return writeBundle(files)
+}
+
+// writeBundle writes files into a gzipped tar archive.
+func writeBundle(files []bundleFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderManifest builds a minimal deployment manifest from a deployment and
+// its VMs, grouping VMs into instance groups by job. It is used for
+// deployments that have no stored manifest.
+func renderManifest(d Deployment, vms []VM) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "name: %s\n\n", d.Name)
+
+	b.WriteString("releases:\n")
+	for _, r := range d.Releases {
+		fmt.Fprintf(&b, "- name: %s\n  version: %s\n", r.Name, r.Version)
+	}
+
+	b.WriteString("\nstemcells:\n")
+	for _, sc := range d.Stemcells {
+		fmt.Fprintf(&b, "- alias: default\n  name: %s\n  version: \"%s\"\n", sc.Name, sc.Version)
+	}
+
+	type group struct {
+		name      string
+		instances int
+		vmType    string
+		azs       map[string]bool
+	}
+	var groups []*group
+	byName := make(map[string]*group)
+	for _, vm := range vms {
+		g, ok := byName[vm.Job]
+		if !ok {
+			g = &group{name: vm.Job, vmType: vm.VMType, azs: make(map[string]bool)}
+			byName[vm.Job] = g
+			groups = append(groups, g)
+		}
+		g.instances++
+		g.azs[vm.AZ] = true
+	}
+
+	b.WriteString("\ninstance_groups:\n")
+	for _, g := range groups {
+		azs := make([]string, 0, len(g.azs))
+		for az := range g.azs {
+			azs = append(azs, az)
+		}
+		sort.Strings(azs)
+
+		fmt.Fprintf(&b, "- name: %s\n", g.name)
+		fmt.Fprintf(&b, "  instances: %d\n", g.instances)
+		fmt.Fprintf(&b, "  azs: [%s]\n", strings.Join(azs, ", "))
+		fmt.Fprintf(&b, "  vm_type: %s\n", g.vmType)
+		b.WriteString("  stemcell: default\n")
+		b.WriteString("  networks:\n  - name: default\n")
+	}
+
+	return b.String()
+}
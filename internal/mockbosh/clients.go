@@ -0,0 +1,64 @@
+// ABOUTME: User-Agent matching for client-specific response variants.
+// ABOUTME: Lets the mock reproduce version-specific BOSH CLI behavior.
+
+package mockbosh
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ClientProfile tailors responses for clients whose User-Agent matches.
+type ClientProfile struct {
+	Name           string                 // Label identifying the profile
+	OmitInfoFields []string               // /info keys removed for this client
+	InfoOverrides  map[string]interface{} // /info keys added or replaced
+}
+
+// DefaultClientProfiles returns the built-in profiles, keyed by the
+// User-Agent substring they match.
+func DefaultClientProfiles() map[string]ClientProfile {
+	return map[string]ClientProfile{
+		// CLI v5 predates stemcell_os and still reads the legacy features block
+		"bosh-cli/5.": {
+			Name:           "legacy-cli",
+			OmitInfoFields: []string{"stemcell_os"},
+			InfoOverrides: map[string]interface{}{
+				"features": map[string]interface{}{
+					"dns": map[string]interface{}{
+						"status": false,
+						"extras": map[string]interface{}{"domain_name": "bosh"},
+					},
+					"snapshots":     map[string]interface{}{"status": false},
+					"config_server": map[string]interface{}{"status": true},
+				},
+			},
+		},
+	}
+}
+
+// matchClientProfile returns the profile whose key is the longest substring
+// of the request's User-Agent, so more specific keys win.
+func matchClientProfile(profiles map[string]ClientProfile, r *http.Request) (ClientProfile, bool) {
+	ua := r.UserAgent()
+	best := ""
+	for key := range profiles {
+		if key != "" && strings.Contains(ua, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		return ClientProfile{}, false
+	}
+	return profiles[best], true
+}
+
+// applyInfo adjusts an /info response for this client.
+func (p ClientProfile) applyInfo(info map[string]interface{}) {
+	for _, field := range p.OmitInfoFields {
+		delete(info, field)
+	}
+	for k, v := range p.InfoOverrides {
+		info[k] = v
+	}
+}
@@ -0,0 +1,221 @@
+// ABOUTME: Cloud config helpers for the mock BOSH Director.
+// ABOUTME: Reads AZs, subnets, and VM/disk sizing; allocates IPs within an AZ.
+
+package mockbosh
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cloudConfigSummary holds the parts of a cloud config the mock reads.
+type cloudConfigSummary struct {
+	AZs       []string
+	Subnets   []cloudSubnet
+	VMTypes   map[string]vmTypeSize
+	DiskTypes map[string]int
+}
+
+// vmTypeSize is the sizing of a vm_type, from explicit cpu/ram cloud
+// properties or inferred from its machine type.
+type vmTypeSize struct {
+	CPU             int
+	MemoryMB        int
+	EphemeralDiskMB int
+}
+
+// machineTypePattern matches GCE-style machine types such as n1-standard-4.
+var machineTypePattern = regexp.MustCompile(`^[a-z0-9]+-(standard|highmem|highcpu)-(\d+)$`)
+
+// machineTypeMemoryPerCPU is the memory per vCPU of each GCE machine family.
+var machineTypeMemoryPerCPU = map[string]int{
+	"standard": 3840,
+	"highmem":  6656,
+	"highcpu":  922,
+}
+
+// diskSizePattern matches disk type names that state their size, like 10GB.
+var diskSizePattern = regexp.MustCompile(`^(\d+)\s*(MB|GB|TB)$`)
+
+// diskTypeSize returns the size in MB of a persistent disk type, from the
+// cloud config's disk_types or, failing that, a size-like type name.
+func (c cloudConfigSummary) diskTypeSize(diskType string) int {
+	if size, ok := c.DiskTypes[diskType]; ok {
+		return size
+	}
+	m := diskSizePattern.FindStringSubmatch(strings.ToUpper(diskType))
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	switch m[2] {
+	case "GB":
+		return n * 1024
+	case "TB":
+		return n * 1024 * 1024
+	}
+	return n
+}
+
+// cloudSubnet is a manual network subnet and the AZs it serves.
+type cloudSubnet struct {
+	Range string
+	AZs   []string
+}
+
+// hasAZ reports whether the cloud config defines the named AZ.
+func (c cloudConfigSummary) hasAZ(az string) bool {
+	return containsString(c.AZs, az)
+}
+
+// subnetRanges returns the ranges of every subnet serving az.
+func (c cloudConfigSummary) subnetRanges(az string) []string {
+	var ranges []string
+	for _, subnet := range c.Subnets {
+		if containsString(subnet.AZs, az) {
+			ranges = append(ranges, subnet.Range)
+		}
+	}
+	return ranges
+}
+
+// parseCloudConfig extracts AZ names, subnets, vm_type sizing, and disk type
+// sizes from a cloud config. Like
+// parseManifest, it only understands the block-style YAML BOSH configs use.
+func parseCloudConfig(content string) cloudConfigSummary {
+	summary := cloudConfigSummary{
+		VMTypes:   make(map[string]vmTypeSize),
+		DiskTypes: make(map[string]int),
+	}
+	section := ""
+	inSubnets := false
+	vmType := ""
+	diskType := ""
+	machineTypes := make(map[string]string)
+
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			section, _ = splitYAMLKey(trimmed)
+			inSubnets = false
+			continue
+		}
+
+		switch section {
+		case "vm_types":
+			key, value := splitYAMLKey(strings.TrimPrefix(trimmed, "- "))
+			if indent == 0 && key == "name" {
+				vmType = value
+				summary.VMTypes[vmType] = vmTypeSize{}
+				continue
+			}
+			size := summary.VMTypes[vmType]
+			n, _ := strconv.Atoi(value)
+			switch key {
+			case "machine_type", "instance_type":
+				machineTypes[vmType] = value
+			case "cpu":
+				size.CPU = n
+			case "ram":
+				size.MemoryMB = n
+			case "root_disk_size_gb":
+				size.EphemeralDiskMB = n * 1024
+			case "disk":
+				size.EphemeralDiskMB = n
+			}
+			if vmType != "" {
+				summary.VMTypes[vmType] = size
+			}
+		case "disk_types":
+			key, value := splitYAMLKey(strings.TrimPrefix(trimmed, "- "))
+			switch {
+			case indent == 0 && key == "name":
+				diskType = value
+			case key == "disk_size" && diskType != "":
+				summary.DiskTypes[diskType], _ = strconv.Atoi(value)
+			}
+		case "azs":
+			if indent == 0 && strings.HasPrefix(trimmed, "- name:") {
+				_, name := splitYAMLKey(strings.TrimPrefix(trimmed, "- "))
+				summary.AZs = append(summary.AZs, name)
+			}
+		case "networks":
+			if indent == 2 && !strings.HasPrefix(trimmed, "-") {
+				key, _ := splitYAMLKey(trimmed)
+				inSubnets = key == "subnets"
+				continue
+			}
+			if !inSubnets {
+				continue
+			}
+			if strings.HasPrefix(trimmed, "- ") {
+				summary.Subnets = append(summary.Subnets, cloudSubnet{})
+				trimmed = strings.TrimPrefix(trimmed, "- ")
+			}
+			if len(summary.Subnets) == 0 {
+				continue
+			}
+			subnet := &summary.Subnets[len(summary.Subnets)-1]
+			key, value := splitYAMLKey(trimmed)
+			switch key {
+			case "range":
+				subnet.Range = value
+			case "azs":
+				subnet.AZs = parseYAMLList(value)
+			case "az":
+				subnet.AZs = []string{value}
+			}
+		}
+	}
+
+	// Infer sizing the cloud properties don't state from the machine type
+	for name, machineType := range machineTypes {
+		size := summary.VMTypes[name]
+		if m := machineTypePattern.FindStringSubmatch(machineType); m != nil && size.CPU == 0 {
+			size.CPU, _ = strconv.Atoi(m[2])
+			if size.MemoryMB == 0 {
+				size.MemoryMB = size.CPU * machineTypeMemoryPerCPU[m[1]]
+			}
+		}
+		summary.VMTypes[name] = size
+	}
+
+	return summary
+}
+
+// nextFreeIPInRange returns the first unused address in a CIDR range,
+// skipping the first ten addresses BOSH configs usually reserve.
+func nextFreeIPInRange(cidr string, used map[string]bool) string {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	ip = ip.Mask(network.Mask).To4()
+	if ip == nil {
+		return ""
+	}
+
+	for offset := 10; ; offset++ {
+		candidate := make(net.IP, len(ip))
+		copy(candidate, ip)
+		carry := offset
+		for i := len(candidate) - 1; i >= 0 && carry > 0; i-- {
+			sum := int(candidate[i]) + carry
+			candidate[i] = byte(sum % 256)
+			carry = sum / 256
+		}
+		if carry > 0 || !network.Contains(candidate) {
+			return ""
+		}
+		if !used[candidate.String()] {
+			return candidate.String()
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// ABOUTME: Optional CORS headers so browser apps can call the mock, with
+// ABOUTME: OPTIONS preflights answered before authentication.
+
+package mockbosh
+
+import "net/http"
+
+const (
+	corsAllowMethods  = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, Accept-Encoding, If-None-Match"
+	corsExposeHeaders = "Location, ETag, Retry-After"
+)
+
+// corsMiddleware adds CORS headers for the configured origin and answers
+// OPTIONS preflights with 204. It does nothing when CORSOrigin is empty.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	if s.config.CORSOrigin == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", s.config.CORSOrigin)
+		if s.config.CORSOrigin != "*" {
+			h.Add("Vary", "Origin")
+		}
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		// Browsers send preflights without credentials, so they must not
+		// reach the auth middleware
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
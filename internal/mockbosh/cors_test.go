@@ -0,0 +1,87 @@
+// ABOUTME: Tests for CORS support.
+// ABOUTME: Verifies preflights skip auth and real requests carry the headers.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	config := DefaultServerConfig()
+	config.CORSOrigin = "http://localhost:3000"
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.corsMiddleware(server.authMiddleware(mux))
+
+	req := httptest.NewRequest(http.MethodOptions, "/deployments", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected an unauthenticated preflight to get %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Expected the configured origin, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != corsAllowMethods {
+		t.Errorf("Expected allowed methods %q, got %q", corsAllowMethods, got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != corsAllowHeaders {
+		t.Errorf("Expected allowed headers %q, got %q", corsAllowHeaders, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Expected the configured origin on the response, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != corsExposeHeaders {
+		t.Errorf("Expected exposed headers %q, got %q", corsExposeHeaders, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected real requests to still need auth, got %d", w.Code)
+	}
+}
+
+func TestCORSMiddlewareDisabled(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.corsMiddleware(server.authMiddleware(mux))
+
+	req := httptest.NewRequest(http.MethodOptions, "/deployments", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected preflights to need auth without -cors-origin, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no CORS headers by default, got %q", got)
+	}
+}
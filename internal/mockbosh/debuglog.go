@@ -0,0 +1,89 @@
+// ABOUTME: Builds `bosh task --debug` style logs from a task's recorded
+// ABOUTME: progression: lock handling, per-stage and per-instance lines.
+
+package mockbosh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// debugLogPID stands in for the director worker's process ID in log lines.
+const debugLogPID = 4217
+
+// taskVerbs maps the first word of a task description to the verb its
+// per-instance log lines use.
+var taskVerbs = map[string]string{
+	"create":   "updating",
+	"update":   "updating",
+	"delete":   "deleting",
+	"recreate": "recreating",
+	"start":    "starting",
+	"stop":     "stopping",
+	"restart":  "restarting",
+	"migrate":  "migrating",
+	"run":      "running",
+}
+
+// taskDebugLog returns a multi-line debug log for a task, timestamped from
+// when it was created, started, produced each event, and finished.
+func (ts *TaskSimulator) taskDebugLog(task *Task) string {
+	var b strings.Builder
+	line := func(unix int64, level, format string, args ...interface{}) {
+		stamp := time.Unix(unix, 0).UTC().Format("2006-01-02T15:04:05.000000")
+		fmt.Fprintf(&b, "%s, [%s #%d] [task:%d] %5s -- DirectorJobRunner: %s\n",
+			level[:1], stamp, debugLogPID, task.ID, level, fmt.Sprintf(format, args...))
+	}
+
+	verb := ""
+	if fields := strings.Fields(task.Description); len(fields) > 0 {
+		verb = taskVerbs[fields[0]]
+	}
+
+	line(task.Timestamp, "DEBUG", "Looking for task with task id %d", task.ID)
+	line(task.Timestamp, "DEBUG", "Found task %d: %s (state %s, user %s)", task.ID, task.Description, task.State, task.User)
+	if task.StartedAt == 0 {
+		line(task.Timestamp, "INFO", "Task %d is %s", task.ID, task.State)
+		return b.String()
+	}
+
+	line(task.StartedAt, "INFO", "Starting task: %d", task.ID)
+	if task.Deployment != "" {
+		line(task.StartedAt, "INFO", "Acquiring deployment lock on %s", task.Deployment)
+		line(task.StartedAt, "INFO", "Deployment lock acquired: %s", task.Deployment)
+		if names := ts.state.InstanceTaskNames(task.Deployment, "", ""); len(names) > 0 {
+			line(task.StartedAt, "DEBUG", "Instances in deployment %s: %s", task.Deployment, strings.Join(names, ", "))
+		}
+	}
+
+	for _, e := range ts.state.GetTaskEvents(task.ID, 0) {
+		subject := strings.ToLower(e.Stage)
+		if e.Task != e.Stage {
+			subject = e.Task
+			if verb != "" {
+				subject = verb + " " + e.Task
+			}
+		}
+		switch e.State {
+		case "started":
+			line(e.Time, "INFO", "Started %s", subject)
+		case "finished":
+			line(e.Time, "INFO", "Finished %s", subject)
+		case "failed":
+			line(e.Time, "ERROR", "Failed %s", subject)
+		}
+	}
+
+	if !isTerminalTaskState(task.State) {
+		return b.String()
+	}
+	if task.State == "error" {
+		line(task.FinishedAt, "ERROR", "%s", task.Result)
+	}
+	if task.Deployment != "" {
+		line(task.FinishedAt, "INFO", "Deployment lock released: %s", task.Deployment)
+	}
+	line(task.FinishedAt, "INFO", "Task %d %s", task.ID, task.State)
+	return b.String()
+}
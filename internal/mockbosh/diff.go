@@ -0,0 +1,88 @@
+// ABOUTME: Line-based manifest diff for the mock BOSH Director.
+// ABOUTME: Compares manifests as `bosh deploy` previews them, redacting secrets.
+
+package mockbosh
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Diff line states, as in the director's diff response.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+)
+
+// redactedValue replaces sensitive values in diff output.
+const redactedValue = "<redacted>"
+
+// sensitiveKeyPattern matches manifest keys whose values are redacted.
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(password|secret|key)`)
+
+// diffManifests returns the added and removed lines between two manifests,
+// in order, using a longest-common-subsequence line diff. Unchanged lines are
+// omitted, so identical manifests produce an empty diff. Where a line
+// changes, its removal is listed before its replacement.
+func diffManifests(before, after string) [][]string {
+	a := splitManifestLines(before)
+	b := splitManifestLines(after)
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	result := make([][]string, 0)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			result = append(result, []string{redactLine(b[j]), DiffAdded})
+			j++
+		default:
+			result = append(result, []string{redactLine(a[i]), DiffRemoved})
+			i++
+		}
+	}
+	return result
+}
+
+// splitManifestLines splits a manifest into lines, ignoring trailing blank
+// lines so a missing final newline doesn't register as a change.
+func splitManifestLines(manifest string) []string {
+	manifest = strings.TrimRight(manifest, "\n")
+	if manifest == "" {
+		return nil
+	}
+	return strings.Split(manifest, "\n")
+}
+
+// redactLine replaces the value of a "key: value" line when the key looks
+// sensitive, keeping indentation and any list marker.
+func redactLine(line string) string {
+	key, value, ok := strings.Cut(line, ":")
+	if !ok || strings.TrimSpace(value) == "" {
+		return line
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(key), "- "))
+	if !sensitiveKeyPattern.MatchString(name) {
+		return line
+	}
+	return key + ": " + redactedValue
+}
@@ -0,0 +1,104 @@
+// ABOUTME: Attaches and detaches persistent disks on instances, moving
+// ABOUTME: replaced and detached disks to the orphaned disk list.
+
+package mockbosh
+
+import (
+	"fmt"
+	"time"
+)
+
+// AttachDisk attaches diskCID to an instance, orphaning the disk it replaces.
+// A disk attached to any other instance cannot be attached; attaching an
+// orphaned disk removes it from the orphaned list.
+func (s *State) AttachDisk(deployment, job, id, diskCID string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	inst, err := s.diskInstance(deployment, job, id)
+	if err != nil {
+		return err
+	}
+	if inst.Disk == diskCID {
+		return nil
+	}
+	for dep, instances := range s.data.Instances {
+		for _, other := range instances {
+			if other.Disk == diskCID {
+				return fmt.Errorf("disk '%s' is already attached to %s/%s", diskCID, dep, s.naming.instanceName(other.Job, other.ID, other.Index))
+			}
+		}
+	}
+
+	for i, d := range s.data.Disks {
+		if d.DiskCID == diskCID {
+			s.data.Disks = append(s.data.Disks[:i:i], s.data.Disks[i+1:]...)
+			break
+		}
+	}
+	if inst.Disk != "" {
+		s.orphanDisk(deployment, *inst)
+	}
+	inst.Disk = diskCID
+	return nil
+}
+
+// DetachDisk detaches diskCID from an instance and orphans it.
+func (s *State) DetachDisk(deployment, job, id, diskCID string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	inst, err := s.diskInstance(deployment, job, id)
+	if err != nil {
+		return err
+	}
+	if inst.Disk != diskCID {
+		return fmt.Errorf("disk '%s' is not attached to %s", diskCID, s.naming.instanceName(job, id, inst.Index))
+	}
+
+	s.orphanDisk(deployment, *inst)
+	inst.Disk = ""
+	return nil
+}
+
+// diskInstance finds the non-errand instance whose disk is being changed.
+// The caller must hold the write lock.
+func (s *State) diskInstance(deployment, job, id string) (*Instance, error) {
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		if instances[i].Job == job && instances[i].ID == id {
+			if instances[i].Lifecycle == LifecycleErrand {
+				return nil, fmt.Errorf("instance '%s/%s' is an errand and has no VM", job, id)
+			}
+			return &instances[i], nil
+		}
+	}
+	return nil, fmt.Errorf("instance '%s/%s' not found", job, id)
+}
+
+// orphanDisk adds an instance's current disk to the orphaned list, sized by
+// its instance group's persistent_disk_type. The caller must hold the write
+// lock.
+func (s *State) orphanDisk(deployment string, inst Instance) {
+	size := 0
+	if n := len(s.data.CloudConfigs); n > 0 {
+		cloud := parseCloudConfig(s.data.CloudConfigs[n-1].Properties)
+		for _, g := range parseManifest(s.data.Deployments[deployment].Manifest).InstanceGroups {
+			if g.Name == inst.Job {
+				size = cloud.diskTypeSize(g.PersistentDiskType)
+			}
+		}
+	}
+
+	s.data.Disks = append(s.data.Disks, OrphanedDisk{
+		DiskCID:      inst.Disk,
+		Size:         size,
+		Deployment:   deployment,
+		InstanceName: s.naming.instanceName(inst.Job, inst.ID, inst.Index),
+		AZ:           inst.AZ,
+		OrphanedAt:   time.Now().UTC().Format(snapshotTimeFormat),
+	})
+}
@@ -0,0 +1,72 @@
+// ABOUTME: Per-action task durations for the task simulator.
+// ABOUTME: Parses overrides like "recreate=10s,deploy=60s" for slow-task testing.
+
+package mockbosh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TaskDurations maps a task action to how long its main work takes before
+// speed scaling. Actions are delete, deploy, migrate, recreate, start, stop,
+// and restart.
+type TaskDurations map[string]time.Duration
+
+// DefaultTaskDurations returns the durations the simulator uses unless
+// overridden. Restarts spend half their duration stopping and half starting.
+func DefaultTaskDurations() TaskDurations {
+	return TaskDurations{
+		"delete":   2 * time.Second,
+		"deploy":   2 * time.Second,
+		"migrate":  3 * time.Second,
+		"recreate": 3 * time.Second,
+		"start":    1 * time.Second,
+		"stop":     1 * time.Second,
+		"restart":  2 * time.Second,
+	}
+}
+
+// ParseTaskDurations parses comma-separated action=duration pairs, e.g.
+// "recreate=10s,deploy=60s". Actions must be ones DefaultTaskDurations knows.
+func ParseTaskDurations(spec string) (TaskDurations, error) {
+	known := DefaultTaskDurations()
+	result := make(TaskDurations)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		action, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid duration %q: expected ACTION=DURATION", pair)
+		}
+		action = strings.TrimSpace(action)
+		if _, ok := known[action]; !ok {
+			return nil, fmt.Errorf("invalid duration %q: unknown action %q", pair, action)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %q: bad duration", pair)
+		}
+		result[action] = d
+	}
+	return result, nil
+}
+
+// String formats the durations in the form ParseTaskDurations accepts.
+func (d TaskDurations) String() string {
+	actions := make([]string, 0, len(d))
+	for action := range d {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	pairs := make([]string, len(actions))
+	for i, action := range actions {
+		pairs[i] = fmt.Sprintf("%s=%s", action, d[action])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,54 @@
+// ABOUTME: Tests for per-action task durations.
+// ABOUTME: Verifies duration spec parsing and that overrides slow tasks down.
+
+package mockbosh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTaskDurations(t *testing.T) {
+	durations, err := ParseTaskDurations("recreate=10s, deploy=1m")
+	if err != nil {
+		t.Fatalf("ParseTaskDurations failed: %v", err)
+	}
+	if durations["recreate"] != 10*time.Second || durations["deploy"] != time.Minute || len(durations) != 2 {
+		t.Errorf("Unexpected durations: %v", durations)
+	}
+	if s := durations.String(); s != "deploy=1m0s,recreate=10s" {
+		t.Errorf("Expected String to round-trip, got %q", s)
+	}
+
+	invalid := []string{"recreate", "reboot=10s", "errand=5s", "deploy=soon", "stop=-1s"}
+	for _, spec := range invalid {
+		if _, err := ParseTaskDurations(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestTaskDurationOverride(t *testing.T) {
+	state := NewState()
+	simulator := NewTaskSimulator(state, 10.0, false)
+	simulator.SetTaskDurations(TaskDurations{"stop": 5 * time.Second})
+
+	if d := simulator.actionDuration("start"); d != DefaultTaskDurations()["start"] {
+		t.Errorf("Expected default start duration, got %s", d)
+	}
+	if d := simulator.actionDuration("migrate"); d != 3*time.Second {
+		t.Errorf("Expected a 3s default migrate duration, got %s", d)
+	}
+
+	// At 10x, stop takes 500ms instead of the default 100ms
+	task := state.CreateTask("stop redis", "redis", "admin")
+	simulator.ExecuteStop(task.ID, "redis", "", "", false)
+
+	time.Sleep(400 * time.Millisecond)
+	if got, _ := state.GetTask(task.ID); got.State != "processing" {
+		t.Errorf("Expected slow stop still processing, got %s", got.State)
+	}
+	if got := waitForTask(t, state, task.ID, 2*time.Second); got.State != "done" {
+		t.Errorf("Expected stop to finish, got %s", got.State)
+	}
+}
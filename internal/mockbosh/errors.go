@@ -0,0 +1,75 @@
+// ABOUTME: Registry of error codes returned in error response bodies.
+// ABOUTME: Mirrors director error codes where the real API defines one.
+
+package mockbosh
+
+import (
+	"net/http"
+	"sort"
+)
+
+// ErrorCode describes an error the mock can return. Code is the value of the
+// "code" field in the response body and Status is the HTTP status.
+type ErrorCode struct {
+	Code        int    `json:"code"`
+	Name        string `json:"name"`
+	Status      int    `json:"http_status"`
+	Description string `json:"description"`
+}
+
+// Director error codes used in place of the HTTP status.
+var (
+	ErrCodeTaskNotFound       = ErrorCode{Code: 10000, Name: "TaskNotFound", Status: http.StatusNotFound, Description: "Task does not exist"}
+	ErrCodeDeploymentNotFound = ErrorCode{Code: 70000, Name: "DeploymentNotFound", Status: http.StatusNotFound, Description: "Deployment does not exist"}
+	ErrCodeUnauthorized       = ErrorCode{Code: 600000, Name: "Unauthorized", Status: http.StatusUnauthorized, Description: "Missing or invalid credentials"}
+)
+
+// directorErrorCodes lists every director-specific code the mock returns.
+var directorErrorCodes = []ErrorCode{
+	ErrCodeTaskNotFound,
+	ErrCodeDeploymentNotFound,
+	ErrCodeUnauthorized,
+}
+
+// statusErrorCodes are the HTTP statuses writeError returns with the status
+// itself as the code.
+var statusErrorCodes = []int{
+	http.StatusBadRequest,
+	http.StatusForbidden,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusConflict,
+	http.StatusPreconditionFailed,
+	http.StatusRequestEntityTooLarge,
+	http.StatusUnprocessableEntity,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusServiceUnavailable,
+}
+
+// ErrorCatalog returns every error code the mock can produce, ordered by code.
+// Injected faults may additionally return any configured status.
+func ErrorCatalog() []ErrorCode {
+	catalog := make([]ErrorCode, 0, len(directorErrorCodes)+len(statusErrorCodes))
+	catalog = append(catalog, directorErrorCodes...)
+	for _, status := range statusErrorCodes {
+		catalog = append(catalog, ErrorCode{
+			Code:        status,
+			Name:        http.StatusText(status),
+			Status:      status,
+			Description: http.StatusText(status),
+		})
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		return catalog[i].Code < catalog[j].Code
+	})
+	return catalog
+}
+
+// writeErrorCode writes an error response carrying a director error code.
+func writeErrorCode(w http.ResponseWriter, code ErrorCode, message string) {
+	writeJSON(w, code.Status, ErrorResponse{
+		Code:        code.Code,
+		Description: message,
+	})
+}
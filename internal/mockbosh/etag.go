@@ -0,0 +1,53 @@
+// ABOUTME: ETags and If-None-Match handling for responses clients can cache,
+// ABOUTME: such as configs and /info.
+
+package mockbosh
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// configETag returns an ETag over each config's properties and creation
+// time, so it changes whenever a version is uploaded or deleted.
+func configETag(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// etagMatches reports whether an If-None-Match header names etag. Weak
+// validators match their strong form.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag writes v with an ETag, or 304 with no body when the
+// request's If-None-Match already names it.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, etag string, v interface{}) {
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// bodyETag returns an ETag over v's JSON encoding, for responses that don't
+// carry their own version.
+func bodyETag(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return configETag(string(b))
+}
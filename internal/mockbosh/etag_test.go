@@ -0,0 +1,81 @@
+// ABOUTME: Tests for ETags on cacheable responses.
+// ABOUTME: Verifies 304s for unchanged configs and /info and new tags after changes.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigsETag(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	get := func(query, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/configs?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handlers.HandleConfigs(w, req)
+		return w
+	}
+
+	for _, query := range []string{"type=cloud", "type=runtime", "type=cpi", "type=cloud&latest=false"} {
+		w := get(query, "")
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: expected 200 with an ETag, got %d %q", query, w.Code, etag)
+		}
+		w = get(query, etag)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: expected an empty 304, got %d with %d bytes", query, w.Code, w.Body.Len())
+		}
+		if w := get(query, `"stale", W/`+etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: expected a weak match in a list to count, got %d", query, w.Code)
+		}
+	}
+
+	etag := get("type=cloud", "").Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodPost, "/configs", strings.NewReader(`{"type":"cloud","name":"default","content":"azs:\n- name: z9\n"}`))
+	req.SetBasicAuth("admin", "admin")
+	handlers.HandleConfigs(httptest.NewRecorder(), req)
+
+	w := get("type=cloud", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after an upload, got %d", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("Expected a new ETag after an upload")
+	}
+}
+
+func TestInfoETag(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handlers.HandleInfo(w, req)
+		return w
+	}
+
+	etag := get("").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on /info")
+	}
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	handlers.state.SetResurrection(true)
+	if w := get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag once /info changes, got %d", w.Code)
+	}
+}
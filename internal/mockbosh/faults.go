@@ -0,0 +1,95 @@
+// ABOUTME: Configurable error injection for resilience testing.
+// ABOUTME: Parses fault specs and matches them against incoming requests.
+
+package mockbosh
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// FaultConfig describes an error to inject for matching requests.
+type FaultConfig struct {
+	Method      string  // Empty matches any method
+	Path        string  // Exact path, or prefix when ending in "*"
+	Status      int     // HTTP status code to return
+	Probability float64 // Chance of failing a matching request (0-1]
+}
+
+// ParseFault parses a fault spec of the form [METHOD:]PATH:STATUS[@PROBABILITY],
+// e.g. "/stemcells:503", "DELETE:/deployments/*:500", or "/stemcells:503@0.5".
+func ParseFault(spec string) (FaultConfig, error) {
+	fault := FaultConfig{Probability: 1.0}
+
+	sep := strings.LastIndex(spec, ":")
+	if sep < 0 {
+		return fault, fmt.Errorf("invalid fault %q: expected PATH:STATUS", spec)
+	}
+	target, statusPart := spec[:sep], spec[sep+1:]
+
+	if at := strings.Index(statusPart, "@"); at >= 0 {
+		p, err := strconv.ParseFloat(statusPart[at+1:], 64)
+		if err != nil || p <= 0 || p > 1 {
+			return fault, fmt.Errorf("invalid fault %q: probability must be in (0, 1]", spec)
+		}
+		fault.Probability = p
+		statusPart = statusPart[:at]
+	}
+
+	status, err := strconv.Atoi(statusPart)
+	if err != nil || status < 100 || status > 599 {
+		return fault, fmt.Errorf("invalid fault %q: bad status code", spec)
+	}
+	fault.Status = status
+
+	if i := strings.Index(target, ":"); i >= 0 {
+		fault.Method = strings.ToUpper(target[:i])
+		target = target[i+1:]
+	}
+	if !strings.HasPrefix(target, "/") {
+		return fault, fmt.Errorf("invalid fault %q: path must start with /", spec)
+	}
+	fault.Path = target
+
+	return fault, nil
+}
+
+// Matches reports whether the fault applies to the request.
+func (f FaultConfig) Matches(r *http.Request) bool {
+	if f.Method != "" && f.Method != r.Method {
+		return false
+	}
+	if strings.HasSuffix(f.Path, "*") {
+		return strings.HasPrefix(r.URL.Path, strings.TrimSuffix(f.Path, "*"))
+	}
+	return r.URL.Path == f.Path
+}
+
+// String formats the fault in the same form ParseFault accepts.
+func (f FaultConfig) String() string {
+	s := fmt.Sprintf("%s:%d", f.Path, f.Status)
+	if f.Method != "" {
+		s = f.Method + ":" + s
+	}
+	if f.Probability < 1 {
+		s += fmt.Sprintf("@%g", f.Probability)
+	}
+	return s
+}
+
+// findFault returns the first fault that matches the request and fires.
+func findFault(faults []FaultConfig, r *http.Request) *FaultConfig {
+	for i := range faults {
+		if !faults[i].Matches(r) {
+			continue
+		}
+		if faults[i].Probability < 1 && rand.Float64() >= faults[i].Probability {
+			continue
+		}
+		return &faults[i]
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// ABOUTME: Tests for fault injection.
+// ABOUTME: Verifies fault spec parsing and request matching.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseFault(t *testing.T) {
+	testCases := []struct {
+		spec        string
+		method      string
+		path        string
+		status      int
+		probability float64
+	}{
+		{"/stemcells:503", "", "/stemcells", 503, 1.0},
+		{"/stemcells:503@0.5", "", "/stemcells", 503, 0.5},
+		{"delete:/deployments/*:500", "DELETE", "/deployments/*", 500, 1.0},
+	}
+
+	for _, tc := range testCases {
+		fault, err := ParseFault(tc.spec)
+		if err != nil {
+			t.Errorf("ParseFault(%q) failed: %v", tc.spec, err)
+			continue
+		}
+		if fault.Method != tc.method || fault.Path != tc.path || fault.Status != tc.status || fault.Probability != tc.probability {
+			t.Errorf("ParseFault(%q) = %+v", tc.spec, fault)
+		}
+	}
+
+	invalid := []string{"/stemcells", "stemcells:503", "/stemcells:abc", "/stemcells:999", "/stemcells:503@0", "/stemcells:503@2"}
+	for _, spec := range invalid {
+		if _, err := ParseFault(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestFaultMiddleware(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Faults = []FaultConfig{
+		{Path: "/stemcells", Status: http.StatusServiceUnavailable, Probability: 1.0},
+		{Method: http.MethodDelete, Path: "/deployments/*", Status: http.StatusInternalServerError, Probability: 1.0},
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.faultMiddleware(mux)
+
+	testCases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/stemcells", http.StatusServiceUnavailable},
+		{http.MethodGet, "/releases", http.StatusOK},
+		{http.MethodDelete, "/deployments/cf", http.StatusInternalServerError},
+		{http.MethodGet, "/deployments/cf", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.path, tc.status, w.Code)
+		}
+	}
+}
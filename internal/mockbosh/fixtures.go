@@ -5,6 +5,7 @@ package mockbosh
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -12,20 +13,127 @@ import (
 func DefaultFixtures() *StateData {
 	now := time.Now()
 
-	return &StateData{
-		Deployments: defaultDeployments(),
-		VMs:         defaultVMs(),
-		Instances:   defaultInstances(),
-		Variables:   defaultVariables(),
-		Tasks:       defaultTasks(now),
-		Stemcells:   defaultStemcells(),
-		Releases:    defaultReleases(),
-		CloudConfig: defaultCloudConfig(now),
+	data := &StateData{
+		Deployments:    defaultDeployments(),
+		VMs:            defaultVMs(),
+		Instances:      defaultInstances(),
+		Variables:      defaultVariables(),
+		Links:          defaultLinks(),
+		HealthChecks:   defaultHealthChecks(),
+		Tasks:          defaultTasks(now),
+		TaskEvents:     map[int][]TaskEvent{},
+		Snapshots:      defaultSnapshots(now),
+		Disks:          defaultOrphanedDisks(now),
+		Events:         defaultEvents(now),
+		Stemcells:      defaultStemcells(),
+		Releases:       defaultReleases(),
+		CloudConfigs:   defaultCloudConfigs(now),
 		RuntimeConfigs: defaultRuntimeConfigs(now),
-		CPIConfig:   defaultCPIConfig(now),
-		Locks:       []Lock{},
-		nextTaskID:  100,
+		CPIConfigs:     defaultCPIConfigs(now),
+		Locks:          []Lock{},
+		Blobs:          map[string]*Blob{},
+		nextTaskID:     100,
 	}
+	assignManifestJobs(data)
+	return data
+}
+
+// assignManifestJobs sets each VM's and instance's Jobs to those its
+// deployment manifest lists for its instance group.
+func assignManifestJobs(data *StateData) {
+	for name, d := range data.Deployments {
+		jobs := make(map[string][]string)
+		for _, g := range parseManifest(d.Manifest).InstanceGroups {
+			jobs[g.Name] = g.Jobs
+		}
+		for i := range data.VMs[name] {
+			data.VMs[name][i].Jobs = jobs[data.VMs[name][i].Job]
+		}
+		for i := range data.Instances[name] {
+			data.Instances[name][i].Jobs = jobs[data.Instances[name][i].Job]
+		}
+	}
+}
+
+// EmptyFixtures returns a state with no deployments, stemcells, releases,
+// configs, or tasks, for building state entirely via the API.
+func EmptyFixtures() *StateData {
+	return &StateData{
+		Deployments:    map[string]*Deployment{},
+		VMs:            map[string][]VM{},
+		Instances:      map[string][]Instance{},
+		Variables:      map[string][]Variable{},
+		Links:          map[string]map[string]JobLinks{},
+		HealthChecks:   map[string]HealthCheck{},
+		Tasks:          map[int]*Task{},
+		TaskEvents:     map[int][]TaskEvent{},
+		Snapshots:      map[string][]Snapshot{},
+		Disks:          []OrphanedDisk{},
+		Events:         []Event{},
+		Stemcells:      []Stemcell{},
+		Releases:       []Release{},
+		CloudConfigs:   []CloudConfig{},
+		RuntimeConfigs: []RuntimeConfig{},
+		CPIConfigs:     []CPIConfig{},
+		Locks:          []Lock{},
+		Blobs:          map[string]*Blob{},
+		nextTaskID:     0,
+	}
+}
+
+// GenerateSyntheticFixtures returns the default fixtures plus n synthetic
+// deployments, app-0001 through app-NNNN, each running two nginx instances.
+// Instances share process templates to keep memory down at large n.
+func GenerateSyntheticFixtures(n int) *StateData {
+	data := DefaultFixtures()
+
+	releases := []NameVersion{{Name: "nginx", Version: "1.21.0"}}
+	stemcells := []NameVersion{{Name: "bosh-google-kvm-ubuntu-jammy-go_agent", Version: "1.200"}}
+	processes := []Process{
+		{Name: "nginx", State: "running", Uptime: &Uptime{Seconds: 86400}, Memory: &ResourceUsage{Percent: 2.5, KB: 51200}, CPU: &CPUUsage{Total: 0.5}},
+	}
+	jobs := []string{"nginx"}
+	azs := []string{"z1", "z2"}
+
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("app-%04d", i)
+		data.Deployments[name] = &Deployment{
+			Name:        name,
+			CloudConfig: "latest",
+			Teams:       []string{},
+			Manifest:    syntheticManifestYAML(name),
+			Releases:    releases,
+			Stemcells:   stemcells,
+		}
+		for index, az := range azs {
+			id := fmt.Sprintf("%s-%d-id", name, index)
+			ip := syntheticIP((i-1)*len(azs) + index)
+			agent := fmt.Sprintf("agent-%s-%d", name, index)
+			cid := fmt.Sprintf("vm-%s-%d", name, index)
+			data.VMs[name] = append(data.VMs[name], VM{
+				VMCID: cid, Active: true, AgentID: agent,
+				AZ: az, Bootstrap: index == 0, Deployment: name, IPs: []string{ip},
+				Job: "app", Index: index, ID: id, ProcessState: "running",
+				State: "started", VMType: "small", Lifecycle: LifecycleService, Jobs: jobs,
+			})
+			data.Instances[name] = append(data.Instances[name], Instance{
+				AgentID: agent, AZ: az, Bootstrap: index == 0, Deployment: name,
+				Expects: true, ID: id, IPs: []string{ip},
+				Job: "app", Index: index, State: "running", VMType: "small", VMCID: cid,
+				Lifecycle: LifecycleService, Jobs: jobs,
+				Processes: processes[:len(processes):len(processes)],
+			})
+		}
+	}
+	return data
+}
+
+// syntheticIP returns the nth address of 172.16.0.0/12, skipping .0 and
+// .255 so every synthetic VM gets a distinct, plausible IP.
+func syntheticIP(n int) string {
+	host := n%254 + 1
+	n /= 254
+	return fmt.Sprintf("172.%d.%d.%d", 16+n/256, n%256, host)
 }
 
 func defaultDeployments() map[string]*Deployment {
@@ -33,6 +141,8 @@ func defaultDeployments() map[string]*Deployment {
 		"cf": {
 			Name:        "cf",
 			CloudConfig: "latest",
+			Teams:       []string{"admin"},
+			Manifest:    cfManifestYAML(),
 			Releases: []NameVersion{
 				{Name: "cf-deployment", Version: "40.0.0"},
 				{Name: "cflinuxfs4", Version: "1.50.0"},
@@ -46,6 +156,8 @@ func defaultDeployments() map[string]*Deployment {
 		"redis": {
 			Name:        "redis",
 			CloudConfig: "latest",
+			Teams:       []string{},
+			Manifest:    redisManifestYAML(),
 			Releases: []NameVersion{
 				{Name: "redis", Version: "16.0.0"},
 			},
@@ -56,6 +168,8 @@ func defaultDeployments() map[string]*Deployment {
 		"mysql": {
 			Name:        "mysql",
 			CloudConfig: "latest",
+			Teams:       []string{},
+			Manifest:    mysqlManifestYAML(),
 			Releases: []NameVersion{
 				{Name: "pxc", Version: "0.42.0"},
 			},
@@ -73,83 +187,83 @@ func defaultVMs() map[string][]VM {
 				VMCID: "vm-cf-diego-cell-0", Active: true, AgentID: "agent-cf-dc0",
 				AZ: "z1", Bootstrap: false, Deployment: "cf", IPs: []string{"10.0.1.10"},
 				Job: "diego_cell", Index: 0, ID: "cf-dc0-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-diego-cell-1", Active: true, AgentID: "agent-cf-dc1",
 				AZ: "z2", Bootstrap: false, Deployment: "cf", IPs: []string{"10.0.2.10"},
 				Job: "diego_cell", Index: 1, ID: "cf-dc1-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-diego-cell-2", Active: true, AgentID: "agent-cf-dc2",
 				AZ: "z3", Bootstrap: false, Deployment: "cf", IPs: []string{"10.0.3.10"},
 				Job: "diego_cell", Index: 2, ID: "cf-dc2-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-router-0", Active: true, AgentID: "agent-cf-r0",
 				AZ: "z1", Bootstrap: true, Deployment: "cf", IPs: []string{"10.0.1.20"},
 				Job: "router", Index: 0, ID: "cf-r0-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-router-1", Active: true, AgentID: "agent-cf-r1",
 				AZ: "z2", Bootstrap: false, Deployment: "cf", IPs: []string{"10.0.2.20"},
 				Job: "router", Index: 1, ID: "cf-r1-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-api-0", Active: true, AgentID: "agent-cf-api0",
 				AZ: "z1", Bootstrap: true, Deployment: "cf", IPs: []string{"10.0.1.30"},
 				Job: "api", Index: 0, ID: "cf-api0-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-uaa-0", Active: true, AgentID: "agent-cf-uaa0",
 				AZ: "z1", Bootstrap: true, Deployment: "cf", IPs: []string{"10.0.1.40"},
 				Job: "uaa", Index: 0, ID: "cf-uaa0-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-cf-doppler-0", Active: true, AgentID: "agent-cf-dop0",
 				AZ: "z1", Bootstrap: true, Deployment: "cf", IPs: []string{"10.0.1.50"},
 				Job: "doppler", Index: 0, ID: "cf-dop0-id", ProcessState: "running",
-				State: "started", VMType: "small", Ignore: false,
+				State: "started", VMType: "small", Ignore: false, Lifecycle: LifecycleService,
 			},
 		},
 		"redis": {
 			{
 				VMCID: "vm-redis-0", Active: true, AgentID: "agent-redis-0",
-				AZ: "z1", Bootstrap: true, Deployment: "redis", IPs: []string{"10.0.4.10"},
+				AZ: "z1", Bootstrap: true, Deployment: "redis", IPs: []string{"10.0.1.60"},
 				Job: "redis", Index: 0, ID: "redis-0-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-redis-1", Active: true, AgentID: "agent-redis-1",
-				AZ: "z2", Bootstrap: false, Deployment: "redis", IPs: []string{"10.0.4.11"},
+				AZ: "z2", Bootstrap: false, Deployment: "redis", IPs: []string{"10.0.2.60"},
 				Job: "redis", Index: 1, ID: "redis-1-id", ProcessState: "running",
-				State: "started", VMType: "medium", Ignore: false,
+				State: "started", VMType: "medium", Ignore: false, Lifecycle: LifecycleService,
 			},
 		},
 		"mysql": {
 			{
 				VMCID: "vm-mysql-0", Active: true, AgentID: "agent-mysql-0",
-				AZ: "z1", Bootstrap: true, Deployment: "mysql", IPs: []string{"10.0.5.10"},
+				AZ: "z1", Bootstrap: true, Deployment: "mysql", IPs: []string{"10.0.1.70"},
 				Job: "mysql", Index: 0, ID: "mysql-0-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-mysql-1", Active: true, AgentID: "agent-mysql-1",
-				AZ: "z2", Bootstrap: false, Deployment: "mysql", IPs: []string{"10.0.5.11"},
+				AZ: "z2", Bootstrap: false, Deployment: "mysql", IPs: []string{"10.0.2.70"},
 				Job: "mysql", Index: 1, ID: "mysql-1-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 			{
 				VMCID: "vm-mysql-2", Active: true, AgentID: "agent-mysql-2",
-				AZ: "z3", Bootstrap: false, Deployment: "mysql", IPs: []string{"10.0.5.12"},
+				AZ: "z3", Bootstrap: false, Deployment: "mysql", IPs: []string{"10.0.3.70"},
 				Job: "mysql", Index: 2, ID: "mysql-2-id", ProcessState: "running",
-				State: "started", VMType: "large", Ignore: false,
+				State: "started", VMType: "large", Ignore: false, Lifecycle: LifecycleService,
 			},
 		},
 	}
@@ -162,6 +276,7 @@ func defaultInstances() map[string][]Instance {
 				AgentID: "agent-cf-dc0", AZ: "z1", Bootstrap: false, Deployment: "cf",
 				Disk: "disk-cf-dc0", Expects: true, ID: "cf-dc0-id", IPs: []string{"10.0.1.10"},
 				Job: "diego_cell", Index: 0, State: "running", VMType: "large", VMCID: "vm-cf-diego-cell-0",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "rep", State: "running", Uptime: &Uptime{Seconds: 86400}, Memory: &ResourceUsage{Percent: 45.2, KB: 1024000}, CPU: &CPUUsage{Total: 12.5}},
 					{Name: "garden", State: "running", Uptime: &Uptime{Seconds: 86400}, Memory: &ResourceUsage{Percent: 30.1, KB: 512000}, CPU: &CPUUsage{Total: 8.2}},
@@ -172,6 +287,7 @@ func defaultInstances() map[string][]Instance {
 				AgentID: "agent-cf-dc1", AZ: "z2", Bootstrap: false, Deployment: "cf",
 				Disk: "disk-cf-dc1", Expects: true, ID: "cf-dc1-id", IPs: []string{"10.0.2.10"},
 				Job: "diego_cell", Index: 1, State: "running", VMType: "large", VMCID: "vm-cf-diego-cell-1",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "rep", State: "running", Uptime: &Uptime{Seconds: 86400}, Memory: &ResourceUsage{Percent: 42.0, KB: 980000}, CPU: &CPUUsage{Total: 10.0}},
 					{Name: "garden", State: "running", Uptime: &Uptime{Seconds: 86400}, Memory: &ResourceUsage{Percent: 28.5, KB: 490000}, CPU: &CPUUsage{Total: 7.5}},
@@ -182,6 +298,7 @@ func defaultInstances() map[string][]Instance {
 				AgentID: "agent-cf-r0", AZ: "z1", Bootstrap: true, Deployment: "cf",
 				Disk: "disk-cf-r0", Expects: true, ID: "cf-r0-id", IPs: []string{"10.0.1.20"},
 				Job: "router", Index: 0, State: "running", VMType: "medium", VMCID: "vm-cf-router-0",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "gorouter", State: "running", Uptime: &Uptime{Seconds: 172800}, Memory: &ResourceUsage{Percent: 20.0, KB: 256000}, CPU: &CPUUsage{Total: 15.0}},
 					{Name: "route_registrar", State: "running", Uptime: &Uptime{Seconds: 172800}, Memory: &ResourceUsage{Percent: 2.0, KB: 25600}, CPU: &CPUUsage{Total: 0.5}},
@@ -191,17 +308,31 @@ func defaultInstances() map[string][]Instance {
 				AgentID: "agent-cf-api0", AZ: "z1", Bootstrap: true, Deployment: "cf",
 				Disk: "disk-cf-api0", Expects: true, ID: "cf-api0-id", IPs: []string{"10.0.1.30"},
 				Job: "api", Index: 0, State: "running", VMType: "medium", VMCID: "vm-cf-api-0",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "cloud_controller_ng", State: "running", Uptime: &Uptime{Seconds: 259200}, Memory: &ResourceUsage{Percent: 35.0, KB: 450000}, CPU: &CPUUsage{Total: 8.0}},
 					{Name: "nginx", State: "running", Uptime: &Uptime{Seconds: 259200}, Memory: &ResourceUsage{Percent: 5.0, KB: 64000}, CPU: &CPUUsage{Total: 2.0}},
 				},
 			},
+			{
+				AgentID: "", AZ: "z1", Bootstrap: true, Deployment: "cf",
+				Expects: false, ID: "cf-smoke0-id", IPs: []string{},
+				Job: "smoke_tests", Index: 0, State: "stopped", VMType: "small", VMCID: "",
+				Lifecycle: LifecycleErrand,
+			},
+			{
+				AgentID: "", AZ: "z1", Bootstrap: true, Deployment: "cf",
+				Expects: false, ID: "cf-acceptance0-id", IPs: []string{},
+				Job: "acceptance_tests", Index: 0, State: "stopped", VMType: "small", VMCID: "",
+				Lifecycle: LifecycleErrand,
+			},
 		},
 		"redis": {
 			{
 				AgentID: "agent-redis-0", AZ: "z1", Bootstrap: true, Deployment: "redis",
-				Disk: "disk-redis-0", Expects: true, ID: "redis-0-id", IPs: []string{"10.0.4.10"},
+				Disk: "disk-redis-0", Expects: true, ID: "redis-0-id", IPs: []string{"10.0.1.60"},
 				Job: "redis", Index: 0, State: "running", VMType: "medium", VMCID: "vm-redis-0",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "redis-server", State: "running", Uptime: &Uptime{Seconds: 604800}, Memory: &ResourceUsage{Percent: 60.0, KB: 768000}, CPU: &CPUUsage{Total: 5.0}},
 					{Name: "redis-sentinel", State: "running", Uptime: &Uptime{Seconds: 604800}, Memory: &ResourceUsage{Percent: 2.0, KB: 25600}, CPU: &CPUUsage{Total: 0.2}},
@@ -209,8 +340,9 @@ func defaultInstances() map[string][]Instance {
 			},
 			{
 				AgentID: "agent-redis-1", AZ: "z2", Bootstrap: false, Deployment: "redis",
-				Disk: "disk-redis-1", Expects: true, ID: "redis-1-id", IPs: []string{"10.0.4.11"},
+				Disk: "disk-redis-1", Expects: true, ID: "redis-1-id", IPs: []string{"10.0.2.60"},
 				Job: "redis", Index: 1, State: "running", VMType: "medium", VMCID: "vm-redis-1",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "redis-server", State: "running", Uptime: &Uptime{Seconds: 604800}, Memory: &ResourceUsage{Percent: 55.0, KB: 704000}, CPU: &CPUUsage{Total: 4.5}},
 					{Name: "redis-sentinel", State: "running", Uptime: &Uptime{Seconds: 604800}, Memory: &ResourceUsage{Percent: 1.8, KB: 23000}, CPU: &CPUUsage{Total: 0.2}},
@@ -220,8 +352,9 @@ func defaultInstances() map[string][]Instance {
 		"mysql": {
 			{
 				AgentID: "agent-mysql-0", AZ: "z1", Bootstrap: true, Deployment: "mysql",
-				Disk: "disk-mysql-0", Expects: true, ID: "mysql-0-id", IPs: []string{"10.0.5.10"},
+				Disk: "disk-mysql-0", Expects: true, ID: "mysql-0-id", IPs: []string{"10.0.1.70"},
 				Job: "mysql", Index: 0, State: "running", VMType: "large", VMCID: "vm-mysql-0",
+				Lifecycle: LifecycleService,
 				Processes: []Process{
 					{Name: "pxc-mysql", State: "running", Uptime: &Uptime{Seconds: 1209600}, Memory: &ResourceUsage{Percent: 70.0, KB: 2048000}, CPU: &CPUUsage{Total: 20.0}},
 					{Name: "galera-agent", State: "running", Uptime: &Uptime{Seconds: 1209600}, Memory: &ResourceUsage{Percent: 3.0, KB: 38400}, CPU: &CPUUsage{Total: 0.5}},
@@ -231,8 +364,10 @@ func defaultInstances() map[string][]Instance {
 	}
 }
 
+// defaultVariables returns each deployment's variables with the values
+// interpolated manifests resolve them to.
 func defaultVariables() map[string][]Variable {
-	return map[string][]Variable{
+	variables := map[string][]Variable{
 		"cf": {
 			{ID: "var-1", Name: "cf_admin_password"},
 			{ID: "var-2", Name: "uaa_admin_client_secret"},
@@ -251,6 +386,123 @@ func defaultVariables() map[string][]Variable {
 			{ID: "var-22", Name: "mysql_server_certificate"},
 		},
 	}
+	for deployment, vars := range variables {
+		for i := range vars {
+			vars[i].Value = syntheticVariableValue(deployment, vars[i].Name)
+		}
+	}
+	return variables
+}
+
+func defaultLinks() map[string]map[string]JobLinks {
+	return map[string]map[string]JobLinks{
+		"cf": {
+			"api": {
+				Provides: []LinkDefinition{{Name: "cloud_controller", Type: "cloud_controller"}},
+				Consumes: []string{"uaa", "doppler"},
+			},
+			"uaa": {
+				Provides: []LinkDefinition{{Name: "uaa", Type: "uaa"}},
+			},
+			"router": {
+				Provides: []LinkDefinition{{Name: "gorouter", Type: "http-router"}},
+				Consumes: []string{"uaa"},
+			},
+			"diego_cell": {
+				Consumes: []string{"cloud_controller", "doppler"},
+			},
+			"doppler": {
+				Provides: []LinkDefinition{{Name: "doppler", Type: "doppler"}},
+			},
+		},
+		"redis": {
+			"redis": {
+				Provides: []LinkDefinition{{Name: "redis", Type: "redis"}},
+				Consumes: []string{"redis"},
+			},
+		},
+		"mysql": {
+			"mysql": {
+				Provides: []LinkDefinition{{Name: "mysql", Type: "mysql"}},
+				Consumes: []string{"mysql"},
+			},
+		},
+	}
+}
+
+func defaultHealthChecks() map[string]HealthCheck {
+	return map[string]HealthCheck{
+		"diego_cell": {Port: 1800, Path: "/ping"},
+		"router":     {Port: 8080, Path: "/health"},
+		"api":        {Port: 9022, Path: "/healthz"},
+		"uaa":        {Port: 8080, Path: "/healthz"},
+		"doppler":    {Port: 14825, Path: "/health"},
+		"redis":      {Port: 8080, Path: "/health"},
+		"mysql":      {Port: 9200, Path: "/"},
+	}
+}
+
+func defaultSnapshots(now time.Time) map[string][]Snapshot {
+	return map[string][]Snapshot{
+		"mysql": {
+			{
+				Job: "mysql", Index: 0, SnapshotCID: "snap-disk-mysql-0-1",
+				CreatedAt: now.Add(-26 * time.Hour).UTC().Format(snapshotTimeFormat), Clean: true,
+			},
+			{
+				Job: "mysql", Index: 0, SnapshotCID: "snap-disk-mysql-0-2",
+				CreatedAt: now.Add(-2 * time.Hour).UTC().Format(snapshotTimeFormat), Clean: false,
+			},
+		},
+	}
+}
+
+func defaultOrphanedDisks(now time.Time) []OrphanedDisk {
+	return []OrphanedDisk{
+		{
+			DiskCID: "disk-cf-dc2-orphaned", Size: 102400, Deployment: "cf",
+			InstanceName: "diego_cell/cf-dc2-id", AZ: "z3",
+			OrphanedAt: now.Add(-72 * time.Hour).UTC().Format(snapshotTimeFormat),
+		},
+		{
+			DiskCID: "disk-redis-2-orphaned", Size: 10240, Deployment: "redis",
+			InstanceName: "redis/redis-2-id", AZ: "z1",
+			OrphanedAt: now.Add(-30 * time.Hour).UTC().Format(snapshotTimeFormat),
+		},
+	}
+}
+
+func defaultEvents(now time.Time) []Event {
+	return []Event{
+		{
+			ID: 1, Timestamp: now.Add(-24 * time.Hour).Unix(), User: "admin", Action: "create",
+			ObjectType: "deployment", ObjectName: "cf", DeploymentName: "cf", TaskID: "1",
+		},
+		{
+			ID: 2, Timestamp: now.Add(-20 * time.Hour).Unix(), User: "admin", Action: "create",
+			ObjectType: "deployment", ObjectName: "redis", DeploymentName: "redis", TaskID: "2",
+		},
+		{
+			ID: 3, Timestamp: now.Add(-16 * time.Hour).Unix(), User: "admin", Action: "create",
+			ObjectType: "deployment", ObjectName: "mysql", DeploymentName: "mysql", TaskID: "3",
+		},
+		{
+			ID: 4, Timestamp: now.Add(-12 * time.Hour).Unix(), User: "admin", Action: "run",
+			ObjectType: "errand", ObjectName: "smoke_tests", DeploymentName: "cf", TaskID: "4",
+		},
+		{
+			ID: 5, Timestamp: now.Add(-4 * time.Hour).Unix(), User: "admin", Action: "update",
+			ObjectType: "deployment", ObjectName: "cf", DeploymentName: "cf", TaskID: "6",
+		},
+		{
+			ID: 6, Timestamp: now.Add(-2 * time.Hour).Unix(), User: "admin", Action: "snapshot",
+			ObjectType: "deployment", ObjectName: "mysql", DeploymentName: "mysql", TaskID: "7",
+		},
+		{
+			ID: 7, Timestamp: now.Add(-1 * time.Hour).Unix(), User: "admin", Action: "update",
+			ObjectType: "cloud-config", ObjectName: "default", TaskID: "8",
+		},
+	}
 }
 
 func defaultTasks(now time.Time) map[int]*Task {
@@ -287,6 +539,16 @@ func defaultTasks(now time.Time) map[int]*Task {
 			ID: 8, State: "done", Description: "update cloud config",
 			Timestamp: now.Add(-1 * time.Hour).Unix(), Result: "Updated", User: "admin",
 		},
+		9: {
+			ID: 9, State: "done", Description: "scan and fix",
+			Timestamp: now.Add(-45 * time.Minute).Unix(), Result: "0 resurrected", User: "health_monitor", Deployment: "cf",
+			Verbose: 2,
+		},
+		10: {
+			ID: 10, State: "done", Description: "snapshot deployment redis",
+			Timestamp: now.Add(-30 * time.Minute).Unix(), Result: "Snapshot created", User: "scheduler", Deployment: "redis",
+			Verbose: 2,
+		},
 	}
 }
 
@@ -321,24 +583,47 @@ func defaultReleases() []Release {
 		{Name: "pxc", Version: "0.42.0", CommitHash: "pxc42def", UncommittedChanges: false},
 		{Name: "bpm", Version: "1.2.0", CommitHash: "bpm12ghi", UncommittedChanges: false},
 		{Name: "os-conf", Version: "22.0.0", CommitHash: "osconf22jkl", UncommittedChanges: false},
+		// Uploaded as source and not yet compiled against any stemcell
+		{Name: "nginx", Version: "1.21.0", CommitHash: "nginx121mno", UncommittedChanges: false, Packages: []string{"nginx", "pcre"}},
 	}
 }
 
-func defaultCloudConfig(now time.Time) *CloudConfig {
-	return &CloudConfig{
-		Properties: cloudConfigYAML(),
-		CreatedAt:  now.Add(-1 * time.Hour).Format(time.RFC3339),
+// Config IDs are shared across config types and increase with CreatedAt.
+
+func defaultCloudConfigs(now time.Time) []CloudConfig {
+	current := cloudConfigYAML()
+	// Earlier versions lacked the large VM type, and before that ran a single AZ
+	withoutLarge := strings.Replace(current, `- name: large
+  cloud_properties:
+    machine_type: n1-standard-4
+    root_disk_size_gb: 100
+`, "", 1)
+	singleAZ := withoutLarge
+	for _, az := range []struct{ name, zone, subnet string }{
+		{"z2", "us-central1-b", "10.0.2"},
+		{"z3", "us-central1-c", "10.0.3"},
+	} {
+		singleAZ = strings.Replace(singleAZ, fmt.Sprintf("- name: %s\n  cloud_properties:\n    zone: %s\n", az.name, az.zone), "", 1)
+		singleAZ = strings.Replace(singleAZ, fmt.Sprintf("  - range: %[1]s.0/24\n    gateway: %[1]s.1\n    azs: [%[2]s]\n    dns: [8.8.8.8, 8.8.4.4]\n", az.subnet, az.name), "", 1)
+	}
+
+	return []CloudConfig{
+		{ID: "2", Properties: singleAZ, CreatedAt: now.Add(-60 * time.Hour).Format(time.RFC3339)},
+		{ID: "4", Properties: withoutLarge, CreatedAt: now.Add(-30 * time.Hour).Format(time.RFC3339)},
+		{ID: "6", Properties: current, CreatedAt: now.Add(-1 * time.Hour).Format(time.RFC3339)},
 	}
 }
 
 func defaultRuntimeConfigs(now time.Time) []RuntimeConfig {
 	return []RuntimeConfig{
 		{
+			ID:         "5",
 			Name:       "default",
 			Properties: runtimeConfigYAML("default"),
 			CreatedAt:  now.Add(-24 * time.Hour).Format(time.RFC3339),
 		},
 		{
+			ID:         "3",
 			Name:       "dns",
 			Properties: runtimeConfigYAML("dns"),
 			CreatedAt:  now.Add(-48 * time.Hour).Format(time.RFC3339),
@@ -346,13 +631,270 @@ func defaultRuntimeConfigs(now time.Time) []RuntimeConfig {
 	}
 }
 
-func defaultCPIConfig(now time.Time) *CPIConfig {
-	return &CPIConfig{
-		Properties: cpiConfigYAML(),
-		CreatedAt:  now.Add(-72 * time.Hour).Format(time.RFC3339),
+func defaultCPIConfigs(now time.Time) []CPIConfig {
+	return []CPIConfig{
+		{ID: "1", Properties: cpiConfigYAML(), CreatedAt: now.Add(-72 * time.Hour).Format(time.RFC3339)},
 	}
 }
 
+func cfManifestYAML() string {
+	return `name: cf
+
+releases:
+- name: cf-deployment
+  version: 40.0.0
+- name: cflinuxfs4
+  version: 1.50.0
+- name: diego
+  version: 2.80.0
+- name: garden-runc
+  version: 1.28.0
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+update:
+  canaries: 1
+  max_in_flight: 1
+  canary_watch_time: 30000-1200000
+  update_watch_time: 5000-1200000
+  serial: false
+
+instance_groups:
+- name: diego_cell
+  instances: 3
+  azs: [z1, z2, z3]
+  vm_type: large
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: rep
+    release: diego
+  - name: garden
+    release: garden-runc
+- name: router
+  instances: 2
+  azs: [z1, z2]
+  vm_type: medium
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: gorouter
+    release: cf-deployment
+    properties:
+      router:
+        tls_pem:
+        - cert_chain: ((router_ssl.certificate))
+          private_key: ((router_ssl.private_key))
+- name: api
+  instances: 1
+  azs: [z1]
+  vm_type: medium
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: cloud_controller_ng
+    release: cf-deployment
+    properties:
+      cc:
+        db_encryption_key: ((cc_db_encryption_key))
+- name: uaa
+  instances: 1
+  azs: [z1]
+  vm_type: medium
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: uaa
+    release: cf-deployment
+    properties:
+      uaa:
+        scim:
+          users:
+          - name: admin
+            password: ((cf_admin_password))
+        clients:
+          admin:
+            secret: ((uaa_admin_client_secret))
+- name: doppler
+  instances: 1
+  azs: [z1]
+  vm_type: small
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: doppler
+    release: cf-deployment
+- name: smoke_tests
+  lifecycle: errand
+  instances: 1
+  azs: [z1]
+  vm_type: small
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: smoke_tests
+    release: cf-deployment
+- name: acceptance_tests
+  lifecycle: errand
+  instances: 1
+  azs: [z1]
+  vm_type: small
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: acceptance_tests
+    release: cf-deployment
+
+variables:
+- name: cf_admin_password
+  type: password
+- name: uaa_admin_client_secret
+  type: password
+- name: router_ca
+  type: certificate
+- name: router_ssl
+  type: certificate
+- name: diego_instance_identity_ca
+  type: certificate
+- name: cc_db_encryption_key
+  type: password
+`
+}
+
+func redisManifestYAML() string {
+	return `name: redis
+
+releases:
+- name: redis
+  version: 16.0.0
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+update:
+  canaries: 1
+  max_in_flight: 1
+  canary_watch_time: 10000-600000
+  update_watch_time: 10000-600000
+  serial: true
+
+instance_groups:
+- name: redis
+  instances: 2
+  azs: [z1, z2]
+  vm_type: medium
+  stemcell: default
+  persistent_disk_type: 10GB
+  networks:
+  - name: default
+  jobs:
+  - name: redis-server
+    release: redis
+    properties:
+      password: ((redis_password))
+      tls:
+        ca: ((redis_tls_ca.certificate))
+
+variables:
+- name: redis_password
+  type: password
+- name: redis_tls_ca
+  type: certificate
+`
+}
+
+func syntheticManifestYAML(name string) string {
+	return fmt.Sprintf(`name: %s
+
+releases:
+- name: nginx
+  version: 1.21.0
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+update:
+  canaries: 1
+  max_in_flight: 1
+  canary_watch_time: 10000-600000
+  update_watch_time: 10000-600000
+
+instance_groups:
+- name: app
+  instances: 2
+  azs: [z1, z2]
+  vm_type: small
+  stemcell: default
+  networks:
+  - name: default
+  jobs:
+  - name: nginx
+    release: nginx
+`, name)
+}
+
+func mysqlManifestYAML() string {
+	return `name: mysql
+
+releases:
+- name: pxc
+  version: 0.42.0
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+update:
+  canaries: 1
+  max_in_flight: 1
+  canary_watch_time: 10000-600000
+  update_watch_time: 10000-600000
+  serial: true
+
+instance_groups:
+- name: mysql
+  instances: 3
+  azs: [z1, z2, z3]
+  vm_type: large
+  stemcell: default
+  persistent_disk_type: 50GB
+  networks:
+  - name: default
+  jobs:
+  - name: pxc-mysql
+    release: pxc
+    properties:
+      admin_password: ((mysql_admin_password))
+      tls:
+        galera:
+          ca: ((pxc_galera_ca.certificate))
+        server: ((mysql_server_certificate))
+
+variables:
+- name: mysql_admin_password
+  type: password
+- name: pxc_galera_ca
+  type: certificate
+- name: mysql_server_certificate
+  type: certificate
+`
+}
+
 func cloudConfigYAML() string {
 	return `azs:
 - name: z1
@@ -383,9 +925,17 @@ networks:
 - name: default
   type: manual
   subnets:
-  - range: 10.0.0.0/16
-    gateway: 10.0.0.1
-    azs: [z1, z2, z3]
+  - range: 10.0.1.0/24
+    gateway: 10.0.1.1
+    azs: [z1]
+    dns: [8.8.8.8, 8.8.4.4]
+  - range: 10.0.2.0/24
+    gateway: 10.0.2.1
+    azs: [z2]
+    dns: [8.8.8.8, 8.8.4.4]
+  - range: 10.0.3.0/24
+    gateway: 10.0.3.1
+    azs: [z3]
     dns: [8.8.8.8, 8.8.4.4]
 
 compilation:
@@ -0,0 +1,169 @@
+// ABOUTME: Loads hand-written YAML fixtures from a directory, one file per
+// ABOUTME: resource, over the default fixtures for anything not provided.
+
+package mockbosh
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fixtureLoaders replaces the StateData fields each known fixture file holds.
+var fixtureLoaders = map[string]func(node interface{}, data *StateData) error{
+	"deployments.yml": loadDeploymentFixtures,
+	"stemcells.yml":   loadStemcellFixtures,
+	"tasks.yml":       loadTaskFixtures,
+}
+
+// LoadFixturesDir replaces the deployments, stemcells, or tasks in data with
+// those listed in deployments.yml, stemcells.yml, and tasks.yml under dir.
+// Missing files leave data's fixtures in place; other files are skipped with
+// a warning. Stemcells then list the deployments that use them.
+func LoadFixturesDir(dir string, data *StateData) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read fixtures dir: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		load, ok := fixtureLoaders[entry.Name()]
+		if !ok || entry.IsDir() {
+			log.Printf("Ignoring unknown fixture file %s", path)
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read fixture file %s: %w", path, err)
+		}
+		node, err := parseYAML(string(b))
+		if err != nil {
+			return fmt.Errorf("failed to parse fixture file %s: %w", path, err)
+		}
+		if err := load(node, data); err != nil {
+			return fmt.Errorf("invalid fixture file %s: %w", path, err)
+		}
+	}
+	linkStemcellDeployments(data)
+	return nil
+}
+
+// linkStemcellDeployments rebuilds each stemcell's deployment list from the
+// stemcells the deployments reference, matched by name or OS the way deploys
+// match them. Release usage is read from the deployments directly.
+func linkStemcellDeployments(data *StateData) {
+	for i := range data.Stemcells {
+		data.Stemcells[i].Deployments = []string{}
+	}
+	names := make([]string, 0, len(data.Deployments))
+	for name := range data.Deployments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, ref := range data.Deployments[name].Stemcells {
+			for i := range data.Stemcells {
+				sc := &data.Stemcells[i]
+				if (sc.Name == ref.Name || sc.OperatingSystem == ref.Name) && sc.Version == ref.Version {
+					if !containsString(sc.Deployments, name) {
+						sc.Deployments = append(sc.Deployments, name)
+					}
+					break
+				}
+			}
+		}
+	}
+}
+
+// loadDeploymentFixtures replaces the deployments with a list of them. VMs,
+// instances, and other per-deployment data survive only for deployments
+// still listed.
+func loadDeploymentFixtures(node interface{}, data *StateData) error {
+	var deployments []Deployment
+	if err := decodeYAML(node, &deployments); err != nil {
+		return err
+	}
+
+	b := &StateBuilder{data: data}
+	data.Deployments = map[string]*Deployment{}
+	for i, d := range deployments {
+		if d.Name == "" {
+			return fmt.Errorf("[%d]: name is required", i)
+		}
+		if _, dup := data.Deployments[d.Name]; dup {
+			return fmt.Errorf("[%d]: duplicate deployment %q", i, d.Name)
+		}
+		b.AddDeployment(d)
+	}
+
+	for name := range data.VMs {
+		if data.Deployments[name] == nil {
+			delete(data.VMs, name)
+			delete(data.Instances, name)
+		}
+	}
+	for name := range data.Variables {
+		if data.Deployments[name] == nil {
+			delete(data.Variables, name)
+		}
+	}
+	for name := range data.Links {
+		if data.Deployments[name] == nil {
+			delete(data.Links, name)
+		}
+	}
+	for name := range data.Snapshots {
+		if data.Deployments[name] == nil {
+			delete(data.Snapshots, name)
+		}
+	}
+	assignManifestJobs(data)
+	return nil
+}
+
+// loadStemcellFixtures replaces the stemcells with a list of them.
+func loadStemcellFixtures(node interface{}, data *StateData) error {
+	var stemcells []Stemcell
+	if err := decodeYAML(node, &stemcells); err != nil {
+		return err
+	}
+	for i := range stemcells {
+		s := &stemcells[i]
+		if s.Name == "" || s.Version == "" {
+			return fmt.Errorf("[%d]: name and version are required", i)
+		}
+		if s.CID == "" {
+			s.CID = fmt.Sprintf("stemcell-%s-%s", s.Name, s.Version)
+		}
+		if s.Deployments == nil {
+			s.Deployments = []string{}
+		}
+	}
+	data.Stemcells = stemcells
+	return nil
+}
+
+// loadTaskFixtures replaces the task history with a list of tasks, which get
+// the same defaults as StateBuilder.AddTask.
+func loadTaskFixtures(node interface{}, data *StateData) error {
+	var tasks []Task
+	if err := decodeYAML(node, &tasks); err != nil {
+		return err
+	}
+
+	b := &StateBuilder{data: data}
+	data.Tasks = map[int]*Task{}
+	data.TaskEvents = map[int][]TaskEvent{}
+	data.nextTaskID = 0
+	for i, task := range tasks {
+		if _, dup := data.Tasks[task.ID]; dup {
+			return fmt.Errorf("[%d]: duplicate task ID %d", i, task.ID)
+		}
+		b.AddTask(task)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// ABOUTME: Tests for loading YAML fixture directories.
+// ABOUTME: Verifies per-file replacement, defaults, and error reporting.
+
+package mockbosh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFixture(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestLoadFixturesDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "deployments.yml", `
+# Two deployments; cf keeps its default VMs
+- name: cf
+  releases:
+  - name: cf
+    version: 1.0   # stays a string
+  stemcells: [{name: bosh-google-kvm-ubuntu-jammy-go_agent, version: "1.200"}]
+  teams: [dev]
+  manifest: |
+    name: cf
+    instance_groups:
+    - name: router
+      instances: 1
+- name: staging
+`)
+	writeFixture(t, dir, "tasks.yml", `
+- description: create deployment staging
+  deployment: staging
+- {id: 7, state: error, description: "delete deployment old", result: 'timed out'}
+- description: >
+    run errand
+    smoke_tests
+`)
+	writeFixture(t, dir, "notes.txt", "not a fixture")
+
+	data := DefaultFixtures()
+	if err := LoadFixturesDir(dir, data); err != nil {
+		t.Fatalf("LoadFixturesDir failed: %v", err)
+	}
+
+	if len(data.Deployments) != 2 {
+		t.Fatalf("Expected 2 deployments, got %d", len(data.Deployments))
+	}
+	cf := data.Deployments["cf"]
+	if cf.Releases[0].Version != "1.0" || cf.Teams[0] != "dev" || cf.CloudConfig != "latest" {
+		t.Errorf("Unexpected cf deployment %+v", cf)
+	}
+	if !strings.HasPrefix(cf.Manifest, "name: cf\ninstance_groups:\n- name: router\n") {
+		t.Errorf("Expected the literal manifest, got %q", cf.Manifest)
+	}
+	if data.Deployments["staging"].Stemcells == nil {
+		t.Error("Expected nil lists to become empty")
+	}
+	if len(data.VMs["cf"]) == 0 {
+		t.Error("Expected cf to keep its VMs")
+	}
+	if _, ok := data.VMs["redis"]; ok {
+		t.Error("Expected VMs of unlisted deployments to be dropped")
+	}
+
+	if len(data.Tasks) != 3 {
+		t.Fatalf("Expected 3 tasks, got %d", len(data.Tasks))
+	}
+	if task := data.Tasks[1]; task.State != "done" || task.User != "admin" || task.Deployment != "staging" {
+		t.Errorf("Expected builder defaults on task 1, got %+v", task)
+	}
+	if task := data.Tasks[7]; task.State != "error" || task.Result != "timed out" {
+		t.Errorf("Unexpected task 7 %+v", task)
+	}
+	if task := data.Tasks[8]; task == nil || task.Description != "run errand smoke_tests\n" {
+		t.Errorf("Expected a folded description numbered after task 7, got %+v", task)
+	}
+
+	if len(data.Stemcells) != len(defaultStemcells()) {
+		t.Errorf("Expected the default stemcells without stemcells.yml, got %d", len(data.Stemcells))
+	}
+}
+
+func TestLoadFixturesDirStemcellDeployments(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "deployments.yml", `
+- name: staging
+  stemcells: [{name: ubuntu-bionic, version: "1.150"}]
+- name: cf
+`)
+
+	data := DefaultFixtures()
+	if err := LoadFixturesDir(dir, data); err != nil {
+		t.Fatalf("LoadFixturesDir failed: %v", err)
+	}
+	for _, sc := range data.Stemcells {
+		want := 0
+		if sc.Version == "1.150" {
+			want = 1
+		}
+		if len(sc.Deployments) != want {
+			t.Errorf("Expected %s/%s to be used by %d deployments, got %v", sc.Name, sc.Version, want, sc.Deployments)
+		}
+	}
+
+	state := NewStateWithData(data)
+	deletion, err := state.DeploymentDeletion("staging")
+	if err != nil {
+		t.Fatalf("DeploymentDeletion failed: %v", err)
+	}
+	if len(deletion.Stemcells) != 1 || deletion.Stemcells[0] != "bosh-google-kvm-ubuntu-bionic-go_agent/1.150" {
+		t.Errorf("Expected staging's stemcell in the deletion preview, got %v", deletion.Stemcells)
+	}
+}
+
+func TestLoadFixturesDirErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"stemcells.yml", "- name: ubuntu\n   version: 1\n", "stemcells.yml: line 2: unexpected indentation"},
+		{"stemcells.yml", "- name: ubuntu\n", "name and version are required"},
+		{"stemcells.yml", "- name: ubuntu\n  version: 1\n  flavor: x\n", `[0]: unknown field "flavor"`},
+		{"tasks.yml", "- id: seven\n", `[0].id: expected an integer, got "seven"`},
+		{"deployments.yml", "name: cf\n", "expected a list"},
+		{"deployments.yml", "- name: cf\n- name: cf\n", `duplicate deployment "cf"`},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeFixture(t, dir, tt.name, tt.content)
+		err := LoadFixturesDir(dir, DefaultFixtures())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.content, tt.want, err)
+		}
+	}
+}
+
+func TestServerFixturesDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "stemcells.yml", "- name: ubuntu\n  operating_system: ubuntu-noble\n  version: 1.5\n")
+
+	config := DefaultServerConfig()
+	config.Empty = true
+	config.FixturesDir = dir
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	stemcells := server.state.GetStemcells()
+	if len(stemcells) != 1 || stemcells[0].CID != "stemcell-ubuntu-1.5" {
+		t.Errorf("Expected the stemcell from the fixtures dir, got %+v", stemcells)
+	}
+
+	config.FixturesDir = filepath.Join(dir, "missing")
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected an error for a missing fixtures dir")
+	}
+}
@@ -0,0 +1,136 @@
+// ABOUTME: Gzip response compression for clients sending Accept-Encoding: gzip.
+// ABOUTME: Small responses, streams, and the cert and health endpoints go out plain.
+
+package mockbosh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body worth compressing.
+const gzipMinSize = 1024
+
+// gzipMiddleware compresses responses for clients that accept gzip.
+func (s *Server) gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.URL.Path == "/ca-cert" || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds back the start of a body until it is big enough to
+// compress. A body that ends or is flushed before then goes out as is.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	plain  bool
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.status == 0 {
+		gw.status = code
+	}
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	switch {
+	case gw.gz != nil:
+		return gw.gz.Write(b)
+	case gw.plain:
+		return gw.ResponseWriter.Write(b)
+	}
+	gw.buf.Write(b)
+	if gw.buf.Len() >= gzipMinSize {
+		if err := gw.compress(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what is held back, uncompressed unless compression already
+// started, so streams reach the client as they are written.
+func (gw *gzipWriter) Flush() {
+	if gw.gz == nil && !gw.plain {
+		gw.sendPlain()
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// compress starts a gzip body with what is held back, unless the handler
+// already encoded the body.
+func (gw *gzipWriter) compress() error {
+	h := gw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return gw.sendPlain()
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	_, err := gw.gz.Write(gw.buf.Bytes())
+	gw.buf.Reset()
+	return err
+}
+
+// sendPlain writes the status and held-back body uncompressed.
+func (gw *gzipWriter) sendPlain() error {
+	gw.plain = true
+	if gw.status == 0 {
+		return nil
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+	_, err := gw.ResponseWriter.Write(gw.buf.Bytes())
+	gw.buf.Reset()
+	return err
+}
+
+// finish ends the gzip stream or sends a body too small to compress.
+func (gw *gzipWriter) finish() {
+	switch {
+	case gw.gz != nil:
+		gw.gz.Close()
+	case !gw.plain:
+		gw.sendPlain()
+	}
+}
@@ -0,0 +1,79 @@
+// ABOUTME: Tests for gzip response compression.
+// ABOUTME: Verifies compressed listings decode and small or exempt responses stay plain.
+
+package mockbosh
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.loggingMiddleware(server.gzipMiddleware(server.authMiddleware(mux)))
+
+	do := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/deployments", "br, gzip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", enc)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzip body: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Failed to decompress: %v", err)
+	}
+	var deployments []Deployment
+	if err := json.Unmarshal(body, &deployments); err != nil {
+		t.Fatalf("Expected JSON after decompressing: %v", err)
+	}
+	if len(deployments) != 3 {
+		t.Errorf("Expected 3 deployments, got %d", len(deployments))
+	}
+
+	tests := []struct {
+		path, acceptEncoding string
+	}{
+		{"/deployments", ""},
+		{"/deployments", "gzip;q=0"},
+		{"/info", "gzip"},
+		{"/health", "gzip"},
+		{"/deployments/nope", "gzip"},
+	}
+	for _, tt := range tests {
+		w := do(tt.path, tt.acceptEncoding)
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s with %q: expected no encoding, got %q", tt.path, tt.acceptEncoding, enc)
+		}
+		if !json.Valid(w.Body.Bytes()) {
+			t.Errorf("%s with %q: expected plain JSON, got %q", tt.path, tt.acceptEncoding, w.Body.String())
+		}
+	}
+	if w := do("/deployments/nope", "gzip"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the handler's status through the wrapper, got %d", w.Code)
+	}
+}
@@ -5,11 +5,15 @@ package mockbosh
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Handlers provides HTTP handlers for the mock BOSH Director API.
@@ -18,18 +22,45 @@ type Handlers struct {
 	simulator *TaskSimulator
 	username  string
 	password  string
+	uaaURL    string
+	tokens    *TokenIssuer
+
+	directorName    string
+	directorUUID    string
+	directorVersion string
+
+	requireDeleteConfirm bool
+	inlineTasks          bool
+	clientProfiles       map[string]ClientProfile
+	userTeams            UserTeams
 }
 
 // NewHandlers creates a new handlers instance.
 func NewHandlers(state *State, simulator *TaskSimulator, username, password string) *Handlers {
 	return &Handlers{
-		state:     state,
-		simulator: simulator,
-		username:  username,
-		password:  password,
+		state:           state,
+		simulator:       simulator,
+		username:        username,
+		password:        password,
+		directorName:    DefaultDirectorName,
+		directorUUID:    DefaultDirectorUUID,
+		directorVersion: DefaultDirectorVersion,
+		clientProfiles:  DefaultClientProfiles(),
 	}
 }
 
+// SetDirectorInfo sets the name, UUID, and version reported by /info.
+func (h *Handlers) SetDirectorInfo(name, uuid, version string) {
+	h.directorName = name
+	h.directorUUID = uuid
+	h.directorVersion = version
+}
+
+// SetClientProfiles replaces the User-Agent profiles used to tailor responses.
+func (h *Handlers) SetClientProfiles(profiles map[string]ClientProfile) {
+	h.clientProfiles = profiles
+}
+
 // ErrorResponse represents an error response.
 type ErrorResponse struct {
 	Code        int    `json:"code"`
@@ -53,333 +84,1709 @@ func writeError(w http.ResponseWriter, status int, message string) {
 	})
 }
 
-// CheckAuth validates Basic Auth credentials.
+// UseUAA switches authentication to UAA bearer tokens issued by tokens,
+// advertising uaaURL in /info.
+func (h *Handlers) UseUAA(uaaURL string, tokens *TokenIssuer) {
+	h.uaaURL = uaaURL
+	h.tokens = tokens
+}
+
+// SetRequireDeleteConfirm makes deployment deletes require ?confirm=<name>.
+func (h *Handlers) SetRequireDeleteConfirm(require bool) {
+	h.requireDeleteConfirm = require
+}
+
+// SetInlineTasks makes task-starting requests return 202 with the task body
+// instead of redirecting to it.
+func (h *Handlers) SetInlineTasks(inline bool) {
+	h.inlineTasks = inline
+}
+
+// redirectToTask responds to a request that started a task, with a 302 to
+// the task or, with inline tasks, a 202 carrying it.
+func (h *Handlers) redirectToTask(w http.ResponseWriter, taskID int) {
+	w.Header().Set("Location", fmt.Sprintf("/tasks/%d", taskID))
+	if !h.inlineTasks {
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	task, err := h.state.GetTask(taskID)
+	if err != nil {
+		writeErrorCode(w, ErrCodeTaskNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, task)
+}
+
+// createTask creates a task for a request, recording the client's
+// X-Bosh-Context-Id header as its context ID.
+func (h *Handlers) createTask(r *http.Request, description, deployment string) *Task {
+	return h.state.CreateTaskInContext(description, deployment, h.requestUser(r), r.Header.Get("X-Bosh-Context-Id"))
+}
+
+// createLockedTask creates a task that takes the deployment lock as it's
+// created. If another task holds the lock, it writes a 412 error and returns
+// false.
+func (h *Handlers) createLockedTask(w http.ResponseWriter, r *http.Request, description, deployment string) (*Task, bool) {
+	task, err := h.state.CreateLockedTask(description, deployment, h.requestUser(r), r.Header.Get("X-Bosh-Context-Id"))
+	if err != nil {
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+		return nil, false
+	}
+	return task, true
+}
+
+// CheckAuth validates Basic Auth credentials, or a bearer token in UAA mode.
 func (h *Handlers) CheckAuth(r *http.Request) bool {
+	if h.tokens != nil {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		return h.tokens.Validate(strings.TrimPrefix(auth, "Bearer ")) == nil
+	}
+
 	user, pass, ok := r.BasicAuth()
 	if !ok {
 		return false
 	}
-	return user == h.username && pass == h.password
+	if _, scoped := h.userTeams[user]; !scoped && user != h.username {
+		return false
+	}
+	return pass == h.password
 }
 
-// HandleDeployments handles GET /deployments.
+// HandleDeployments handles GET /deployments, listing the deployments the
+// user's teams own. With ?exclude_configs=true each entry omits its
+// cloud_config.
 func (h *Handlers) HandleDeployments(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	deployments := h.state.GetDeployments()
+	deployments := make([]Deployment, 0)
+	for _, d := range h.state.GetDeployments() {
+		if h.canAccess(r, d.Teams) {
+			deployments = append(deployments, d)
+		}
+	}
+	if r.URL.Query().Get("exclude_configs") == "true" {
+		excluded := make([]deploymentWithoutConfigs, len(deployments))
+		for i, d := range deployments {
+			excluded[i] = deploymentWithoutConfigs{Deployment: d}
+		}
+		writeJSON(w, http.StatusOK, excluded)
+		return
+	}
 	writeJSON(w, http.StatusOK, deployments)
 }
 
-// HandleDeploymentVMs handles GET /deployments/:name/vms.
-func (h *Handlers) HandleDeploymentVMs(w http.ResponseWriter, r *http.Request, deployment string) {
-	if r.Method != http.MethodGet {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
+// deploymentWithoutConfigs lists a Deployment for ?exclude_configs=true. Its
+// empty CloudConfig shadows the embedded one, leaving cloud_config out.
+type deploymentWithoutConfigs struct {
+	Deployment
+	CloudConfig string `json:"cloud_config,omitempty"`
+}
 
-	vms, err := h.state.GetVMs(deployment)
-	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
-		return
-	}
+// maxManifestSize bounds the size of an uploaded deployment manifest.
+const maxManifestSize = 10 << 20
 
-	writeJSON(w, http.StatusOK, vms)
+// readManifestBody reads a request body of at most maxManifestSize bytes,
+// writing 413 for a longer one and 400 if it can't be read.
+func readManifestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxManifestSize))
+		return nil, false
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "failed to read manifest")
+		return nil, false
+	}
+	return body, true
 }
 
-// HandleDeploymentInstances handles GET /deployments/:name/instances.
-func (h *Handlers) HandleDeploymentInstances(w http.ResponseWriter, r *http.Request, deployment string) {
+// HandleDeployment handles GET /deployments/:name, returning the manifest.
+// With ?interpolated=true, ((variable)) placeholders are replaced with
+// credentials.
+func (h *Handlers) HandleDeployment(w http.ResponseWriter, r *http.Request, deployment string) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	instances, err := h.state.GetInstances(deployment)
+	d, err := h.state.GetDeployment(deployment)
 	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
 		return
 	}
 
-	// Check if full format is requested
-	format := r.URL.Query().Get("format")
-	if format != "full" {
-		// Strip processes for non-full format
-		for i := range instances {
-			instances[i].Processes = nil
-		}
+	manifest := d.Manifest
+	if r.URL.Query().Get("interpolated") == "true" {
+		variables, _ := h.state.GetVariables(d.Name)
+		manifest = interpolateManifest(d.Name, manifest, variables)
 	}
 
-	writeJSON(w, http.StatusOK, instances)
+	writeJSON(w, http.StatusOK, DeploymentManifest{Manifest: manifest, ResurrectionPaused: d.ResurrectionPaused})
 }
 
-// HandleDeploymentVariables handles GET /deployments/:name/variables.
-func (h *Handlers) HandleDeploymentVariables(w http.ResponseWriter, r *http.Request, deployment string) {
-	if r.Method != http.MethodGet {
+// HandleDeploy handles POST /deployments and PUT /deployments/:name with a
+// YAML manifest body. For POST the deployment name comes from the manifest.
+// With ?dry_run=true it returns the diff instead of starting a task.
+func (h *Handlers) HandleDeploy(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	variables, err := h.state.GetVariables(deployment)
-	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+	body, ok := readManifestBody(w, r)
+	if !ok {
 		return
 	}
-
-	writeJSON(w, http.StatusOK, variables)
-}
-
-// HandleDeleteDeployment handles DELETE /deployments/:name.
-func (h *Handlers) HandleDeleteDeployment(w http.ResponseWriter, r *http.Request, deployment string) {
-	if r.Method != http.MethodDelete {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	manifest := string(body)
+	if strings.TrimSpace(manifest) == "" {
+		writeError(w, http.StatusBadRequest, "manifest is required")
 		return
 	}
 
-	// Check if deployment exists
-	if !h.state.HasDeployment(deployment) {
-		writeError(w, http.StatusNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+	name := parseManifest(manifest).Name
+	if deployment == "" {
+		deployment = name
+	}
+	if deployment == "" {
+		writeError(w, http.StatusBadRequest, "manifest must specify a deployment name")
 		return
 	}
-
-	// Check force parameter
-	force := r.URL.Query().Get("force") == "true"
-
-	// Create task
-	task := h.state.CreateTask(fmt.Sprintf("delete deployment %s", deployment), deployment, h.username)
-
-	// Start simulation
-	h.simulator.ExecuteDelete(task.ID, deployment, force)
-
-	// Return task location
-	w.Header().Set("Location", fmt.Sprintf("/tasks/%d", task.ID))
-	w.WriteHeader(http.StatusFound)
-}
-
-// HandleDeploymentJobs handles PUT /deployments/:name/jobs/:job for state changes.
-func (h *Handlers) HandleDeploymentJobs(w http.ResponseWriter, r *http.Request, deployment, job string) {
-	if r.Method != http.MethodPut {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	if name != "" && name != deployment {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("manifest name '%s' does not match deployment '%s'", name, deployment))
 		return
 	}
 
-	// Check if deployment exists
-	if !h.state.HasDeployment(deployment) {
-		writeError(w, http.StatusNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+	// Without instance groups a deploy would delete every VM
+	if len(parseManifest(manifest).InstanceGroups) == 0 {
+		writeError(w, http.StatusBadRequest, "manifest must specify instance_groups")
 		return
 	}
 
-	// Get state parameter
-	state := r.URL.Query().Get("state")
-	if state == "" {
-		writeError(w, http.StatusBadRequest, "state parameter is required")
+	// POST /deployments names the deployment only in the manifest, so the
+	// teams middleware can't check it
+	if d, err := h.state.GetDeployment(deployment); err == nil && !h.canAccess(r, d.Teams) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("user '%s' is not authorized to change deployment '%s'", h.requestUser(r), deployment))
 		return
 	}
 
-	// Parse job and index
-	jobName := job
-	index := ""
-	if strings.Contains(job, "/") {
-		parts := strings.SplitN(job, "/", 2)
-		jobName = parts[0]
-		index = parts[1]
+	// The CLI pins the configs it diffed against in ?context
+	var pinned *DiffContext
+	if raw := r.URL.Query().Get("context"); raw != "" {
+		pinned = &DiffContext{}
+		if err := json.Unmarshal([]byte(raw), pinned); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid context parameter")
+			return
+		}
 	}
 
-	// Create task based on state
-	var task *Task
-	switch state {
-	case "started":
-		desc := fmt.Sprintf("start jobs in deployment %s", deployment)
-		if jobName != "" {
-			desc = fmt.Sprintf("start job %s in deployment %s", jobName, deployment)
-		}
-		task = h.state.CreateTask(desc, deployment, h.username)
-		h.simulator.ExecuteStart(task.ID, deployment, jobName)
-	case "stopped":
-		desc := fmt.Sprintf("stop jobs in deployment %s", deployment)
-		if jobName != "" {
-			desc = fmt.Sprintf("stop job %s in deployment %s", jobName, deployment)
-		}
-		task = h.state.CreateTask(desc, deployment, h.username)
-		h.simulator.ExecuteStop(task.ID, deployment, jobName)
-	case "restart":
-		desc := fmt.Sprintf("restart jobs in deployment %s", deployment)
-		if jobName != "" {
-			desc = fmt.Sprintf("restart job %s in deployment %s", jobName, deployment)
-		}
-		task = h.state.CreateTask(desc, deployment, h.username)
-		h.simulator.ExecuteRestart(task.ID, deployment, jobName)
-	case "recreate":
-		desc := fmt.Sprintf("recreate VMs for deployment %s", deployment)
-		if jobName != "" {
-			desc = fmt.Sprintf("recreate VMs for %s/%s", deployment, jobName)
-			if index != "" {
-				desc = fmt.Sprintf("recreate VM %s/%s/%s", deployment, jobName, index)
+	// dry_run=true answers with the diff the deploy would apply, as
+	// `bosh deploy --dry-run` expects, and leaves the deployment alone
+	if r.URL.Query().Get("dry_run") == "true" {
+		context := h.diffContext()
+		if pinned != nil {
+			context = *pinned
+			if context.RuntimeConfigIDs == nil {
+				context.RuntimeConfigIDs = make([]string, 0)
 			}
 		}
-		task = h.state.CreateTask(desc, deployment, h.username)
-		h.simulator.ExecuteRecreate(task.ID, deployment, jobName, index)
-	default:
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown state: %s", state))
+		writeJSON(w, http.StatusOK, DeploymentDiff{
+			Diff:    diffManifests(h.currentManifest(deployment), manifest),
+			Context: context,
+		})
+		return
+	}
+
+	desc := fmt.Sprintf("create deployment %s", deployment)
+	if h.state.HasDeployment(deployment) {
+		desc = fmt.Sprintf("update deployment %s", deployment)
+	}
+	task, ok := h.createLockedTask(w, r, desc, deployment)
+	if !ok {
+		return
+	}
+	if err := h.simulator.ExecuteDeploy(task.ID, deployment, manifest); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// Return task location
-	w.Header().Set("Location", fmt.Sprintf("/tasks/%d", task.ID))
-	w.WriteHeader(http.StatusFound)
+	h.redirectToTask(w, task.ID)
 }
 
-// HandleDeploymentRecreate handles PUT /deployments/:name?state=recreate.
-func (h *Handlers) HandleDeploymentRecreate(w http.ResponseWriter, r *http.Request, deployment string) {
-	if r.Method != http.MethodPut {
+// HandleDeploymentDiff handles POST /deployments/:name/diff, comparing a
+// candidate manifest with the stored one. A deployment that doesn't exist yet
+// diffs against an empty manifest.
+func (h *Handlers) HandleDeploymentDiff(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	// Check if deployment exists
-	if !h.state.HasDeployment(deployment) {
-		writeError(w, http.StatusNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+	body, ok := readManifestBody(w, r)
+	if !ok {
 		return
 	}
-
-	// Get state parameter
-	state := r.URL.Query().Get("state")
-	if state != "recreate" {
-		writeError(w, http.StatusBadRequest, "state=recreate is required")
+	if strings.TrimSpace(string(body)) == "" {
+		writeError(w, http.StatusBadRequest, "manifest is required")
 		return
 	}
 
-	// Create task
-	task := h.state.CreateTask(fmt.Sprintf("recreate VMs for deployment %s", deployment), deployment, h.username)
+	writeJSON(w, http.StatusOK, DeploymentDiff{
+		Diff:    diffManifests(h.currentManifest(deployment), string(body)),
+		Context: h.diffContext(),
+	})
+}
 
-	// Start simulation
-	h.simulator.ExecuteRecreate(task.ID, deployment, "", "")
+// currentManifest returns a deployment's stored manifest, or "" if it doesn't
+// exist yet.
+func (h *Handlers) currentManifest(deployment string) string {
+	if d, err := h.state.GetDeployment(deployment); err == nil {
+		return d.Manifest
+	}
+	return ""
+}
 
-	// Return task location
-	w.Header().Set("Location", fmt.Sprintf("/tasks/%d", task.ID))
-	w.WriteHeader(http.StatusFound)
+// diffContext returns the IDs of the latest cloud and runtime configs.
+func (h *Handlers) diffContext() DiffContext {
+	context := DiffContext{RuntimeConfigIDs: make([]string, 0)}
+	if cc := h.state.GetCloudConfig(); cc != nil {
+		context.CloudConfigID = cc.ID
+	}
+	for _, rc := range h.state.GetRuntimeConfigs() {
+		context.RuntimeConfigIDs = append(context.RuntimeConfigIDs, rc.ID)
+	}
+	return context
 }
 
-// HandleTasks handles GET /tasks.
-func (h *Handlers) HandleTasks(w http.ResponseWriter, r *http.Request) {
+// HandleDeploymentVMs handles GET /deployments/:name/vms.
+func (h *Handlers) HandleDeploymentVMs(w http.ResponseWriter, r *http.Request, deployment string) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	state := r.URL.Query().Get("state")
-	deployment := r.URL.Query().Get("deployment")
-	limitStr := r.URL.Query().Get("limit")
+	vms, err := h.state.GetVMs(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
 
-	limit := 0
-	if limitStr != "" {
-		var err error
-		limit, err = strconv.Atoi(limitStr)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid limit parameter")
-			return
+	// Optionally narrow to one job, or one instance such as router/1
+	job := r.URL.Query().Get("job")
+	index := r.URL.Query().Get("index")
+	if job != "" || index != "" {
+		matched := make([]VM, 0, len(vms))
+		for _, vm := range vms {
+			if (job == "" || vm.Job == job) && (index == "" || strconv.Itoa(vm.Index) == index) {
+				matched = append(matched, vm)
+			}
 		}
+		vms = matched
 	}
 
-	tasks := h.state.GetTasks(state, deployment, limit)
-	writeJSON(w, http.StatusOK, tasks)
+	writeJSON(w, http.StatusOK, vms)
 }
 
-// HandleTask handles GET /tasks/:id.
-func (h *Handlers) HandleTask(w http.ResponseWriter, r *http.Request, taskID int) {
+// HandleDeploymentInstances handles GET /deployments/:name/instances.
+func (h *Handlers) HandleDeploymentInstances(w http.ResponseWriter, r *http.Request, deployment string) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	task, err := h.state.GetTask(taskID)
+	instances, err := h.state.GetInstances(deployment)
 	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
 		return
 	}
 
-	writeJSON(w, http.StatusOK, task)
-}
+	// Optionally hide errand instance groups
+	if r.URL.Query().Get("exclude_errands") == "true" {
+		services := make([]Instance, 0, len(instances))
+		for _, inst := range instances {
+			if inst.Lifecycle != LifecycleErrand {
+				services = append(services, inst)
+			}
+		}
+		instances = services
+	}
 
-// HandleTaskOutput handles GET /tasks/:id/output.
-func (h *Handlers) HandleTaskOutput(w http.ResponseWriter, r *http.Request, taskID int) {
-	if r.Method != http.MethodGet {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
+	// Check if full format is requested
+	format := r.URL.Query().Get("format")
+	if format != "full" {
+		// Strip processes for non-full format
+		for i := range instances {
+			instances[i].Processes = nil
+		}
+	} else {
+		// Attach the links each instance provides and consumes
+		links, err := h.state.GetInstanceLinks(deployment)
+		if err != nil {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+			return
+		}
+		for i := range instances {
+			if l, ok := links[instances[i].Job]; ok {
+				instances[i].Links = &l
+			}
+			instances[i].HealthURL = h.state.GetHealthURL(instances[i])
+		}
+
+		// Optionally keep only the named processes (comma-separated)
+		if process := r.URL.Query().Get("process"); process != "" {
+			names := strings.Split(process, ",")
+			for i := range instances {
+				matching := make([]Process, 0)
+				for _, p := range instances[i].Processes {
+					if containsString(names, p.Name) {
+						matching = append(matching, p)
+					}
+				}
+				instances[i].Processes = matching
+			}
+		}
 	}
 
-	task, err := h.state.GetTask(taskID)
-	if err != nil {
-		writeError(w, http.StatusNotFound, err.Error())
+	// Optionally nest instances under their AZ, ordered by job and index
+	switch groupBy := r.URL.Query().Get("group_by"); groupBy {
+	case "":
+	case "az":
+		sort.SliceStable(instances, func(i, j int) bool {
+			if instances[i].Job != instances[j].Job {
+				return instances[i].Job < instances[j].Job
+			}
+			return instances[i].Index < instances[j].Index
+		})
+		grouped := make(map[string][]Instance)
+		for _, inst := range instances {
+			grouped[inst.AZ] = append(grouped[inst.AZ], inst)
+		}
+		writeJSON(w, http.StatusOK, grouped)
+		return
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported group_by: %s", groupBy))
 		return
 	}
 
-	outputType := r.URL.Query().Get("type")
-	output := h.simulator.GetTaskOutput(task, outputType)
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(output))
+	writeJSON(w, http.StatusOK, instances)
 }
 
-// HandleStemcells handles GET /stemcells.
-func (h *Handlers) HandleStemcells(w http.ResponseWriter, r *http.Request) {
+// HandleDeploymentVitals handles GET /deployments/:name/vitals.
+func (h *Handlers) HandleDeploymentVitals(w http.ResponseWriter, r *http.Request, deployment string) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	stemcells := h.state.GetStemcells()
-	writeJSON(w, http.StatusOK, stemcells)
-}
-
-// HandleReleases handles GET /releases.
-func (h *Handlers) HandleReleases(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	vitals, err := h.state.GetDeploymentVitals(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
 		return
 	}
 
-	releases := h.state.GetReleases()
-	writeJSON(w, http.StatusOK, releases)
+	writeJSON(w, http.StatusOK, vitals)
 }
 
-// HandleConfigs handles GET /configs with type and latest parameters.
-func (h *Handlers) HandleConfigs(w http.ResponseWriter, r *http.Request) {
+// HandleDeploymentErrands handles GET /deployments/:name/errands.
+func (h *Handlers) HandleDeploymentErrands(w http.ResponseWriter, r *http.Request, deployment string) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	configType := r.URL.Query().Get("type")
-	// latest := r.URL.Query().Get("latest") == "true" // Not used but could filter
-
-	switch configType {
-	case "cloud":
-		config := h.state.GetCloudConfig()
-		if config == nil {
-			writeJSON(w, http.StatusOK, []CloudConfig{})
-		} else {
-			writeJSON(w, http.StatusOK, []CloudConfig{*config})
-		}
-	case "runtime":
-		configs := h.state.GetRuntimeConfigs()
-		writeJSON(w, http.StatusOK, configs)
-	case "cpi":
-		config := h.state.GetCPIConfig()
-		if config == nil {
-			writeJSON(w, http.StatusOK, []CPIConfig{})
-		} else {
-			writeJSON(w, http.StatusOK, []CPIConfig{*config})
-		}
-	default:
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", configType))
+	errands, err := h.state.GetErrands(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
 	}
+
+	writeJSON(w, http.StatusOK, errands)
 }
 
-// HandleLocks handles GET /locks.
-func (h *Handlers) HandleLocks(w http.ResponseWriter, r *http.Request) {
+// HandleDeploymentProblems handles GET /deployments/:name/problems, listing
+// cloud check problems, and PUT, applying resolutions over a task.
+func (h *Handlers) HandleDeploymentProblems(w http.ResponseWriter, r *http.Request, deployment string) {
+	switch r.Method {
+	case http.MethodGet:
+		problems, err := h.state.GetProblems(deployment)
+		if err != nil {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, problems)
+	case http.MethodPut:
+		if !h.state.HasDeployment(deployment) {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+			return
+		}
+
+		var req ProblemsResolveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		resolutions := make(map[int]string, len(req.Resolutions))
+		for key, resolution := range req.Resolutions {
+			id, err := strconv.Atoi(key)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid problem ID: %s", key))
+				return
+			}
+			resolutions[id] = resolution
+		}
+		if err := h.state.ValidateResolutions(deployment, resolutions); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		task, ok := h.createLockedTask(w, r, "apply resolutions", deployment)
+		if !ok {
+			return
+		}
+		h.simulator.ExecuteResolveProblems(task.ID, deployment, resolutions)
+
+		h.redirectToTask(w, task.ID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleDeploymentScans handles POST /deployments/:name/scans, starting a
+// cloud check scan.
+func (h *Handlers) HandleDeploymentScans(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+	task, ok := h.createLockedTask(w, r, "scan cloud", deployment)
+	if !ok {
+		return
+	}
+	h.simulator.ExecuteScan(task.ID, deployment)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeploymentColocation handles GET /deployments/:name/colocation,
+// reporting which jobs share each instance group's VMs.
+func (h *Handlers) HandleDeploymentColocation(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	groups, err := h.state.GetColocation(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// HandleDeploymentSSH handles POST /deployments/:name/ssh, starting an ssh
+// setup or cleanup task for the targeted instances.
+func (h *Handlers) HandleDeploymentSSH(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	var req SSHRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	switch req.Command {
+	case "setup":
+		if req.Params.User == "" || req.Params.PublicKey == "" {
+			writeError(w, http.StatusBadRequest, "setup requires params.user and params.public_key")
+			return
+		}
+	case "cleanup":
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown ssh command: %s", req.Command))
+		return
+	}
+
+	vms, err := h.state.SSHTargets(deployment, req.Target)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+	if len(vms) == 0 {
+		writeError(w, http.StatusBadRequest, "no instances match the ssh target")
+		return
+	}
+
+	task := h.createTask(r, fmt.Sprintf("ssh %s", req.Command), deployment)
+	h.simulator.ExecuteSSH(task.ID, deployment, req.Command, vms)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleInstanceLogs handles GET /deployments/:name/instances/:job/:index/logs,
+// starting a task that bundles the instance's logs into the blobstore.
+// ?type=agent fetches agent logs instead of job logs.
+func (h *Handlers) HandleInstanceLogs(w http.ResponseWriter, r *http.Request, deployment, job, indexStr string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	logType := r.URL.Query().Get("type")
+	if logType == "" {
+		logType = "job"
+	}
+	if logType != "job" && logType != "agent" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown log type: %s", logType))
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+	index, err := strconv.Atoi(indexStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid index")
+		return
+	}
+	inst, err := h.state.GetInstance(deployment, job, index)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	task := h.createTask(r, fmt.Sprintf("fetch %s logs for %s", logType, h.state.InstanceName(deployment, job, inst.ID)), deployment)
+	h.simulator.ExecuteFetchLogs(task.ID, deployment, job, index, logType)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeploymentSnapshots handles GET, POST, and DELETE
+// /deployments/:name/snapshots.
+func (h *Handlers) HandleDeploymentSnapshots(w http.ResponseWriter, r *http.Request, deployment string) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := h.state.GetSnapshots(deployment)
+		if err != nil {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	desc := fmt.Sprintf("snapshot deployment %s", deployment)
+	if r.Method == http.MethodDelete {
+		desc = fmt.Sprintf("delete snapshots of deployment %s", deployment)
+	}
+	task, ok := h.createLockedTask(w, r, desc, deployment)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodPost {
+		h.simulator.ExecuteSnapshot(task.ID, deployment)
+	} else {
+		h.simulator.ExecuteDeleteSnapshots(task.ID, deployment)
+	}
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeploymentVariables handles GET /deployments/:name/variables. Values
+// are only included with ?include_values=true.
+func (h *Handlers) HandleDeploymentVariables(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	variables, err := h.state.GetVariables(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+	if r.URL.Query().Get("include_values") != "true" {
+		for i := range variables {
+			variables[i].Value = ""
+		}
+	}
+
+	writeJSON(w, http.StatusOK, variables)
+}
+
+// HandleVariables handles GET /variables, listing the variables of every
+// deployment the user can see. ?name= filters by name substring, and values
+// are only included with ?include_values=true.
+func (h *Handlers) HandleVariables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	teams := make(map[string][]string)
+	for _, d := range h.state.GetDeployments() {
+		teams[d.Name] = d.Teams
+	}
+	name := r.URL.Query().Get("name")
+	includeValues := r.URL.Query().Get("include_values") == "true"
+
+	result := make([]VariableWithDeployment, 0)
+	for _, v := range h.state.GetAllVariables() {
+		if !strings.Contains(v.Name, name) || !h.canAccess(r, teams[v.Deployment]) {
+			continue
+		}
+		if !includeValues {
+			v.Value = ""
+		}
+		result = append(result, v)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandleVariableRotate handles POST /deployments/:name/variables/:id/rotate,
+// returning the variable under its new ID.
+func (h *Handlers) HandleVariableRotate(w http.ResponseWriter, r *http.Request, deployment, id string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+	variable, err := h.state.RotateVariable(deployment, id, h.requestUser(r))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	variable.Value = ""
+
+	writeJSON(w, http.StatusOK, variable)
+}
+
+// HandleDeploymentVariableUsage handles GET
+// /deployments/:name/variables/usage.
+func (h *Handlers) HandleDeploymentVariableUsage(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	usage, err := h.state.GetVariableUsage(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// HandleDeleteDeployment handles DELETE /deployments/:name.
+func (h *Handlers) HandleDeleteDeployment(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Check if deployment exists
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	// dry_run=true previews what the delete would remove and changes nothing
+	if r.URL.Query().Get("dry_run") == "true" {
+		deletion, err := h.state.DeploymentDeletion(deployment)
+		if err != nil {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, deletion)
+		return
+	}
+
+	// Guard against accidental deletes when confirmation is required
+	if h.requireDeleteConfirm && r.URL.Query().Get("confirm") != deployment {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("deleting deployment '%s' requires confirm=%s", deployment, deployment))
+		return
+	}
+
+	// Check force parameter
+	force := r.URL.Query().Get("force") == "true"
+
+	// Create task
+	task, ok := h.createLockedTask(w, r, fmt.Sprintf("delete deployment %s", deployment), deployment)
+	if !ok {
+		return
+	}
+
+	// Start simulation
+	h.simulator.ExecuteDelete(task.ID, deployment, force)
+
+	// Return task location
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeploymentJobs handles PUT /deployments/:name/jobs/:job for state changes.
+func (h *Handlers) HandleDeploymentJobs(w http.ResponseWriter, r *http.Request, deployment, job string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Check if deployment exists
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	// Get state parameter
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		writeError(w, http.StatusBadRequest, "state parameter is required")
+		return
+	}
+
+	// Parse job and index
+	jobName := job
+	index := ""
+	if strings.Contains(job, "/") {
+		parts := strings.SplitN(job, "/", 2)
+		jobName = parts[0]
+		index = parts[1]
+	}
+
+	if jobName != "" && !h.state.HasJob(deployment, jobName) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("instance group '%s' not found", jobName))
+		return
+	}
+
+	// Describe the task and how to run it based on state
+	var desc string
+	var execute func(taskID int)
+	switch state {
+	case "started":
+		desc = fmt.Sprintf("start jobs in deployment %s", deployment)
+		if jobName != "" {
+			desc = fmt.Sprintf("start job %s in deployment %s", jobName, deployment)
+		}
+		execute = func(taskID int) { h.simulator.ExecuteStart(taskID, deployment, jobName, index) }
+	case "stopped":
+		desc = fmt.Sprintf("stop jobs in deployment %s", deployment)
+		if jobName != "" {
+			desc = fmt.Sprintf("stop job %s in deployment %s", jobName, deployment)
+		}
+		hard := r.URL.Query().Get("hard") == "true"
+		execute = func(taskID int) { h.simulator.ExecuteStop(taskID, deployment, jobName, index, hard) }
+	case "restart":
+		desc = fmt.Sprintf("restart jobs in deployment %s", deployment)
+		if jobName != "" {
+			desc = fmt.Sprintf("restart job %s in deployment %s", jobName, deployment)
+		}
+		execute = func(taskID int) { h.simulator.ExecuteRestart(taskID, deployment, jobName, index) }
+	case "recreate":
+		desc = fmt.Sprintf("recreate VMs for deployment %s", deployment)
+		if jobName != "" {
+			desc = fmt.Sprintf("recreate VMs for %s/%s", deployment, jobName)
+			if index != "" {
+				desc = fmt.Sprintf("recreate VM %s/%s/%s", deployment, jobName, index)
+			}
+		}
+		execute = func(taskID int) { h.simulator.ExecuteRecreate(taskID, deployment, jobName, index) }
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown state: %s", state))
+		return
+	}
+
+	task, ok := h.createLockedTask(w, r, desc, deployment)
+	if !ok {
+		return
+	}
+	execute(task.ID)
+
+	// Return task location
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeploymentRecreate handles PUT /deployments/:name?state=recreate.
+func (h *Handlers) HandleDeploymentRecreate(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Check if deployment exists
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	// Get state parameter
+	state := r.URL.Query().Get("state")
+	if state != "recreate" {
+		writeError(w, http.StatusBadRequest, "state=recreate is required")
+		return
+	}
+
+	// Create task
+	task, ok := h.createLockedTask(w, r, fmt.Sprintf("recreate VMs for deployment %s", deployment), deployment)
+	if !ok {
+		return
+	}
+
+	// Start simulation
+	h.simulator.ExecuteRecreate(task.ID, deployment, "", "")
+
+	// Return task location
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleInstanceMigrate handles PUT
+// /deployments/:name/instance_groups/:job/:id/migrate?az=..., moving an
+// instance to another AZ over a task.
+func (h *Handlers) HandleInstanceMigrate(w http.ResponseWriter, r *http.Request, deployment, job, id string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	az := r.URL.Query().Get("az")
+	if az == "" {
+		writeError(w, http.StatusBadRequest, "az is required")
+		return
+	}
+	if !h.state.HasAZ(az) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("az '%s' not found in cloud config", az))
+		return
+	}
+
+	instances, err := h.state.GetInstances(deployment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	found := false
+	for _, inst := range instances {
+		if inst.Job == job && inst.ID == id && inst.Lifecycle != LifecycleErrand {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("instance '%s/%s' not found", job, id))
+		return
+	}
+
+	task, ok := h.createLockedTask(w, r, fmt.Sprintf("migrate instance %s to az %s", h.state.InstanceName(deployment, job, id), az), deployment)
+	if !ok {
+		return
+	}
+	h.simulator.ExecuteMigrate(task.ID, deployment, job, id, az)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// IgnoreRequest is the body of PUT
+// /deployments/:name/instance_groups/:job/:id/ignore.
+type IgnoreRequest struct {
+	Ignore bool `json:"ignore"`
+}
+
+// HandleInstanceIgnore handles PUT
+// /deployments/:name/instance_groups/:job/:id/ignore, toggling whether
+// recreates and state changes skip the instance.
+func (h *Handlers) HandleInstanceIgnore(w http.ResponseWriter, r *http.Request, deployment, job, id string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	var req IgnoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid ignore request")
+		return
+	}
+
+	if err := h.state.SetIgnore(deployment, job, id, req.Ignore); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleInstanceDisk handles PUT
+// /deployments/:name/instance_groups/:job/:id/disks/{attach,detach}?disk_cid=...,
+// attaching or detaching an instance's persistent disk over a task.
+func (h *Handlers) HandleInstanceDisk(w http.ResponseWriter, r *http.Request, deployment, job, id, action string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if action != "attach" && action != "detach" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	diskCID := r.URL.Query().Get("disk_cid")
+	if diskCID == "" {
+		writeError(w, http.StatusBadRequest, "disk_cid is required")
+		return
+	}
+
+	instances, err := h.state.GetInstances(deployment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	found := false
+	for _, inst := range instances {
+		if inst.Job == job && inst.ID == id && inst.Lifecycle != LifecycleErrand {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("instance '%s/%s' not found", job, id))
+		return
+	}
+
+	name := h.state.InstanceName(deployment, job, id)
+	desc := fmt.Sprintf("detach disk %s from %s", diskCID, name)
+	if action == "attach" {
+		desc = fmt.Sprintf("attach disk %s to %s", diskCID, name)
+	}
+	task, ok := h.createLockedTask(w, r, desc, deployment)
+	if !ok {
+		return
+	}
+	if action == "attach" {
+		h.simulator.ExecuteAttachDisk(task.ID, deployment, job, id, diskCID)
+	} else {
+		h.simulator.ExecuteDetachDisk(task.ID, deployment, job, id, diskCID)
+	}
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleTasks handles GET /tasks.
+func (h *Handlers) HandleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	deployment := r.URL.Query().Get("deployment")
+	limitStr := r.URL.Query().Get("limit")
+
+	limit := 0
+	if limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit parameter")
+			return
+		}
+	}
+
+	// verbose=1 (the default) lists user tasks; verbose=2 adds internal ones
+	verbose := 1
+	if v := r.URL.Query().Get("verbose"); v != "" {
+		var err error
+		verbose, err = strconv.Atoi(v)
+		if err != nil || verbose < 1 || verbose > 2 {
+			writeError(w, http.StatusBadRequest, "invalid verbose parameter")
+			return
+		}
+	}
+
+	tasks := h.state.GetTasks(state, deployment, r.URL.Query().Get("context_id"), verbose, limit)
+	for i := range tasks {
+		tasks[i].AffectedResources = nil
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// HandleEvents handles GET /events.
+func (h *Handlers) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := EventFilter{
+		Deployment: query.Get("deployment"),
+		Action:     query.Get("action"),
+		ObjectType: query.Get("object_type"),
+		TaskID:     query.Get("task"),
+	}
+	if beforeID := query.Get("before_id"); beforeID != "" {
+		id, err := strconv.Atoi(beforeID)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid before_id parameter")
+			return
+		}
+		filter.BeforeID = id
+	}
+
+	writeJSON(w, http.StatusOK, h.state.GetEvents(filter))
+}
+
+// HandleTaskStream handles GET /tasks/stream, sending task events as
+// Server-Sent Events as they happen. ?task=<id> limits it to one task.
+func (h *Handlers) HandleTaskStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	taskID := 0
+	if task := r.URL.Query().Get("task"); task != "" {
+		id, err := strconv.Atoi(task)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid task parameter")
+			return
+		}
+		taskID = id
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	events, unsubscribe := h.state.SubscribeTaskEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if taskID != 0 && e.TaskID != taskID {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: task\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// HandleTask handles GET /tasks/:id.
+func (h *Handlers) HandleTask(w http.ResponseWriter, r *http.Request, taskID int) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	task, err := h.state.GetTask(taskID)
+	if err != nil {
+		writeErrorCode(w, ErrCodeTaskNotFound, err.Error())
+		return
+	}
+	if verbose, _ := strconv.Atoi(r.URL.Query().Get("verbose")); verbose < 1 {
+		task.AffectedResources = nil
+	}
+
+	writeJSON(w, http.StatusOK, task)
+}
+
+// HandleCancelTask handles DELETE /tasks/:id.
+func (h *Handlers) HandleCancelTask(w http.ResponseWriter, r *http.Request, taskID int) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if _, err := h.state.GetTask(taskID); err != nil {
+		writeErrorCode(w, ErrCodeTaskNotFound, err.Error())
+		return
+	}
+
+	if err := h.state.CancelTask(taskID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTaskOutput handles GET /tasks/:id/output.
+func (h *Handlers) HandleTaskOutput(w http.ResponseWriter, r *http.Request, taskID int) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	task, err := h.state.GetTask(taskID)
+	if err != nil {
+		writeErrorCode(w, ErrCodeTaskNotFound, err.Error())
+		return
+	}
+
+	outputType := r.URL.Query().Get("type")
+	if r.URL.Query().Get("follow") == "true" && (outputType == "" || outputType == "event") {
+		if flusher, ok := w.(http.Flusher); ok {
+			h.followTaskEvents(w, r, flusher, taskID)
+			return
+		}
+	}
+	output := h.simulator.GetTaskOutput(task, outputType)
+
+	// Event output can be resumed from a byte offset
+	if sinceStr := r.URL.Query().Get("since_offset"); sinceStr != "" && outputType == "event" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil || since < 0 {
+			writeError(w, http.StatusBadRequest, "invalid since_offset parameter")
+			return
+		}
+		output = h.simulator.GetTaskEventOutput(task, since)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(output))
+}
+
+// taskFollowInterval is how often a followed task is checked for new events.
+const taskFollowInterval = 100 * time.Millisecond
+
+// followTaskEvents streams a task's event lines as they are recorded,
+// flushing each batch, until the task ends or the client goes away.
+func (h *Handlers) followTaskEvents(w http.ResponseWriter, r *http.Request, flusher http.Flusher, taskID int) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(taskFollowInterval)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		// Read the state before the events so the last batch is never missed
+		task, err := h.state.GetTask(taskID)
+		if err != nil {
+			return
+		}
+		for _, e := range h.state.GetTaskEvents(taskID, offset) {
+			line, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+			offset = e.Offset + int64(len(line)) + 1
+		}
+		flusher.Flush()
+		if isTerminalTaskState(task.State) {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandleResource handles GET /resources/:id, downloading a blob.
+func (h *Handlers) HandleResource(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	blob, err := h.state.GetBlob(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Sha1", blob.SHA1)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(blob.Content))
+}
+
+// HandleStemcells handles GET /stemcells.
+func (h *Handlers) HandleStemcells(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stemcells := h.state.GetStemcells()
+	writeJSON(w, http.StatusOK, stemcells)
+}
+
+// HandleDisks handles GET /disks.
+func (h *Handlers) HandleDisks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	disks := h.state.GetOrphanedDisks()
+	writeJSON(w, http.StatusOK, disks)
+}
+
+// HandleDeleteDisk handles DELETE /disks/:cid.
+func (h *Handlers) HandleDeleteDisk(w http.ResponseWriter, r *http.Request, cid string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasOrphanedDisk(cid) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("disk '%s' not found", cid))
+		return
+	}
+
+	task := h.createTask(r, fmt.Sprintf("delete orphaned disk %s", cid), "")
+	h.simulator.ExecuteDeleteDisk(task.ID, cid)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleDeleteTask handles DELETE /_internal/tasks/:id, removing a task
+// outright and stopping its simulation.
+func (h *Handlers) HandleDeleteTask(w http.ResponseWriter, r *http.Request, taskID int) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := h.simulator.DeleteTask(taskID); err != nil {
+		writeErrorCode(w, ErrCodeTaskNotFound, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleInstanceResponsiveness handles POST
+// /admin/instances/:deployment/:job/:index/(unresponsive|responsive),
+// simulating an agent that stops or resumes responding.
+func (h *Handlers) HandleInstanceResponsiveness(w http.ResponseWriter, r *http.Request, deployment, job, index string, responsive bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+	if err := h.state.SetInstanceResponsiveness(deployment, job, index, responsive); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !responsive {
+		h.simulator.Resurrect(deployment, job, index)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ScaleRequest is the body of POST /admin/deployments/:name/scale, and its
+// response.
+type ScaleRequest struct {
+	Job       string `json:"job"`
+	Instances *int   `json:"instances"`
+}
+
+// HandleAdminScale handles POST /admin/deployments/:name/scale, growing or
+// shrinking a job's VMs and instances without a deploy.
+func (h *Handlers) HandleAdminScale(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	var req ScaleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid scale request")
+		return
+	}
+	if req.Job == "" || req.Instances == nil {
+		writeError(w, http.StatusBadRequest, "job and instances are required")
+		return
+	}
+	if *req.Instances < 0 {
+		writeError(w, http.StatusBadRequest, "instances must not be negative")
+		return
+	}
+
+	instances, err := h.state.GetInstances(deployment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, inst := range instances {
+		if inst.Job == req.Job && inst.Lifecycle == LifecycleErrand {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("job '%s' is an errand and cannot be scaled", req.Job))
+			return
+		}
+	}
+
+	if err := h.state.ScaleJob(deployment, req.Job, *req.Instances); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// RestartAllRequest is the body of POST /admin/restart-all. Deployments in
+// Order restart first, in that order, then the rest alphabetically.
+type RestartAllRequest struct {
+	Order []string `json:"order"`
+}
+
+// RestartAllResponse lists the restart tasks, in the order they run.
+type RestartAllResponse struct {
+	Tasks []int `json:"tasks"`
+}
+
+// HandleRestartAll handles POST /admin/restart-all, restarting every
+// deployment one after another. It returns the tasks at once; each starts
+// when the one before it ends.
+func (h *Handlers) HandleRestartAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req RestartAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid restart request")
+		return
+	}
+
+	var rest []string
+	for _, d := range h.state.GetDeployments() {
+		if !containsString(req.Order, d.Name) {
+			rest = append(rest, d.Name)
+		}
+	}
+	sort.Strings(rest)
+	seen := make(map[string]bool)
+	for _, name := range req.Order {
+		if seen[name] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("deployment '%s' is listed twice", name))
+			return
+		}
+		seen[name] = true
+		if !h.state.HasDeployment(name) {
+			writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", name))
+			return
+		}
+	}
+	deployments := append(append([]string{}, req.Order...), rest...)
+	// Lock every deployment or none: tasks created before hitting a locked
+	// deployment are withdrawn
+	resp := RestartAllResponse{Tasks: make([]int, 0, len(deployments))}
+	for _, name := range deployments {
+		task, ok := h.createLockedTask(w, r, fmt.Sprintf("restart jobs in deployment %s", name), name)
+		if !ok {
+			for _, id := range resp.Tasks {
+				h.state.DeleteTask(id)
+			}
+			return
+		}
+		resp.Tasks = append(resp.Tasks, task.ID)
+	}
+	h.simulator.ExecuteRestartAll(resp.Tasks, deployments)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// CleanupRequest is the body of POST /cleanup.
+type CleanupRequest struct {
+	Config struct {
+		RemoveAll bool `json:"remove_all"`
+	} `json:"config"`
+}
+
+// HandleCleanup handles POST /cleanup.
+func (h *Handlers) HandleCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req CleanupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid cleanup request")
+		return
+	}
+
+	task := h.createTask(r, "clean up", "")
+	h.simulator.ExecuteCleanup(task.ID, req.Config.RemoveAll)
+
+	h.redirectToTask(w, task.ID)
+}
+
+// HandleReleases handles GET /releases.
+func (h *Handlers) HandleReleases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	releases := h.state.GetReleases()
+	writeJSON(w, http.StatusOK, releases)
+}
+
+// HandleConfigs handles GET /configs with type and latest parameters, POST
+// /configs to upload a new version, and DELETE /configs to remove one.
+func (h *Handlers) HandleConfigs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.handleCreateConfig(w, r)
+		return
+	case http.MethodDelete:
+		h.handleDeleteConfig(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	configType := r.URL.Query().Get("type")
+	latest := r.URL.Query().Get("latest") != "false"
+
+	// Each config's properties and creation time make up the ETag
+	var fields []string
+	switch configType {
+	case "cloud":
+		configs := []CloudConfig{}
+		if !latest {
+			configs = h.state.GetCloudConfigHistory()
+		} else if config := h.state.GetCloudConfig(); config != nil {
+			configs = []CloudConfig{*config}
+		}
+		for _, c := range configs {
+			fields = append(fields, c.Properties, c.CreatedAt)
+		}
+		writeJSONWithETag(w, r, configETag(fields...), configs)
+	case "runtime":
+		configs := h.state.GetRuntimeConfigs()
+		if !latest {
+			configs = h.state.GetRuntimeConfigHistory()
+		}
+		for _, c := range configs {
+			fields = append(fields, c.Properties, c.CreatedAt)
+		}
+		writeJSONWithETag(w, r, configETag(fields...), configs)
+	case "cpi":
+		configs := []CPIConfig{}
+		if !latest {
+			configs = h.state.GetCPIConfigHistory()
+		} else if config := h.state.GetCPIConfig(); config != nil {
+			configs = []CPIConfig{*config}
+		}
+		for _, c := range configs {
+			fields = append(fields, c.Properties, c.CreatedAt)
+		}
+		writeJSONWithETag(w, r, configETag(fields...), configs)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", configType))
+	}
+}
+
+// ConfigRequest is the body of POST /configs.
+type ConfigRequest struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// handleCreateConfig handles POST /configs, storing a new config version.
+func (h *Handlers) handleCreateConfig(w http.ResponseWriter, r *http.Request) {
+	body, ok := readManifestBody(w, r)
+	if !ok {
+		return
+	}
+	var req ConfigRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid config request")
+		return
+	}
+
+	if !isConfigType(req.Type) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", req.Type))
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, http.StatusUnprocessableEntity, "config content must not be empty")
+		return
+	}
+
+	switch req.Type {
+	case "cloud":
+		writeJSON(w, http.StatusCreated, h.state.AddCloudConfig(req.Content))
+	case "runtime":
+		name := req.Name
+		if name == "" {
+			name = "default"
+		}
+		writeJSON(w, http.StatusCreated, h.state.AddRuntimeConfig(name, req.Content))
+	case "cpi":
+		writeJSON(w, http.StatusCreated, h.state.AddCPIConfig(req.Content))
+	}
+}
+
+// HandleValidateConfig handles POST /configs/validate, checking a config
+// without storing it. Invalid configs still return 200 with their errors.
+func (h *Handlers) HandleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, ok := readManifestBody(w, r)
+	if !ok {
+		return
+	}
+	var req ConfigRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid config request")
+		return
+	}
+	if !isConfigType(req.Type) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", req.Type))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.state.ValidateConfig(req.Type, req.Content))
+}
+
+// HandleConfigDiff handles GET /configs/diff?type=...&name=...&from=...&to=...,
+// diffing two stored versions of a config by ID.
+func (h *Handlers) HandleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	configType := query.Get("type")
+	if !isConfigType(configType) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", configType))
+		return
+	}
+	name := query.Get("name")
+	if name == "" {
+		name = "default"
+	}
+	from, to := query.Get("from"), query.Get("to")
+	if from == "" || to == "" {
+		writeError(w, http.StatusBadRequest, "from and to are required")
+		return
+	}
+
+	before, err := h.state.GetConfigVersion(configType, name, from)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	after, err := h.state.GetConfigVersion(configType, name, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ConfigDiff{From: from, To: to, Diff: diffManifests(before, after)})
+}
+
+// handleDeleteConfig handles DELETE /configs?type=...&name=..., removing a
+// config and its history.
+func (h *Handlers) handleDeleteConfig(w http.ResponseWriter, r *http.Request) {
+	configType := r.URL.Query().Get("type")
+	if !isConfigType(configType) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown config type: %s", configType))
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "default"
+	}
+	if err := h.state.DeleteConfig(configType, name); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLocks handles GET /locks.
+func (h *Handlers) HandleLocks(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
@@ -389,6 +1796,210 @@ func (h *Handlers) HandleLocks(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, locks)
 }
 
+// HandleAdminReset handles POST /admin/reset, restoring default fixtures.
+func (h *Handlers) HandleAdminReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	h.simulator.Reset(DefaultFixtures())
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+}
+
+// HandleExportBundle handles GET /_internal/export-bundle, returning the
+// current state as a gzipped tarball.
+func (h *Handlers) HandleExportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	bundle, err := h.state.ExportBundle()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="bosh-mock-bundle.tgz"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bundle)
+}
+
+// HandleErrorCodes handles GET /_internal/error-codes, listing the error
+// codes responses may carry.
+func (h *Handlers) HandleErrorCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ErrorCatalog())
+}
+
+// HandleVMTypes handles GET /_internal/vm-types, counting VMs per vm_type
+// across all deployments.
+func (h *Handlers) HandleVMTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.state.VMTypeCounts())
+}
+
+// HandleIPs handles GET /_internal/ips, listing the IPs VMs hold across
+// deployments and flagging duplicates.
+func (h *Handlers) HandleIPs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.state.IPInventory())
+}
+
+// HandleStuckDeployScenario handles POST /_internal/scenario/stuck-deploy,
+// leaving a deployment (cf unless ?deployment= is given) as a deploy would
+// when one agent stops responding: the deploy task has failed and cloud
+// check reports an unresponsive agent that only resolving the problem fixes.
+func (h *Handlers) HandleStuckDeployScenario(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	deployment := r.URL.Query().Get("deployment")
+	if deployment == "" {
+		deployment = "cf"
+	}
+	vms, err := h.state.GetVMs(deployment)
+	if err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+
+	var target *VM
+	for i := range vms {
+		if vms[i].Lifecycle != LifecycleErrand && vms[i].VMCID != "" {
+			target = &vms[i]
+			break
+		}
+	}
+	if target == nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("deployment '%s' has no VMs", deployment))
+		return
+	}
+	if err := h.state.SetAgentUnresponsive(deployment, target.Job, target.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	task := h.createTask(r, fmt.Sprintf("update deployment %s", deployment), deployment)
+	h.state.UpdateTaskState(task.ID, "error", fmt.Sprintf("Timed out pinging to %s after 600 seconds", target.AgentID))
+
+	writeJSON(w, http.StatusOK, StuckDeployScenario{
+		Deployment: deployment,
+		Instance:   h.state.InstanceName(deployment, target.Job, target.ID),
+		TaskID:     task.ID,
+	})
+}
+
+// HandleProbe handles GET /_internal/probe?target=deployment/job/index,
+// reporting synthetic health from the instance's process states.
+func (h *Handlers) HandleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	parts := strings.Split(target, "/")
+	if len(parts) != 3 {
+		writeError(w, http.StatusBadRequest, "target must be deployment/job/index")
+		return
+	}
+	index, err := strconv.Atoi(parts[2])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid instance index")
+		return
+	}
+
+	inst, err := h.state.GetInstance(parts[0], parts[1], index)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	healthy := inst.State == "running"
+	for _, p := range inst.Processes {
+		if p.State != "running" {
+			healthy = false
+		}
+	}
+
+	result := ProbeResult{
+		Target:    target,
+		URL:       h.state.GetHealthURL(*inst),
+		Healthy:   healthy,
+		State:     inst.State,
+		Processes: inst.Processes,
+	}
+	if result.Processes == nil {
+		result.Processes = []Process{}
+	}
+
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
+
+// HandleOAuthToken handles POST /oauth/token for the client_credentials grant.
+// Client credentials may be sent via Basic Auth or as form fields.
+func (h *Handlers) HandleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.tokens == nil {
+		writeError(w, http.StatusNotFound, "UAA authentication is not enabled")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, OAuthError{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+
+	if grant := r.PostForm.Get("grant_type"); grant != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, OAuthError{
+			Error:            "unsupported_grant_type",
+			ErrorDescription: fmt.Sprintf("Unsupported grant type: %s", grant),
+		})
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if clientID != h.username || clientSecret != h.password {
+		writeJSON(w, http.StatusUnauthorized, OAuthError{Error: "unauthorized", ErrorDescription: "Bad credentials"})
+		return
+	}
+
+	token, err := h.tokens.Issue(clientID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, OAuthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, token)
+}
+
 // HandleInfo handles GET /info for BOSH Director info.
 func (h *Handlers) HandleInfo(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -396,16 +2007,31 @@ func (h *Handlers) HandleInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userAuth := map[string]interface{}{
+		"type": "basic",
+	}
+	if h.tokens != nil {
+		userAuth = map[string]interface{}{
+			"type": "uaa",
+			"options": map[string]interface{}{
+				"url":  h.uaaURL,
+				"urls": []string{h.uaaURL},
+			},
+		}
+	}
+
 	info := map[string]interface{}{
-		"name":         "Mock BOSH Director",
-		"uuid":         "mock-bosh-director-uuid",
-		"version":      "281.0.0 (00000000)",
-		"user":         h.username,
-		"cpi":          "google_cpi",
-		"stemcell_os":  "ubuntu-jammy",
-		"user_authentication": map[string]interface{}{
-			"type": "basic",
-		},
-	}
-	writeJSON(w, http.StatusOK, info)
+		"name":                h.directorName,
+		"uuid":                h.directorUUID,
+		"version":             h.directorVersion,
+		"user":                h.username,
+		"cpi":                 "google_cpi",
+		"stemcell_os":         "ubuntu-jammy",
+		"user_authentication": userAuth,
+		"resurrection_paused": h.state.ResurrectionPaused(),
+	}
+	if profile, ok := matchClientProfile(h.clientProfiles, r); ok {
+		profile.applyInfo(info)
+	}
+	writeJSONWithETag(w, r, bodyETag(info), info)
 }
@@ -4,10 +4,21 @@
 package mockbosh
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func setupTestHandlers() *Handlers {
@@ -39,6 +50,44 @@ func TestHandleDeployments(t *testing.T) {
 	}
 }
 
+func TestHandleDeploymentsExcludeConfigs(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	list := func(query string) []map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/deployments"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeployments(w, req)
+		var deployments []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &deployments); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return deployments
+	}
+
+	for _, d := range list("") {
+		if d["cloud_config"] != "latest" {
+			t.Errorf("Expected cloud_config latest for %v, got %v", d["name"], d["cloud_config"])
+		}
+		teams, ok := d["teams"].([]interface{})
+		if !ok {
+			t.Fatalf("Expected teams array for %v, got %v", d["name"], d["teams"])
+		}
+		if d["name"] == "cf" && (len(teams) != 1 || teams[0] != "admin") {
+			t.Errorf("Expected cf teams [admin], got %v", teams)
+		}
+	}
+
+	for _, d := range list("?exclude_configs=true") {
+		if _, ok := d["cloud_config"]; ok {
+			t.Errorf("Expected no cloud_config for %v", d["name"])
+		}
+		if _, ok := d["teams"]; !ok {
+			t.Errorf("Expected teams for %v", d["name"])
+		}
+	}
+}
+
 func TestHandleDeploymentVMs(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -62,6 +111,47 @@ func TestHandleDeploymentVMs(t *testing.T) {
 	}
 }
 
+func TestHandleDeploymentVMsFilter(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	get := func(query string) []VM {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/deployments/cf/vms?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentVMs(w, req, "cf")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, w.Code)
+		}
+		var vms []VM
+		if err := json.Unmarshal(w.Body.Bytes(), &vms); err != nil {
+			t.Fatalf("%s: failed to unmarshal response: %v", query, err)
+		}
+		if vms == nil {
+			t.Fatalf("%s: expected a JSON array, got %s", query, w.Body.String())
+		}
+		return vms
+	}
+
+	routers := get("job=router")
+	if len(routers) != 2 {
+		t.Errorf("Expected 2 router VMs, got %d", len(routers))
+	}
+	for _, vm := range routers {
+		if vm.Job != "router" {
+			t.Errorf("Expected only router VMs, got %s", vm.Job)
+		}
+	}
+
+	if vms := get("job=router&index=1"); len(vms) != 1 || vms[0].Job != "router" || vms[0].Index != 1 {
+		t.Errorf("Expected just router/1, got %+v", vms)
+	}
+
+	if vms := get("job=router&index=7"); len(vms) != 0 {
+		t.Errorf("Expected no VMs, got %d", len(vms))
+	}
+}
+
 func TestHandleDeploymentVMsNotFound(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -112,6 +202,101 @@ func TestHandleDeploymentInstances(t *testing.T) {
 	}
 }
 
+func TestHandleDeploymentInstancesGroupByAZ(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	// cf's instances span z1 and z2; move the router to z3 to cover all three
+	if err := handlers.state.MigrateInstance("cf", "router", "cf-r0-id", "z3"); err != nil {
+		t.Fatalf("MigrateInstance failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/cf/instances?group_by=az", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploymentInstances(w, req, "cf")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var grouped map[string][]Instance
+	if err := json.Unmarshal(w.Body.Bytes(), &grouped); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	instances, _ := handlers.state.GetInstances("cf")
+	expected := make(map[string]int)
+	for _, inst := range instances {
+		expected[inst.AZ]++
+	}
+
+	for _, az := range []string{"z1", "z2", "z3"} {
+		if len(grouped[az]) != expected[az] || expected[az] == 0 {
+			t.Errorf("Expected %d instances in %s, got %d", expected[az], az, len(grouped[az]))
+		}
+		for _, inst := range grouped[az] {
+			if inst.AZ != az {
+				t.Errorf("Instance %s in %s is grouped under %s", inst.ID, inst.AZ, az)
+			}
+		}
+	}
+	if len(grouped) != len(expected) {
+		t.Errorf("Expected %d AZ groups, got %d", len(expected), len(grouped))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments/cf/instances?group_by=job", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeploymentInstances(w, req, "cf")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unsupported group_by, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleDeploymentInstancesProcessFilter(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	get := func(query string) []Instance {
+		req := httptest.NewRequest(http.MethodGet, "/deployments/cf/instances?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentInstances(w, req, "cf")
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var instances []Instance
+		if err := json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return instances
+	}
+
+	all := get("format=full")
+	filtered := get("format=full&process=garden")
+	if len(filtered) != len(all) {
+		t.Fatalf("Expected %d instances, got %d", len(all), len(filtered))
+	}
+	for _, inst := range filtered {
+		for _, p := range inst.Processes {
+			if p.Name != "garden" {
+				t.Errorf("Expected only garden processes, got %s on %s", p.Name, inst.ID)
+			}
+		}
+		if inst.Job == "diego_cell" && len(inst.Processes) != 1 {
+			t.Errorf("Expected 1 garden process on %s, got %d", inst.ID, len(inst.Processes))
+		}
+		if inst.Job == "router" && len(inst.Processes) != 0 {
+			t.Errorf("Expected no processes on %s, got %d", inst.ID, len(inst.Processes))
+		}
+	}
+
+	for _, inst := range get("process=garden") {
+		if len(inst.Processes) != 0 {
+			t.Errorf("Expected no processes without format=full, got %d on %s", len(inst.Processes), inst.ID)
+		}
+	}
+}
+
 func TestHandleTasks(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -161,6 +346,59 @@ func TestHandleTasksWithFilters(t *testing.T) {
 	}
 }
 
+func TestHandleTasksVerbose(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	tests := []struct {
+		query    string
+		wantCode int
+		internal bool
+	}{
+		{"", http.StatusOK, false},
+		{"?verbose=1", http.StatusOK, false},
+		{"?verbose=2", http.StatusOK, true},
+		{"?verbose=3", http.StatusBadRequest, false},
+		{"?verbose=all", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tasks"+tt.query, nil)
+			req.SetBasicAuth("admin", "admin")
+			w := httptest.NewRecorder()
+
+			handlers.HandleTasks(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var tasks []Task
+			if err := json.Unmarshal(w.Body.Bytes(), &tasks); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			internal := 0
+			for _, task := range tasks {
+				if task.Verbose == 2 {
+					internal++
+				}
+			}
+			if tt.internal && internal != 2 {
+				t.Errorf("Expected 2 internal tasks, got %d", internal)
+			}
+			if !tt.internal && internal != 0 {
+				t.Errorf("Expected internal tasks hidden, got %d", internal)
+			}
+			if len(tasks)-internal != 8 {
+				t.Errorf("Expected 8 user tasks, got %d", len(tasks)-internal)
+			}
+		})
+	}
+}
+
 func TestHandleTask(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -269,6 +507,245 @@ func TestHandleConfigs(t *testing.T) {
 	}
 }
 
+func TestHandleConfigsHistory(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	fetch := func(query string) []CloudConfig {
+		req := httptest.NewRequest(http.MethodGet, "/configs?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleConfigs(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, w.Code)
+		}
+		var configs []CloudConfig
+		if err := json.Unmarshal(w.Body.Bytes(), &configs); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return configs
+	}
+
+	for _, query := range []string{"type=cloud", "type=cloud&latest=true"} {
+		latest := fetch(query)
+		if len(latest) != 1 || latest[0].ID != "6" {
+			t.Errorf("%s: expected only the newest cloud config, got %+v", query, latest)
+		}
+	}
+
+	history := fetch("type=cloud&latest=false")
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 cloud config versions, got %d", len(history))
+	}
+	for i, id := range []string{"6", "4", "2"} {
+		if history[i].ID != id {
+			t.Errorf("Expected version %d to have ID %s, got %s", i, id, history[i].ID)
+		}
+	}
+	if history[0].Properties == history[1].Properties {
+		t.Error("Expected historical cloud configs to differ")
+	}
+
+	if runtime := fetch("type=runtime&latest=false"); len(runtime) != 2 {
+		t.Errorf("Expected 2 runtime config versions, got %d", len(runtime))
+	}
+}
+
+func TestHandleCreateConfig(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/configs", strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleConfigs(w, req)
+		return w
+	}
+
+	w := post(`{"type":"cloud","name":"default","content":"azs:\n- name: z9\n"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	var created CloudConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if created.ID != "7" || created.CreatedAt == "" {
+		t.Errorf("Expected new config with ID 7 and a timestamp, got %+v", created)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/configs?type=cloud&latest=true", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleConfigs(w, req)
+	var latest []CloudConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(latest) != 1 || latest[0] != created {
+		t.Errorf("Expected latest cloud config to be the upload, got %+v", latest)
+	}
+
+	if w := post(`{"type":"bogus","content":"x: 1"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Unknown type: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := post(`{"type":"runtime","name":"dns","content":"  "}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Empty content: expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+
+	// Only /configs/validate is strict; uploads take configs it would flag
+	undefinedAZ, _ := json.Marshal(ConfigRequest{Type: "cloud", Content: "azs:\n- name: z1\nnetworks:\n- name: default\n  subnets:\n  - range: 10.0.1.0/24\n    azs: [z9]\n"})
+	if w := post(string(undefinedAZ)); w.Code != http.StatusCreated {
+		t.Errorf("Cloud config with an undefined az: expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	big, _ := json.Marshal(ConfigRequest{Type: "runtime", Name: "dns", Content: strings.Repeat("x", maxManifestSize)})
+	if w := post(string(big)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized body: expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestHandleConfigDiff(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	upload := func(content string) string {
+		body, _ := json.Marshal(ConfigRequest{Type: "runtime", Name: "dns", Content: content})
+		req := httptest.NewRequest(http.MethodPost, "/configs", strings.NewReader(string(body)))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleConfigs(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var created RuntimeConfig
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return created.ID
+	}
+	diff := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/configs/diff?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleConfigDiff(w, req)
+		return w
+	}
+
+	v1 := runtimeConfigYAML("dns")
+	from := upload(v1)
+	to := upload(strings.Replace(v1, "version: 1.32.0", "version: 1.33.0", 1))
+
+	w := diff(fmt.Sprintf("type=runtime&name=dns&from=%s&to=%s", from, to))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var got ConfigDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	want := [][]string{{"  version: 1.32.0", DiffRemoved}, {"  version: 1.33.0", DiffAdded}}
+	changed := make([][]string, 0)
+	for _, entry := range got.Diff {
+		if entry[1] != "" {
+			changed = append(changed, entry)
+		}
+	}
+	if fmt.Sprint(changed) != fmt.Sprint(want) {
+		t.Errorf("Expected changed lines %v, got %v", want, changed)
+	}
+
+	if w := diff(fmt.Sprintf("type=runtime&name=os-conf&from=%s&to=%s", from, to)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another config's versions, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := diff("type=runtime&name=dns&from=" + from); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without to, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleValidateConfig(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	validate := func(configType, content string) ConfigValidation {
+		t.Helper()
+		body, _ := json.Marshal(ConfigRequest{Type: configType, Content: content})
+		req := httptest.NewRequest(http.MethodPost, "/configs/validate", strings.NewReader(string(body)))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleValidateConfig(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var result ConfigValidation
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return result
+	}
+
+	before := len(handlers.state.GetRuntimeConfigHistory())
+	result := validate("runtime", "releases:\n- name: telegraf\n  version: 1.0.0\n")
+	if !result.Valid || len(result.Errors) != 0 {
+		t.Errorf("Expected a valid config, got errors %v", result.Errors)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "telegraf/1.0.0") {
+		t.Errorf("Expected a warning about telegraf/1.0.0, got %v", result.Warnings)
+	}
+	if after := len(handlers.state.GetRuntimeConfigHistory()); after != before {
+		t.Errorf("Expected validation not to store the config, history grew from %d to %d", before, after)
+	}
+
+	if result := validate("runtime", runtimeConfigYAML("default")); len(result.Warnings) != 0 {
+		t.Errorf("Expected no warnings for uploaded releases, got %v", result.Warnings)
+	}
+
+	broken := validate("cloud", "azs:\n- name: z1\nnetworks:\n- name: default\n  subnets:\n  - range: 10.0.1.0/24\n    azs: [z9]\n")
+	if broken.Valid || len(broken.Errors) != 1 || !strings.Contains(broken.Errors[0], "z9") {
+		t.Errorf("Expected an undefined az error, got %+v", broken)
+	}
+
+	big, _ := json.Marshal(ConfigRequest{Type: "runtime", Content: strings.Repeat("x", maxManifestSize)})
+	req := httptest.NewRequest(http.MethodPost, "/configs/validate", strings.NewReader(string(big)))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleValidateConfig(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for an oversized config, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestHandleDeleteConfig(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	del := func(query string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/configs?"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleConfigs(w, req)
+		return w.Code
+	}
+
+	if code := del("type=runtime&name=dns"); code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, code)
+	}
+
+	runtime := handlers.state.GetRuntimeConfigs()
+	if len(runtime) != 1 || runtime[0].Name != "default" {
+		t.Errorf("Expected only the default runtime config, got %+v", runtime)
+	}
+
+	if code := del("type=runtime&name=dns"); code != http.StatusNotFound {
+		t.Errorf("Expected status %d deleting again, got %d", http.StatusNotFound, code)
+	}
+	if code := del("type=cpi"); code != http.StatusNoContent {
+		t.Errorf("Expected status %d clearing cpi config, got %d", http.StatusNoContent, code)
+	}
+	if handlers.state.GetCPIConfig() != nil {
+		t.Error("Expected no CPI config after delete")
+	}
+	if code := del("type=bogus"); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown type, got %d", http.StatusBadRequest, code)
+	}
+}
+
 func TestHandleLocks(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -329,6 +806,46 @@ func TestHandleDeleteDeployment(t *testing.T) {
 	}
 }
 
+func TestHandleDeleteDeploymentDryRun(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodDelete, "/deployments/cf?dry_run=true", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeleteDeployment(w, req, "cf")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var deletion DeploymentDeletion
+	if err := json.Unmarshal(w.Body.Bytes(), &deletion); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if deletion.VMs != len(defaultVMs()["cf"]) {
+		t.Errorf("Expected %d VMs, got %d", len(defaultVMs()["cf"]), deletion.VMs)
+	}
+	if deletion.Instances != len(defaultInstances()["cf"]) {
+		t.Errorf("Expected %d instances, got %d", len(defaultInstances()["cf"]), deletion.Instances)
+	}
+	if deletion.Variables != len(defaultVariables()["cf"]) {
+		t.Errorf("Expected %d variables, got %d", len(defaultVariables()["cf"]), deletion.Variables)
+	}
+	if len(deletion.Stemcells) != 1 || deletion.Stemcells[0] != "bosh-google-kvm-ubuntu-jammy-go_agent/1.200" {
+		t.Errorf("Expected cf's stemcell to be dereferenced, got %v", deletion.Stemcells)
+	}
+
+	if w.Header().Get("Location") != "" {
+		t.Error("Expected no task for a dry run")
+	}
+	if !handlers.state.HasDeployment("cf") {
+		t.Error("Expected a dry run to leave the deployment in place")
+	}
+	if vms, _ := handlers.state.GetVMs("cf"); len(vms) != deletion.VMs {
+		t.Errorf("Expected a dry run to leave the VMs in place, got %d", len(vms))
+	}
+}
+
 func TestHandleDeleteDeploymentNotFound(t *testing.T) {
 	handlers := setupTestHandlers()
 
@@ -380,3 +897,3616 @@ func TestMethodNotAllowed(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
 	}
 }
+
+func TestEmptyMode(t *testing.T) {
+	state := NewStateWithData(EmptyFixtures())
+	simulator := NewTaskSimulator(state, 10.0, false)
+	handlers := NewHandlers(state, simulator, "admin", "admin")
+
+	endpoints := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/deployments", handlers.HandleDeployments},
+		{"/stemcells", handlers.HandleStemcells},
+		{"/releases", handlers.HandleReleases},
+		{"/tasks", handlers.HandleTasks},
+		{"/locks", handlers.HandleLocks},
+		{"/configs?type=cloud", handlers.HandleConfigs},
+		{"/configs?type=runtime", handlers.HandleConfigs},
+		{"/configs?type=cpi", handlers.HandleConfigs},
+	}
+
+	for _, ep := range endpoints {
+		req := httptest.NewRequest(http.MethodGet, ep.path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+
+		ep.handler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusOK, ep.path, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+			t.Errorf("Expected empty array for %s, got %s", ep.path, body)
+		}
+	}
+
+	task := state.CreateTask("first task", "", "admin")
+	if task.ID != 1 {
+		t.Errorf("Expected first task ID 1, got %d", task.ID)
+	}
+	if _, err := state.GetTask(task.ID); err != nil {
+		t.Errorf("Expected created task to be retrievable: %v", err)
+	}
+}
+
+func TestSyntheticFixtures(t *testing.T) {
+	state := NewStateWithData(GenerateSyntheticFixtures(500))
+	simulator := NewTaskSimulator(state, 10.0, false)
+	handlers := NewHandlers(state, simulator, "admin", "admin")
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeployments(w, req)
+
+	var deployments []Deployment
+	if err := json.Unmarshal(w.Body.Bytes(), &deployments); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(deployments) != 503 {
+		t.Errorf("Expected 503 deployments, got %d", len(deployments))
+	}
+
+	ips := make(map[string]string)
+	for _, name := range []string{"app-0001", "app-0250", "app-0500"} {
+		vms, err := state.GetVMs(name)
+		if err != nil || len(vms) != 2 {
+			t.Fatalf("Expected 2 VMs for %s, got %d (%v)", name, len(vms), err)
+		}
+		for _, vm := range vms {
+			if owner, ok := ips[vm.IPs[0]]; ok {
+				t.Errorf("IP %s used by both %s and %s", vm.IPs[0], owner, vm.ID)
+			}
+			ips[vm.IPs[0]] = vm.ID
+		}
+	}
+
+	// Instances share process templates, so stopping one must not leak
+	if err := state.ChangeJobState("app-0001", "", "", "stopped", false); err != nil {
+		t.Fatalf("ChangeJobState failed: %v", err)
+	}
+	instances, _ := state.GetInstances("app-0002")
+	for _, inst := range instances {
+		for _, p := range inst.Processes {
+			if p.State != "running" {
+				t.Errorf("Expected app-0002 process %s running, got %s", p.Name, p.State)
+			}
+		}
+	}
+}
+
+func TestHandleAdminReset(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	if err := handlers.state.DeleteDeployment("redis"); err != nil {
+		t.Fatalf("DeleteDeployment failed: %v", err)
+	}
+
+	// Start a task that would otherwise complete after the reset
+	task := handlers.state.CreateTask("stop jobs in deployment cf", "cf", "admin")
+	handlers.simulator.ExecuteStop(task.ID, "cf", "", "", false)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/reset", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleAdminReset(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if body["status"] != "reset" {
+		t.Errorf("Expected status 'reset', got '%s'", body["status"])
+	}
+
+	if !handlers.state.HasDeployment("redis") {
+		t.Error("Expected redis deployment to be restored")
+	}
+	if _, err := handlers.state.GetTask(task.ID); err == nil {
+		t.Error("Expected task created before reset to be gone")
+	}
+
+	// The abandoned task must not touch the restored state
+	time.Sleep(300 * time.Millisecond)
+	vms, _ := handlers.state.GetVMs("cf")
+	for _, vm := range vms {
+		if vm.ProcessState != "running" {
+			t.Errorf("Expected %s/%d to stay running, got '%s'", vm.Job, vm.Index, vm.ProcessState)
+		}
+	}
+	if locks := handlers.state.GetLocks(); len(locks) != 0 {
+		t.Errorf("Expected no locks after reset, got %d", len(locks))
+	}
+}
+
+func TestHandleDeploymentInstancesLinks(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/cf/instances?format=full", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeploymentInstances(w, req, "cf")
+
+	var instances []Instance
+	if err := json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	var api *Instance
+	for i := range instances {
+		if instances[i].Job == "api" {
+			api = &instances[i]
+		}
+	}
+	if api == nil || api.Links == nil {
+		t.Fatal("Expected api instance with links")
+	}
+
+	if len(api.Links.Provides) != 1 || api.Links.Provides[0].Name != "cloud_controller" {
+		t.Errorf("Expected api to provide cloud_controller, got %+v", api.Links.Provides)
+	}
+
+	consumed := make(map[string]string)
+	for _, l := range api.Links.Consumes {
+		consumed[l.Name] = l.InstanceGroup
+	}
+	if consumed["uaa"] != "uaa" {
+		t.Errorf("Expected uaa link provided by uaa, got '%s'", consumed["uaa"])
+	}
+	if consumed["doppler"] != "doppler" {
+		t.Errorf("Expected doppler link provided by doppler, got '%s'", consumed["doppler"])
+	}
+
+	// Links are only included with format=full
+	req = httptest.NewRequest(http.MethodGet, "/deployments/cf/instances", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+
+	handlers.HandleDeploymentInstances(w, req, "cf")
+
+	if strings.Contains(w.Body.String(), `"links"`) {
+		t.Error("Expected no links without format=full")
+	}
+}
+
+func TestHandleExportBundle(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/_internal/export-bundle", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleExportBundle(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to open gzip stream: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar entry: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", hdr.Name, err)
+		}
+		files[hdr.Name] = content
+	}
+
+	expected := []string{
+		"state.json",
+		"manifests/cf.yml",
+		"manifests/redis.yml",
+		"manifests/mysql.yml",
+		"configs/cloud.yml",
+		"configs/runtime-default.yml",
+		"configs/runtime-dns.yml",
+		"configs/cpi.yml",
+	}
+	for _, name := range expected {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in bundle", name)
+		}
+	}
+
+	data := &StateData{}
+	if err := json.Unmarshal(files["state.json"], data); err != nil {
+		t.Fatalf("Failed to parse state.json: %v", err)
+	}
+	if _, ok := data.Deployments["cf"]; !ok {
+		t.Error("Expected cf deployment in state.json")
+	}
+
+	if !strings.Contains(string(files["manifests/cf.yml"]), "- name: diego_cell\n  instances: 3") {
+		t.Errorf("Expected diego_cell instance group in cf manifest, got:\n%s", files["manifests/cf.yml"])
+	}
+}
+
+func TestHandleCancelTask(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	before, _ := handlers.state.GetVMs("cf")
+	task := handlers.state.CreateTask("recreate VMs for deployment cf", "cf", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "cf", "", "")
+
+	// Let the task reach processing and take the deployment lock
+	time.Sleep(100 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodDelete, "/tasks/1", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleCancelTask(w, req, task.ID)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	updated, _ := handlers.state.GetTask(task.ID)
+	if updated.State != "cancelled" {
+		t.Errorf("Expected state 'cancelled', got '%s'", updated.State)
+	}
+	if locks := handlers.state.GetLocks(); len(locks) != 0 {
+		t.Errorf("Expected lock to be released, got %d locks", len(locks))
+	}
+	vms, _ := handlers.state.GetVMs("cf")
+	for i, vm := range vms {
+		if vm.VMCID != before[i].VMCID {
+			t.Errorf("Expected %s to not be recreated, got %s", before[i].VMCID, vm.VMCID)
+		}
+	}
+
+	// Cancelling again is rejected since the task is terminal
+	w = httptest.NewRecorder()
+	handlers.HandleCancelTask(w, req, task.ID)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Fixture task 1 is done
+	w = httptest.NewRecorder()
+	handlers.HandleCancelTask(w, req, 1)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handlers.HandleCancelTask(w, req, 99999)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleProbe(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	if err := handlers.state.ChangeJobState("cf", "api", "", "stopped", false); err != nil {
+		t.Fatalf("ChangeJobState failed: %v", err)
+	}
+
+	testCases := []struct {
+		target  string
+		status  int
+		healthy bool
+		url     string
+	}{
+		{"cf/router/0", http.StatusOK, true, "http://10.0.1.20:8080/health"},
+		{"cf/api/0", http.StatusServiceUnavailable, false, "http://10.0.1.30:9022/healthz"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/_internal/probe?target="+tc.target, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+
+		handlers.HandleProbe(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.target, tc.status, w.Code)
+		}
+
+		var result ProbeResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if result.Healthy != tc.healthy {
+			t.Errorf("%s: expected healthy=%v, got %v", tc.target, tc.healthy, result.Healthy)
+		}
+		if result.URL != tc.url {
+			t.Errorf("%s: expected url '%s', got '%s'", tc.target, tc.url, result.URL)
+		}
+	}
+
+	for target, status := range map[string]int{
+		"cf/router":    http.StatusBadRequest,
+		"cf/router/x":  http.StatusBadRequest,
+		"cf/router/99": http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/_internal/probe?target="+target, nil)
+		w := httptest.NewRecorder()
+		handlers.HandleProbe(w, req)
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", target, status, w.Code)
+		}
+	}
+}
+
+func TestUAAAuth(t *testing.T) {
+	handlers := setupTestHandlers()
+	tokens, err := NewTokenIssuer("https://localhost:25555/oauth/token")
+	if err != nil {
+		t.Fatalf("NewTokenIssuer failed: %v", err)
+	}
+	handlers.UseUAA("https://localhost:25555", tokens)
+
+	// Basic auth is no longer accepted
+	req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.SetBasicAuth("admin", "admin")
+	if handlers.CheckAuth(req) {
+		t.Error("Expected basic auth to fail in UAA mode")
+	}
+
+	// Bad client credentials
+	req = httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "wrong")
+	w := httptest.NewRecorder()
+	handlers.HandleOAuthToken(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Unsupported grant
+	req = httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type=password"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handlers.HandleOAuthToken(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Valid client credentials as form fields
+	req = httptest.NewRequest(http.MethodPost, "/oauth/token",
+		strings.NewReader("grant_type=client_credentials&client_id=admin&client_secret=admin"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handlers.HandleOAuthToken(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var token TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if token.TokenType != "bearer" || token.ExpiresIn <= 0 {
+		t.Errorf("Unexpected token response: %+v", token)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if !handlers.CheckAuth(req) {
+		t.Error("Expected issued token to be accepted")
+	}
+
+	// Tampered token
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken+"x")
+	if handlers.CheckAuth(req) {
+		t.Error("Expected tampered token to be rejected")
+	}
+
+	// Expired token
+	tokens.now = func() time.Time { return time.Now().Add(2 * tokenTTL) }
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if handlers.CheckAuth(req) {
+		t.Error("Expected expired token to be rejected")
+	}
+
+	// /info advertises UAA
+	req = httptest.NewRequest(http.MethodGet, "/info", nil)
+	w = httptest.NewRecorder()
+	handlers.HandleInfo(w, req)
+
+	var info struct {
+		UserAuthentication struct {
+			Type    string `json:"type"`
+			Options struct {
+				URL string `json:"url"`
+			} `json:"options"`
+		} `json:"user_authentication"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if info.UserAuthentication.Type != "uaa" || info.UserAuthentication.Options.URL != "https://localhost:25555" {
+		t.Errorf("Unexpected user_authentication: %+v", info.UserAuthentication)
+	}
+}
+
+func TestHandleDeploymentManifestInterpolation(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	getManifest := func(path string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+
+		handlers.HandleDeployment(w, req, "cf")
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var d Deployment
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return d.Manifest
+	}
+
+	raw := getManifest("/deployments/cf")
+	if !strings.Contains(raw, "((cf_admin_password))") {
+		t.Error("Expected raw manifest to contain ((cf_admin_password))")
+	}
+
+	interpolated := getManifest("/deployments/cf?interpolated=true")
+	if strings.Contains(interpolated, "((") || strings.Contains(interpolated, "))") {
+		t.Errorf("Expected no placeholders in interpolated manifest, got:\n%s", interpolated)
+	}
+	if !strings.Contains(interpolated, "cert_chain: mock-certificate-") {
+		t.Error("Expected certificate placeholder to be replaced with a synthetic certificate")
+	}
+
+	// Values are stable across requests
+	if again := getManifest("/deployments/cf?interpolated=true"); again != interpolated {
+		t.Error("Expected interpolation to be deterministic")
+	}
+}
+
+func TestHandleDeploymentErrands(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/cf/errands", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeploymentErrands(w, req, "cf")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var errands []Errand
+	if err := json.Unmarshal(w.Body.Bytes(), &errands); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, e := range errands {
+		names[e.Name] = true
+	}
+	if len(errands) != 2 || !names["smoke_tests"] || !names["acceptance_tests"] {
+		t.Errorf("Expected smoke_tests and acceptance_tests errands, got %+v", errands)
+	}
+
+	countErrands := func(path string) (total, errandCount int) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentInstances(w, req, "cf")
+
+		var instances []Instance
+		if err := json.Unmarshal(w.Body.Bytes(), &instances); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		for _, inst := range instances {
+			if inst.Lifecycle == LifecycleErrand {
+				errandCount++
+			}
+		}
+		return len(instances), errandCount
+	}
+
+	all, errandsIncluded := countErrands("/deployments/cf/instances")
+	if errandsIncluded != 2 {
+		t.Errorf("Expected 2 errand instances by default, got %d", errandsIncluded)
+	}
+
+	services, errandsExcluded := countErrands("/deployments/cf/instances?exclude_errands=true")
+	if errandsExcluded != 0 {
+		t.Errorf("Expected no errand instances when excluded, got %d", errandsExcluded)
+	}
+	if services != all-2 {
+		t.Errorf("Expected %d service instances, got %d", all-2, services)
+	}
+
+	// Redis has no errands
+	w = httptest.NewRecorder()
+	handlers.HandleDeploymentErrands(w, req, "redis")
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("Expected no errands for redis, got %s", body)
+	}
+}
+
+func TestHandleInfoDirectorInfo(t *testing.T) {
+	config := DefaultServerConfig()
+	config.DirectorName = "test-director"
+	config.DirectorUUID = "test-uuid"
+	config.DirectorVersion = "270.1.0 (abcdef01)"
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/info", nil)
+	w := httptest.NewRecorder()
+
+	server.handlers.HandleInfo(w, req)
+
+	var info map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if info["name"] != "test-director" || info["uuid"] != "test-uuid" || info["version"] != "270.1.0 (abcdef01)" {
+		t.Errorf("Unexpected director info: %v", info)
+	}
+
+	config.DirectorVersion = " "
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected error for empty director version")
+	}
+}
+
+func TestHandleInfoClientProfiles(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	fetch := func(userAgent string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		req.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		handlers.HandleInfo(w, req)
+
+		var info map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return info
+	}
+
+	current := fetch("bosh-cli/7.5.2")
+	if _, ok := current["stemcell_os"]; !ok {
+		t.Error("Expected stemcell_os for current CLI")
+	}
+	if _, ok := current["features"]; ok {
+		t.Error("Expected no features block for current CLI")
+	}
+
+	legacy := fetch("bosh-cli/5.5.1")
+	if _, ok := legacy["stemcell_os"]; ok {
+		t.Error("Expected stemcell_os omitted for legacy CLI")
+	}
+	if _, ok := legacy["features"]; !ok {
+		t.Error("Expected features block for legacy CLI")
+	}
+
+	// The most specific matching key wins
+	handlers.SetClientProfiles(map[string]ClientProfile{
+		"bosh-cli/":    {Name: "any", InfoOverrides: map[string]interface{}{"cpi": "any_cpi"}},
+		"bosh-cli/6.4": {Name: "v6.4", InfoOverrides: map[string]interface{}{"cpi": "old_cpi"}},
+	})
+	if cpi := fetch("bosh-cli/6.4.17")["cpi"]; cpi != "old_cpi" {
+		t.Errorf("Expected cpi 'old_cpi', got %v", cpi)
+	}
+}
+
+// waitForTask polls until a task reaches a terminal state or the timeout expires.
+func waitForTask(t *testing.T, state *State, id int, timeout time.Duration) *Task {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		task, err := state.GetTask(id)
+		if err != nil {
+			t.Fatalf("GetTask failed: %v", err)
+		}
+		if isTerminalTaskState(task.State) || time.Now().After(deadline) {
+			return task
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHandleDeployManifestRoundTrip(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	manifest := `name: nginx
+
+releases:
+- name: nginx
+  version: "1.21.0"
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+instance_groups:
+- name: web
+  instances: 1
+  azs: [z1]
+`
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	req.Header.Set("Content-Type", "text/yaml")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeploy(w, req, "")
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	task := waitForTask(t, handlers.state, taskID, 2*time.Second)
+	if task.State != "done" {
+		t.Fatalf("Expected deploy task to be done, got '%s'", task.State)
+	}
+	if task.Description != "create deployment nginx" {
+		t.Errorf("Expected create description, got '%s'", task.Description)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments/nginx", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+
+	handlers.HandleDeployment(w, req, "nginx")
+
+	var got DeploymentManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if got.Manifest != manifest {
+		t.Errorf("Expected manifest round trip, got:\n%s", got.Manifest)
+	}
+
+	d, _ := handlers.state.GetDeployment("nginx")
+	if len(d.Releases) != 1 || d.Releases[0].Version != "1.21.0" {
+		t.Errorf("Expected nginx/1.21.0 release, got %+v", d.Releases)
+	}
+	if len(d.Stemcells) != 1 || d.Stemcells[0].Name != "bosh-google-kvm-ubuntu-jammy-go_agent" {
+		t.Errorf("Expected stemcell resolved by OS, got %+v", d.Stemcells)
+	}
+
+	// Updating via PUT with a mismatched name is rejected
+	req = httptest.NewRequest(http.MethodPut, "/deployments/redis", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Empty body is rejected
+	req = httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(""))
+	w = httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleDeployDryRun(t *testing.T) {
+	handlers := setupTestHandlers()
+	before := len(handlers.state.GetTasks("", "", "", 2, 0))
+
+	candidate := strings.Replace(redisManifestYAML(), "  instances: 2", "  instances: 3", 1)
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis?dry_run=true", strings.NewReader(candidate))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result DeploymentDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(result.Diff) != 2 || result.Diff[1][0] != "  instances: 3" {
+		t.Errorf("Expected the instances change, got %v", result.Diff)
+	}
+	if result.Context.CloudConfigID != "6" {
+		t.Errorf("Expected cloud config ID 6 in context, got %q", result.Context.CloudConfigID)
+	}
+	if after := len(handlers.state.GetTasks("", "", "", 2, 0)); after != before {
+		t.Errorf("Expected no task for a dry run, got %d new", after-before)
+	}
+	if d, _ := handlers.state.GetDeployment("redis"); d.Manifest != redisManifestYAML() {
+		t.Error("Expected a dry run to leave the manifest alone")
+	}
+
+	// A pinned context is echoed back
+	req = httptest.NewRequest(http.MethodPut, `/deployments/redis?dry_run=true&context={"cloud_config_id":"3","runtime_config_ids":["4"]}`, strings.NewReader(candidate))
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Context.CloudConfigID != "3" || len(result.Context.RuntimeConfigIDs) != 1 {
+		t.Errorf("Expected the pinned context, got %+v", result.Context)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/deployments/redis?context=nope", strings.NewReader(candidate))
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a bad context, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleDeleteDeploymentConfirm(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.SetRequireDeleteConfirm(true)
+
+	for _, path := range []string{"/deployments/redis", "/deployments/redis?confirm=cf"} {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+
+		handlers.HandleDeleteDeployment(w, req, "redis")
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/deployments/redis?confirm=redis", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeleteDeployment(w, req, "redis")
+
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+}
+
+func TestDeploymentLockContention(t *testing.T) {
+	state := NewState()
+	simulator := NewTaskSimulator(state, 1.0, false)
+	handlers := NewHandlers(state, simulator, "admin", "admin")
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/cf?state=recreate", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeploymentRecreate(w, req, "cf")
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+
+	// The recreate holds the lock from the moment it's created
+	if !state.IsLocked("cf") {
+		t.Fatal("Expected cf to be locked during recreate")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/deployments/cf", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+
+	handlers.HandleDeleteDeployment(w, req, "cf")
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+
+	var errResp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if errResp.Description != "deployment cf is locked" {
+		t.Errorf("Expected locked description, got '%s'", errResp.Description)
+	}
+
+	// Other deployments are unaffected
+	req = httptest.NewRequest(http.MethodDelete, "/deployments/redis", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+
+	handlers.HandleDeleteDeployment(w, req, "redis")
+
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+}
+
+func TestConcurrentDeploysLockContention(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	const deploys = 2
+	codes := make(chan int, deploys)
+	var wg sync.WaitGroup
+	for i := 0; i < deploys; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(redisManifestYAML()))
+			req.SetBasicAuth("admin", "admin")
+			req.Header.Set("Content-Type", "text/yaml")
+			w := httptest.NewRecorder()
+			handlers.HandleDeploy(w, req, "redis")
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusFound] != 1 || counts[http.StatusPreconditionFailed] != 1 {
+		t.Errorf("Expected one deploy started and one rejected as locked, got %v", counts)
+	}
+}
+
+func TestHandleTaskOutputEventOffsets(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	task := handlers.state.CreateTask("restart jobs in deployment redis", "redis", "admin")
+	handlers.simulator.ExecuteRestart(task.ID, "redis", "", "")
+	waitForTask(t, handlers.state, task.ID, 2*time.Second)
+
+	fetch := func(query string) []TaskEvent {
+		req := httptest.NewRequest(http.MethodGet, "/tasks/1/output?type=event"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+
+		handlers.HandleTaskOutput(w, req, task.ID)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var events []TaskEvent
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var e TaskEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Failed to unmarshal event line %q: %v", line, err)
+			}
+			events = append(events, e)
+		}
+		return events
+	}
+
+	all := fetch("")
+	if len(all) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(all))
+	}
+
+	// Offsets are the byte positions of each line in the full output
+	offset := int64(0)
+	for _, e := range all {
+		if e.Offset != offset {
+			t.Errorf("Expected offset %d, got %d", offset, e.Offset)
+		}
+		line, _ := json.Marshal(e)
+		offset += int64(len(line)) + 1
+	}
+
+	resumed := fetch(fmt.Sprintf("&since_offset=%d", all[2].Offset))
+	if len(resumed) != 2 {
+		t.Fatalf("Expected 2 events after offset, got %d", len(resumed))
+	}
+	if resumed[0].Offset != all[2].Offset || resumed[0].Stage != "Starting instances" {
+		t.Errorf("Expected resume at 'Starting instances', got %+v", resumed[0])
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/tasks/1/output?type=event&since_offset=abc", nil)
+	w := httptest.NewRecorder()
+	handlers.HandleTaskOutput(w, req, task.ID)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleDeployIPAssignDelay(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.simulator.SetIPAssignDelay(5 * time.Second) // 500ms at 10x
+
+	manifest := `name: nginx
+
+instance_groups:
+- name: web
+  instances: 2
+  azs: [z1, z2]
+  vm_type: small
+  jobs:
+  - name: nginx
+    release: nginx
+`
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "")
+
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	task := waitForTask(t, handlers.state, taskID, 2*time.Second)
+	if task.State != "done" {
+		t.Fatalf("Expected deploy task to be done, got '%s'", task.State)
+	}
+
+	instances, err := handlers.state.GetInstances("nginx")
+	if err != nil {
+		t.Fatalf("GetInstances failed: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(instances))
+	}
+	for _, inst := range instances {
+		if len(inst.IPs) != 0 {
+			t.Errorf("Expected %s/%d to have no IPs yet, got %v", inst.Job, inst.Index, inst.IPs)
+		}
+	}
+	if instances[0].AZ != "z1" || instances[1].AZ != "z2" {
+		t.Errorf("Expected instances spread across z1 and z2, got %s and %s", instances[0].AZ, instances[1].AZ)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		instances, _ = handlers.state.GetInstances("nginx")
+		if len(instances[0].IPs) > 0 && len(instances[1].IPs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for IPs to be assigned")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if instances[0].IPs[0] == instances[1].IPs[0] {
+		t.Errorf("Expected distinct IPs, both got %s", instances[0].IPs[0])
+	}
+	vms, _ := handlers.state.GetVMs("nginx")
+	for _, vm := range vms {
+		if len(vm.IPs) == 0 {
+			t.Errorf("Expected VM %s to have an IP", vm.ID)
+		}
+	}
+}
+
+func TestHandleTaskOutputRecreateEvents(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	task := handlers.state.CreateTask("recreate deployment redis", "redis", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "redis", "", "")
+	waitForTask(t, handlers.state, task.ID, 2*time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/tasks/1/output?type=event", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleTaskOutput(w, req, task.ID)
+
+	started := make(map[string]bool)
+	finished := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var e TaskEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Failed to unmarshal event line %q: %v", line, err)
+		}
+		if e.Stage != "Updating instance" {
+			continue
+		}
+		switch e.State {
+		case "started":
+			started[e.Task] = true
+		case "finished":
+			finished[e.Task] = true
+		}
+		if len(e.Tags) != 1 || !strings.HasPrefix(e.Task, e.Tags[0]+"/") {
+			t.Errorf("Expected job tag for %s, got %v", e.Task, e.Tags)
+		}
+	}
+
+	instances, _ := handlers.state.GetInstances("redis")
+	for _, inst := range instances {
+		name := fmt.Sprintf("%s/%s (%d)", inst.Job, inst.ID, inst.Index)
+		if !started[name] || !finished[name] {
+			t.Errorf("Expected started and finished events for %s", name)
+		}
+	}
+	if len(started) != len(instances) {
+		t.Errorf("Expected %d instance events, got %d", len(instances), len(started))
+	}
+}
+
+func TestRecreateAppliesBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.state.SetInstanceNaming(InstanceNamingIndex)
+
+	before := make(map[string]string)
+	vms, _ := handlers.state.GetVMs("cf")
+	for _, vm := range vms {
+		before[fmt.Sprintf("%s/%d", vm.Job, vm.Index)] = vm.VMCID
+	}
+
+	task := handlers.state.CreateTask("recreate VMs for cf/router", "cf", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "cf", "router", "")
+
+	// Events are read before VMs, so a finished event seen here must already
+	// have its VM replaced
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		finished := make(map[string]bool)
+		for _, e := range handlers.state.GetTaskEvents(task.ID, 0) {
+			if e.Stage == "Updating instance" && e.State == "finished" {
+				finished[e.Task] = true
+			}
+		}
+		vms, _ := handlers.state.GetVMs("cf")
+		for _, vm := range vms {
+			name := fmt.Sprintf("%s/%d", vm.Job, vm.Index)
+			if finished[name] && vm.VMCID == before[name] {
+				t.Fatalf("Expected %s recreated before its finished event", name)
+			}
+		}
+		if len(finished) == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if task := waitForTask(t, handlers.state, task.ID, 2*time.Second); task.State != "done" {
+		t.Errorf("Expected task done, got %s: %s", task.State, task.Result)
+	}
+}
+
+func TestDeployAppliesBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	manifest := `name: web
+instance_groups:
+- name: nginx
+  instances: 3
+  azs: [z1]
+  jobs:
+  - name: nginx
+`
+	task := handlers.state.CreateTask("create deployment web", "web", "admin")
+	handlers.simulator.ExecuteDeploy(task.ID, "web", manifest)
+
+	// Events are read before instances, so a finished event seen here must
+	// already have its instance
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		finished := 0
+		for _, e := range handlers.state.GetTaskEvents(task.ID, 0) {
+			if e.Stage == "Updating instance" && e.State == "finished" {
+				finished++
+			}
+		}
+		instances, _ := handlers.state.GetInstances("web")
+		if len(instances) < finished {
+			t.Fatalf("Expected an instance per finished event, got %d instances after %d events", len(instances), finished)
+		}
+		if finished == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if task := waitForTask(t, handlers.state, task.ID, 3*time.Second); task.State != "done" {
+		t.Errorf("Expected task done, got %s: %s", task.State, task.Result)
+	}
+}
+
+func TestInstanceDisksApplyBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	diskOf := func() string {
+		instances, _ := handlers.state.GetInstances("redis")
+		for _, inst := range instances {
+			if inst.ID == "redis-0-id" {
+				return inst.Disk
+			}
+		}
+		return ""
+	}
+
+	task := handlers.state.CreateTask("attach disk", "redis", "admin")
+	handlers.simulator.ExecuteAttachDisk(task.ID, "redis", "redis", "redis-0-id", "disk-redis-2-orphaned")
+	checkAppliedBeforeFinished(t, handlers, task.ID, "Attaching disk", func() bool {
+		return diskOf() == "disk-redis-2-orphaned"
+	})
+
+	task = handlers.state.CreateTask("detach disk", "redis", "admin")
+	handlers.simulator.ExecuteDetachDisk(task.ID, "redis", "redis", "redis-0-id", "disk-redis-2-orphaned")
+	checkAppliedBeforeFinished(t, handlers, task.ID, "Detaching disk", func() bool {
+		return diskOf() == ""
+	})
+}
+
+func TestResolveProblemsApplyBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.state.SetResurrection(true)
+
+	for _, index := range []string{"0", "1"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/instances/cf/router/"+index+"/unresponsive", nil)
+		w := httptest.NewRecorder()
+		handlers.HandleInstanceResponsiveness(w, req, "cf", "router", index, false)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+	}
+	problems, _ := handlers.state.GetProblems("cf")
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %d", len(problems))
+	}
+
+	// Deleting the first VM's reference leaves its instance missing a VM
+	resolutions := map[int]string{problems[0].ID: ResolutionDeleteVMReference, problems[1].ID: ResolutionRebootVM}
+	task := handlers.state.CreateTask("apply resolutions", "cf", "admin")
+	handlers.simulator.ExecuteResolveProblems(task.ID, "cf", resolutions)
+	checkAppliedBeforeFinished(t, handlers, task.ID, "Applying problem resolutions", func() bool {
+		vms, _ := handlers.state.GetVMs("cf")
+		for _, vm := range vms {
+			if vm.ID == problems[0].InstanceID {
+				return vm.VMCID == ""
+			}
+		}
+		return false
+	})
+
+	if remaining, _ := handlers.state.GetProblems("cf"); len(remaining) != 1 || remaining[0].Type != ProblemMissingVM {
+		t.Errorf("Expected only the deleted VM reference's missing VM left, got %+v", remaining)
+	}
+}
+
+func TestFetchLogsApplyBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	task := handlers.state.CreateTask("fetch job logs", "redis", "admin")
+	handlers.simulator.ExecuteFetchLogs(task.ID, "redis", "redis", 0, "job")
+	checkAppliedBeforeFinished(t, handlers, task.ID, "Fetching logs", func() bool {
+		handlers.state.data.mu.RLock()
+		defer handlers.state.data.mu.RUnlock()
+		for id := range handlers.state.data.Blobs {
+			if strings.HasPrefix(id, "logs-redis-redis-0-") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestHandleTaskOutputDebug(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.state.SetInstanceNaming(InstanceNamingIndex)
+
+	task := handlers.state.CreateTask("recreate VMs for cf/router", "cf", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "cf", "router", "")
+	waitForTask(t, handlers.state, task.ID, 2*time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tasks/%d/output?type=debug", task.ID), nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleTaskOutput(w, req, task.ID)
+	body := w.Body.String()
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	wants := []string{
+		fmt.Sprintf("Starting task: %d", task.ID),
+		"Acquiring deployment lock on cf",
+		"Deployment lock acquired: cf",
+		"Instances in deployment cf: ",
+		"Started preparing deployment",
+		"Started recreating router/0",
+		"Finished recreating router/0",
+		"Deployment lock released: cf",
+		fmt.Sprintf("Task %d done", task.ID),
+	}
+	next := 0
+	for _, line := range lines {
+		if !strings.Contains(line, fmt.Sprintf("[task:%d]", task.ID)) {
+			t.Errorf("Expected a task-tagged log line, got %q", line)
+		}
+		if next < len(wants) && strings.Contains(line, wants[next]) {
+			next++
+		}
+	}
+	if next != len(wants) {
+		t.Errorf("Expected %q (and the lines after it, in order) in:\n%s", wants[next], body)
+	}
+}
+
+func TestHandleTaskOutputFollow(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	task := handlers.state.CreateTask("recreate deployment redis", "redis", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "redis", "", "")
+
+	// Following blocks until the task ends, streaming every event
+	req := httptest.NewRequest(http.MethodGet, "/tasks/1/output?type=event&follow=true", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleTaskOutput(w, req, task.ID)
+
+	if got, _ := handlers.state.GetTask(task.ID); got.State != "done" {
+		t.Errorf("Expected follow to return once the task is done, got %s", got.State)
+	}
+	followed := w.Body.String()
+	if !w.Flushed {
+		t.Error("Expected the followed output to be flushed")
+	}
+
+	// The stream matches the one-shot output line for line
+	req = httptest.NewRequest(http.MethodGet, "/tasks/1/output?type=event", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleTaskOutput(w, req, task.ID)
+	if followed != w.Body.String() {
+		t.Errorf("Expected followed output to match the full event output:\n%s\nvs\n%s", followed, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Expected Content-Length %d, got %q", w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+
+	// A client that disconnects stops the stream of a running task
+	handlers.simulator.SetTaskDurations(TaskDurations{"recreate": time.Minute})
+	running := handlers.state.CreateTask("recreate deployment redis", "redis", "admin")
+	handlers.simulator.ExecuteRecreate(running.ID, "redis", "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodGet, "/tasks/2/output?type=event&follow=true", nil).WithContext(ctx)
+	req.SetBasicAuth("admin", "admin")
+	done := make(chan struct{})
+	go func() {
+		handlers.HandleTaskOutput(httptest.NewRecorder(), req, running.ID)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected follow to stop when the client disconnects")
+	}
+}
+
+func TestHandleDeploymentSnapshots(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	list := func() []Snapshot {
+		req := httptest.NewRequest(http.MethodGet, "/deployments/mysql/snapshots", nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentSnapshots(w, req, "mysql")
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var snapshots []Snapshot
+		if err := json.Unmarshal(w.Body.Bytes(), &snapshots); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return snapshots
+	}
+
+	mutate := func(method string) {
+		req := httptest.NewRequest(method, "/deployments/mysql/snapshots", nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentSnapshots(w, req, "mysql")
+
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+		}
+		var taskID int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+		if task := waitForTask(t, handlers.state, taskID, 2*time.Second); task.State != "done" {
+			t.Fatalf("Expected %s task to be done, got '%s'", method, task.State)
+		}
+	}
+
+	if got := list(); len(got) != 2 {
+		t.Fatalf("Expected 2 seeded snapshots, got %d", len(got))
+	}
+
+	mutate(http.MethodPost)
+	snapshots := list()
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 snapshots after POST, got %d", len(snapshots))
+	}
+	if latest := snapshots[2]; latest.Job != "mysql" || !latest.Clean || latest.SnapshotCID == "" {
+		t.Errorf("Unexpected new snapshot: %+v", latest)
+	}
+
+	mutate(http.MethodDelete)
+	if got := list(); len(got) != 0 {
+		t.Errorf("Expected no snapshots after DELETE, got %d", len(got))
+	}
+
+	// CIDs of deleted snapshots aren't handed out again
+	mutate(http.MethodPost)
+	if got := list(); len(got) != 1 || got[0].SnapshotCID == snapshots[2].SnapshotCID {
+		t.Errorf("Expected one snapshot with a new CID after %s, got %+v", snapshots[2].SnapshotCID, got)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/deployments/nonexistent/snapshots", nil)
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentSnapshots(w, req, "nonexistent")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", method, http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+func TestOrphanedDisks(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	list := func() []OrphanedDisk {
+		req := httptest.NewRequest(http.MethodGet, "/disks", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var disks []OrphanedDisk
+		if err := json.Unmarshal(w.Body.Bytes(), &disks); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return disks
+	}
+
+	disks := list()
+	if len(disks) != 2 {
+		t.Fatalf("Expected 2 seeded disks, got %d", len(disks))
+	}
+	cid := disks[0].DiskCID
+
+	req := httptest.NewRequest(http.MethodDelete, "/disks/"+cid, nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	if task := waitForTask(t, server.state, taskID, 2*time.Second); task.State != "done" {
+		t.Fatalf("Expected delete task to be done, got '%s'", task.State)
+	}
+
+	disks = list()
+	if len(disks) != 1 || disks[0].DiskCID == cid {
+		t.Errorf("Expected %s removed, got %+v", cid, disks)
+	}
+	if locks := server.state.GetLocks(); len(locks) != 0 {
+		t.Errorf("Expected no locks after disk delete, got %+v", locks)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/disks/"+cid, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleDeployWithoutInstanceGroups(t *testing.T) {
+	handlers := setupTestHandlers()
+	before, _ := handlers.state.GetVMs("redis")
+
+	manifest := `name: redis
+
+releases:
+- name: redis
+  version: "0.1.0"
+`
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "instance_groups") {
+		t.Errorf("Expected the error to name instance_groups, got %s", w.Body.String())
+	}
+	if after, _ := handlers.state.GetVMs("redis"); len(after) != len(before) {
+		t.Errorf("Expected redis to keep its %d VMs, got %d", len(before), len(after))
+	}
+
+	if _, err := handlers.state.SaveDeployment("redis", manifest); err == nil {
+		t.Error("Expected SaveDeployment to refuse a manifest without instance groups")
+	}
+	if after, _ := handlers.state.GetVMs("redis"); len(after) != len(before) {
+		t.Errorf("Expected redis to keep its %d VMs, got %d", len(before), len(after))
+	}
+}
+
+func TestHandleDeployManifestTooLarge(t *testing.T) {
+	handlers := setupTestHandlers()
+	before, _ := handlers.state.GetDeployment("redis")
+
+	manifest := "name: redis\n# " + strings.Repeat("x", maxManifestSize) + "\ninstance_groups:\n- name: redis\n  instances: 1\n"
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "redis")
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if after, _ := handlers.state.GetDeployment("redis"); after.Manifest != before.Manifest {
+		t.Error("Expected an oversized manifest not to be stored")
+	}
+}
+
+func TestHandleDeployCompilesReleases(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	manifest := `name: nginx
+
+releases:
+- name: nginx
+  version: "1.21.0"
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+instance_groups:
+- name: nginx
+  instances: 1
+  azs: [z1]
+`
+
+	deploy := func() *Task {
+		req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploy(w, req, "")
+
+		var taskID int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+		task, err := handlers.state.GetTask(taskID)
+		if err != nil {
+			t.Fatalf("GetTask failed: %v", err)
+		}
+		return task
+	}
+
+	compileTasks := func(contextID string) []Task {
+		var result []Task
+		for _, task := range handlers.state.GetTasks("", "nginx", "", 2, 0) {
+			if strings.HasPrefix(task.Description, "compile package ") && task.ContextID == contextID {
+				result = append(result, task)
+			}
+		}
+		return result
+	}
+
+	parent := deploy()
+	if parent.ContextID == "" {
+		t.Fatal("Expected deploy task to get a context ID")
+	}
+	children := compileTasks(parent.ContextID)
+	if len(children) != 2 {
+		t.Fatalf("Expected 2 compilation tasks, got %d", len(children))
+	}
+	for _, child := range children {
+		if !strings.HasSuffix(child.Description, "stemcell ubuntu-jammy/1.200") {
+			t.Errorf("Unexpected compilation description: %s", child.Description)
+		}
+	}
+
+	if done := waitForTask(t, handlers.state, parent.ID, 2*time.Second); done.State != "done" {
+		t.Fatalf("Expected deploy task to be done, got '%s'", done.State)
+	}
+	for _, child := range compileTasks(parent.ContextID) {
+		if child.State != "done" {
+			t.Errorf("Expected %q to be done, got '%s'", child.Description, child.State)
+		}
+	}
+
+	// Packages are compiled once per stemcell
+	redeploy := deploy()
+	waitForTask(t, handlers.state, redeploy.ID, 2*time.Second)
+	if redeploy.ContextID != "" {
+		t.Errorf("Expected no compilation on redeploy, got context %s", redeploy.ContextID)
+	}
+}
+
+func TestDeployCancelEndsCompilations(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	manifest := `name: nginx
+
+releases:
+- name: nginx
+  version: "1.21.0"
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+instance_groups:
+- name: nginx
+  instances: 1
+  azs: [z1]
+`
+	parent := handlers.state.CreateTask("create deployment nginx", "nginx", "admin")
+	if err := handlers.simulator.ExecuteDeploy(parent.ID, "nginx", manifest); err != nil {
+		t.Fatalf("ExecuteDeploy failed: %v", err)
+	}
+	parent, _ = handlers.state.GetTask(parent.ID)
+
+	children := func() []Task {
+		var result []Task
+		for _, task := range handlers.state.GetTasks("", "nginx", parent.ContextID, 2, 0) {
+			if task.ID != parent.ID {
+				result = append(result, task)
+			}
+		}
+		return result
+	}
+
+	// Cancel once the first package is compiling
+	deadline := time.Now().Add(2 * time.Second)
+	for processing := false; !processing; {
+		for _, child := range children() {
+			processing = processing || child.State == "processing"
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a compilation to start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := handlers.state.CancelTask(parent.ID); err != nil {
+		t.Fatalf("CancelTask failed: %v", err)
+	}
+
+	if done := waitForTask(t, handlers.state, parent.ID, 2*time.Second); done.State != "cancelled" {
+		t.Fatalf("Expected the deploy cancelled, got %s", done.State)
+	}
+	got := children()
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 compilation tasks, got %d", len(got))
+	}
+	for _, child := range got {
+		if child.State != "cancelled" {
+			t.Errorf("Expected %q cancelled with its deploy, got %s", child.Description, child.State)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	fetch := func(query string) []Event {
+		req := httptest.NewRequest(http.MethodGet, "/events"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleEvents(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusOK, w.Code)
+		}
+		var events []Event
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return events
+	}
+
+	seeded := fetch("")
+	if len(seeded) == 0 {
+		t.Fatal("Expected seeded events")
+	}
+	for i := 1; i < len(seeded); i++ {
+		if seeded[i].ID >= seeded[i-1].ID {
+			t.Fatalf("Expected newest-first ordering, got IDs %d then %d", seeded[i-1].ID, seeded[i].ID)
+		}
+	}
+
+	// Deleting a deployment records task and deployment events
+	req := httptest.NewRequest(http.MethodDelete, "/deployments/redis", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeleteDeployment(w, req, "redis")
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	waitForTask(t, handlers.state, taskID, 2*time.Second)
+
+	deletes := fetch("?deployment=redis&action=delete&object_type=deployment")
+	if len(deletes) != 1 || deletes[0].ObjectName != "redis" || deletes[0].User != "admin" {
+		t.Errorf("Expected one delete event for redis by admin, got %+v", deletes)
+	}
+
+	taskEvents := fetch(fmt.Sprintf("?task=%d", taskID))
+	if len(taskEvents) < 3 {
+		t.Fatalf("Expected create and update events for task %d, got %d", taskID, len(taskEvents))
+	}
+	if last := taskEvents[len(taskEvents)-1]; last.Action != "create" || last.ObjectType != "task" {
+		t.Errorf("Expected oldest task event to be its creation, got %+v", last)
+	}
+
+	// before_id pages backwards from a cursor
+	all := fetch("")
+	page := fetch(fmt.Sprintf("?before_id=%d", all[1].ID))
+	if len(page) != len(all)-2 || page[0].ID != all[2].ID {
+		t.Errorf("Expected page to start at ID %d, got %+v", all[2].ID, page)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/events?before_id=abc", nil)
+	w = httptest.NewRecorder()
+	handlers.HandleEvents(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleCleanup(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodPost, "/cleanup", strings.NewReader(`{"config":{"remove_all":true}}`))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleCleanup(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	task := waitForTask(t, handlers.state, taskID, 2*time.Second)
+	if task.State != "done" {
+		t.Fatalf("Expected cleanup task to be done, got '%s'", task.State)
+	}
+
+	var summary CleanupSummary
+	if err := json.Unmarshal([]byte(task.Result), &summary); err != nil {
+		t.Fatalf("Failed to unmarshal task result %q: %v", task.Result, err)
+	}
+	if len(summary.Releases) == 0 || len(summary.Stemcells) == 0 || len(summary.OrphanedDisks) == 0 {
+		t.Errorf("Expected releases, stemcells, and disks removed, got %+v", summary)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/cleanup", strings.NewReader("{"))
+	w = httptest.NewRecorder()
+	handlers.HandleCleanup(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestHandleDeploymentsUpdateSettings(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	manifest := `name: web
+
+update:
+  canaries: 2
+  max_in_flight: 30%
+  serial: false
+
+instance_groups:
+- name: nginx
+  instances: 3
+  azs: [z1]
+  update:
+    canaries: 1
+    serial: true
+  jobs:
+  - name: nginx
+    release: nginx
+- name: worker
+  instances: 2
+  azs: [z1]
+`
+
+	req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "")
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	waitForTask(t, handlers.state, taskID, 2*time.Second)
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeployments(w, req)
+
+	var deployments []Deployment
+	if err := json.Unmarshal(w.Body.Bytes(), &deployments); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	groups := make(map[string]UpdateSettings)
+	for _, d := range deployments {
+		if d.Name != "web" {
+			continue
+		}
+		for _, g := range d.InstanceGroups {
+			groups[g.Name] = g.Update
+		}
+	}
+
+	want := map[string]UpdateSettings{
+		"nginx":  {Canaries: 1, MaxInFlight: "30%", Serial: true},
+		"worker": {Canaries: 2, MaxInFlight: "30%", Serial: false},
+	}
+	for name, settings := range want {
+		if groups[name] != settings {
+			t.Errorf("Expected %s update %+v, got %+v", name, settings, groups[name])
+		}
+	}
+}
+
+func TestHandleTaskStreamDeployProgress(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleTaskStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	received := make(chan TaskStreamEvent, 64)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var e TaskStreamEvent
+			if json.Unmarshal([]byte(data), &e) == nil {
+				received <- e
+			}
+		}
+	}()
+
+	manifest := `name: nginx
+
+releases:
+- name: nginx
+  version: "1.21.0"
+
+stemcells:
+- alias: default
+  os: ubuntu-jammy
+  version: "1.200"
+
+instance_groups:
+- name: web
+  instances: 2
+  azs: [z1]
+`
+	req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploy(w, req, "")
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+
+	var progress []string
+	timeout := time.After(3 * time.Second)
+	for len(progress) == 0 || progress[len(progress)-1] != "Updating instance web/1 finished" {
+		select {
+		case e := <-received:
+			if e.TaskID != taskID {
+				t.Fatalf("Expected task_id %d, got %d", taskID, e.TaskID)
+			}
+			progress = append(progress, fmt.Sprintf("%s %s %s", e.Stage, e.Task, e.State))
+		case <-timeout:
+			t.Fatalf("Timed out waiting for deploy progress, got %v", progress)
+		}
+	}
+
+	want := []string{
+		"Compiling packages nginx/nginx started",
+		"Compiling packages nginx/nginx finished",
+		"Compiling packages nginx/pcre started",
+		"Compiling packages nginx/pcre finished",
+		"Preparing deployment Preparing deployment started",
+		"Preparing deployment Preparing deployment finished",
+		"Updating instance web/0 (canary) started",
+		"Updating instance web/0 (canary) finished",
+		"Updating instance web/1 started",
+		"Updating instance web/1 finished",
+	}
+	if strings.Join(progress, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected progress:\n%s", strings.Join(progress, "\n"))
+	}
+}
+
+func TestHandleErrorCodes(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/_internal/error-codes", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleErrorCodes(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var catalog []ErrorCode
+	if err := json.Unmarshal(w.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	codes := make(map[string]int)
+	for _, ec := range catalog {
+		codes[ec.Name] = ec.Code
+	}
+	if codes["DeploymentNotFound"] != 70000 || codes["TaskNotFound"] != 10000 {
+		t.Errorf("Expected deployment and task not-found codes, got %v", codes)
+	}
+	if codes["Forbidden"] != http.StatusForbidden {
+		t.Errorf("Expected the 403 team users get changing others' deployments, got %v", codes)
+	}
+	if codes["Conflict"] != http.StatusConflict {
+		t.Errorf("Expected the 409 for forcing an ended task's outcome, got %v", codes)
+	}
+
+	// Responses carry the catalogued code
+	req = httptest.NewRequest(http.MethodGet, "/deployments/nonexistent/vms", nil)
+	w = httptest.NewRecorder()
+	handlers.HandleDeploymentVMs(w, req, "nonexistent")
+
+	var errResp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if w.Code != http.StatusNotFound || errResp.Code != ErrCodeDeploymentNotFound.Code {
+		t.Errorf("Expected 404 with code %d, got %d with code %d", ErrCodeDeploymentNotFound.Code, w.Code, errResp.Code)
+	}
+}
+
+func TestInstanceMigrate(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	migrate := func(az string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/deployments/cf/instance_groups/diego_cell/cf-dc0-id/migrate?az="+az, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := migrate("z9"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown az, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := migrate("z3")
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	if task := waitForTask(t, server.state, taskID, 5*time.Second); task.State != "done" {
+		t.Fatalf("Expected task done, got %s", task.State)
+	}
+
+	instances, _ := server.state.GetInstances("cf")
+	found := false
+	for _, inst := range instances {
+		if inst.ID != "cf-dc0-id" {
+			continue
+		}
+		found = true
+		if inst.AZ != "z3" {
+			t.Errorf("Expected az z3, got %s", inst.AZ)
+		}
+		if len(inst.IPs) != 1 || !strings.HasPrefix(inst.IPs[0], "10.0.3.") || inst.IPs[0] == "10.0.3.10" {
+			t.Errorf("Expected a free IP in the z3 subnet, got %v", inst.IPs)
+		}
+		if inst.VMCID == "vm-cf-diego-cell-0" {
+			t.Error("Expected a new VM CID")
+		}
+	}
+	if !found {
+		t.Fatal("Expected the migrated instance cf-dc0-id")
+	}
+
+	vms, _ := server.state.GetVMs("cf")
+	for _, vm := range vms {
+		if vm.ID == "cf-dc0-id" && vm.AZ != "z3" {
+			t.Errorf("Expected VM az z3, got %s", vm.AZ)
+		}
+	}
+}
+
+// checkAppliedBeforeFinished watches a task's events until a target of
+// stage reports finished, then fails unless applied sees its change. It
+// checks while holding the simulator's lock, so the task can't apply a
+// change between the event and the check.
+func checkAppliedBeforeFinished(t *testing.T, handlers *Handlers, taskID int, stage string, applied func() bool) {
+	t.Helper()
+	ts := handlers.simulator
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ts.mu.Lock()
+		finished := false
+		for _, e := range handlers.state.GetTaskEvents(taskID, 0) {
+			if e.Stage == stage && e.State == "finished" {
+				finished = true
+			}
+		}
+		ok := !finished || applied()
+		ts.mu.Unlock()
+		if !ok {
+			t.Fatalf("Expected the %s change applied before its finished event", stage)
+		}
+		if finished {
+			break
+		}
+	}
+	if task := waitForTask(t, handlers.state, taskID, 5*time.Second); task.State != "done" {
+		t.Errorf("Expected task done, got %s: %s", task.State, task.Result)
+	}
+}
+
+func TestInstanceMigrateNewVMCIDs(t *testing.T) {
+	state := NewState()
+
+	vmCID := func() string {
+		instances, _ := state.GetInstances("cf")
+		for _, inst := range instances {
+			if inst.ID == "cf-dc0-id" {
+				return inst.VMCID
+			}
+		}
+		t.Fatal("Expected the instance cf-dc0-id")
+		return ""
+	}
+
+	// Moving back to an earlier AZ still gets a VM CID never used before
+	seen := map[string]bool{vmCID(): true}
+	for _, az := range []string{"z3", "z1", "z3"} {
+		if err := state.MigrateInstance("cf", "diego_cell", "cf-dc0-id", az); err != nil {
+			t.Fatalf("MigrateInstance to %s failed: %v", az, err)
+		}
+		cid := vmCID()
+		if seen[cid] {
+			t.Errorf("Expected a new VM CID migrating to %s, got reused %s", az, cid)
+		}
+		seen[cid] = true
+	}
+}
+
+func TestInstanceMigrateAppliesBeforeFinishedEvent(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	task := handlers.state.CreateTask("migrate instance", "cf", "admin")
+	handlers.simulator.ExecuteMigrate(task.ID, "cf", "diego_cell", "cf-dc0-id", "z3")
+	checkAppliedBeforeFinished(t, handlers, task.ID, "Updating instance", func() bool {
+		instances, _ := handlers.state.GetInstances("cf")
+		for _, inst := range instances {
+			if inst.ID == "cf-dc0-id" {
+				return inst.AZ == "z3"
+			}
+		}
+		return false
+	})
+}
+
+func TestInstanceAttachDetachDisk(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	disk := func(action, cid string) *Task {
+		req := httptest.NewRequest(http.MethodPut, "/deployments/redis/instance_groups/redis/redis-0-id/disks/"+action+"?disk_cid="+cid, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		var taskID int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+		return waitForTask(t, server.state, taskID, 5*time.Second)
+	}
+	diskOf := func(id string) string {
+		instances, _ := server.state.GetInstances("redis")
+		for _, inst := range instances {
+			if inst.ID == id {
+				return inst.Disk
+			}
+		}
+		return ""
+	}
+
+	if task := disk("attach", "disk-redis-2-orphaned"); task.State != "done" {
+		t.Fatalf("Expected attach done, got %s: %s", task.State, task.Result)
+	}
+	if got := diskOf("redis-0-id"); got != "disk-redis-2-orphaned" {
+		t.Errorf("Expected attached disk disk-redis-2-orphaned, got %q", got)
+	}
+	if server.state.HasOrphanedDisk("disk-redis-2-orphaned") {
+		t.Error("Expected attached disk to leave the orphaned list")
+	}
+	if !server.state.HasOrphanedDisk("disk-redis-0") {
+		t.Error("Expected replaced disk disk-redis-0 to be orphaned")
+	}
+
+	if task := disk("attach", "disk-redis-1"); task.State != "error" {
+		t.Errorf("Expected attaching another instance's disk to error, got %s", task.State)
+	}
+	if got := diskOf("redis-1-id"); got != "disk-redis-1" {
+		t.Errorf("Expected redis-1 to keep its disk, got %q", got)
+	}
+
+	if task := disk("detach", "disk-redis-2-orphaned"); task.State != "done" {
+		t.Fatalf("Expected detach done, got %s: %s", task.State, task.Result)
+	}
+	if got := diskOf("redis-0-id"); got != "" {
+		t.Errorf("Expected no disk after detach, got %q", got)
+	}
+	if !server.state.HasOrphanedDisk("disk-redis-2-orphaned") {
+		t.Error("Expected detached disk to be orphaned")
+	}
+}
+
+func TestHandleDeploymentDiff(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	diff := func(manifest string) DeploymentDiff {
+		req := httptest.NewRequest(http.MethodPost, "/deployments/redis/diff", strings.NewReader(manifest))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentDiff(w, req, "redis")
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var result DeploymentDiff
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return result
+	}
+
+	unchanged := diff(redisManifestYAML())
+	if len(unchanged.Diff) != 0 {
+		t.Errorf("Expected empty diff for unchanged manifest, got %v", unchanged.Diff)
+	}
+	if unchanged.Context.CloudConfigID != "6" {
+		t.Errorf("Expected cloud config ID 6 in context, got %q", unchanged.Context.CloudConfigID)
+	}
+
+	candidate := strings.Replace(redisManifestYAML(), "  instances: 2", "  instances: 3", 1)
+	candidate = strings.Replace(candidate, "password: ((redis_password))", "password: hunter2", 1)
+	changed := diff(candidate)
+
+	expected := [][]string{
+		{"  instances: 2", DiffRemoved},
+		{"  instances: 3", DiffAdded},
+		{"      password: <redacted>", DiffRemoved},
+		{"      password: <redacted>", DiffAdded},
+	}
+	if len(changed.Diff) != len(expected) {
+		t.Fatalf("Expected %d diff lines, got %v", len(expected), changed.Diff)
+	}
+	for i, line := range expected {
+		if changed.Diff[i][0] != line[0] || changed.Diff[i][1] != line[1] {
+			t.Errorf("Diff line %d: expected %v, got %v", i, line, changed.Diff[i])
+		}
+	}
+
+	// An oversized candidate is refused rather than diffed truncated
+	req := httptest.NewRequest(http.MethodPost, "/deployments/redis/diff", strings.NewReader(redisManifestYAML()+"# "+strings.Repeat("x", maxManifestSize)))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploymentDiff(w, req, "redis")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for an oversized manifest, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestHandleVMTypes(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/_internal/vm-types", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleVMTypes(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var counts map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	// cf's 3 diego cells and mysql's 3 nodes are large; cf's 2 routers, api,
+	// and uaa plus both redis nodes are medium; cf's doppler is small
+	expected := map[string]int{"large": 6, "medium": 6, "small": 1}
+	for vmType, count := range expected {
+		if counts[vmType] != count {
+			t.Errorf("Expected %d %s VMs, got %d", count, vmType, counts[vmType])
+		}
+	}
+	if len(counts) != len(expected) {
+		t.Errorf("Expected %d vm_types, got %v", len(expected), counts)
+	}
+}
+
+func TestHandleIPs(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	inventory := func() IPInventory {
+		req := httptest.NewRequest(http.MethodGet, "/_internal/ips", nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleIPs(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var result IPInventory
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return result
+	}
+
+	result := inventory()
+	listed := make(map[string]IPAllocation)
+	for _, a := range result.IPs {
+		listed[a.IP] = a
+		if a.Duplicate {
+			t.Errorf("Expected %s not to be flagged duplicate", a.IP)
+		}
+	}
+	for _, deployment := range []string{"cf", "redis", "mysql"} {
+		vms, _ := handlers.state.GetVMs(deployment)
+		for _, vm := range vms {
+			for _, ip := range vm.IPs {
+				a, ok := listed[ip]
+				if !ok {
+					t.Errorf("Expected %s of %s/%s in the IP list", ip, deployment, vm.ID)
+				} else if a.Deployment != deployment || a.Instance != vm.Job+"/"+vm.ID {
+					t.Errorf("Expected %s owned by %s %s/%s, got %+v", ip, deployment, vm.Job, vm.ID, a)
+				}
+			}
+		}
+	}
+	if len(result.Duplicates) != 0 {
+		t.Errorf("Expected no duplicates, got %v", result.Duplicates)
+	}
+	if result.IPs[0].IP != "10.0.1.10" {
+		t.Errorf("Expected IPs sorted by address, first is %s", result.IPs[0].IP)
+	}
+
+	handlers.state.data.VMs["redis"][0].IPs = []string{"10.0.1.20"}
+	result = inventory()
+	if len(result.Duplicates) != 1 || result.Duplicates[0] != "10.0.1.20" {
+		t.Errorf("Expected duplicate 10.0.1.20, got %v", result.Duplicates)
+	}
+	flagged := 0
+	for _, a := range result.IPs {
+		if a.Duplicate {
+			flagged++
+		}
+	}
+	if flagged != 2 {
+		t.Errorf("Expected both holders flagged, got %d", flagged)
+	}
+}
+
+func TestStuckDeployScenario(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	taskFrom := func(w *httptest.ResponseRecorder) *Task {
+		t.Helper()
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		var id int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &id)
+		return waitForTask(t, server.state, id, 5*time.Second)
+	}
+	problems := func() []Problem {
+		t.Helper()
+		w := do(http.MethodGet, "/deployments/cf/problems", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var result []Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to unmarshal problems: %v", err)
+		}
+		return result
+	}
+
+	if p := problems(); len(p) != 0 {
+		t.Fatalf("Expected no problems before the scenario, got %v", p)
+	}
+
+	w := do(http.MethodPost, "/_internal/scenario/stuck-deploy", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var scenario StuckDeployScenario
+	if err := json.Unmarshal(w.Body.Bytes(), &scenario); err != nil {
+		t.Fatalf("Failed to unmarshal scenario: %v", err)
+	}
+	if task, _ := server.state.GetTask(scenario.TaskID); task.State != "error" {
+		t.Errorf("Expected the deploy task to have failed, got %s", task.State)
+	}
+
+	found := problems()
+	if len(found) != 1 || found[0].Type != ProblemUnresponsiveAgent {
+		t.Fatalf("Expected one unresponsive agent problem, got %v", found)
+	}
+	if got := found[0].InstanceGroup + "/" + found[0].InstanceID; got != scenario.Instance {
+		t.Errorf("Expected problem on %s, got %s", scenario.Instance, got)
+	}
+
+	// Recreating doesn't help while the agent is unresponsive
+	if task := taskFrom(do(http.MethodPut, "/deployments/cf?state=recreate", "")); task.State != "error" {
+		t.Errorf("Expected recreate to fail, got %s", task.State)
+	}
+	if p := problems(); len(p) != 1 {
+		t.Fatalf("Expected the problem to remain after recreate, got %v", p)
+	}
+
+	body := fmt.Sprintf(`{"resolutions":{"%d":"%s"}}`, found[0].ID, ResolutionRecreateVM)
+	if task := taskFrom(do(http.MethodPut, "/deployments/cf/problems", body)); task.State != "done" {
+		t.Fatalf("Expected resolution task done, got %s: %s", task.State, task.Result)
+	}
+
+	if p := problems(); len(p) != 0 {
+		t.Errorf("Expected no problems after cloud check, got %v", p)
+	}
+	vms, _ := server.state.GetVMs("cf")
+	for _, vm := range vms {
+		if vm.Job+"/"+vm.ID == scenario.Instance && vm.ProcessState != "running" {
+			t.Errorf("Expected %s running, got %s", scenario.Instance, vm.ProcessState)
+		}
+	}
+}
+
+func TestDeploymentScanMissingVM(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	server.state.SetResurrection(true)
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	taskFrom := func(w *httptest.ResponseRecorder) *Task {
+		t.Helper()
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		var id int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &id)
+		task := waitForTask(t, server.state, id, 5*time.Second)
+		if task.State != "done" {
+			t.Fatalf("Expected task %d done, got %s: %s", id, task.State, task.Result)
+		}
+		return task
+	}
+	scan := func() []Problem {
+		t.Helper()
+		task := taskFrom(do(http.MethodPost, "/deployments/redis/scans", ""))
+		var found []Problem
+		if err := json.Unmarshal([]byte(task.Result), &found); err != nil {
+			t.Fatalf("Expected the scan result to list problems, got %q", task.Result)
+		}
+		return found
+	}
+
+	if found := scan(); len(found) != 0 {
+		t.Fatalf("Expected a clean scan, got %v", found)
+	}
+
+	// Deleting an unresponsive VM's reference leaves its instance without one
+	do(http.MethodPost, "/admin/instances/redis/redis/1/unresponsive", "")
+	found := scan()
+	if len(found) != 1 || found[0].Type != ProblemUnresponsiveAgent {
+		t.Fatalf("Expected one unresponsive agent, got %v", found)
+	}
+	taskFrom(do(http.MethodPut, "/deployments/redis/problems",
+		fmt.Sprintf(`{"resolutions":{"%d":"%s"}}`, found[0].ID, ResolutionDeleteVMReference)))
+
+	found = scan()
+	if len(found) != 1 || found[0].Type != ProblemMissingVM || found[0].InstanceID != "redis-1-id" {
+		t.Fatalf("Expected a missing VM for redis-1-id, got %v", found)
+	}
+	var listed []Problem
+	json.Unmarshal(do(http.MethodGet, "/deployments/redis/problems", "").Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].ID != found[0].ID {
+		t.Errorf("Expected GET problems to match the scan, got %v", listed)
+	}
+
+	taskFrom(do(http.MethodPut, "/deployments/redis/problems",
+		fmt.Sprintf(`{"resolutions":{"%d":"%s"}}`, found[0].ID, ResolutionRecreateVM)))
+	if found := scan(); len(found) != 0 {
+		t.Errorf("Expected no problems after recreating, got %v", found)
+	}
+	vms, _ := server.state.GetVMs("redis")
+	for _, vm := range vms {
+		if vm.ID == "redis-1-id" && (vm.VMCID == "" || vm.ProcessState != "running") {
+			t.Errorf("Expected redis/1 on a new running VM, got %q %q", vm.VMCID, vm.ProcessState)
+		}
+	}
+
+	if w := do(http.MethodPost, "/deployments/nope/scans", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown deployment, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	server.startedAt = time.Now().Add(-90 * time.Second)
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.authMiddleware(mux)
+
+	// No credentials: /health is exempt from auth
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var health HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if health.Status != "ok" {
+		t.Errorf("Expected status ok, got %q", health.Status)
+	}
+	if health.UptimeSeconds < 90 {
+		t.Errorf("Expected uptime of at least 90 seconds, got %d", health.UptimeSeconds)
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	config := DefaultServerConfig()
+	config.StartupDelay = 100 * time.Millisecond
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.startupMiddleware(server.authMiddleware(mux))
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/deployments")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d while starting, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil || errResp.Description != "Director is starting" {
+		t.Errorf("Expected a Director is starting error, got %s", w.Body.String())
+	}
+	for _, path := range []string{"/info", "/health"} {
+		if w := do(path); w.Code != http.StatusOK {
+			t.Errorf("Expected %s to answer while starting, got %d", path, w.Code)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if w := do("/deployments"); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d once started, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestDeleteTaskStopsSimulation(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	config.TaskDurations = TaskDurations{"recreate": 10 * time.Second}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	vmsBefore, _ := server.state.GetVMs("redis")
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis?state=recreate", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+
+	// Wait for the task to take the deployment lock
+	deadline := time.Now().Add(2 * time.Second)
+	for !server.state.IsLocked("redis") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !server.state.IsLocked("redis") {
+		t.Fatal("Expected the recreate task to lock redis")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/_internal/tasks/%d", taskID), nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	if server.state.IsLocked("redis") {
+		t.Error("Expected the lock to be released")
+	}
+	if _, err := server.state.GetTask(taskID); err == nil {
+		t.Error("Expected the task to be gone")
+	}
+
+	// Give the goroutine time to reach the end of the recreate
+	time.Sleep(1200 * time.Millisecond)
+	vmsAfter, _ := server.state.GetVMs("redis")
+	for i := range vmsBefore {
+		if vmsAfter[i].VMCID != vmsBefore[i].VMCID {
+			t.Errorf("Expected deleted task not to recreate %s", vmsBefore[i].ID)
+		}
+	}
+	if server.state.IsLocked("redis") {
+		t.Error("Expected the deleted task not to re-take the lock")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/_internal/tasks/%d", taskID), nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d deleting again, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	config := DefaultServerConfig()
+	config.FailureRate = 1.5
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected NewServer to reject a failure rate above 1")
+	}
+
+	config.Speed = 10.0
+	config.FailureRate = 1.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	vmsBefore, _ := server.state.GetVMs("redis")
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis?state=recreate", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+
+	task := waitForTask(t, server.state, taskID, 2*time.Second)
+	if task.State != "error" {
+		t.Fatalf("Expected task error, got %s", task.State)
+	}
+	if !strings.HasPrefix(task.Result, "Error: unresponsive agent on redis/") {
+		t.Errorf("Expected an unresponsive agent error, got %q", task.Result)
+	}
+	events := server.state.GetTaskEvents(taskID, 0)
+	if n := len(events); n < 2 || events[n-2].State != "started" || events[n-1].State != "failed" || events[n-1].Stage != events[n-2].Stage {
+		t.Errorf("Expected the first step to start and then fail, got %+v", events)
+	}
+	if server.state.IsLocked("redis") {
+		t.Error("Expected the lock to be released")
+	}
+
+	vmsAfter, _ := server.state.GetVMs("redis")
+	for i := range vmsBefore {
+		if vmsAfter[i].VMCID != vmsBefore[i].VMCID {
+			t.Errorf("Expected failed task not to recreate %s", vmsBefore[i].ID)
+		}
+	}
+}
+
+func TestHandleDeploymentVitals(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/cf/vitals", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploymentVitals(w, req, "cf")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var vitals DeploymentVitals
+	if err := json.Unmarshal(w.Body.Bytes(), &vitals); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	// gorouter (15.0, 256000 KB) plus route_registrar (0.5, 25600 KB)
+	if router := vitals.Jobs["router"]; router.CPU != 15.5 || router.MemKB != 281600 {
+		t.Errorf("Expected router vitals {15.5 281600}, got %+v", router)
+	}
+	if _, ok := vitals.Jobs["smoke_tests"]; ok {
+		t.Error("Expected errands to be excluded")
+	}
+
+	var total VitalsUsage
+	for _, usage := range vitals.Jobs {
+		total.CPU += usage.CPU
+		total.MemKB += usage.MemKB
+	}
+	if vitals.Total.MemKB != total.MemKB || math.Abs(vitals.Total.CPU-total.CPU) > 0.001 {
+		t.Errorf("Expected total %+v to sum the jobs, got %+v", total, vitals.Total)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments/nope/vitals", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handlers.HandleDeploymentVitals(w, req, "nope")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleDeploymentVariableUsage(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	req := httptest.NewRequest(http.MethodGet, "/deployments/cf/variables/usage", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handlers.HandleDeploymentVariableUsage(w, req, "cf")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var usage []VariableUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	byName := make(map[string][]VariableReference)
+	for _, u := range usage {
+		byName[u.Name] = u.References
+	}
+
+	admin := byName["cf_admin_password"]
+	if len(admin) == 0 {
+		t.Fatal("Expected cf_admin_password to have a consuming job")
+	}
+	if admin[0].InstanceGroup != "uaa" || admin[0].Job != "uaa" || admin[0].Property != "uaa.scim.users.password" {
+		t.Errorf("Unexpected cf_admin_password reference: %+v", admin[0])
+	}
+
+	// Certificate fields group under the variable
+	if refs := byName["router_ssl"]; len(refs) != 2 {
+		t.Errorf("Expected 2 router_ssl references, got %+v", refs)
+	}
+	if refs, ok := byName["router_ca"]; !ok || len(refs) != 0 {
+		t.Errorf("Expected unreferenced router_ca listed with no references, got %+v", refs)
+	}
+}
+
+func TestInstanceResponsiveness(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	post := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	routerStates := func() (vm0, vm1, inst0 string) {
+		vms, _ := server.state.GetVMs("cf")
+		for _, vm := range vms {
+			if vm.Job == "router" && vm.Index == 0 {
+				vm0 = vm.ProcessState
+			}
+			if vm.Job == "router" && vm.Index == 1 {
+				vm1 = vm.ProcessState
+			}
+		}
+		instances, _ := server.state.GetInstances("cf")
+		for _, inst := range instances {
+			if inst.Job == "router" && inst.Index == 0 {
+				inst0 = inst.State
+			}
+		}
+		return vm0, vm1, inst0
+	}
+
+	if code := post("/admin/instances/cf/router/0/unresponsive"); code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, code)
+	}
+	vm0, vm1, inst0 := routerStates()
+	if vm0 != ProcessStateUnresponsive || inst0 != ProcessStateUnresponsive {
+		t.Errorf("Expected router/0 unresponsive, got VM %q instance %q", vm0, inst0)
+	}
+	if vm1 != "running" {
+		t.Errorf("Expected router/1 unaffected, got %q", vm1)
+	}
+	if problems, _ := server.state.GetProblems("cf"); len(problems) != 1 {
+		t.Errorf("Expected cloud check to report 1 problem, got %d", len(problems))
+	}
+
+	if code := post("/admin/instances/cf/router/0/responsive"); code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, code)
+	}
+	if vm0, _, inst0 := routerStates(); vm0 != "running" || inst0 != "running" {
+		t.Errorf("Expected router/0 running again, got VM %q instance %q", vm0, inst0)
+	}
+
+	if code := post("/admin/instances/cf/router/9/unresponsive"); code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown instance, got %d", http.StatusNotFound, code)
+	}
+	if code := post("/admin/instances/nope/router/0/unresponsive"); code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown deployment, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestTaskQueuePosition(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.simulator.SetMaxConcurrentTasks(1)
+	handlers.simulator.SetTaskDurations(TaskDurations{"start": 5 * time.Second})
+
+	var ids []int
+	for _, deployment := range []string{"cf", "redis", "mysql"} {
+		task := handlers.state.CreateTask("start jobs in deployment "+deployment, deployment, "admin")
+		handlers.simulator.ExecuteStart(task.ID, deployment, "", "")
+		ids = append(ids, task.ID)
+	}
+
+	position := func(id int) int {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tasks/%d", id), nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleTask(w, req, id)
+		var task Task
+		if err := json.Unmarshal(w.Body.Bytes(), &task); err != nil {
+			t.Fatalf("Failed to unmarshal task: %v", err)
+		}
+		return task.QueuePosition
+	}
+	waitForState := func(id int, state string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if task, _ := handlers.state.GetTask(id); task.State == state {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for task %d to be %s", id, state)
+	}
+
+	waitForState(ids[0], "processing")
+	if got := []int{position(ids[0]), position(ids[1]), position(ids[2])}; got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Errorf("Expected positions [0 1 2], got %v", got)
+	}
+
+	waitForState(ids[1], "processing")
+	if task, _ := handlers.state.GetTask(ids[0]); task.State != "done" {
+		t.Errorf("Expected first task done before second started, got %s", task.State)
+	}
+	if got := position(ids[2]); got != 1 {
+		t.Errorf("Expected last task at position 1, got %d", got)
+	}
+
+	if task := waitForTask(t, handlers.state, ids[2], 5*time.Second); task.State != "done" {
+		t.Fatalf("Expected last task done, got %s", task.State)
+	}
+	if got := position(ids[2]); got != 0 {
+		t.Errorf("Expected no queue position once done, got %d", got)
+	}
+}
+
+func TestDeployReport(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	// Scale redis down to one node and add a sentinel
+	sentinel := `- name: sentinel
+  instances: 1
+  azs: [z1]
+  vm_type: small
+  jobs:
+  - name: redis-sentinel
+    release: redis
+
+`
+	manifest := strings.Replace(redisManifestYAML(), "  instances: 2\n", "  instances: 1\n", 1)
+	manifest = strings.Replace(manifest, "variables:\n", sentinel+"variables:\n", 1)
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	req.Header.Set("Content-Type", "text/yaml")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	task := waitForTask(t, server.state, taskID, 5*time.Second)
+	if task.State != "done" {
+		t.Fatalf("Expected deploy done, got %s: %s", task.State, task.Result)
+	}
+
+	link := task.Result[strings.Index(task.Result, "/resources/"):]
+	req = httptest.NewRequest(http.MethodGet, link, nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d downloading %s, got %d", http.StatusOK, link, w.Code)
+	}
+
+	var report DeployReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to unmarshal report: %v", err)
+	}
+	if report.Deployment != "redis" || report.TaskID != taskID {
+		t.Errorf("Expected report for redis task %d, got %s task %d", taskID, report.Deployment, report.TaskID)
+	}
+	if len(report.Created) != 1 || !strings.HasPrefix(report.Created[0], "sentinel/") {
+		t.Errorf("Expected one created sentinel, got %v", report.Created)
+	}
+	if len(report.Updated) != 1 || report.Updated[0] != "redis/redis-0-id" {
+		t.Errorf("Expected redis/redis-0-id updated, got %v", report.Updated)
+	}
+	if len(report.Deleted) != 1 || report.Deleted[0] != "redis/redis-1-id" {
+		t.Errorf("Expected redis/redis-1-id deleted, got %v", report.Deleted)
+	}
+	if len(report.Releases) != 1 || report.Releases[0].Name != "redis" {
+		t.Errorf("Expected the redis release, got %v", report.Releases)
+	}
+	if report.FinishedAt < report.StartedAt || report.DurationSeconds <= 0 {
+		t.Errorf("Expected a positive duration, got %+v", report)
+	}
+}
+
+func TestTaskProgress(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.simulator.SetTaskDurations(TaskDurations{"recreate": 5 * time.Second})
+
+	get := func(id int) Task {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tasks/%d", id), nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleTask(w, req, id)
+		var task Task
+		if err := json.Unmarshal(w.Body.Bytes(), &task); err != nil {
+			t.Fatalf("Failed to unmarshal task: %v", err)
+		}
+		return task
+	}
+
+	task := handlers.state.CreateTask("recreate VMs for deployment redis", "redis", "admin")
+	if got := get(task.ID); got.StartedAt != 0 || got.FinishedAt != 0 || got.ProgressPercent != 0 {
+		t.Errorf("Expected a queued task without progress or timestamps, got %+v", got)
+	}
+	handlers.simulator.ExecuteRecreate(task.ID, "redis", "", "")
+
+	// Preparing finishes well before the 500ms recreate step does
+	seen := make(map[int]bool)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		got := get(task.ID)
+		if got.State == "processing" {
+			seen[got.ProgressPercent] = true
+			if got.StartedAt == 0 {
+				t.Error("Expected started_at once processing")
+			}
+		}
+		if isTerminalTaskState(got.State) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !seen[0] || !seen[50] {
+		t.Errorf("Expected to observe 0%% and 50%% while processing, saw %v", seen)
+	}
+
+	done := get(task.ID)
+	if done.State != "done" || done.ProgressPercent != 100 {
+		t.Errorf("Expected done at 100%%, got %s at %d%%", done.State, done.ProgressPercent)
+	}
+	if done.FinishedAt < done.StartedAt {
+		t.Errorf("Expected finished_at after started_at, got %d < %d", done.FinishedAt, done.StartedAt)
+	}
+
+	// Fixture tasks serialize without the new fields
+	body, _ := json.Marshal(handlers.state.data.Tasks[1])
+	for _, field := range []string{"progress_percent", "started_at", "finished_at"} {
+		if strings.Contains(string(body), field) {
+			t.Errorf("Expected fixture task to omit %s, got %s", field, body)
+		}
+	}
+}
+
+func TestTaskAffectedResources(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	get := func(id int, query string) Task {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tasks/%d%s", id, query), nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleTask(w, req, id)
+		var task Task
+		if err := json.Unmarshal(w.Body.Bytes(), &task); err != nil {
+			t.Fatalf("Failed to unmarshal task: %v", err)
+		}
+		return task
+	}
+
+	before, _ := handlers.state.GetVMs("redis")
+	task := handlers.state.CreateTask("recreate VMs for deployment redis", "redis", "admin")
+	handlers.simulator.ExecuteRecreate(task.ID, "redis", "", "")
+	if done := waitForTask(t, handlers.state, task.ID, 5*time.Second); done.State != "done" {
+		t.Fatalf("Expected recreate done, got %s", done.State)
+	}
+	after, _ := handlers.state.GetVMs("redis")
+
+	if got := get(task.ID, ""); got.AffectedResources != nil {
+		t.Errorf("Expected affected resources only when verbose, got %+v", got.AffectedResources)
+	}
+
+	affected := get(task.ID, "?verbose=1").AffectedResources
+	if affected == nil {
+		t.Fatal("Expected affected resources with verbose=1")
+	}
+	contains := func(list []string, s string) bool {
+		for _, item := range list {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, vm := range before {
+		if !contains(affected.VMsDeleted, vm.VMCID) {
+			t.Errorf("Expected deleted VM %s in %v", vm.VMCID, affected.VMsDeleted)
+		}
+	}
+	for _, vm := range after {
+		if !contains(affected.VMsCreated, vm.VMCID) {
+			t.Errorf("Expected created VM %s in %v", vm.VMCID, affected.VMsCreated)
+		}
+	}
+	if len(affected.Instances) != 2 {
+		t.Errorf("Expected both redis instances changed, got %v", affected.Instances)
+	}
+}
+
+func TestHandleDeploymentSSH(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	ssh := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/deployments/cf/ssh", strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handlers.HandleDeploymentSSH(w, req, "cf")
+		return w
+	}
+	finish := func(w *httptest.ResponseRecorder) *Task {
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		var taskID int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+		task := waitForTask(t, handlers.state, taskID, 2*time.Second)
+		if task.State != "done" {
+			t.Fatalf("Expected ssh task done, got %s", task.State)
+		}
+		return task
+	}
+
+	task := finish(ssh(`{"command":"setup","target":{"job":"router","indexes":["0"]},"params":{"user":"bosh_abc","public_key":"ssh-rsa AAAA"}}`))
+	if task.Description != "ssh setup" {
+		t.Errorf("Expected ssh setup description, got %q", task.Description)
+	}
+	var results []SSHResult
+	if err := json.Unmarshal([]byte(task.Result), &results); err != nil {
+		t.Fatalf("Failed to unmarshal ssh result %q: %v", task.Result, err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected one instance, got %+v", results)
+	}
+	if r := results[0]; r.Job != "router" || r.Index != 0 || r.IP != "10.0.1.20" || r.Status != "success" {
+		t.Errorf("Unexpected ssh result %+v", r)
+	}
+
+	task = finish(ssh(`{"command":"setup","target":{"job":"diego_cell"},"params":{"user":"bosh_abc","public_key":"ssh-rsa AAAA"}}`))
+	if err := json.Unmarshal([]byte(task.Result), &results); err != nil || len(results) != 3 {
+		t.Errorf("Expected all 3 diego cells targeted, got %s", task.Result)
+	}
+
+	task = finish(ssh(`{"command":"cleanup","target":{"job":"router","ids":["cf-r1-id"]},"params":{"user_regex":"^bosh_abc"}}`))
+	if task.Description != "ssh cleanup" {
+		t.Errorf("Expected ssh cleanup description, got %q", task.Description)
+	}
+
+	for _, body := range []string{
+		`{"command":"reboot","target":{"job":"router"}}`,
+		`{"command":"setup","target":{"job":"router"},"params":{}}`,
+		`{"command":"setup","target":{"job":"nope"},"params":{"user":"u","public_key":"k"}}`,
+	} {
+		if w := ssh(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+}
+
+func TestHandleInstanceLogs(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/deployments/cf/instances/router/0/logs?type=agent")
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	task := waitForTask(t, server.state, taskID, 2*time.Second)
+	if task.State != "done" {
+		t.Fatalf("Expected fetch logs task done, got %s", task.State)
+	}
+	if task.Description != "fetch agent logs for router/cf-r0-id" {
+		t.Errorf("Expected agent logs description, got %q", task.Description)
+	}
+	if !strings.HasPrefix(task.Result, "logs-cf-router-0-") {
+		t.Errorf("Expected a logs blob ID, got %q", task.Result)
+	}
+	if w := get("/resources/" + task.Result); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "router/cf-r0-id agent logs") {
+		t.Errorf("Expected the logs blob to download, got %d: %s", w.Code, w.Body.String())
+	}
+	events := server.state.GetTaskEvents(taskID, 0)
+	if len(events) == 0 || events[len(events)-1].Task != "router/cf-r0-id" {
+		t.Errorf("Expected events for target router/cf-r0-id, got %+v", events)
+	}
+
+	testCases := []struct {
+		path   string
+		status int
+	}{
+		{"/deployments/cf/instances/router/9/logs", http.StatusNotFound},
+		{"/deployments/cf/instances/nope/0/logs", http.StatusNotFound},
+		{"/deployments/nope/instances/router/0/logs", http.StatusNotFound},
+		{"/deployments/cf/instances/router/0/logs?type=system", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if w := get(tc.path); w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, w.Code)
+		}
+	}
+}
+
+func TestHandleDeploymentColocation(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	colocation := func(deployment string) []ColocationGroup {
+		req := httptest.NewRequest(http.MethodGet, "/deployments/"+deployment+"/colocation", nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var groups []ColocationGroup
+		if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return groups
+	}
+
+	groups := colocation("redis")
+	if len(groups) != 1 || groups[0].Colocated || strings.Join(groups[0].Jobs, ",") != "redis-server" {
+		t.Fatalf("Expected redis-server alone before redeploy, got %+v", groups)
+	}
+
+	// Colocate the sentinel with the server on the redis VMs
+	sentinel := "  - name: redis-sentinel\n    release: redis\n\nvariables:\n"
+	manifest := strings.Replace(redisManifestYAML(), "\nvariables:\n", sentinel, 1)
+	req := httptest.NewRequest(http.MethodPut, "/deployments/redis", strings.NewReader(manifest))
+	req.SetBasicAuth("admin", "admin")
+	req.Header.Set("Content-Type", "text/yaml")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	if task := waitForTask(t, server.state, taskID, 5*time.Second); task.State != "done" {
+		t.Fatalf("Expected deploy done, got %s: %s", task.State, task.Result)
+	}
+
+	groups = colocation("redis")
+	if len(groups) != 1 {
+		t.Fatalf("Expected one instance group, got %+v", groups)
+	}
+	g := groups[0]
+	if g.InstanceGroup != "redis" || !g.Colocated || strings.Join(g.Jobs, ",") != "redis-server,redis-sentinel" {
+		t.Errorf("Expected redis-server and redis-sentinel colocated, got %+v", g)
+	}
+	if strings.Join(g.VMs, ",") != "vm-redis-0,vm-redis-1" {
+		t.Errorf("Expected both redis VMs, got %v", g.VMs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments/missing/colocation", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing deployment, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestRestartAll(t *testing.T) {
+	handlers := setupTestHandlers()
+	handlers.simulator.SetTaskDurations(TaskDurations{"restart": time.Second})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/restart-all", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handlers.HandleRestartAll(w, req)
+		return w
+	}
+	restart := func(body string) []*Task {
+		t.Helper()
+		w := post(body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var resp RestartAllResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		tasks := make([]*Task, len(resp.Tasks))
+		for i, id := range resp.Tasks {
+			tasks[i] = waitForTask(t, handlers.state, id, 5*time.Second)
+		}
+		return tasks
+	}
+	deploymentsOf := func(tasks []*Task) string {
+		var names []string
+		for _, task := range tasks {
+			names = append(names, task.Deployment)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tasks := restart(`{"order":["mysql","redis"]}`)
+	if got := deploymentsOf(tasks); got != "mysql,redis,cf" {
+		t.Errorf("Expected the given order then the rest, got %s", got)
+	}
+	for i, task := range tasks {
+		if task.State != "done" {
+			t.Errorf("Expected %s restarted, got %s: %s", task.Deployment, task.State, task.Result)
+		}
+		if i > 0 && task.StartedAt < tasks[i-1].FinishedAt {
+			t.Errorf("Expected %s to start after %s finished", task.Deployment, tasks[i-1].Deployment)
+		}
+	}
+
+	if got := deploymentsOf(restart("")); got != "cf,mysql,redis" {
+		t.Errorf("Expected alphabetical order by default, got %s", got)
+	}
+
+	if w := post(`{"order":["nope"]}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown deployment, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := post(`{"order":["cf","cf"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a repeated deployment, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAdminScale(t *testing.T) {
+	config := DefaultServerConfig()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	scale := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/deployments/cf/scale", strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	indices := func() (map[int]string, map[int]string) {
+		vms, _ := server.state.GetVMs("cf")
+		instances, _ := server.state.GetInstances("cf")
+		vmIPs, instanceCIDs := map[int]string{}, map[int]string{}
+		for _, vm := range vms {
+			if vm.Job == "diego_cell" {
+				vmIPs[vm.Index] = strings.Join(vm.IPs, ",")
+			}
+		}
+		for _, inst := range instances {
+			if inst.Job == "diego_cell" {
+				instanceCIDs[inst.Index] = inst.VMCID
+			}
+		}
+		return vmIPs, instanceCIDs
+	}
+
+	w := scale(`{"job":"diego_cell","instances":5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ScaleRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Instances == nil || *resp.Instances != 5 {
+		t.Errorf("Expected the new count 5, got %s", w.Body.String())
+	}
+
+	vmIPs, instanceCIDs := indices()
+	if len(vmIPs) != 5 || len(instanceCIDs) != 5 {
+		t.Fatalf("Expected 5 diego_cell VMs and instances, got %d and %d", len(vmIPs), len(instanceCIDs))
+	}
+	seen := map[string]bool{}
+	for index := 0; index < 5; index++ {
+		ip := vmIPs[index]
+		if !strings.HasPrefix(ip, "10.0.") || seen[ip] {
+			t.Errorf("Expected a distinct 10.0.x.x IP for diego_cell/%d, got %q", index, ip)
+		}
+		seen[ip] = true
+		if instanceCIDs[index] == "" {
+			t.Errorf("Expected diego_cell/%d to have a VM", index)
+		}
+	}
+
+	if w := scale(`{"job":"diego_cell","instances":1}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	vmIPs, instanceCIDs = indices()
+	if len(vmIPs) != 1 || len(instanceCIDs) != 1 || instanceCIDs[0] != "vm-cf-diego-cell-0" {
+		t.Errorf("Expected only diego_cell/0 after scaling down, got VMs %v and instances %v", vmIPs, instanceCIDs)
+	}
+
+	if w := scale(`{"job":"missing","instances":2}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown job, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := scale(`{"job":"smoke_tests","instances":2}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for an errand, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if w := scale(`{"job":"diego_cell"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without instances, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestInstanceIgnore(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPut, "/deployments/cf/instance_groups/router/cf-r1-id/ignore", strings.NewReader(`{"ignore":true}`))
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/deployments/cf/jobs/router?state=stopped", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var taskID int
+	fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+	if task := waitForTask(t, server.state, taskID, 5*time.Second); task.State != "done" {
+		t.Fatalf("Expected stop done, got %s: %s", task.State, task.Result)
+	}
+
+	vms, _ := server.state.GetVMs("cf")
+	for _, vm := range vms {
+		if vm.Job != "router" {
+			continue
+		}
+		want := "stopped"
+		if vm.Index == 1 {
+			want = "started"
+			if !vm.Ignore {
+				t.Error("Expected router/1 to be ignored")
+			}
+		}
+		if vm.State != want {
+			t.Errorf("Expected router/%d %s, got %s", vm.Index, want, vm.State)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/deployments/cf/instance_groups/router/missing-id/ignore", strings.NewReader(`{"ignore":true}`))
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown instance, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config := DefaultServerConfig()
+	config.RateLimit = 5
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.rateLimitMiddleware(mux)
+
+	burst := func() (ok, limited int, retryAfter string) {
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/info", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			switch w.Code {
+			case http.StatusOK:
+				ok++
+			case http.StatusTooManyRequests:
+				limited++
+				retryAfter = w.Header().Get("Retry-After")
+			}
+		}
+		return ok, limited, retryAfter
+	}
+
+	ok, limited, retryAfter := burst()
+	if ok < 5 || limited == 0 {
+		t.Fatalf("Expected a burst of 5 then 429s, got %d ok and %d limited", ok, limited)
+	}
+	if retryAfter != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", retryAfter)
+	}
+
+	// The bucket refills at 5 tokens a second
+	time.Sleep(400 * time.Millisecond)
+	if ok, _, _ := burst(); ok == 0 {
+		t.Error("Expected requests to succeed again after a pause")
+	}
+}
+
+func TestTaskContextID(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	do := func(method, path, contextID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		if contextID != "" {
+			req.Header.Set("X-Bosh-Context-Id", contextID)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	var ids []int
+	for _, path := range []string{"/deployments/redis/jobs/redis?state=restart", "/deployments/mysql/jobs/mysql?state=restart"} {
+		w := do(http.MethodPut, path, "batch-42")
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+		}
+		var id int
+		fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &id)
+		ids = append(ids, id)
+	}
+	do(http.MethodPut, "/deployments/cf/jobs/router?state=restart", "")
+
+	var task Task
+	json.Unmarshal(do(http.MethodGet, fmt.Sprintf("/tasks/%d", ids[0]), "").Body.Bytes(), &task)
+	if task.ContextID != "batch-42" {
+		t.Errorf("Expected context_id batch-42, got %q", task.ContextID)
+	}
+
+	var tasks []Task
+	json.Unmarshal(do(http.MethodGet, "/tasks?context_id=batch-42", "").Body.Bytes(), &tasks)
+	if len(tasks) != 2 || tasks[0].ID != ids[1] || tasks[1].ID != ids[0] {
+		t.Errorf("Expected tasks %v for the context, got %+v", ids, tasks)
+	}
+	for _, task := range tasks {
+		if task.ContextID != "batch-42" {
+			t.Errorf("Expected context_id in the task list, got %q", task.ContextID)
+		}
+	}
+}
+
+func TestHandleDeploymentJobsUnknownJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		job    string
+		status int
+	}{
+		{"valid job", "redis", http.StatusFound},
+		{"valid job and index", "redis/0", http.StatusFound},
+		{"missing job", "postgres", http.StatusNotFound},
+		{"whole deployment", "", http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := setupTestHandlers()
+			before := len(handlers.state.GetTasks("", "", "", 2, 0))
+
+			req := httptest.NewRequest(http.MethodPut, "/deployments/redis/jobs/"+tt.job+"?state=restart", nil)
+			req.SetBasicAuth("admin", "admin")
+			w := httptest.NewRecorder()
+			handlers.HandleDeploymentJobs(w, req, "redis", tt.job)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			created := len(handlers.state.GetTasks("", "", "", 2, 0)) - before
+			if tt.status == http.StatusNotFound {
+				if !strings.Contains(w.Body.String(), "instance group 'postgres' not found") {
+					t.Errorf("Expected instance group not found, got %s", w.Body.String())
+				}
+				if created != 0 {
+					t.Errorf("Expected no task for a missing job, got %d", created)
+				}
+			} else if created != 1 {
+				t.Errorf("Expected one task, got %d", created)
+			}
+		})
+	}
+}
+
+func TestVariableRotate(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	variables := func(query string) []Variable {
+		var vars []Variable
+		json.Unmarshal(do(http.MethodGet, "/deployments/redis/variables"+query).Body.Bytes(), &vars)
+		return vars
+	}
+
+	if vars := variables(""); len(vars) != 2 || vars[0].Value != "" {
+		t.Fatalf("Expected redacted values by default, got %+v", vars)
+	}
+	before := variables("?include_values=true")
+	if before[0].Value == "" {
+		t.Fatalf("Expected values with include_values=true, got %+v", before)
+	}
+
+	w := do(http.MethodPost, "/deployments/redis/variables/var-10/rotate")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var rotated Variable
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	if rotated.ID != "var-23" || rotated.Name != "redis_password" || rotated.Value != "" {
+		t.Errorf("Expected redis_password under the next free ID without its value, got %+v", rotated)
+	}
+
+	after := variables("?include_values=true")
+	if after[0].ID != "var-23" || after[0].Value == before[0].Value {
+		t.Errorf("Expected a new ID and value, got %+v", after[0])
+	}
+	if after[1] != before[1] {
+		t.Errorf("Expected other variables untouched, got %+v", after[1])
+	}
+
+	events := server.state.GetEvents(EventFilter{ObjectType: "variable"})
+	if len(events) != 1 || events[0].Action != "rotate" || events[0].Context["old_id"] != "var-10" || events[0].Context["new_id"] != "var-23" {
+		t.Errorf("Expected a rotate event, got %+v", events)
+	}
+
+	// The interpolated manifest resolves to the rotated value
+	var manifest DeploymentManifest
+	json.Unmarshal(do(http.MethodGet, "/deployments/redis?interpolated=true").Body.Bytes(), &manifest)
+	if !strings.Contains(manifest.Manifest, "password: "+after[0].Value+"\n") {
+		t.Errorf("Expected the interpolated manifest to use the rotated password %s, got:\n%s", after[0].Value, manifest.Manifest)
+	}
+
+	if w := do(http.MethodPost, "/deployments/redis/variables/var-10/rotate"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for the old ID, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := do(http.MethodGet, "/deployments/redis/variables/var-23/rotate"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d for GET, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestHandleVariables(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	fetch := func(query string) []VariableWithDeployment {
+		req := httptest.NewRequest(http.MethodGet, "/variables"+query, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handlers.HandleVariables(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var vars []VariableWithDeployment
+		if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return vars
+	}
+
+	all := fetch("")
+	if len(all) != 11 {
+		t.Fatalf("Expected 11 variables across deployments, got %d", len(all))
+	}
+	var order []string
+	for _, v := range all {
+		order = append(order, v.Deployment+"/"+v.ID)
+		if v.Value != "" {
+			t.Errorf("Expected redacted values, got %q for %s", v.Value, v.Name)
+		}
+	}
+	if got := strings.Join(order[:3], ","); got != "cf/var-6,cf/var-5,cf/var-4" {
+		t.Errorf("Expected cf first, newest ID first, got %s", got)
+	}
+	if got := strings.Join(order[6:], ","); got != "mysql/var-22,mysql/var-21,mysql/var-20,redis/var-11,redis/var-10" {
+		t.Errorf("Expected mysql then redis, got %s", got)
+	}
+
+	passwords := fetch("?name=password&include_values=true")
+	if len(passwords) != 3 {
+		t.Fatalf("Expected 3 password variables, got %+v", passwords)
+	}
+	for _, v := range passwords {
+		if !strings.Contains(v.Name, "password") || v.Value == "" {
+			t.Errorf("Expected a password with its value, got %+v", v)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// ABOUTME: Maintenance windows during which the director rejects mutations.
+// ABOUTME: Windows are fixed time ranges or ranges recurring daily in UTC.
+
+package mockbosh
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow is a period during which mutating requests are rejected.
+// A fixed window runs from Start to End; a daily window recurs each day from
+// DailyStart to DailyEnd (offsets from midnight UTC), wrapping past midnight
+// when DailyEnd is earlier.
+type MaintenanceWindow struct {
+	Start, End           time.Time
+	Daily                bool
+	DailyStart, DailyEnd time.Duration
+}
+
+// ParseMaintenanceWindow parses a window as either START/END in RFC 3339,
+// e.g. "2024-01-01T02:00:00Z/2024-01-01T04:00:00Z", or a daily UTC range,
+// e.g. "daily 02:00-04:00".
+func ParseMaintenanceWindow(spec string) (MaintenanceWindow, error) {
+	if rest, ok := strings.CutPrefix(spec, "daily "); ok {
+		from, to, found := strings.Cut(rest, "-")
+		if !found {
+			return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: expected daily HH:MM-HH:MM", spec)
+		}
+		start, err := parseClockTime(from)
+		if err != nil {
+			return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+		}
+		end, err := parseClockTime(to)
+		if err != nil {
+			return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+		}
+		return MaintenanceWindow{Daily: true, DailyStart: start, DailyEnd: end}, nil
+	}
+
+	from, to, found := strings.Cut(spec, "/")
+	if !found {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: expected START/END or daily HH:MM-HH:MM", spec)
+	}
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+	}
+	end, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+	}
+	if !end.After(start) {
+		return MaintenanceWindow{}, fmt.Errorf("invalid maintenance window %q: end must be after start", spec)
+	}
+	return MaintenanceWindow{Start: start, End: end}, nil
+}
+
+// parseClockTime parses HH:MM into an offset from midnight.
+func parseClockTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether the window covers t.
+func (mw MaintenanceWindow) Active(t time.Time) bool {
+	if !mw.Daily {
+		return !t.Before(mw.Start) && t.Before(mw.End)
+	}
+	t = t.UTC()
+	offset := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+	if mw.DailyStart <= mw.DailyEnd {
+		return offset >= mw.DailyStart && offset < mw.DailyEnd
+	}
+	return offset >= mw.DailyStart || offset < mw.DailyEnd
+}
+
+// String formats the window in the same form ParseMaintenanceWindow accepts.
+func (mw MaintenanceWindow) String() string {
+	if mw.Daily {
+		clock := func(d time.Duration) string {
+			return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+		}
+		return fmt.Sprintf("daily %s-%s", clock(mw.DailyStart), clock(mw.DailyEnd))
+	}
+	return mw.Start.Format(time.RFC3339) + "/" + mw.End.Format(time.RFC3339)
+}
+
+// inMaintenance reports whether any window covers t.
+func inMaintenance(windows []MaintenanceWindow, t time.Time) bool {
+	for _, mw := range windows {
+		if mw.Active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMutating reports whether a request changes director state. Token
+// requests, dry-run deletes, and the mock's own control endpoints never
+// count.
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	case http.MethodDelete:
+		if r.URL.Query().Get("dry_run") == "true" {
+			return false
+		}
+	}
+	path := r.URL.Path
+	return path != "/oauth/token" && !strings.HasPrefix(path, "/_internal/") && !strings.HasPrefix(path, "/admin/")
+}
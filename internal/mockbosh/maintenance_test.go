@@ -0,0 +1,84 @@
+// ABOUTME: Tests for maintenance windows.
+// ABOUTME: Verifies window parsing and that mutations are rejected while one is active.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	fixed, err := ParseMaintenanceWindow("2024-01-01T02:00:00Z/2024-01-01T04:00:00Z")
+	if err != nil {
+		t.Fatalf("ParseMaintenanceWindow failed: %v", err)
+	}
+	at := func(s string) time.Time {
+		parsed, _ := time.Parse(time.RFC3339, s)
+		return parsed
+	}
+	if !fixed.Active(at("2024-01-01T03:00:00Z")) || fixed.Active(at("2024-01-01T04:00:00Z")) {
+		t.Error("Expected the fixed window to cover 03:00 but not its end")
+	}
+
+	overnight, err := ParseMaintenanceWindow("daily 23:30-00:30")
+	if err != nil {
+		t.Fatalf("ParseMaintenanceWindow failed: %v", err)
+	}
+	if !overnight.Active(at("2024-03-05T23:45:00Z")) || !overnight.Active(at("2024-03-06T00:15:00Z")) {
+		t.Error("Expected the daily window to wrap past midnight")
+	}
+	if overnight.Active(at("2024-03-06T12:00:00Z")) {
+		t.Error("Expected the daily window to be inactive at noon")
+	}
+	if s := overnight.String(); s != "daily 23:30-00:30" {
+		t.Errorf("Expected String to round-trip, got %q", s)
+	}
+
+	for _, spec := range []string{"", "daily 02:00", "daily 25:00-26:00", "2024-01-01T04:00:00Z/2024-01-01T02:00:00Z"} {
+		if _, err := ParseMaintenanceWindow(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestMaintenanceMiddleware(t *testing.T) {
+	start := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	config := DefaultServerConfig()
+	config.MaintenanceWindows = []MaintenanceWindow{{Start: start, End: start.Add(2 * time.Hour)}}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	now := start.Add(time.Hour)
+	server.now = func() time.Time { return now }
+
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.maintenanceMiddleware(mux)
+
+	do := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do(http.MethodDelete, "/deployments/redis"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected delete rejected with %d during maintenance, got %d", http.StatusServiceUnavailable, code)
+	}
+	if code := do(http.MethodGet, "/deployments/redis"); code != http.StatusOK {
+		t.Errorf("Expected GET to succeed during maintenance, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/deployments/redis?dry_run=true"); code != http.StatusOK {
+		t.Errorf("Expected a dry-run delete to succeed during maintenance, got %d", code)
+	}
+
+	now = start.Add(3 * time.Hour)
+	if code := do(http.MethodDelete, "/deployments/redis"); code != http.StatusFound {
+		t.Errorf("Expected delete permitted after maintenance, got %d", code)
+	}
+}
@@ -0,0 +1,402 @@
+// ABOUTME: Deployment manifest helpers for the mock BOSH Director.
+// ABOUTME: Interpolates ((variable)) placeholders with synthetic credentials.
+
+package mockbosh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// placeholderPattern matches ((name)) and ((name.field)) placeholders.
+var placeholderPattern = regexp.MustCompile(`\(\(\s*!?([^()\s]+)\s*\)\)`)
+
+// interpolateManifest replaces every ((var)) placeholder in a manifest with
+// the variable's stored value, as `bosh manifest` would after resolving
+// credentials. Fields such as ((router_ssl.certificate)) derive from their
+// variable's value, so rotating it changes them too; variables the
+// deployment doesn't store get a synthetic value.
+func interpolateManifest(deployment, manifest string, variables []Variable) string {
+	values := make(map[string]string, len(variables))
+	for _, v := range variables {
+		values[v.Name] = v.Value
+	}
+	return placeholderPattern.ReplaceAllStringFunc(manifest, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		base, field, _ := strings.Cut(name, ".")
+		value, ok := values[base]
+		switch {
+		case !ok || value == "":
+			return syntheticVariableValue(deployment, name)
+		case field != "":
+			return syntheticVariableValue(value, name)
+		}
+		return value
+	})
+}
+
+// syntheticVariableValue derives a stable fake credential for a variable path
+// such as "cf_admin_password" or "router_ssl.certificate".
+func syntheticVariableValue(deployment, name string) string {
+	sum := sha256.Sum256([]byte(deployment + "/" + name))
+	value := hex.EncodeToString(sum[:])[:24]
+
+	field := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		field = name[i+1:]
+	}
+	switch field {
+	case "certificate", "ca":
+		return "mock-certificate-" + value
+	case "private_key":
+		return "mock-private-key-" + value
+	case "public_key":
+		return "mock-public-key-" + value
+	}
+	return value
+}
+
+// variableReferences maps each variable used in a manifest's job properties
+// to where it's used. Properties are dotted paths of mapping keys; list items
+// don't add a path segment. Field suffixes such as ".certificate" are dropped
+// so references group under the variable itself.
+func variableReferences(manifest string) map[string][]VariableReference {
+	refs := make(map[string][]VariableReference)
+
+	type pathKey struct {
+		indent int
+		key    string
+	}
+	section := ""
+	group, job := "", ""
+	inProperties := false
+	var path []pathKey
+
+	for _, line := range strings.Split(manifest, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			section, _ = splitYAMLKey(trimmed)
+			continue
+		}
+		if section != "instance_groups" {
+			continue
+		}
+
+		key, value := splitYAMLKey(strings.TrimPrefix(trimmed, "- "))
+		switch {
+		case indent == 0 && key == "name":
+			group, job, inProperties = value, "", false
+			continue
+		case indent == 2 && strings.HasPrefix(trimmed, "- ") && key == "name":
+			job, inProperties = value, false
+			continue
+		case indent == 4 && key == "properties":
+			inProperties, path = true, nil
+			continue
+		case indent <= 4:
+			inProperties = false
+			continue
+		}
+		if !inProperties || job == "" {
+			continue
+		}
+
+		// List items' keys sit two columns right of the dash
+		keyIndent := indent
+		if strings.HasPrefix(trimmed, "- ") {
+			keyIndent += 2
+		}
+		for len(path) > 0 && path[len(path)-1].indent >= keyIndent {
+			path = path[:len(path)-1]
+		}
+		if value == "" {
+			path = append(path, pathKey{keyIndent, key})
+			continue
+		}
+
+		segments := make([]string, 0, len(path)+1)
+		for _, p := range path {
+			segments = append(segments, p.key)
+		}
+		property := strings.Join(append(segments, key), ".")
+		for _, match := range placeholderPattern.FindAllStringSubmatch(value, -1) {
+			name, _, _ := strings.Cut(match[1], ".")
+			refs[name] = append(refs[name], VariableReference{InstanceGroup: group, Job: job, Property: property})
+		}
+	}
+
+	return refs
+}
+
+// manifestSummary holds the top-level fields the mock reads from a manifest.
+type manifestSummary struct {
+	Name           string
+	Releases       []NameVersion
+	Stemcells      []manifestStemcell
+	InstanceGroups []manifestInstanceGroup
+	Update         manifestUpdate
+}
+
+// manifestUpdate is an update block. Unset fields are nil so per-group blocks
+// can override only some of the global settings.
+type manifestUpdate struct {
+	Canaries    *int
+	MaxInFlight *string
+	Serial      *bool
+}
+
+// set records an update block key, ignoring keys the mock doesn't model.
+func (u *manifestUpdate) set(key, value string) {
+	switch key {
+	case "canaries":
+		if n, err := strconv.Atoi(value); err == nil {
+			u.Canaries = &n
+		}
+	case "max_in_flight":
+		u.MaxInFlight = &value
+	case "serial":
+		if b, err := strconv.ParseBool(value); err == nil {
+			u.Serial = &b
+		}
+	}
+}
+
+// merge returns u with unset fields taken from defaults.
+func (u manifestUpdate) merge(defaults manifestUpdate) manifestUpdate {
+	if u.Canaries == nil {
+		u.Canaries = defaults.Canaries
+	}
+	if u.MaxInFlight == nil {
+		u.MaxInFlight = defaults.MaxInFlight
+	}
+	if u.Serial == nil {
+		u.Serial = defaults.Serial
+	}
+	return u
+}
+
+// settings resolves the block to concrete values, using the director's
+// defaults (one canary, one in flight, serial) for anything unset.
+func (u manifestUpdate) settings() UpdateSettings {
+	result := UpdateSettings{Canaries: 1, MaxInFlight: "1", Serial: true}
+	if u.Canaries != nil {
+		result.Canaries = *u.Canaries
+	}
+	if u.MaxInFlight != nil {
+		result.MaxInFlight = *u.MaxInFlight
+	}
+	if u.Serial != nil {
+		result.Serial = *u.Serial
+	}
+	return result
+}
+
+// manifestStemcell is a stemcell reference from a manifest's stemcells block.
+type manifestStemcell struct {
+	Alias   string
+	OS      string
+	Name    string
+	Version string
+}
+
+// manifestInstanceGroup is an entry from a manifest's instance_groups block.
+type manifestInstanceGroup struct {
+	Name               string
+	Instances          int
+	AZs                []string
+	VMType             string
+	Lifecycle          string
+	PersistentDiskType string
+	Jobs               []string
+	Update             manifestUpdate
+	// Text is the group's lines without blanks or comments, so any edit to
+	// the group, including its job properties, shows as a change.
+	Text string
+}
+
+// changedInstanceGroups returns the instance groups in manifest that are new
+// or differ from their definition in previous.
+func changedInstanceGroups(previous, manifest string) map[string]bool {
+	before := make(map[string]string)
+	for _, g := range parseManifest(previous).InstanceGroups {
+		before[g.Name] = g.Text
+	}
+	changed := make(map[string]bool)
+	for _, g := range parseManifest(manifest).InstanceGroups {
+		if text, ok := before[g.Name]; !ok || text != g.Text {
+			changed[g.Name] = true
+		}
+	}
+	return changed
+}
+
+// instanceGroupSummaries returns each instance group's effective update
+// settings, with per-group update blocks overriding the global one.
+func (m manifestSummary) instanceGroupSummaries() []InstanceGroupSummary {
+	result := make([]InstanceGroupSummary, 0, len(m.InstanceGroups))
+	for _, g := range m.InstanceGroups {
+		result = append(result, InstanceGroupSummary{
+			Name:   g.Name,
+			Update: g.Update.merge(m.Update).settings(),
+		})
+	}
+	return result
+}
+
+// resourceTotals sums the resources of the manifest's non-errand instances
+// using the cloud config's sizing. Unknown vm_types and disk types count as 0.
+func (m manifestSummary) resourceTotals(cloud cloudConfigSummary) ResourceTotals {
+	var totals ResourceTotals
+	for _, g := range m.InstanceGroups {
+		if g.Lifecycle == LifecycleErrand {
+			continue
+		}
+		size := cloud.VMTypes[g.VMType]
+		totals.CPU += g.Instances * size.CPU
+		totals.MemoryMB += g.Instances * size.MemoryMB
+		totals.EphemeralDiskMB += g.Instances * size.EphemeralDiskMB
+		totals.PersistentDiskMB += g.Instances * cloud.diskTypeSize(g.PersistentDiskType)
+	}
+	return totals
+}
+
+// parseManifest extracts the deployment name, releases, stemcells, and
+// instance groups from a manifest. It understands the block-style YAML BOSH
+// manifests use and is not a general YAML parser.
+func parseManifest(manifest string) manifestSummary {
+	var summary manifestSummary
+	section := ""
+	subsection := ""
+
+	for _, line := range strings.Split(manifest, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Top-level keys start a new section
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+			key, value := splitYAMLKey(trimmed)
+			section = key
+			if key == "name" {
+				summary.Name = value
+			}
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		isItem := strings.HasPrefix(trimmed, "- ")
+		key, value := splitYAMLKey(strings.TrimPrefix(trimmed, "- "))
+
+		// A new list item or a sibling key ends any nested block
+		isTopItem := isItem && indent == 0
+		isChild := isTopItem || (indent == 2 && !isItem)
+		if isChild {
+			subsection = ""
+		}
+
+		switch section {
+		case "update":
+			if isChild {
+				summary.Update.set(key, value)
+			}
+		case "releases":
+			if isTopItem {
+				summary.Releases = append(summary.Releases, NameVersion{})
+			}
+			if n := len(summary.Releases); n > 0 && isChild {
+				switch key {
+				case "name":
+					summary.Releases[n-1].Name = value
+				case "version":
+					summary.Releases[n-1].Version = value
+				}
+			}
+		case "stemcells":
+			if isTopItem {
+				summary.Stemcells = append(summary.Stemcells, manifestStemcell{})
+			}
+			if n := len(summary.Stemcells); n > 0 && isChild {
+				switch key {
+				case "alias":
+					summary.Stemcells[n-1].Alias = value
+				case "os":
+					summary.Stemcells[n-1].OS = value
+				case "name":
+					summary.Stemcells[n-1].Name = value
+				case "version":
+					summary.Stemcells[n-1].Version = value
+				}
+			}
+		case "instance_groups":
+			if isTopItem {
+				summary.InstanceGroups = append(summary.InstanceGroups, manifestInstanceGroup{Lifecycle: LifecycleService})
+			}
+			n := len(summary.InstanceGroups)
+			if n == 0 {
+				continue
+			}
+			g := &summary.InstanceGroups[n-1]
+			g.Text += strings.TrimRight(line, " \t") + "\n"
+			if isChild {
+				switch key {
+				case "name":
+					g.Name = value
+				case "instances":
+					g.Instances, _ = strconv.Atoi(value)
+				case "azs":
+					g.AZs = parseYAMLList(value)
+				case "vm_type":
+					g.VMType = value
+				case "lifecycle":
+					g.Lifecycle = value
+				case "persistent_disk_type":
+					g.PersistentDiskType = value
+				case "jobs", "update":
+					subsection = key
+				}
+				continue
+			}
+			if subsection == "update" && !isItem && indent == 4 {
+				g.Update.set(key, value)
+			}
+			// Job entries are list items nested one level under jobs
+			if subsection == "jobs" && isItem && indent == 2 && key == "name" {
+				g.Jobs = append(g.Jobs, value)
+			}
+		}
+	}
+
+	return summary
+}
+
+// parseYAMLList parses a flow-style list such as "[z1, z2]".
+func parseYAMLList(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	result := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.Trim(strings.TrimSpace(item), `"'`); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// splitYAMLKey splits "key: value" and strips surrounding quotes from value.
+func splitYAMLKey(s string) (string, string) {
+	key, value, _ := strings.Cut(s, ":")
+	value = strings.TrimSpace(value)
+	value = strings.Trim(value, `"'`)
+	return strings.TrimSpace(key), value
+}
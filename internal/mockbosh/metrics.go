@@ -0,0 +1,120 @@
+// ABOUTME: Prometheus-style counters for requests and tasks, served in the
+// ABOUTME: text exposition format at /metrics when -metrics is set.
+
+package mockbosh
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics counts requests by path and status and task state transitions.
+// A nil *Metrics counts nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int
+	tasks    map[string]int
+}
+
+type requestKey struct {
+	path   string
+	status int
+}
+
+// NewMetrics returns empty counters.
+func NewMetrics() *Metrics {
+	return &Metrics{requests: map[requestKey]int{}, tasks: map[string]int{}}
+}
+
+// SetMetrics makes the state count task state changes in m.
+func (s *State) SetMetrics(m *Metrics) {
+	s.metrics = m
+}
+
+// countRequest counts a completed request. Numeric path segments such as
+// task IDs become :id so each route has one series.
+func (m *Metrics) countRequest(path string, status int) {
+	if m == nil {
+		return
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			parts[i] = ":id"
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{strings.Join(parts, "/"), status}]++
+}
+
+// countTask counts a task entering a state.
+func (m *Metrics) countTask(state string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tasks[state]++
+}
+
+// write renders the counters and the active lock gauge.
+func (m *Metrics) write(b *strings.Builder, activeLocks int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+	b.WriteString("# HELP mockbosh_requests_total Requests served, by path and status.\n")
+	b.WriteString("# TYPE mockbosh_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "mockbosh_requests_total{path=\"%s\",status=\"%d\"} %d\n", escapeLabel(key.path), key.status, m.requests[key])
+	}
+
+	states := make([]string, 0, len(m.tasks))
+	for state := range m.tasks {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	b.WriteString("# HELP mockbosh_tasks_total Tasks entering each state.\n")
+	b.WriteString("# TYPE mockbosh_tasks_total counter\n")
+	for _, state := range states {
+		fmt.Fprintf(b, "mockbosh_tasks_total{state=\"%s\"} %d\n", escapeLabel(state), m.tasks[state])
+	}
+
+	b.WriteString("# HELP mockbosh_active_locks Deployment and task locks currently held.\n")
+	b.WriteString("# TYPE mockbosh_active_locks gauge\n")
+	fmt.Fprintf(b, "mockbosh_active_locks %d\n", activeLocks)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the text exposition format.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// handleMetrics handles GET /metrics.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var b strings.Builder
+	s.metrics.write(&b, len(s.state.GetLocks()))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
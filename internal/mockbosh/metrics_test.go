@@ -0,0 +1,73 @@
+// ABOUTME: Tests for the /metrics endpoint.
+// ABOUTME: Verifies request and task counters and that -metrics gates it.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	config.Metrics = true
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.loggingMiddleware(server.authMiddleware(mux))
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	scrape := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d without credentials, got %d", http.StatusOK, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	do(http.MethodGet, "/info")
+	if body := scrape(); !strings.Contains(body, `mockbosh_requests_total{path="/info",status="200"} 1`+"\n") {
+		t.Errorf("Expected one /info request, got:\n%s", body)
+	}
+	do(http.MethodGet, "/info")
+	do(http.MethodGet, "/tasks/999999")
+	do(http.MethodPut, "/deployments/redis/jobs/redis?state=restart")
+
+	body := scrape()
+	for _, want := range []string{
+		`mockbosh_requests_total{path="/info",status="200"} 2`,
+		`mockbosh_requests_total{path="/tasks/:id",status="404"} 1`,
+		`mockbosh_requests_total{path="/metrics",status="200"} 1`,
+		`mockbosh_tasks_total{state="queued"} 1`,
+		"# TYPE mockbosh_requests_total counter",
+		"# TYPE mockbosh_active_locks gauge",
+		"mockbosh_active_locks ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in:\n%s", want, body)
+		}
+	}
+
+	server, _ = NewServer(DefaultServerConfig())
+	mux = http.NewServeMux()
+	server.registerRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected /metrics off by default, got %d", w.Code)
+	}
+}
@@ -0,0 +1,63 @@
+// ABOUTME: Instance naming conventions for display names in responses and tasks.
+// ABOUTME: Older directors name instances job/index; newer ones use job/id.
+
+package mockbosh
+
+import "fmt"
+
+// InstanceNaming selects how instances are identified in display names.
+type InstanceNaming string
+
+// Supported instance naming conventions.
+const (
+	InstanceNamingID    InstanceNaming = "id"
+	InstanceNamingIndex InstanceNaming = "index"
+)
+
+// ParseInstanceNaming validates a naming convention, defaulting "" to id.
+func ParseInstanceNaming(s string) (InstanceNaming, error) {
+	switch InstanceNaming(s) {
+	case "", InstanceNamingID:
+		return InstanceNamingID, nil
+	case InstanceNamingIndex:
+		return InstanceNamingIndex, nil
+	}
+	return "", fmt.Errorf("unknown instance naming %q (want id or index)", s)
+}
+
+// instanceName returns the canonical name of an instance, job/id or
+// job/index depending on the convention.
+func (n InstanceNaming) instanceName(job, id string, index int) string {
+	if n == InstanceNamingIndex {
+		return fmt.Sprintf("%s/%d", job, index)
+	}
+	return fmt.Sprintf("%s/%s", job, id)
+}
+
+// taskName returns the name task events and problems use for an instance.
+// The id convention appends the index the way newer directors do.
+func (n InstanceNaming) taskName(job, id string, index int) string {
+	if n == InstanceNamingIndex {
+		return n.instanceName(job, id, index)
+	}
+	return fmt.Sprintf("%s (%d)", n.instanceName(job, id, index), index)
+}
+
+// SetInstanceNaming sets the convention used for instance display names.
+func (s *State) SetInstanceNaming(n InstanceNaming) {
+	s.naming = n
+}
+
+// InstanceName returns the canonical name of a deployment's instance,
+// falling back to job/id if the instance is unknown.
+func (s *State) InstanceName(deployment, job, id string) string {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Job == job && inst.ID == id {
+			return s.naming.instanceName(job, id, inst.Index)
+		}
+	}
+	return fmt.Sprintf("%s/%s", job, id)
+}
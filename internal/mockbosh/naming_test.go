@@ -0,0 +1,79 @@
+// ABOUTME: Tests for instance naming conventions.
+// ABOUTME: Verifies job/id and job/index names in task descriptions and events.
+
+package mockbosh
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInstanceNamingConvention(t *testing.T) {
+	tests := []struct {
+		naming      string
+		description string
+		eventName   string
+	}{
+		{"id", "migrate instance diego_cell/cf-dc1-id to az z3", "diego_cell/cf-dc1-id"},
+		{"index", "migrate instance diego_cell/1 to az z3", "diego_cell/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.naming, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.Speed = 10.0
+			config.InstanceNaming = tt.naming
+			server, err := NewServer(config)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			mux := http.NewServeMux()
+			server.registerRoutes(mux)
+
+			req := httptest.NewRequest(http.MethodPut, "/deployments/cf/instance_groups/diego_cell/cf-dc1-id/migrate?az=z3", nil)
+			req.SetBasicAuth("admin", "admin")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != http.StatusFound {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+			}
+			var taskID int
+			fmt.Sscanf(w.Header().Get("Location"), "/tasks/%d", &taskID)
+			task := waitForTask(t, server.state, taskID, 5*time.Second)
+			if task.Description != tt.description {
+				t.Errorf("Expected description %q, got %q", tt.description, task.Description)
+			}
+
+			found := false
+			for _, e := range server.state.GetTaskEvents(taskID, 0) {
+				if e.Stage == "Updating instance" {
+					found = true
+					if e.Task != tt.eventName {
+						t.Errorf("Expected event task %q, got %q", tt.eventName, e.Task)
+					}
+				}
+			}
+			if !found {
+				t.Error("Expected Updating instance events")
+			}
+
+			names := server.state.InstanceTaskNames("cf", "diego_cell", "1")
+			want := "diego_cell/cf-dc1-id (1)"
+			if tt.naming == "index" {
+				want = "diego_cell/1"
+			}
+			if len(names) != 1 || names[0] != want {
+				t.Errorf("Expected instance names [%s], got %v", want, names)
+			}
+		})
+	}
+
+	config := DefaultServerConfig()
+	config.InstanceNaming = "uuid"
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected an error for an unknown naming convention")
+	}
+}
@@ -0,0 +1,126 @@
+// ABOUTME: Forced task outcomes: scripted scenarios make an in-flight task end
+// ABOUTME: with a chosen state and result instead of the simulated one.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TaskOutcomeRequest is the body of POST /admin/tasks/:id/outcome. After is a
+// duration such as "2s" from now, not scaled by -speed.
+type TaskOutcomeRequest struct {
+	State  string `json:"state"`
+	Result string `json:"result"`
+	After  string `json:"after,omitempty"`
+}
+
+// SetTaskOutcome makes an in-flight task end in state with result once after
+// passes. Until then the simulator carries on with the task's steps but
+// doesn't end it, so the forced outcome is the one clients see. The outcome is
+// dropped once applied, or if the task is deleted or ends some other way.
+func (ts *TaskSimulator) SetTaskOutcome(taskID int, state, result string, after time.Duration) error {
+	task, err := ts.state.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	if isTerminalTaskState(task.State) {
+		return fmt.Errorf("task %d is already %s", taskID, task.State)
+	}
+
+	ts.outcomeMu.Lock()
+	if ts.outcomes == nil {
+		ts.outcomes = make(map[int]bool)
+	}
+	ts.outcomes[taskID] = true
+	ts.outcomeMu.Unlock()
+
+	gen := ts.currentGeneration()
+	time.AfterFunc(after, func() {
+		ts.apply(gen, func() {
+			ts.outcomeMu.Lock()
+			defer ts.outcomeMu.Unlock()
+			if !ts.outcomes[taskID] {
+				return
+			}
+			delete(ts.outcomes, taskID)
+
+			task, err := ts.state.GetTask(taskID)
+			if err != nil || isTerminalTaskState(task.State) {
+				return
+			}
+			ts.state.UpdateTaskState(taskID, state, result)
+			ts.log("Task %d: Forced %s", taskID, state)
+		})
+	})
+	return nil
+}
+
+// dropOutcome forgets a task's forced outcome, if it has one.
+func (ts *TaskSimulator) dropOutcome(taskID int) {
+	ts.outcomeMu.Lock()
+	defer ts.outcomeMu.Unlock()
+	delete(ts.outcomes, taskID)
+}
+
+// finish ends a task with the simulator's own outcome and releases the
+// deployment lock, unless a forced outcome will end it instead or already
+// has. A task cancelled before it finishes successfully ends cancelled. It
+// returns the state the task ended in, or "" if finish left it alone.
+// Callers must be running under applyTask.
+func (ts *TaskSimulator) finish(taskID int, deployment, state, result string) string {
+	ts.outcomeMu.Lock()
+	defer ts.outcomeMu.Unlock()
+	if ts.outcomes[taskID] {
+		return ""
+	}
+	if task, err := ts.state.GetTask(taskID); err != nil || isTerminalTaskState(task.State) {
+		return ""
+	}
+	if state == "done" {
+		state, _ = ts.state.CompleteTask(taskID, result)
+		return state
+	}
+	ts.state.UpdateTaskState(taskID, state, result)
+	return state
+}
+
+// HandleTaskOutcome handles POST /admin/tasks/:id/outcome.
+func (h *Handlers) HandleTaskOutcome(w http.ResponseWriter, r *http.Request, taskID int) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req TaskOutcomeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid outcome request")
+		return
+	}
+	if req.State != "done" && req.State != "error" && req.State != "cancelled" {
+		writeError(w, http.StatusBadRequest, "state must be done, error, or cancelled")
+		return
+	}
+	var after time.Duration
+	if req.After != "" {
+		var err error
+		after, err = time.ParseDuration(req.After)
+		if err != nil || after < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid after duration: %s", req.After))
+			return
+		}
+	}
+
+	if !h.state.HasTask(taskID) {
+		writeErrorCode(w, ErrCodeTaskNotFound, fmt.Sprintf("task %d not found", taskID))
+		return
+	}
+	if err := h.simulator.SetTaskOutcome(taskID, req.State, req.Result, after); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, req)
+}
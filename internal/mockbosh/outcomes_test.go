@@ -0,0 +1,92 @@
+// ABOUTME: Tests for forced task outcomes.
+// ABOUTME: Verifies overrides before and after the simulated work, cleanup, and validation.
+
+package mockbosh
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskOutcome(t *testing.T) {
+	handlers := setupTestHandlers()
+
+	force := func(taskID int, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/tasks/1/outcome", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handlers.HandleTaskOutcome(w, req, taskID)
+		return w.Code
+	}
+	recreate := func(deployment string) *Task {
+		task := handlers.state.CreateTask("recreate deployment "+deployment, deployment, "admin")
+		handlers.simulator.ExecuteRecreate(task.ID, deployment, "", "")
+		return task
+	}
+
+	// Forced before the simulated work ends: the task stops there
+	handlers.simulator.SetTaskDurations(TaskDurations{"recreate": 10 * time.Second})
+	task := recreate("redis")
+	if code := force(task.ID, `{"state":"error","result":"custom message","after":"100ms"}`); code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+	}
+	got := waitForTask(t, handlers.state, task.ID, 2*time.Second)
+	if got.State != "error" || got.Result != "custom message" {
+		t.Fatalf("Expected the forced error, got %s: %s", got.State, got.Result)
+	}
+	if handlers.state.IsLocked("redis") {
+		t.Error("Expected the forced outcome to release the deployment lock")
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if got, _ := handlers.state.GetTask(task.ID); got.State != "error" {
+		t.Errorf("Expected the simulator to leave the forced outcome alone, got %s", got.State)
+	}
+
+	// Forced after the simulated work ends: the task waits for it
+	handlers.simulator.SetTaskDurations(TaskDurations{"recreate": time.Second})
+	task = recreate("mysql")
+	if code := force(task.ID, `{"state":"done","result":"scripted","after":"800ms"}`); code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if got, _ := handlers.state.GetTask(task.ID); isTerminalTaskState(got.State) {
+		t.Errorf("Expected the task to wait for its forced outcome, got %s", got.State)
+	}
+	if got := waitForTask(t, handlers.state, task.ID, 2*time.Second); got.State != "done" || got.Result != "scripted" {
+		t.Errorf("Expected the forced result, got %s: %s", got.State, got.Result)
+	}
+
+	// Applied outcomes are forgotten, as are those of deleted tasks
+	task = recreate("cf")
+	if code := force(task.ID, `{"state":"error","after":"1h"}`); code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+	}
+	if err := handlers.simulator.DeleteTask(task.ID); err != nil {
+		t.Fatalf("DeleteTask failed: %v", err)
+	}
+	handlers.simulator.outcomeMu.Lock()
+	remaining := len(handlers.simulator.outcomes)
+	handlers.simulator.outcomeMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected no forced outcomes left, got %d", remaining)
+	}
+
+	tests := []struct {
+		taskID int
+		body   string
+		want   int
+	}{
+		{1, `{"state":"error"}`, http.StatusConflict},
+		{9999, `{"state":"error"}`, http.StatusNotFound},
+		{1, `{"state":"processing"}`, http.StatusBadRequest},
+		{1, `{"state":"error","after":"soon"}`, http.StatusBadRequest},
+		{1, `nope`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code := force(tt.taskID, tt.body); code != tt.want {
+			t.Errorf("Task %d with %s: expected status %d, got %d", tt.taskID, tt.body, tt.want, code)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// ABOUTME: Cloud check problems for the mock BOSH Director.
+// ABOUTME: Detects unresponsive agents and missing VMs and applies `bosh cck`
+// ABOUTME: resolutions.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ProcessStateUnresponsive is the process state of a VM whose agent has
+// stopped responding.
+const ProcessStateUnresponsive = "unresponsive agent"
+
+// Problem types reported by cloud check.
+const (
+	ProblemUnresponsiveAgent = "unresponsive_agent"
+	ProblemMissingVM         = "missing_vm"
+)
+
+// Problem resolutions, by the names `bosh cck` submits.
+const (
+	ResolutionIgnore            = "ignore"
+	ResolutionRebootVM          = "reboot_vm"
+	ResolutionRecreateVM        = "recreate_vm"
+	ResolutionDeleteVMReference = "delete_vm_reference"
+)
+
+// unresponsiveAgentResolutions are the resolutions offered for an
+// unresponsive agent, in the order the director lists them.
+var unresponsiveAgentResolutions = []ProblemResolution{
+	{Name: ResolutionIgnore, Plan: "Skip for now"},
+	{Name: ResolutionRebootVM, Plan: "Reboot VM"},
+	{Name: ResolutionRecreateVM, Plan: "Recreate VM without waiting for processes to start"},
+	{Name: ResolutionDeleteVMReference, Plan: "Delete VM reference"},
+}
+
+// missingVMResolutions are the resolutions offered for an instance whose VM
+// is gone.
+var missingVMResolutions = []ProblemResolution{
+	{Name: ResolutionIgnore, Plan: "Skip for now"},
+	{Name: ResolutionRecreateVM, Plan: "Recreate VM without waiting for processes to start"},
+	{Name: ResolutionDeleteVMReference, Plan: "Delete VM reference"},
+}
+
+// SetAgentUnresponsive marks an instance's agent as no longer responding, as
+// if its VM had hung.
+func (s *State) SetAgentUnresponsive(deployment, job, id string) error {
+	return s.setResponsiveness(deployment, fmt.Sprintf("%s/%s", job, id), func(vm VM) bool {
+		return vm.Job == job && vm.ID == id
+	}, false)
+}
+
+// SetInstanceResponsiveness marks the agent of the instance at job/index as
+// unresponsive, or restores it. Restored instances report running, or
+// stopped if their VM was stopped.
+func (s *State) SetInstanceResponsiveness(deployment, job, index string, responsive bool) error {
+	return s.setResponsiveness(deployment, fmt.Sprintf("%s/%s", job, index), func(vm VM) bool {
+		return vm.Job == job && strconv.Itoa(vm.Index) == index
+	}, responsive)
+}
+
+// setResponsiveness applies a responsiveness change to the VMs matching
+// match and their instances. Instance names the target in errors.
+func (s *State) setResponsiveness(deployment, instance string, match func(VM) bool, responsive bool) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	changed := make(map[string]string)
+	vms := s.data.VMs[deployment]
+	for i := range vms {
+		if !match(vms[i]) || vms[i].VMCID == "" {
+			continue
+		}
+		state := ProcessStateUnresponsive
+		if responsive {
+			state = "running"
+			if vms[i].State == "stopped" {
+				state = "stopped"
+			}
+		}
+		vms[i].ProcessState = state
+		changed[vms[i].ID] = state
+	}
+	if len(changed) == 0 {
+		return fmt.Errorf("no VM for instance '%s'", instance)
+	}
+
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		state, ok := changed[instances[i].ID]
+		if !ok {
+			continue
+		}
+		instances[i].State = state
+		processState := state
+		if !responsive {
+			processState = "unknown"
+		}
+		instances[i].Processes = processesInState(instances[i].Processes, processState)
+	}
+	return nil
+}
+
+// GetProblems returns a deployment's cloud check problems. Problem IDs are
+// stable while the underlying VMs are unchanged.
+func (s *State) GetProblems(deployment string) ([]Problem, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	return s.problems(deployment), nil
+}
+
+// problems lists a deployment's problems: unresponsive agents, numbered by
+// VM, then instances expecting a VM that has none, numbered after the VMs.
+// Callers must hold the state lock.
+func (s *State) problems(deployment string) []Problem {
+	result := make([]Problem, 0)
+	vms := s.data.VMs[deployment]
+	for i, vm := range vms {
+		if vm.ProcessState != ProcessStateUnresponsive {
+			continue
+		}
+		result = append(result, Problem{
+			ID:   i + 1,
+			Type: ProblemUnresponsiveAgent,
+			Description: fmt.Sprintf("VM for '%s' with cloud ID '%s' is not responding.",
+				s.naming.taskName(vm.Job, vm.ID, vm.Index), vm.VMCID),
+			Data:          map[string]string{"agent_id": vm.AgentID, "vm_cid": vm.VMCID},
+			Resolutions:   unresponsiveAgentResolutions,
+			InstanceGroup: vm.Job,
+			InstanceID:    vm.ID,
+		})
+	}
+	for j, inst := range s.data.Instances[deployment] {
+		if !inst.Expects || inst.VMCID != "" || inst.Lifecycle == LifecycleErrand {
+			continue
+		}
+		result = append(result, Problem{
+			ID:   len(vms) + j + 1,
+			Type: ProblemMissingVM,
+			Description: fmt.Sprintf("VM for '%s' missing.",
+				s.naming.taskName(inst.Job, inst.ID, inst.Index)),
+			Data:          map[string]string{"instance_id": inst.ID},
+			Resolutions:   missingVMResolutions,
+			InstanceGroup: inst.Job,
+			InstanceID:    inst.ID,
+		})
+	}
+	return result
+}
+
+// ValidateResolutions checks that each problem ID exists and each resolution
+// is one offered for it.
+func (s *State) ValidateResolutions(deployment string, resolutions map[int]string) error {
+	problems, err := s.GetProblems(deployment)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int]Problem, len(problems))
+	for _, p := range problems {
+		byID[p.ID] = p
+	}
+	for id, resolution := range resolutions {
+		p, ok := byID[id]
+		if !ok {
+			return fmt.Errorf("problem %d not found", id)
+		}
+		if !offersResolution(p, resolution) {
+			return fmt.Errorf("resolution '%s' is not valid for problem %d", resolution, id)
+		}
+	}
+	return nil
+}
+
+// offersResolution reports whether resolution is one of p's resolutions.
+func offersResolution(p Problem, resolution string) bool {
+	for _, r := range p.Resolutions {
+		if r.Name == resolution {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveProblem applies a resolution to one problem found earlier. Problem
+// IDs shift as other problems are resolved, so it's matched by type and
+// instance; a problem that no longer exists is skipped.
+func (s *State) ResolveProblem(deployment string, p Problem, resolution string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	s.resolveProblem(deployment, p, resolution)
+	return nil
+}
+
+// resolveProblem dispatches a resolution by problem type. Callers must hold
+// the state lock.
+func (s *State) resolveProblem(deployment string, p Problem, resolution string) {
+	switch p.Type {
+	case ProblemUnresponsiveAgent:
+		s.resolveUnresponsiveAgent(deployment, p.InstanceID, resolution)
+	case ProblemMissingVM:
+		s.resolveMissingVM(deployment, p.InstanceID, resolution)
+	}
+}
+
+// resolveUnresponsiveAgent applies a resolution to the VM with an
+// unresponsive agent for instance id. Callers must hold the state lock.
+func (s *State) resolveUnresponsiveAgent(deployment, id, resolution string) {
+	vms := s.data.VMs[deployment]
+	for i := range vms {
+		vm := &vms[i]
+		if vm.ID != id || vm.ProcessState != ProcessStateUnresponsive {
+			continue
+		}
+
+		switch resolution {
+		case ResolutionRebootVM:
+			vm.ProcessState = "running"
+		case ResolutionRecreateVM:
+			vm.ProcessState = "running"
+			vm.VMCID = newVMCID()
+			vm.AgentID = nextAgentID(deployment, vm.Job, vm.Index, vm.AgentID)
+		case ResolutionDeleteVMReference:
+			vm.ProcessState = ""
+			vm.VMCID = ""
+		default:
+			return
+		}
+
+		instances := s.data.Instances[deployment]
+		for j := range instances {
+			if instances[j].ID != vm.ID {
+				continue
+			}
+			instances[j].VMCID = vm.VMCID
+			instances[j].AgentID = vm.AgentID
+			if vm.ProcessState == "running" {
+				instances[j].State = "running"
+				instances[j].Processes = processesInState(instances[j].Processes, "running")
+			}
+		}
+		return
+	}
+}
+
+// resolveMissingVM applies a resolution to instance id, which expects a VM
+// it doesn't have. Recreating gives it a new VM; deleting the reference
+// stops it expecting one. Callers must hold the state lock.
+func (s *State) resolveMissingVM(deployment, id, resolution string) {
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		inst := &instances[i]
+		if inst.ID != id {
+			continue
+		}
+
+		switch resolution {
+		case ResolutionRecreateVM:
+			inst.VMCID = newVMCID()
+			inst.AgentID = nextAgentID(deployment, inst.Job, inst.Index, inst.AgentID)
+			inst.State = "running"
+			inst.Processes = processesInState(inst.Processes, "running")
+			vm := VM{
+				Deployment: deployment,
+				Job:        inst.Job,
+				Index:      inst.Index,
+				ID:         inst.ID,
+				AZ:         inst.AZ,
+				Bootstrap:  inst.Bootstrap,
+				IPs:        append([]string{}, inst.IPs...),
+				VMType:     inst.VMType,
+				Lifecycle:  inst.Lifecycle,
+				Jobs:       inst.Jobs,
+			}
+			vms := s.data.VMs[deployment]
+			existing := -1
+			for j := range vms {
+				if vms[j].ID == id {
+					vm = vms[j]
+					existing = j
+				}
+			}
+			vm.VMCID = inst.VMCID
+			vm.AgentID = inst.AgentID
+			vm.State = "started"
+			vm.ProcessState = "running"
+			vm.Active = true
+			if existing >= 0 {
+				vms[existing] = vm
+			} else {
+				s.data.VMs[deployment] = append(vms, vm)
+			}
+		case ResolutionDeleteVMReference:
+			inst.Expects = false
+		}
+		return
+	}
+}
+
+// ScanProblems returns a deployment's problems as found by a scan, for the
+// scan task's result.
+func (s *State) ScanProblems(deployment string) (string, error) {
+	problems, err := s.GetProblems(deployment)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(problems)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// unresponsiveAgentError returns the error a director reports when an
+// operation touches a VM whose agent doesn't respond, or nil. An empty job
+// checks the whole deployment. Callers must hold the state lock.
+func (s *State) unresponsiveAgentError(deployment, job string) error {
+	for _, vm := range s.data.VMs[deployment] {
+		if job != "" && vm.Job != job {
+			continue
+		}
+		if vm.ProcessState == ProcessStateUnresponsive {
+			return fmt.Errorf("Timed out pinging to %s after 600 seconds", vm.AgentID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// ABOUTME: Task queue tracking for the simulator's concurrency limit.
+// ABOUTME: Records which tasks wait for a slot, in order, and which hold one.
+
+package mockbosh
+
+// EnqueueTask adds a task to the back of the queue of tasks waiting to run.
+func (s *State) EnqueueTask(id int) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	s.data.taskQueue = append(s.data.taskQueue, id)
+}
+
+// StartQueuedTask moves a task from the queue to the running set if it is
+// at the front and fewer than limit tasks are running. It reports whether
+// the task may start.
+func (s *State) StartQueuedTask(id, limit int) bool {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if len(s.data.taskQueue) == 0 || s.data.taskQueue[0] != id || len(s.data.runningTasks) >= limit {
+		return false
+	}
+	s.data.taskQueue = s.data.taskQueue[1:]
+	if s.data.runningTasks == nil {
+		s.data.runningTasks = make(map[int]bool)
+	}
+	s.data.runningTasks[id] = true
+	return true
+}
+
+// FinishQueuedTask drops a task from the queue and frees its slot.
+func (s *State) FinishQueuedTask(id int) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	s.data.dequeueTask(id)
+}
+
+// dequeueTask removes a task from the queue and running set. Callers must
+// hold the state lock.
+func (d *StateData) dequeueTask(id int) {
+	for i, queued := range d.taskQueue {
+		if queued == id {
+			d.taskQueue = append(d.taskQueue[:i:i], d.taskQueue[i+1:]...)
+			break
+		}
+	}
+	delete(d.runningTasks, id)
+}
+
+// queuePosition returns a task's 1-based place in the queue, or 0 if it is
+// not waiting. Callers must hold the state lock.
+func (d *StateData) queuePosition(id int) int {
+	for i, queued := range d.taskQueue {
+		if queued == id {
+			return i + 1
+		}
+	}
+	return 0
+}
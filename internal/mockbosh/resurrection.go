@@ -0,0 +1,161 @@
+// ABOUTME: Resurrection: the health monitor recreating instances whose agents
+// ABOUTME: stop responding, unless paused globally or per deployment.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// resurrectionDelay is how long, before scaling, an agent stays
+// unresponsive before the health monitor recreates its VM.
+const resurrectionDelay = 60 * time.Second
+
+// resurrectorUser runs the scan and fix tasks resurrection starts.
+const resurrectorUser = "health_monitor"
+
+// ResurrectionConfig is the body of PUT /resurrection.
+type ResurrectionConfig struct {
+	ResurrectionPaused *bool `json:"resurrection_paused"`
+}
+
+// SetResurrection pauses or resumes resurrection.
+func (s *State) SetResurrection(paused bool) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+	s.data.ResurrectionPaused = paused
+}
+
+// ResurrectionPaused reports whether resurrection is paused.
+func (s *State) ResurrectionPaused() bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+	return s.data.ResurrectionPaused
+}
+
+// SetDeploymentResurrection pauses or resumes resurrection for one
+// deployment.
+func (s *State) SetDeploymentResurrection(deployment string, paused bool) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	d, ok := s.data.Deployments[deployment]
+	if !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	d.ResurrectionPaused = paused
+	return nil
+}
+
+// DeploymentResurrectionPaused reports whether resurrection is paused for a
+// deployment, either globally or for the deployment itself.
+func (s *State) DeploymentResurrectionPaused(deployment string) bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if s.data.ResurrectionPaused {
+		return true
+	}
+	d, ok := s.data.Deployments[deployment]
+	return ok && d.ResurrectionPaused
+}
+
+// resurrectionResolutions returns a recreate_vm resolution for each
+// unresponsive VM at job/index, keyed by problem ID.
+func (s *State) resurrectionResolutions(deployment, job, index string) map[int]string {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	resolutions := make(map[int]string)
+	for i, vm := range s.data.VMs[deployment] {
+		if vm.Job == job && strconv.Itoa(vm.Index) == index && vm.ProcessState == ProcessStateUnresponsive {
+			resolutions[i+1] = ResolutionRecreateVM
+		}
+	}
+	return resolutions
+}
+
+// Resurrect watches an instance made unresponsive. Once the scaled
+// resurrection delay passes, if resurrection isn't paused for its deployment
+// and the agent still doesn't respond, it starts a scan and fix task that
+// recreates the VM. While the deployment is locked it waits another delay.
+func (ts *TaskSimulator) Resurrect(deployment, job, index string) {
+	gen := ts.currentGeneration()
+	go func() {
+		for {
+			time.Sleep(ts.scaledDuration(resurrectionDelay))
+
+			var task *Task
+			var resolutions map[int]string
+			locked := false
+			if !ts.apply(gen, func() {
+				if ts.state.DeploymentResurrectionPaused(deployment) {
+					return
+				}
+				resolutions = ts.state.resurrectionResolutions(deployment, job, index)
+				if len(resolutions) == 0 {
+					return
+				}
+				var err error
+				task, err = ts.state.CreateLockedInternalTask("scan and fix", deployment, resurrectorUser)
+				locked = err != nil
+			}) {
+				return
+			}
+			if locked {
+				continue
+			}
+			if task != nil {
+				ts.log("Task %d: Resurrecting %s/%s/%s", task.ID, deployment, job, index)
+				ts.ExecuteResolveProblems(task.ID, deployment, resolutions)
+			}
+			return
+		}
+	}()
+}
+
+// HandleResurrection handles PUT /resurrection.
+func (h *Handlers) HandleResurrection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req ResurrectionConfig
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResurrectionPaused == nil {
+		writeError(w, http.StatusBadRequest, "resurrection_paused is required")
+		return
+	}
+
+	h.state.SetResurrection(*req.ResurrectionPaused)
+	writeJSON(w, http.StatusOK, req)
+}
+
+// HandleDeploymentResurrection handles PUT /deployments/:name/resurrection.
+func (h *Handlers) HandleDeploymentResurrection(w http.ResponseWriter, r *http.Request, deployment string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !h.state.HasDeployment(deployment) {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, fmt.Sprintf("deployment '%s' not found", deployment))
+		return
+	}
+
+	var req ResurrectionConfig
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResurrectionPaused == nil {
+		writeError(w, http.StatusBadRequest, "resurrection_paused is required")
+		return
+	}
+
+	if err := h.state.SetDeploymentResurrection(deployment, *req.ResurrectionPaused); err != nil {
+		writeErrorCode(w, ErrCodeDeploymentNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,177 @@
+// ABOUTME: Tests for resurrection.
+// ABOUTME: Verifies the toggle, /info, and recreation of unresponsive instances.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResurrectionToggle(t *testing.T) {
+	config := DefaultServerConfig()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	put := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/resurrection", strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	infoPaused := func() interface{} {
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var info map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &info)
+		return info["resurrection_paused"]
+	}
+
+	if paused := infoPaused(); paused != false {
+		t.Errorf("Expected resurrection enabled by default, got %v", paused)
+	}
+	if code := put(`{"resurrection_paused":true}`); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if !server.state.ResurrectionPaused() || infoPaused() != true {
+		t.Error("Expected resurrection paused")
+	}
+	if code := put(`{"resurrection_paused":false}`); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if server.state.ResurrectionPaused() {
+		t.Error("Expected resurrection resumed")
+	}
+
+	for _, body := range []string{"", "{}", "nope"} {
+		if code := put(body); code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %q, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+}
+
+func TestResurrectionRecreatesUnresponsiveInstance(t *testing.T) {
+	state := NewState()
+	handlers := NewHandlers(state, NewTaskSimulator(state, 200.0, false), "admin", "admin")
+
+	makeUnresponsive := func(index string) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/instances/cf/router/"+index+"/unresponsive", nil)
+		w := httptest.NewRecorder()
+		handlers.HandleInstanceResponsiveness(w, req, "cf", "router", index, false)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+	}
+	routerVM := func(index int) VM {
+		vms, _ := state.GetVMs("cf")
+		for _, vm := range vms {
+			if vm.Job == "router" && vm.Index == index {
+				return vm
+			}
+		}
+		t.Fatalf("router/%d not found", index)
+		return VM{}
+	}
+
+	// Paused: the agent stays unresponsive and no task starts
+	state.SetResurrection(true)
+	makeUnresponsive("1")
+	time.Sleep(600 * time.Millisecond)
+	if vm := routerVM(1); vm.ProcessState != ProcessStateUnresponsive {
+		t.Errorf("Expected router/1 left unresponsive while paused, got %q", vm.ProcessState)
+	}
+	if tasks := state.GetTasks("", "", "", 2, 0); tasks[0].ID != 10 {
+		t.Errorf("Expected no task while paused, got task %d %q", tasks[0].ID, tasks[0].Description)
+	}
+
+	state.SetResurrection(false)
+	before := routerVM(0).VMCID
+	makeUnresponsive("0")
+
+	var task *Task
+	deadline := time.Now().Add(3 * time.Second)
+	for task == nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		if got, err := state.GetTask(101); err == nil {
+			task = got
+		}
+	}
+	if task == nil {
+		t.Fatal("Expected a scan and fix task")
+	}
+	if task.Description != "scan and fix" || task.User != resurrectorUser || task.Verbose != 2 {
+		t.Errorf("Unexpected resurrection task %+v", task)
+	}
+	if task = waitForTask(t, state, task.ID, 2*time.Second); task.State != "done" {
+		t.Fatalf("Expected task done, got %s: %s", task.State, task.Result)
+	}
+	if vm := routerVM(0); vm.ProcessState != "running" || vm.VMCID == before {
+		t.Errorf("Expected router/0 recreated and running, got %q on %s", vm.ProcessState, vm.VMCID)
+	}
+	if vm := routerVM(1); vm.ProcessState != ProcessStateUnresponsive {
+		t.Errorf("Expected router/1 untouched, got %q", vm.ProcessState)
+	}
+}
+
+func TestDeploymentResurrection(t *testing.T) {
+	config := DefaultServerConfig()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	manifestPaused := func(deployment string) bool {
+		var m DeploymentManifest
+		json.Unmarshal(do(http.MethodGet, "/deployments/"+deployment, "").Body.Bytes(), &m)
+		return m.ResurrectionPaused
+	}
+
+	if w := do(http.MethodPut, "/deployments/cf/resurrection", `{"resurrection_paused":true}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !manifestPaused("cf") || manifestPaused("redis") {
+		t.Error("Expected only cf paused in the deployment response")
+	}
+	if w := do(http.MethodPut, "/deployments/nope/resurrection", `{"resurrection_paused":true}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown deployment, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := do(http.MethodPut, "/deployments/cf/resurrection", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without resurrection_paused, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	state := server.state
+	tests := []struct {
+		global, deployment, want bool
+	}{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+		{true, true, true},
+	}
+	for _, tt := range tests {
+		state.SetResurrection(tt.global)
+		state.SetDeploymentResurrection("redis", tt.deployment)
+		if got := state.DeploymentResurrectionPaused("redis"); got != tt.want {
+			t.Errorf("global %v, deployment %v: expected paused %v, got %v", tt.global, tt.deployment, tt.want, got)
+		}
+	}
+}
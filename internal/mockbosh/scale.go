@@ -0,0 +1,149 @@
+// ABOUTME: Grows or shrinks an instance group's VMs and instances in place,
+// ABOUTME: for testing dashboards against changing instance counts.
+
+package mockbosh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScaleJob makes a deployment's job run exactly count instances, indexed 0
+// through count-1. Missing indices get a new VM and instance modeled on the
+// job's highest-indexed instance, spread across its AZs with IPs from the
+// cloud config; indices at or above count are removed.
+func (s *State) ScaleJob(deployment, job string, count int) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	if count < 0 {
+		return fmt.Errorf("instances must not be negative, got %d", count)
+	}
+
+	var template *Instance
+	var azs []string
+	hasInstance := make(map[int]bool)
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Job != job {
+			continue
+		}
+		if template == nil || inst.Index > template.Index {
+			inst := inst
+			template = &inst
+		}
+		if inst.AZ != "" && !containsString(azs, inst.AZ) {
+			azs = append(azs, inst.AZ)
+		}
+		hasInstance[inst.Index] = true
+	}
+	if template == nil {
+		return fmt.Errorf("job '%s' not found in deployment '%s'", job, deployment)
+	}
+	if template.Lifecycle == LifecycleErrand {
+		return fmt.Errorf("job '%s' is an errand and cannot be scaled", job)
+	}
+	if len(azs) == 0 {
+		azs = []string{""}
+	}
+
+	vmByIndex := make(map[int]VM)
+	for _, vm := range s.data.VMs[deployment] {
+		if vm.Job == job {
+			vmByIndex[vm.Index] = vm
+		}
+	}
+
+	var cloud cloudConfigSummary
+	if n := len(s.data.CloudConfigs); n > 0 {
+		cloud = parseCloudConfig(s.data.CloudConfigs[n-1].Properties)
+	}
+	used := s.usedIPs()
+	slug := strings.ReplaceAll(job, "_", "-")
+
+	vms := s.data.VMs[deployment]
+	instances := s.data.Instances[deployment]
+	for index := 0; index < count; index++ {
+		vm, ok := vmByIndex[index]
+		if !ok {
+			az := azs[index%len(azs)]
+			ip := allocateIP(cloud, az, used)
+			vm = VM{
+				VMCID:        newVMCID(),
+				Active:       true,
+				AgentID:      agentID(deployment, job, index, 0),
+				AZ:           az,
+				Bootstrap:    index == 0,
+				Deployment:   deployment,
+				IPs:          []string{ip},
+				Job:          job,
+				Index:        index,
+				ID:           fmt.Sprintf("%s-%s-%d-id", deployment, slug, index),
+				ProcessState: "running",
+				State:        "started",
+				VMType:       template.VMType,
+				Lifecycle:    template.Lifecycle,
+				Jobs:         template.Jobs,
+			}
+			vms = append(vms, vm)
+		}
+		if hasInstance[index] {
+			continue
+		}
+		inst := Instance{
+			AgentID:    vm.AgentID,
+			AZ:         vm.AZ,
+			Bootstrap:  vm.Bootstrap,
+			Deployment: deployment,
+			Expects:    true,
+			ID:         vm.ID,
+			IPs:        append([]string{}, vm.IPs...),
+			Job:        job,
+			Index:      index,
+			State:      "running",
+			VMType:     vm.VMType,
+			VMCID:      vm.VMCID,
+			Processes:  processesInState(template.Processes, "running"),
+			Lifecycle:  template.Lifecycle,
+			Jobs:       template.Jobs,
+		}
+		if template.Disk != "" {
+			inst.Disk = fmt.Sprintf("disk-%s-%s-%d", deployment, slug, index)
+		}
+		instances = append(instances, inst)
+	}
+
+	keptVMs := make([]VM, 0, len(vms))
+	for _, vm := range vms {
+		if vm.Job != job || vm.Index < count {
+			keptVMs = append(keptVMs, vm)
+		}
+	}
+	keptInstances := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Job != job || inst.Index < count {
+			keptInstances = append(keptInstances, inst)
+		}
+	}
+	s.data.VMs[deployment] = keptVMs
+	s.data.Instances[deployment] = keptInstances
+	return nil
+}
+
+// allocateIP reserves the first free IP in one of the az's subnets, falling
+// back to the 10.0.0.0/16 pool when the cloud config has none.
+func allocateIP(cloud cloudConfigSummary, az string, used map[string]bool) string {
+	ip := ""
+	for _, cidr := range cloud.subnetRanges(az) {
+		if ip = nextFreeIPInRange(cidr, used); ip != "" {
+			break
+		}
+	}
+	if ip == "" {
+		ip = nextFreeIP(used)
+	}
+	used[ip] = true
+	return ip
+}
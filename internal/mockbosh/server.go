@@ -11,35 +11,144 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/big"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Default values reported by /info.
+const (
+	DefaultDirectorName    = "Mock BOSH Director"
+	DefaultDirectorUUID    = "mock-bosh-director-uuid"
+	DefaultDirectorVersion = "281.0.0 (00000000)"
+)
+
+// DefaultJitter is how much task delays vary unless configured.
+const DefaultJitter = 0.2
+
 // ServerConfig holds server configuration.
 type ServerConfig struct {
-	Port     int
-	Username string
-	Password string
-	UseTLS   bool
-	Speed    float64
-	Debug    bool
+	Port      int
+	Username  string
+	Password  string
+	UseTLS    bool
+	Speed     float64
+	Debug     bool
+	StateFile string
+	Empty     bool
+	Faults    []FaultConfig
+	AuthMode  string
+
+	RequireDeleteConfirm bool
+	IPAssignDelay        time.Duration
+
+	// FixturesDir holds deployments.yml, stemcells.yml, and tasks.yml
+	// replacing those parts of the starting fixtures
+	FixturesDir string
+
+	// TLSCertFile and TLSKeyFile are a PEM certificate and key to serve
+	// instead of a generated self-signed certificate; set both or neither
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSSANs are extra DNS names and IPs for the self-signed certificate
+	TLSSANs []string
+
+	// ReadTimeout, WriteTimeout, and IdleTimeout tune the HTTP server's
+	// connection handling; 0 means no timeout. A write timeout also cuts
+	// off long-lived streams like /tasks/stream.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// FailureRate is the chance (0-1) that each task fails at random
+	FailureRate float64
+
+	// Jitter varies each task delay by up to this fraction (0-1) either
+	// way; 0 turns it off
+	Jitter float64
+
+	// Metrics serves request and task counters at /metrics, without auth
+	Metrics bool
+
+	// Seed seeds the task simulator's random choices so runs reproduce;
+	// 0 picks a seed from the clock
+	Seed int64
+
+	// MaintenanceWindows reject mutating requests with 503 while active
+	MaintenanceWindows []MaintenanceWindow
+
+	// LogFormat is "text" (a line per request, debug only) or "json" (an
+	// object per request, always)
+	LogFormat string
+
+	// RateLimit caps requests per second across all clients, answering
+	// excess requests with 429; 0 means unlimited
+	RateLimit float64
+
+	// StartupDelay makes everything but /info and /health return 503 for
+	// this long after start, like a director still booting
+	StartupDelay time.Duration
+
+	// Deployments above 3 adds that many synthetic app-NNNN deployments to
+	// the default fixtures, for load testing
+	Deployments int
+
+	// MaxConcurrentTasks caps how many tasks process at once; 0 means no limit
+	MaxConcurrentTasks int
+
+	// InstanceNaming selects job/id or job/index instance names; "" uses
+	// the version mode's convention
+	InstanceNaming string
+
+	// BoshVersionMode emulates an older (legacy) or newer (modern) director
+	BoshVersionMode string
+
+	// TaskDurations overrides how long each task action takes (before -speed)
+	TaskDurations TaskDurations
+
+	// Teams scopes users to the deployments their teams own; users not
+	// listed, including Username, see everything
+	Teams UserTeams
+
+	// CORSOrigin, when set, allows browser requests from that origin ("*"
+	// for any) and answers OPTIONS preflights without auth
+	CORSOrigin string
+
+	// ClientProfiles tailors responses by User-Agent; nil uses the defaults
+	ClientProfiles map[string]ClientProfile
+
+	DirectorName    string
+	DirectorUUID    string
+	DirectorVersion string
 }
 
 // DefaultServerConfig returns default server configuration.
 func DefaultServerConfig() ServerConfig {
 	return ServerConfig{
-		Port:     25555,
-		Username: "admin",
-		Password: "admin",
-		UseTLS:   true,
-		Speed:    1.0,
-		Debug:    false,
+		Port:      25555,
+		Username:  "admin",
+		Password:  "admin",
+		UseTLS:    true,
+		Speed:     1.0,
+		Debug:     false,
+		StateFile: "",
+		Empty:     false,
+		AuthMode:  AuthModeBasic,
+		Jitter:    DefaultJitter,
+
+		DirectorName:    DefaultDirectorName,
+		DirectorUUID:    DefaultDirectorUUID,
+		DirectorVersion: DefaultDirectorVersion,
 	}
 }
 
@@ -50,73 +159,376 @@ type Server struct {
 	simulator  *TaskSimulator
 	handlers   *Handlers
 	httpServer *http.Server
+	startedAt  time.Time
+	now        func() time.Time // Clock for maintenance windows
+	behavior   versionBehavior
+	limiter    *rateLimiter
+	accessLog  AccessLogger // nil logs nothing
+	metrics    *Metrics     // nil when -metrics is off
+
+	listenerMu sync.Mutex
+	listener   net.Listener
+
+	certMu  sync.Mutex
+	certPEM []byte // Certificate served over TLS, for /ca-cert
 }
 
 // NewServer creates a new mock BOSH Director server.
-func NewServer(config ServerConfig) *Server {
-	state := NewState()
+// If a state file is configured and exists, state is loaded from it.
+// Otherwise Empty selects between empty and default fixtures, with any
+// files in FixturesDir replacing parts of them.
+func NewServer(config ServerConfig) (*Server, error) {
+	data := DefaultFixtures()
+	if config.Empty {
+		data = EmptyFixtures()
+	} else if config.Deployments > 3 {
+		data = GenerateSyntheticFixtures(config.Deployments)
+	}
+	if config.FixturesDir != "" {
+		if err := LoadFixturesDir(config.FixturesDir, data); err != nil {
+			return nil, err
+		}
+	}
+	if config.StateFile != "" {
+		loaded, err := LoadStateFromFile(config.StateFile)
+		switch {
+		case err == nil:
+			data = loaded
+		case errors.Is(err, os.ErrNotExist):
+			log.Printf("State file %s not found, starting with fresh state", config.StateFile)
+		default:
+			return nil, err
+		}
+	}
+	return NewServerWithState(config, data)
+}
+
+// NewServerWithState creates a server around data instead of fixtures, for
+// embedding the mock in Go tests; see StateBuilder. Empty and Deployments
+// are ignored, and a configured state file is only written on shutdown.
+func NewServerWithState(config ServerConfig, data *StateData) (*Server, error) {
+	if strings.TrimSpace(config.DirectorVersion) == "" {
+		return nil, fmt.Errorf("director version must not be empty")
+	}
+
+	if config.FailureRate < 0 || config.FailureRate > 1 {
+		return nil, fmt.Errorf("failure rate must be between 0 and 1, got %g", config.FailureRate)
+	}
+
+	if config.Jitter < 0 || config.Jitter >= 1 {
+		return nil, fmt.Errorf("jitter must be at least 0 and below 1, got %g", config.Jitter)
+	}
+
+	if config.RateLimit < 0 {
+		return nil, fmt.Errorf("rate limit must not be negative, got %g", config.RateLimit)
+	}
+
+	if config.StartupDelay < 0 {
+		return nil, fmt.Errorf("startup delay must not be negative, got %s", config.StartupDelay)
+	}
+
+	if config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.IdleTimeout < 0 {
+		return nil, fmt.Errorf("read, write, and idle timeouts must not be negative")
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS cert and key files must be given together")
+	}
+
+	if config.MaxConcurrentTasks < 0 {
+		return nil, fmt.Errorf("max concurrent tasks must not be negative, got %d", config.MaxConcurrentTasks)
+	}
+
+	accessLog, err := newAccessLogger(config.LogFormat, config.Debug, log.Writer())
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := ParseBoshVersionMode(config.BoshVersionMode)
+	if err != nil {
+		return nil, err
+	}
+	behavior := mode.behavior()
+	if config.InstanceNaming == "" {
+		config.InstanceNaming = string(behavior.instanceNaming)
+	}
+	if behavior.infoVersion != "" && config.DirectorVersion == DefaultDirectorVersion {
+		config.DirectorVersion = behavior.infoVersion
+	}
+
+	naming, err := ParseInstanceNaming(config.InstanceNaming)
+	if err != nil {
+		return nil, err
+	}
+
+	state := NewStateWithData(data)
+	state.SetInstanceNaming(naming)
+	var metrics *Metrics
+	if config.Metrics {
+		metrics = NewMetrics()
+		state.SetMetrics(metrics)
+	}
+
 	simulator := NewTaskSimulator(state, config.Speed, config.Debug)
+	simulator.SetIPAssignDelay(config.IPAssignDelay)
+	simulator.SetTaskDurations(config.TaskDurations)
+	simulator.SetFailureRate(config.FailureRate)
+	simulator.SetJitter(config.Jitter)
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	simulator.SetSeed(config.Seed)
+	simulator.SetMaxConcurrentTasks(config.MaxConcurrentTasks)
 	handlers := NewHandlers(state, simulator, config.Username, config.Password)
+	handlers.SetDirectorInfo(config.DirectorName, config.DirectorUUID, config.DirectorVersion)
+	handlers.SetRequireDeleteConfirm(config.RequireDeleteConfirm)
+	handlers.SetInlineTasks(behavior.inlineTasks)
+	handlers.SetUserTeams(config.Teams)
+	if config.ClientProfiles != nil {
+		handlers.SetClientProfiles(config.ClientProfiles)
+	}
+
+	switch config.AuthMode {
+	case "", AuthModeBasic:
+	case AuthModeUAA:
+		// The director serves /oauth/token itself, so it doubles as the UAA.
+		// Listen corrects the port once it's known.
+		uaaURL := config.uaaURL(config.Port)
+		tokens, err := NewTokenIssuer(uaaURL + "/oauth/token")
+		if err != nil {
+			return nil, err
+		}
+		handlers.UseUAA(uaaURL, tokens)
+	default:
+		return nil, fmt.Errorf("unknown auth mode: %s", config.AuthMode)
+	}
 
 	return &Server{
 		config:    config,
 		state:     state,
 		simulator: simulator,
 		handlers:  handlers,
+		startedAt: time.Now(),
+		now:       time.Now,
+		behavior:  behavior,
+		limiter:   newRateLimiter(config.RateLimit),
+		accessLog: accessLog,
+		metrics:   metrics,
+	}, nil
+}
+
+// Listen binds the server's port without serving on it yet, so callers
+// using port 0 can read the assigned port from Addr before Start. Start
+// calls it when it hasn't been called.
+func (s *Server) Listen() error {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	// With port 0 the UAA URL and token issuer only now get a real port
+	if s.handlers.tokens != nil {
+		uaaURL := s.config.uaaURL(listener.Addr().(*net.TCPAddr).Port)
+		s.handlers.UseUAA(uaaURL, s.handlers.tokens.withIssuer(uaaURL+"/oauth/token"))
+	}
+	return nil
+}
+
+// uaaURL returns the URL the director advertises as its UAA when listening
+// on port.
+func (c ServerConfig) uaaURL(port int) string {
+	protocol := "http"
+	if c.UseTLS {
+		protocol = "https"
+	}
+	return fmt.Sprintf("%s://localhost:%d", protocol, port)
+}
+
+// Addr returns the address the server is bound to, or nil before Listen.
+func (s *Server) Addr() net.Addr {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	if s.listener == nil {
+		return nil
 	}
+	return s.listener.Addr()
 }
 
-// Start starts the HTTP server.
+// Start starts the HTTP server, blocking until it stops.
 func (s *Server) Start() error {
 	mux := http.NewServeMux()
 	s.registerRoutes(mux)
 
-	addr := fmt.Sprintf(":%d", s.config.Port)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	addr := fmt.Sprintf(":%d", s.Addr().(*net.TCPAddr).Port)
 
 	s.httpServer = &http.Server{
-		Addr:    addr,
-		Handler: s.loggingMiddleware(s.authMiddleware(mux)),
+		Addr:         addr,
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+		IdleTimeout:  s.config.IdleTimeout,
+		Handler:      s.loggingMiddleware(s.corsMiddleware(s.gzipMiddleware(s.namedErrorsMiddleware(s.rateLimitMiddleware(s.startupMiddleware(s.authMiddleware(s.teamsMiddleware(s.maintenanceMiddleware(s.faultMiddleware(mux)))))))))),
 	}
 
 	protocol := "http"
 	if s.config.UseTLS {
 		protocol = "https"
-		tlsConfig, err := s.generateTLSConfig()
+		tlsConfig, err := s.tlsConfig()
 		if err != nil {
-			return fmt.Errorf("failed to generate TLS config: %w", err)
+			s.listener.Close()
+			return err
 		}
 		s.httpServer.TLSConfig = tlsConfig
 	}
 
 	log.Printf("Mock BOSH Director starting on %s://localhost%s", protocol, addr)
 	log.Printf("Credentials: %s / %s", s.config.Username, s.config.Password)
+	if s.config.AuthMode == AuthModeUAA {
+		log.Printf("Auth mode: uaa (tokens from %s://localhost%s/oauth/token)", protocol, addr)
+	}
 	log.Printf("Simulation speed: %.1fx", s.config.Speed)
+	log.Printf("Random seed: %d", s.config.Seed)
+	if s.config.StartupDelay > 0 {
+		log.Printf("Startup delay: %s", s.config.StartupDelay)
+	}
+	if s.config.CORSOrigin != "" {
+		log.Printf("CORS origin: %s", s.config.CORSOrigin)
+	}
+	if s.config.RateLimit > 0 {
+		log.Printf("Rate limit: %g requests/second", s.config.RateLimit)
+	}
+	for _, f := range s.config.Faults {
+		log.Printf("Fault injection: %s", f)
+	}
 
 	if s.config.UseTLS {
-		return s.httpServer.ListenAndServeTLS("", "")
+		return s.httpServer.ServeTLS(s.listener, "", "")
 	}
-	return s.httpServer.ListenAndServe()
+	return s.httpServer.Serve(s.listener)
 }
 
 // Shutdown gracefully shuts down the server.
+// If a state file is configured, the current state is written to it.
 func (s *Server) Shutdown(ctx context.Context) error {
-	if s.httpServer == nil {
-		return nil
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+	} else if s.Addr() != nil {
+		err = s.listener.Close()
+	}
+
+	if s.config.StateFile != "" {
+		if saveErr := s.state.SaveStateToFile(s.config.StateFile); saveErr != nil {
+			return saveErr
+		}
+		log.Printf("State saved to %s", s.config.StateFile)
 	}
-	return s.httpServer.Shutdown(ctx)
+
+	return err
 }
 
 // registerRoutes registers all API routes.
 func (s *Server) registerRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/info", s.handlers.HandleInfo)
-	mux.HandleFunc("/deployments", s.routeDeployments)
-	mux.HandleFunc("/deployments/", s.routeDeployments)
-	mux.HandleFunc("/tasks", s.routeTasks)
-	mux.HandleFunc("/tasks/", s.routeTasks)
-	mux.HandleFunc("/stemcells", s.handlers.HandleStemcells)
-	mux.HandleFunc("/releases", s.handlers.HandleReleases)
-	mux.HandleFunc("/configs", s.handlers.HandleConfigs)
-	mux.HandleFunc("/locks", s.handlers.HandleLocks)
+	mux.HandleFunc("/info", headAsGet(s.handlers.HandleInfo))
+	mux.HandleFunc("/health", headAsGet(s.handleHealth))
+	mux.HandleFunc("/ca-cert", s.handleCACert)
+	if s.metrics != nil {
+		mux.HandleFunc("/metrics", s.handleMetrics)
+	}
+	mux.HandleFunc("/oauth/token", s.handlers.HandleOAuthToken)
+	mux.HandleFunc("/deployments", headAsGet(s.routeDeployments))
+	mux.HandleFunc("/deployments/", headAsGet(s.routeDeployments))
+	mux.HandleFunc("/tasks", headAsGet(s.routeTasks))
+	mux.HandleFunc("/tasks/", headAsGet(s.routeTasks))
+	mux.HandleFunc("/stemcells", headAsGet(s.handlers.HandleStemcells))
+	mux.HandleFunc("/disks", headAsGet(s.routeDisks))
+	mux.HandleFunc("/disks/", headAsGet(s.routeDisks))
+	mux.HandleFunc("/releases", headAsGet(s.handlers.HandleReleases))
+	mux.HandleFunc("/configs", headAsGet(s.handlers.HandleConfigs))
+	mux.HandleFunc("/configs/validate", s.handlers.HandleValidateConfig)
+	mux.HandleFunc("/configs/diff", s.handlers.HandleConfigDiff)
+	mux.HandleFunc("/resources/", s.routeResources)
+	mux.HandleFunc("/locks", headAsGet(s.handlers.HandleLocks))
+	mux.HandleFunc("/events", headAsGet(s.handlers.HandleEvents))
+	mux.HandleFunc("/variables", headAsGet(s.handlers.HandleVariables))
+	mux.HandleFunc("/resurrection", s.handlers.HandleResurrection)
+	mux.HandleFunc("/cleanup", s.handlers.HandleCleanup)
+	mux.HandleFunc("/admin/reset", s.handlers.HandleAdminReset)
+	mux.HandleFunc("/admin/restart-all", s.handlers.HandleRestartAll)
+	mux.HandleFunc("/_internal/export-bundle", s.handlers.HandleExportBundle)
+	mux.HandleFunc("/_internal/probe", s.handlers.HandleProbe)
+	mux.HandleFunc("/_internal/error-codes", s.handlers.HandleErrorCodes)
+	mux.HandleFunc("/_internal/vm-types", s.handlers.HandleVMTypes)
+	mux.HandleFunc("/_internal/ips", s.handlers.HandleIPs)
+	mux.HandleFunc("/_internal/tasks/", s.routeInternalTasks)
+	mux.HandleFunc("/admin/instances/", s.routeAdminInstances)
+	mux.HandleFunc("/admin/tasks/", s.routeAdminTasks)
+	mux.HandleFunc("/admin/deployments/", s.routeAdminDeployments)
+	mux.HandleFunc("/_internal/scenario/stuck-deploy", s.handlers.HandleStuckDeployScenario)
+}
+
+// headAsGet serves HEAD as a GET whose body is dropped, so clients can probe
+// read endpoints for their status and headers.
+func headAsGet(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next(w, r)
+			return
+		}
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		next(headResponseWriter{w}, get)
+	}
+}
+
+// headResponseWriter discards the body of a HEAD response.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (hw headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// handleHealth handles GET /health, a liveness check that doesn't touch
+// state. It isn't part of the director API.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, HealthStatus{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(s.startedAt).Seconds()),
+	})
+}
+
+// handleCACert handles GET /ca-cert, returning the PEM certificate the
+// server presents so clients can trust it instead of skipping verification.
+func (s *Server) handleCACert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.certMu.Lock()
+	certPEM := s.certPEM
+	s.certMu.Unlock()
+	if certPEM == nil {
+		writeError(w, http.StatusNotFound, "no TLS certificate in use")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(certPEM)
 }
 
 // routeDeployments routes deployment-related requests.
@@ -124,6 +536,10 @@ func (s *Server) routeDeployments(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 
 	if path == "/deployments" {
+		if r.Method == http.MethodPost {
+			s.handlers.HandleDeploy(w, r, "")
+			return
+		}
 		s.handlers.HandleDeployments(w, r)
 		return
 	}
@@ -139,18 +555,16 @@ func (s *Server) routeDeployments(w http.ResponseWriter, r *http.Request) {
 	if len(parts) == 1 {
 		switch r.Method {
 		case http.MethodGet:
-			d, err := s.state.GetDeployment(deployment)
-			if err != nil {
-				writeError(w, http.StatusNotFound, err.Error())
-				return
-			}
-			writeJSON(w, http.StatusOK, d)
+			s.handlers.HandleDeployment(w, r, deployment)
 		case http.MethodDelete:
 			s.handlers.HandleDeleteDeployment(w, r, deployment)
 		case http.MethodPut:
-			if r.URL.Query().Get("state") == "recreate" {
+			switch r.URL.Query().Get("state") {
+			case "recreate":
 				s.handlers.HandleDeploymentRecreate(w, r, deployment)
-			} else {
+			case "":
+				s.handlers.HandleDeploy(w, r, deployment)
+			default:
 				writeError(w, http.StatusBadRequest, "unknown operation")
 			}
 		default:
@@ -159,6 +573,11 @@ func (s *Server) routeDeployments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 2 && parts[1] == "diff" {
+		s.handlers.HandleDeploymentDiff(w, r, deployment)
+		return
+	}
+
 	if len(parts) == 2 && parts[1] == "vms" {
 		s.handlers.HandleDeploymentVMs(w, r, deployment)
 		return
@@ -169,12 +588,91 @@ func (s *Server) routeDeployments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 2 && parts[1] == "vitals" {
+		s.handlers.HandleDeploymentVitals(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "errands" {
+		s.handlers.HandleDeploymentErrands(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "problems" {
+		s.handlers.HandleDeploymentProblems(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "scans" {
+		s.handlers.HandleDeploymentScans(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "colocation" {
+		s.handlers.HandleDeploymentColocation(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "ssh" {
+		s.handlers.HandleDeploymentSSH(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "resurrection" {
+		s.handlers.HandleDeploymentResurrection(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "snapshots" {
+		s.handlers.HandleDeploymentSnapshots(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 3 && parts[1] == "variables" && parts[2] == "usage" {
+		s.handlers.HandleDeploymentVariableUsage(w, r, deployment)
+		return
+	}
+
+	if len(parts) == 4 && parts[1] == "variables" && parts[3] == "rotate" {
+		s.handlers.HandleVariableRotate(w, r, deployment, parts[2])
+		return
+	}
+
 	if len(parts) == 2 && parts[1] == "variables" {
 		s.handlers.HandleDeploymentVariables(w, r, deployment)
 		return
 	}
 
-	if len(parts) >= 3 && parts[1] == "jobs" {
+	if len(parts) == 5 && parts[1] == "instances" && parts[4] == "logs" {
+		s.handlers.HandleInstanceLogs(w, r, deployment, parts[2], parts[3])
+		return
+	}
+
+	if len(parts) == 5 && parts[1] == "instance_groups" && parts[4] == "migrate" {
+		s.handlers.HandleInstanceMigrate(w, r, deployment, parts[2], parts[3])
+		return
+	}
+
+	if len(parts) == 5 && parts[1] == "instance_groups" && parts[4] == "ignore" {
+		s.handlers.HandleInstanceIgnore(w, r, deployment, parts[2], parts[3])
+		return
+	}
+
+	if len(parts) == 6 && parts[1] == "instance_groups" && parts[4] == "disks" {
+		s.handlers.HandleInstanceDisk(w, r, deployment, parts[2], parts[3], parts[5])
+		return
+	}
+
+	if (len(parts) == 3 || len(parts) == 4) && parts[1] == "instance_groups" && s.behavior.instanceGroupsRouting {
+		group := parts[2]
+		if len(parts) == 4 {
+			group = parts[2] + "/" + parts[3]
+		}
+		s.handlers.HandleDeploymentJobs(w, r, deployment, group)
+		return
+	}
+
+	if len(parts) >= 3 && parts[1] == "jobs" && s.behavior.jobsRouting {
 		job := parts[2]
 		if len(parts) == 4 {
 			job = parts[2] + "/" + parts[3]
@@ -195,6 +693,11 @@ func (s *Server) routeTasks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if path == "/tasks/stream" {
+		s.handlers.HandleTaskStream(w, r)
+		return
+	}
+
 	parts := strings.Split(strings.TrimPrefix(path, "/tasks/"), "/")
 	if len(parts) < 1 || parts[0] == "" {
 		writeError(w, http.StatusNotFound, "task ID required")
@@ -208,6 +711,10 @@ func (s *Server) routeTasks(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(parts) == 1 {
+		if r.Method == http.MethodDelete {
+			s.handlers.HandleCancelTask(w, r, taskID)
+			return
+		}
 		s.handlers.HandleTask(w, r, taskID)
 		return
 	}
@@ -220,32 +727,223 @@ func (s *Server) routeTasks(w http.ResponseWriter, r *http.Request) {
 	writeError(w, http.StatusNotFound, "not found")
 }
 
-// loggingMiddleware logs all requests.
+// routeDisks routes orphaned disk requests.
+func (s *Server) routeDisks(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	if path == "/disks" {
+		s.handlers.HandleDisks(w, r)
+		return
+	}
+
+	cid := strings.TrimPrefix(path, "/disks/")
+	if cid == "" || strings.Contains(cid, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	s.handlers.HandleDeleteDisk(w, r, cid)
+}
+
+// routeResources routes /resources/:id blob downloads.
+func (s *Server) routeResources(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/resources/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	s.handlers.HandleResource(w, r, id)
+}
+
+// routeInternalTasks routes /_internal/tasks/:id requests.
+func (s *Server) routeInternalTasks(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/_internal/tasks/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid task ID")
+		return
+	}
+
+	s.handlers.HandleDeleteTask(w, r, taskID)
+}
+
+// routeAdminInstances routes
+// /admin/instances/:deployment/:job/:index/(unresponsive|responsive).
+func (s *Server) routeAdminInstances(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/instances/"), "/")
+	if len(parts) != 4 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch parts[3] {
+	case "unresponsive":
+		s.handlers.HandleInstanceResponsiveness(w, r, parts[0], parts[1], parts[2], false)
+	case "responsive":
+		s.handlers.HandleInstanceResponsiveness(w, r, parts[0], parts[1], parts[2], true)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// routeAdminTasks routes /admin/tasks/:id/outcome.
+func (s *Server) routeAdminTasks(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/tasks/"), "/")
+	if len(parts) != 2 || parts[1] != "outcome" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	taskID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid task ID")
+		return
+	}
+
+	s.handlers.HandleTaskOutcome(w, r, taskID)
+}
+
+// routeAdminDeployments routes /admin/deployments/:name/scale.
+func (s *Server) routeAdminDeployments(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/deployments/"), "/")
+	if len(parts) != 2 || parts[1] != "scale" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	s.handlers.HandleAdminScale(w, r, parts[0])
+}
+
+// loggingMiddleware records each request with the access logger.
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(wrapped, r)
-		if s.config.Debug {
-			log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, time.Since(start))
+		s.metrics.countRequest(r.URL.Path, wrapped.statusCode)
+		if s.accessLog != nil {
+			// Rejected requests log the user they claimed, if any
+			user, _, _ := r.BasicAuth()
+			if s.handlers.CheckAuth(r) {
+				user = s.handlers.requestUser(r)
+			}
+			s.accessLog.Log(AccessRecord{
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     wrapped.statusCode,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				RemoteAddr: r.RemoteAddr,
+				User:       user,
+			})
+		}
+	})
+}
+
+// rateLimiter is a token bucket shared by all clients. It holds up to one
+// second's worth of requests and refills at rate tokens per second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a full bucket, or nil when rate is 0 (unlimited).
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, tokens: math.Max(rate, 1)}
+}
+
+// take spends a token if one is available at now. Otherwise it returns how
+// long until the next token.
+func (rl *rateLimiter) take(now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.last.IsZero() {
+		rl.tokens = math.Min(math.Max(rl.rate, 1), rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	}
+	rl.last = now
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
+
+// rateLimitMiddleware answers requests beyond the rate limit with 429 and a
+// Retry-After header in whole seconds.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := s.limiter.take(s.now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit of %g requests/second exceeded", s.config.RateLimit))
+			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startupMiddleware rejects requests with 503 until StartupDelay has passed
+// since the server started. /info and /health still answer so clients can
+// find the director while it boots.
+func (s *Server) startupMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" && r.URL.Path != "/health" && s.now().Before(s.startedAt.Add(s.config.StartupDelay)) {
+			writeError(w, http.StatusServiceUnavailable, "Director is starting")
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
 // authMiddleware validates Basic Auth.
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/info" {
+		if r.URL.Path == "/info" || r.URL.Path == "/health" || r.URL.Path == "/oauth/token" || r.URL.Path == "/ca-cert" || r.URL.Path == "/metrics" {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		if !s.handlers.CheckAuth(r) {
-			w.Header().Set("WWW-Authenticate", `Basic realm="BOSH Director"`)
-			writeError(w, http.StatusUnauthorized, "unauthorized")
+			// The director answers with code 600000; in UAA mode the
+			// description says where to get a token
+			if s.config.AuthMode == AuthModeUAA {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="BOSH Director"`)
+				writeErrorCode(w, ErrCodeUnauthorized, fmt.Sprintf("Not authorized: a bearer token from %s/oauth/token is required", s.handlers.uaaURL))
+			} else {
+				w.Header().Set("WWW-Authenticate", `Basic realm="BOSH Director"`)
+				writeErrorCode(w, ErrCodeUnauthorized, "Not authorized")
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceMiddleware rejects mutating requests during a maintenance
+// window while letting reads through.
+func (s *Server) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(r) && inMaintenance(s.config.MaintenanceWindows, s.now()) {
+			writeError(w, http.StatusServiceUnavailable, "maintenance: director is in a maintenance window")
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
+// faultMiddleware returns configured errors for matching requests.
+func (s *Server) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fault := findFault(s.config.Faults, r); fault != nil {
+			writeError(w, fault.Status, fmt.Sprintf("injected fault for %s %s", r.Method, r.URL.Path))
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -260,6 +958,46 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush lets streaming handlers flush through the wrapper.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// tlsNextProtos offers HTTP/2 to clients that negotiate it.
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// tlsConfig serves the configured certificate files, or a self-signed
+// certificate when there are none.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.config.TLSCertFile == "" {
+		config, err := s.generateTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate TLS config: %w", err)
+		}
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS cert and key: %w", err)
+	}
+	certPEM, err := os.ReadFile(s.config.TLSCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS cert and key: %w", err)
+	}
+	s.setCertPEM(certPEM)
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: tlsNextProtos}, nil
+}
+
+func (s *Server) setCertPEM(certPEM []byte) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+	s.certPEM = certPEM
+}
+
+// generateTLSConfig mints a self-signed certificate for localhost and
+// 127.0.0.1 plus any configured SANs.
 func (s *Server) generateTLSConfig() (*tls.Config, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -280,6 +1018,13 @@ func (s *Server) generateTLSConfig() (*tls.Config, error) {
 		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
 		DNSNames:              []string{"localhost"},
 	}
+	for _, san := range s.config.TLSSANs {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
 	if err != nil {
@@ -293,8 +1038,10 @@ func (s *Server) generateTLSConfig() (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.setCertPEM(certPEM)
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
+		NextProtos:   tlsNextProtos,
 	}, nil
 }
@@ -0,0 +1,352 @@
+// ABOUTME: Tests for starting and serving the HTTP server.
+// ABOUTME: Verifies listening on real ports, including OS-assigned ones, TLS, and auth failures.
+
+package mockbosh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerListenPortZero(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Port = 0
+	config.UseTLS = false
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if server.Addr() != nil {
+		t.Error("Expected no address before Listen")
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := server.Addr().(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("Expected an assigned port")
+	}
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Start() }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		if err := <-serverErr; err != http.ErrServerClosed {
+			t.Errorf("Expected the server to close cleanly, got %v", err)
+		}
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/info", port))
+	if err != nil {
+		t.Fatalf("GET /info failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServerListenPortZeroUAAURL(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Port = 0
+	config.UseTLS = false
+	config.AuthMode = AuthModeUAA
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer server.listener.Close()
+	want := fmt.Sprintf("http://localhost:%d", server.Addr().(*net.TCPAddr).Port)
+
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/info", nil))
+	if !strings.Contains(w.Body.String(), `"url":"`+want+`"`) {
+		t.Errorf("Expected /info to advertise %s, got %s", want, w.Body.String())
+	}
+	if issuer := server.handlers.tokens.issuer; issuer != want+"/oauth/token" {
+		t.Errorf("Expected token issuer %s/oauth/token, got %s", want, issuer)
+	}
+}
+
+// startTestServer listens on a free port and serves until the test ends.
+func startTestServer(t *testing.T, config ServerConfig) int {
+	t.Helper()
+	config.Port = 0
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Start() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		<-serverErr
+	})
+	return server.Addr().(*net.TCPAddr).Port
+}
+
+// writeTestCertPair writes a self-signed certificate and key for 127.0.0.1
+// to dir, returning their paths and the certificate.
+func writeTestCertPair(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "test director"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "director.crt")
+	keyFile := filepath.Join(dir, "director.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile, cert
+}
+
+func TestServerTLSCertFiles(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertPair(t, t.TempDir())
+
+	config := DefaultServerConfig()
+	config.TLSCertFile = certFile
+	config.TLSKeyFile = keyFile
+	port := startTestServer(t, config)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/info", port))
+	if err != nil {
+		t.Fatalf("GET /info with the supplied CA failed: %v", err)
+	}
+	resp.Body.Close()
+	if served := resp.TLS.PeerCertificates[0]; served.SerialNumber.Int64() != 42 {
+		t.Errorf("Expected the supplied certificate, got serial %v", served.SerialNumber)
+	}
+
+	resp, err = client.Get(fmt.Sprintf("https://127.0.0.1:%d/ca-cert", port))
+	if err != nil {
+		t.Fatalf("GET /ca-cert failed: %v", err)
+	}
+	served, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want, _ := os.ReadFile(certFile); string(served) != string(want) {
+		t.Errorf("Expected /ca-cert to return the supplied certificate, got %q", served)
+	}
+
+	config.TLSKeyFile = ""
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected an error for a cert without a key")
+	}
+}
+
+func TestGenerateTLSConfigSANs(t *testing.T) {
+	config := DefaultServerConfig()
+	config.TLSSANs = []string{"director.internal", "192.0.2.10", "2001:db8::1"}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	tlsConfig, err := server.generateTLSConfig()
+	if err != nil {
+		t.Fatalf("generateTLSConfig failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+
+	for _, host := range []string{"localhost", "127.0.0.1", "director.internal", "192.0.2.10", "2001:db8::1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("Expected the certificate to cover %s: %v", host, err)
+		}
+	}
+	if len(cert.DNSNames) != 2 || len(cert.IPAddresses) != 3 {
+		t.Errorf("Expected IP SANs parsed as IPs, got DNS %v and IPs %v", cert.DNSNames, cert.IPAddresses)
+	}
+}
+
+func TestCACert(t *testing.T) {
+	port := startTestServer(t, DefaultServerConfig())
+	insecure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := insecure.Get(fmt.Sprintf("https://127.0.0.1:%d/ca-cert", port))
+	if err != nil {
+		t.Fatalf("GET /ca-cert failed: %v", err)
+	}
+	certPEM, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d without credentials, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatalf("Expected a PEM certificate, got %q", certPEM)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err = client.Get(fmt.Sprintf("https://127.0.0.1:%d/info", port))
+	if err != nil {
+		t.Fatalf("GET /info trusting /ca-cert failed: %v", err)
+	}
+	resp.Body.Close()
+
+	server, _ := NewServer(DefaultServerConfig())
+	w := httptest.NewRecorder()
+	server.handleCACert(w, httptest.NewRequest(http.MethodGet, "/ca-cert", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d before TLS is set up, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestServerHTTP2(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReadTimeout = 5 * time.Second
+	config.WriteTimeout = 5 * time.Second
+	config.IdleTimeout = time.Minute
+	port := startTestServer(t, config)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/info", port))
+	if err != nil {
+		t.Fatalf("GET /info failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	config.IdleTimeout = -time.Second
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected an error for a negative timeout")
+	}
+}
+
+func TestAuthMiddlewareUnauthorized(t *testing.T) {
+	tests := []struct {
+		mode        string
+		challenge   string
+		description string
+	}{
+		{AuthModeBasic, `Basic realm="BOSH Director"`, "Not authorized"},
+		{AuthModeUAA, `Bearer realm="BOSH Director"`, "/oauth/token is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.AuthMode = tt.mode
+			server, err := NewServer(config)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			mux := http.NewServeMux()
+			server.registerRoutes(mux)
+
+			req := httptest.NewRequest(http.MethodGet, "/deployments", nil)
+			req.SetBasicAuth("admin", "wrong")
+			w := httptest.NewRecorder()
+			server.authMiddleware(mux).ServeHTTP(w, req)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("Expected challenge %q, got %q", tt.challenge, got)
+			}
+			var errResp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &errResp); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if errResp.Code != 600000 {
+				t.Errorf("Expected code 600000, got %d", errResp.Code)
+			}
+			if !strings.HasSuffix(errResp.Description, tt.description) {
+				t.Errorf("Expected a description ending %q, got %q", tt.description, errResp.Description)
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	server, err := NewServer(DefaultServerConfig())
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+
+	for _, path := range []string{"/deployments", "/stemcells", "/deployments/cf/vms", "/tasks", "/tasks/1", "/info"} {
+		req := httptest.NewRequest(http.MethodHead, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("HEAD %s: expected status %d, got %d", path, http.StatusOK, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("HEAD %s: expected no body, got %d bytes", path, w.Body.Len())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("HEAD %s: expected Content-Type application/json, got %q", path, ct)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodHead, "/deployments/nope", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("Expected a bodiless 404 for an unknown deployment, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
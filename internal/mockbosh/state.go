@@ -4,8 +4,16 @@
 package mockbosh
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,39 +25,282 @@ type StateData struct {
 	VMs            map[string][]VM
 	Instances      map[string][]Instance
 	Variables      map[string][]Variable
+	Links          map[string]map[string]JobLinks
+	HealthChecks   map[string]HealthCheck
 	Tasks          map[int]*Task
+	TaskEvents     map[int][]TaskEvent
+	Snapshots      map[string][]Snapshot
+	Disks          []OrphanedDisk
+	Events         []Event
 	Stemcells      []Stemcell
 	Releases       []Release
-	CloudConfig    *CloudConfig
+	CloudConfigs   []CloudConfig
 	RuntimeConfigs []RuntimeConfig
-	CPIConfig      *CPIConfig
+	CPIConfigs     []CPIConfig
 	Locks          []Lock
+	Blobs          map[string]*Blob
 	nextTaskID     int
+
+	// lastConfigID is the highest config ID handed out, kept so IDs of
+	// deleted configs aren't reused
+	lastConfigID int
+
+	// lastSnapshotSeq is the highest snapshot sequence number handed out,
+	// kept so CIDs of deleted snapshots aren't reused
+	lastSnapshotSeq int
+
+	// ResurrectionPaused stops the health monitor recreating unresponsive
+	// instances
+	ResurrectionPaused bool
+
+	// taskQueue and runningTasks track tasks behind the simulator's
+	// concurrency limit. They are not persisted.
+	taskQueue    []int
+	runningTasks map[int]bool
+}
+
+// stateDataJSON is the on-disk representation of StateData. It exists so the
+// unexported task and config counters survive a round trip while the mutex
+// is skipped.
+type stateDataJSON struct {
+	Deployments     map[string]*Deployment         `json:"deployments"`
+	VMs             map[string][]VM                `json:"vms"`
+	Instances       map[string][]Instance          `json:"instances"`
+	Variables       map[string][]Variable          `json:"variables"`
+	Links           map[string]map[string]JobLinks `json:"links"`
+	HealthChecks    map[string]HealthCheck         `json:"health_checks"`
+	Tasks           map[int]*Task                  `json:"tasks"`
+	TaskEvents      map[int][]TaskEvent            `json:"task_events"`
+	Snapshots       map[string][]Snapshot          `json:"snapshots"`
+	Disks           []OrphanedDisk                 `json:"disks"`
+	Events          []Event                        `json:"events"`
+	Stemcells       []Stemcell                     `json:"stemcells"`
+	Releases        []Release                      `json:"releases"`
+	CloudConfigs    []CloudConfig                  `json:"cloud_configs"`
+	RuntimeConfigs  []RuntimeConfig                `json:"runtime_configs"`
+	CPIConfigs      []CPIConfig                    `json:"cpi_configs"`
+	Locks           []Lock                         `json:"locks"`
+	Blobs           map[string]*Blob               `json:"blobs"`
+	NextTaskID      int                            `json:"next_task_id"`
+	LastConfigID    int                            `json:"last_config_id,omitempty"`
+	LastSnapshotSeq int                            `json:"last_snapshot_seq,omitempty"`
+
+	ResurrectionPaused bool `json:"resurrection_paused,omitempty"`
+}
+
+// MarshalJSON serializes the state under a read lock.
+func (d *StateData) MarshalJSON() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return json.Marshal(stateDataJSON{
+		Deployments:     d.Deployments,
+		VMs:             d.VMs,
+		Instances:       d.Instances,
+		Variables:       d.Variables,
+		Links:           d.Links,
+		HealthChecks:    d.HealthChecks,
+		Tasks:           d.Tasks,
+		TaskEvents:      d.TaskEvents,
+		Snapshots:       d.Snapshots,
+		Disks:           d.Disks,
+		Events:          d.Events,
+		Stemcells:       d.Stemcells,
+		Releases:        d.Releases,
+		CloudConfigs:    d.CloudConfigs,
+		RuntimeConfigs:  d.RuntimeConfigs,
+		CPIConfigs:      d.CPIConfigs,
+		Locks:           d.Locks,
+		Blobs:           d.Blobs,
+		NextTaskID:      d.nextTaskID,
+		LastConfigID:    d.lastConfigID,
+		LastSnapshotSeq: d.lastSnapshotSeq,
+
+		ResurrectionPaused: d.ResurrectionPaused,
+	})
+}
+
+// UnmarshalJSON restores the state, ensuring maps are non-nil and the task
+// counter is never behind the highest existing task ID.
+func (d *StateData) UnmarshalJSON(b []byte) error {
+	var raw stateDataJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Deployments = raw.Deployments
+	if d.Deployments == nil {
+		d.Deployments = make(map[string]*Deployment)
+	}
+	d.VMs = raw.VMs
+	if d.VMs == nil {
+		d.VMs = make(map[string][]VM)
+	}
+	d.Instances = raw.Instances
+	if d.Instances == nil {
+		d.Instances = make(map[string][]Instance)
+	}
+	d.Variables = raw.Variables
+	if d.Variables == nil {
+		d.Variables = make(map[string][]Variable)
+	}
+	d.Links = raw.Links
+	if d.Links == nil {
+		d.Links = make(map[string]map[string]JobLinks)
+	}
+	d.HealthChecks = raw.HealthChecks
+	if d.HealthChecks == nil {
+		d.HealthChecks = make(map[string]HealthCheck)
+	}
+	d.Tasks = raw.Tasks
+	if d.Tasks == nil {
+		d.Tasks = make(map[int]*Task)
+	}
+	d.TaskEvents = raw.TaskEvents
+	if d.TaskEvents == nil {
+		d.TaskEvents = make(map[int][]TaskEvent)
+	}
+	d.Snapshots = raw.Snapshots
+	if d.Snapshots == nil {
+		d.Snapshots = make(map[string][]Snapshot)
+	}
+	d.Disks = raw.Disks
+	if d.Disks == nil {
+		d.Disks = []OrphanedDisk{}
+	}
+	d.Events = raw.Events
+	if d.Events == nil {
+		d.Events = []Event{}
+	}
+	d.Stemcells = raw.Stemcells
+	d.Releases = raw.Releases
+	d.CloudConfigs = raw.CloudConfigs
+	d.RuntimeConfigs = raw.RuntimeConfigs
+	d.CPIConfigs = raw.CPIConfigs
+	d.Locks = raw.Locks
+	if d.Locks == nil {
+		d.Locks = []Lock{}
+	}
+	d.Blobs = raw.Blobs
+	if d.Blobs == nil {
+		d.Blobs = make(map[string]*Blob)
+	}
+
+	d.ResurrectionPaused = raw.ResurrectionPaused
+	d.lastConfigID = raw.LastConfigID
+	d.lastSnapshotSeq = raw.LastSnapshotSeq
+	d.nextTaskID = raw.NextTaskID
+	for id := range d.Tasks {
+		if id > d.nextTaskID {
+			d.nextTaskID = id
+		}
+	}
+	return nil
+}
+
+// LoadStateFromFile reads StateData from a JSON file.
+func LoadStateFromFile(path string) (*StateData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &StateData{}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return data, nil
 }
 
 // State wraps StateData with thread-safe operations.
 type State struct {
-	data *StateData
+	data    *StateData
+	stream  *taskEventBroker
+	naming  InstanceNaming
+	metrics *Metrics // nil counts nothing
 }
 
 // NewState creates a new state manager with default fixtures.
 func NewState() *State {
-	return &State{data: DefaultFixtures()}
+	return NewStateWithData(DefaultFixtures())
 }
 
 // NewStateWithData creates a new state manager with custom data.
 func NewStateWithData(data *StateData) *State {
-	return &State{data: data}
+	return &State{data: data, stream: newTaskEventBroker(), naming: InstanceNamingID}
+}
+
+// Reset replaces all state with the given data in place, so holders of this
+// State keep a valid reference.
+func (s *State) Reset(data *StateData) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	s.data.Deployments = data.Deployments
+	s.data.VMs = data.VMs
+	s.data.Instances = data.Instances
+	s.data.Variables = data.Variables
+	s.data.Links = data.Links
+	s.data.HealthChecks = data.HealthChecks
+	s.data.Tasks = data.Tasks
+	s.data.TaskEvents = data.TaskEvents
+	s.data.Snapshots = data.Snapshots
+	s.data.Disks = data.Disks
+	s.data.Events = data.Events
+	s.data.Stemcells = data.Stemcells
+	s.data.Releases = data.Releases
+	s.data.CloudConfigs = data.CloudConfigs
+	s.data.RuntimeConfigs = data.RuntimeConfigs
+	s.data.CPIConfigs = data.CPIConfigs
+	s.data.Locks = data.Locks
+	s.data.Blobs = data.Blobs
+	s.data.nextTaskID = data.nextTaskID
+	s.data.lastConfigID = data.lastConfigID
+	s.data.lastSnapshotSeq = data.lastSnapshotSeq
+	s.data.ResurrectionPaused = data.ResurrectionPaused
+	s.data.taskQueue = nil
+	s.data.runningTasks = nil
+}
+
+// SaveStateToFile writes the current state to a JSON file.
+func (s *State) SaveStateToFile(path string) error {
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize state: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file %s: %w", path, err)
+	}
+	return nil
 }
 
-// GetDeployments returns all deployments.
+// GetDeployments returns all deployments without their manifests, each with
+// its instance groups' update settings and resource totals derived from the
+// manifest and the current cloud config.
 func (s *State) GetDeployments() []Deployment {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
+	var cloud cloudConfigSummary
+	if n := len(s.data.CloudConfigs); n > 0 {
+		cloud = parseCloudConfig(s.data.CloudConfigs[n-1].Properties)
+	}
+
 	result := make([]Deployment, 0, len(s.data.Deployments))
 	for _, d := range s.data.Deployments {
-		result = append(result, *d)
+		summary := *d
+		manifest := parseManifest(d.Manifest)
+		summary.InstanceGroups = manifest.instanceGroupSummaries()
+		totals := manifest.resourceTotals(cloud)
+		summary.Resources = &totals
+		summary.Manifest = ""
+		if summary.Teams == nil {
+			summary.Teams = []string{}
+		}
+		result = append(result, summary)
 	}
 	return result
 }
@@ -67,6 +318,436 @@ func (s *State) GetDeployment(name string) (*Deployment, error) {
 	return &copy, nil
 }
 
+// SaveDeployment creates or updates a deployment from a manifest, storing the
+// manifest verbatim. Stemcells referenced by OS are resolved against uploaded
+// stemcells, and VMs and instances are reconciled with the manifest's
+// instance groups. It returns the instances the deploy created, updated, and
+// deleted; created instances have no IPs until AssignIPs is called.
+func (s *State) SaveDeployment(name, manifest string) (DeployChanges, error) {
+	changes, changed, err := s.prepareDeploy(name, manifest)
+	if err != nil {
+		return changes, err
+	}
+	for _, target := range deployTargets(manifest) {
+		c, err := s.deployInstance(name, manifest, target.group, target.index, changed[target.group])
+		if err != nil {
+			return changes, err
+		}
+		changes.add(c)
+	}
+	return changes, nil
+}
+
+// prepareDeploy starts a deploy: it stores the manifest, releases, and
+// stemcells, removes instances the manifest no longer has, and brings errand
+// instances in line. Service instances are left for deployInstance, one at a
+// time. It returns the instances it created and deleted, and the instance
+// groups that differ from the previous manifest.
+func (s *State) prepareDeploy(name, manifest string) (DeployChanges, map[string]bool, error) {
+	summary := parseManifest(manifest)
+	if summary.Name != "" && summary.Name != name {
+		return DeployChanges{}, nil, fmt.Errorf("manifest name '%s' does not match deployment '%s'", summary.Name, name)
+	}
+	if len(summary.InstanceGroups) == 0 {
+		return DeployChanges{}, nil, fmt.Errorf("manifest for deployment '%s' has no instance groups", name)
+	}
+
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if err := s.unresponsiveAgentError(name, ""); err != nil {
+		return DeployChanges{}, nil, err
+	}
+
+	d, exists := s.data.Deployments[name]
+	if !exists {
+		d = &Deployment{Name: name, CloudConfig: "latest", Teams: []string{}}
+		s.data.Deployments[name] = d
+	}
+
+	changed := changedInstanceGroups(d.Manifest, manifest)
+	d.Manifest = manifest
+	d.Releases = summary.Releases
+	if d.Releases == nil {
+		d.Releases = []NameVersion{}
+	}
+
+	d.Stemcells = make([]NameVersion, 0, len(summary.Stemcells))
+	for _, ms := range summary.Stemcells {
+		stemcellName := ms.Name
+		for i := range s.data.Stemcells {
+			sc := &s.data.Stemcells[i]
+			if (sc.Name == ms.Name || sc.OperatingSystem == ms.OS) && sc.Version == ms.Version {
+				stemcellName = sc.Name
+				if !containsString(sc.Deployments, name) {
+					sc.Deployments = append(sc.Deployments, name)
+				}
+				break
+			}
+		}
+		if stemcellName == "" {
+			stemcellName = ms.OS
+		}
+		d.Stemcells = append(d.Stemcells, NameVersion{Name: stemcellName, Version: ms.Version})
+	}
+
+	return s.reconcileInstanceGroups(name, summary.InstanceGroups), changed, nil
+}
+
+// reconcileInstanceGroups removes the VMs and instances a deploy's instance
+// groups no longer have, and creates or updates the errand instances, which
+// deploys don't report per instance. Groups missing from the manifest are
+// removed. Caller must hold the write lock.
+func (s *State) reconcileInstanceGroups(deployment string, groups []manifestInstanceGroup) DeployChanges {
+	wanted := make(map[string]manifestInstanceGroup, len(groups))
+	for _, g := range groups {
+		wanted[g.Name] = g
+	}
+
+	keepInstance := func(job string, index int) bool {
+		g, ok := wanted[job]
+		return ok && index < g.Instances
+	}
+
+	vms := make([]VM, 0, len(s.data.VMs[deployment]))
+	for _, vm := range s.data.VMs[deployment] {
+		if keepInstance(vm.Job, vm.Index) {
+			vms = append(vms, vm)
+		}
+	}
+
+	var changes DeployChanges
+	existing := make(map[string]bool)
+	instances := make([]Instance, 0, len(s.data.Instances[deployment]))
+	for _, inst := range s.data.Instances[deployment] {
+		if !keepInstance(inst.Job, inst.Index) {
+			changes.Deleted = append(changes.Deleted, inst)
+			continue
+		}
+		if inst.Lifecycle == LifecycleErrand {
+			inst.Jobs = wanted[inst.Job].Jobs
+		}
+		instances = append(instances, inst)
+		existing[fmt.Sprintf("%s/%d", inst.Job, inst.Index)] = true
+	}
+
+	for _, g := range groups {
+		if g.Lifecycle != LifecycleErrand {
+			continue
+		}
+		for index := 0; index < g.Instances; index++ {
+			if existing[fmt.Sprintf("%s/%d", g.Name, index)] {
+				continue
+			}
+			inst, _ := synthesizeInstance(deployment, g, index)
+			instances = append(instances, inst)
+			changes.Created = append(changes.Created, inst)
+		}
+	}
+
+	s.data.VMs[deployment] = vms
+	s.data.Instances[deployment] = instances
+	return changes
+}
+
+// deployInstance creates or updates one service instance of a deploy's
+// instance group, as the deploy reaches it. It returns the instance as
+// created, or as updated when its group changed.
+func (s *State) deployInstance(deployment, manifest, group string, index int, changed bool) (DeployChanges, error) {
+	var g manifestInstanceGroup
+	for _, candidate := range parseManifest(manifest).InstanceGroups {
+		if candidate.Name == group {
+			g = candidate
+		}
+	}
+
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return DeployChanges{}, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	var changes DeployChanges
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		if instances[i].Job != group || instances[i].Index != index {
+			continue
+		}
+		instances[i].Jobs = g.Jobs
+		vms := s.data.VMs[deployment]
+		for j := range vms {
+			if vms[j].ID == instances[i].ID {
+				vms[j].Jobs = g.Jobs
+			}
+		}
+		if changed {
+			changes.Updated = append(changes.Updated, instances[i])
+		}
+		return changes, nil
+	}
+
+	inst, vm := synthesizeInstance(deployment, g, index)
+	s.data.Instances[deployment] = append(instances, inst)
+	if vm != nil {
+		s.data.VMs[deployment] = append(s.data.VMs[deployment], *vm)
+	}
+	changes.Created = append(changes.Created, inst)
+	return changes, nil
+}
+
+// add appends another part of the same deploy's changes.
+func (c *DeployChanges) add(other DeployChanges) {
+	c.Created = append(c.Created, other.Created...)
+	c.Updated = append(c.Updated, other.Updated...)
+	c.Deleted = append(c.Deleted, other.Deleted...)
+}
+
+// synthesizeInstance builds a new instance, and its VM unless the group is an
+// errand, for an instance group member. IPs are assigned separately.
+func synthesizeInstance(deployment string, g manifestInstanceGroup, index int) (Instance, *VM) {
+	slug := strings.ReplaceAll(g.Name, "_", "-")
+	id := fmt.Sprintf("%s-%s-%d-id", deployment, slug, index)
+
+	az := ""
+	if len(g.AZs) > 0 {
+		az = g.AZs[index%len(g.AZs)]
+	}
+
+	inst := Instance{
+		AZ:         az,
+		Bootstrap:  index == 0,
+		Deployment: deployment,
+		ID:         id,
+		IPs:        []string{},
+		Job:        g.Name,
+		Index:      index,
+		VMType:     g.VMType,
+		Lifecycle:  g.Lifecycle,
+		Jobs:       g.Jobs,
+	}
+
+	if g.Lifecycle == LifecycleErrand {
+		inst.State = "stopped"
+		return inst, nil
+	}
+
+	inst.AgentID = agentID(deployment, g.Name, index, 0)
+	inst.VMCID = fmt.Sprintf("vm-%s-%s-%d", deployment, slug, index)
+	inst.Expects = true
+	inst.State = "running"
+	if g.PersistentDiskType != "" {
+		inst.Disk = fmt.Sprintf("disk-%s-%s-%d", deployment, slug, index)
+	}
+	for _, job := range g.Jobs {
+		inst.Processes = append(inst.Processes, Process{
+			Name:   job,
+			State:  "running",
+			Uptime: &Uptime{Seconds: 0},
+			Memory: &ResourceUsage{Percent: 0, KB: 0},
+			CPU:    &CPUUsage{Total: 0},
+		})
+	}
+
+	vm := &VM{
+		VMCID:        inst.VMCID,
+		Active:       true,
+		AgentID:      inst.AgentID,
+		AZ:           az,
+		Bootstrap:    inst.Bootstrap,
+		Deployment:   deployment,
+		IPs:          []string{},
+		Job:          g.Name,
+		Index:        index,
+		ID:           id,
+		ProcessState: "running",
+		State:        "started",
+		VMType:       g.VMType,
+		Lifecycle:    g.Lifecycle,
+		Jobs:         g.Jobs,
+	}
+	return inst, vm
+}
+
+// agentID returns the agent ID for an instance's VM. The scheme is
+// agent-<deployment>-<job>-<index>-<generation>, where generation starts at 0
+// and increments each time the VM is recreated.
+func agentID(deployment, job string, index, generation int) string {
+	return fmt.Sprintf("agent-%s-%s-%d-%d", deployment, job, index, generation)
+}
+
+// newVMCID returns a fresh CID for a replacement VM, vm-<uuid> the way
+// IaaS CPIs name VMs, so repeated recreates never collide.
+func newVMCID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("vm-%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// nextAgentID returns the agent ID for an instance's next VM, one generation
+// after current. IDs not following the scheme are treated as generation 0.
+func nextAgentID(deployment, job string, index int, current string) string {
+	generation := 0
+	prefix := fmt.Sprintf("agent-%s-%s-%d-", deployment, job, index)
+	if n, err := strconv.Atoi(strings.TrimPrefix(current, prefix)); err == nil && strings.HasPrefix(current, prefix) {
+		generation = n
+	}
+	return agentID(deployment, job, index, generation+1)
+}
+
+// AssignIPs allocates an IP from its AZ's subnets to each listed instance of
+// a deployment that has none, updating both the instance and its VM.
+func (s *State) AssignIPs(deployment string, instanceIDs []string) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	var cloud cloudConfigSummary
+	if n := len(s.data.CloudConfigs); n > 0 {
+		cloud = parseCloudConfig(s.data.CloudConfigs[n-1].Properties)
+	}
+	used := s.usedIPs()
+
+	pending := make(map[string]bool, len(instanceIDs))
+	for _, id := range instanceIDs {
+		pending[id] = true
+	}
+
+	assigned := make(map[string]string)
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		if !pending[instances[i].ID] || len(instances[i].IPs) > 0 || instances[i].Lifecycle == LifecycleErrand {
+			continue
+		}
+		ip := allocateIP(cloud, instances[i].AZ, used)
+		instances[i].IPs = []string{ip}
+		assigned[instances[i].ID] = ip
+	}
+
+	vms := s.data.VMs[deployment]
+	for i := range vms {
+		if ip, ok := assigned[vms[i].ID]; ok {
+			vms[i].IPs = []string{ip}
+		}
+	}
+}
+
+// usedIPs returns every IP held by a VM or instance. Callers must hold the
+// state lock.
+func (s *State) usedIPs() map[string]bool {
+	used := make(map[string]bool)
+	for _, vms := range s.data.VMs {
+		for _, vm := range vms {
+			for _, ip := range vm.IPs {
+				used[ip] = true
+			}
+		}
+	}
+	for _, instances := range s.data.Instances {
+		for _, inst := range instances {
+			for _, ip := range inst.IPs {
+				used[ip] = true
+			}
+		}
+	}
+	return used
+}
+
+// HasAZ reports whether the current cloud config defines the named AZ.
+func (s *State) HasAZ(az string) bool {
+	cc := s.GetCloudConfig()
+	if cc == nil {
+		return false
+	}
+	return parseCloudConfig(cc.Properties).hasAZ(az)
+}
+
+// MigrateInstance moves an instance and its VM to another AZ, giving it a new
+// VM, agent, and an IP from the target AZ's subnet.
+func (s *State) MigrateInstance(deployment, job, id, az string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	if len(s.data.CloudConfigs) == 0 {
+		return fmt.Errorf("no cloud config")
+	}
+	cloud := parseCloudConfig(s.data.CloudConfigs[len(s.data.CloudConfigs)-1].Properties)
+	if !cloud.hasAZ(az) {
+		return fmt.Errorf("az '%s' not found in cloud config", az)
+	}
+
+	instances := s.data.Instances[deployment]
+	var inst *Instance
+	for i := range instances {
+		if instances[i].Job == job && instances[i].ID == id {
+			inst = &instances[i]
+			break
+		}
+	}
+	if inst == nil {
+		return fmt.Errorf("instance '%s/%s' not found", job, id)
+	}
+	if inst.Lifecycle == LifecycleErrand {
+		return fmt.Errorf("instance '%s/%s' is an errand and has no VM", job, id)
+	}
+
+	used := s.usedIPs()
+	ip := ""
+	for _, cidr := range cloud.subnetRanges(az) {
+		if ip = nextFreeIPInRange(cidr, used); ip != "" {
+			break
+		}
+	}
+	if ip == "" {
+		return fmt.Errorf("no free IPs in az '%s'", az)
+	}
+
+	inst.AZ = az
+	inst.IPs = []string{ip}
+	inst.VMCID = newVMCID()
+	inst.AgentID = nextAgentID(deployment, job, inst.Index, inst.AgentID)
+
+	vms := s.data.VMs[deployment]
+	for i := range vms {
+		if vms[i].ID == id {
+			vms[i].AZ = inst.AZ
+			vms[i].IPs = []string{ip}
+			vms[i].VMCID = inst.VMCID
+			vms[i].AgentID = inst.AgentID
+		}
+	}
+
+	return nil
+}
+
+// nextFreeIP returns the first unused address in the 10.0.0.0/16 network,
+// starting above the ranges used by the default fixtures.
+func nextFreeIP(used map[string]bool) string {
+	for third := 10; third < 255; third++ {
+		for fourth := 10; fourth < 255; fourth++ {
+			ip := fmt.Sprintf("10.0.%d.%d", third, fourth)
+			if !used[ip] {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteDeployment removes a deployment and associated resources.
 func (s *State) DeleteDeployment(name string) error {
 	s.data.mu.Lock()
@@ -76,10 +757,20 @@ func (s *State) DeleteDeployment(name string) error {
 		return fmt.Errorf("deployment '%s' not found", name)
 	}
 
+	s.recordEvent(Event{
+		User:           s.lockHolder(name),
+		Action:         "delete",
+		ObjectType:     "deployment",
+		ObjectName:     name,
+		DeploymentName: name,
+	})
+
 	delete(s.data.Deployments, name)
 	delete(s.data.VMs, name)
 	delete(s.data.Instances, name)
 	delete(s.data.Variables, name)
+	delete(s.data.Links, name)
+	delete(s.data.Snapshots, name)
 
 	// Update stemcell deployment references
 	for i := range s.data.Stemcells {
@@ -89,184 +780,1356 @@ func (s *State) DeleteDeployment(name string) error {
 				deps = append(deps, d)
 			}
 		}
-		s.data.Stemcells[i].Deployments = deps
+		s.data.Stemcells[i].Deployments = deps
+	}
+
+	return nil
+}
+
+// DeploymentDeletion reports what DeleteDeployment would remove, without
+// changing anything.
+func (s *State) DeploymentDeletion(name string) (*DeploymentDeletion, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[name]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", name)
+	}
+
+	deletion := &DeploymentDeletion{
+		Deployment: name,
+		VMs:        len(s.data.VMs[name]),
+		Instances:  len(s.data.Instances[name]),
+		Variables:  len(s.data.Variables[name]),
+		Stemcells:  []string{},
+	}
+	for _, sc := range s.data.Stemcells {
+		for _, d := range sc.Deployments {
+			if d == name {
+				deletion.Stemcells = append(deletion.Stemcells, sc.Name+"/"+sc.Version)
+				break
+			}
+		}
+	}
+	return deletion, nil
+}
+
+// GetVMs returns VMs for a deployment.
+func (s *State) GetVMs(deployment string) ([]VM, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	vms := s.data.VMs[deployment]
+	result := make([]VM, len(vms))
+	copy(result, vms)
+	return result, nil
+}
+
+// GetDeploymentVitals sums process CPU and memory per job and across the
+// deployment. Errands, which only run on demand, are skipped.
+func (s *State) GetDeploymentVitals(deployment string) (*DeploymentVitals, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	vitals := &DeploymentVitals{Jobs: make(map[string]VitalsUsage)}
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Lifecycle == LifecycleErrand {
+			continue
+		}
+		usage := vitals.Jobs[inst.Job]
+		for _, p := range inst.Processes {
+			if p.CPU != nil {
+				usage.CPU += p.CPU.Total
+			}
+			if p.Memory != nil {
+				usage.MemKB += p.Memory.KB
+			}
+		}
+		vitals.Jobs[inst.Job] = usage
+	}
+
+	// Round away float noise from summing percentages
+	for job, usage := range vitals.Jobs {
+		usage.CPU = math.Round(usage.CPU*100) / 100
+		vitals.Jobs[job] = usage
+		vitals.Total.CPU += usage.CPU
+		vitals.Total.MemKB += usage.MemKB
+	}
+	vitals.Total.CPU = math.Round(vitals.Total.CPU*100) / 100
+	return vitals, nil
+}
+
+// VMTypeCounts returns how many VMs use each vm_type across all deployments.
+func (s *State) VMTypeCounts() map[string]int {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, vms := range s.data.VMs {
+		for _, vm := range vms {
+			counts[vm.VMType]++
+		}
+	}
+	return counts
+}
+
+// GetColocation groups a deployment's VMs by instance group and reports the
+// jobs colocated on each, in the order the groups first appear.
+func (s *State) GetColocation(deployment string) ([]ColocationGroup, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	groups := []ColocationGroup{}
+	position := make(map[string]int)
+	for _, vm := range s.data.VMs[deployment] {
+		i, ok := position[vm.Job]
+		if !ok {
+			jobs := vm.Jobs
+			if jobs == nil {
+				jobs = []string{}
+			}
+			i = len(groups)
+			position[vm.Job] = i
+			groups = append(groups, ColocationGroup{
+				InstanceGroup: vm.Job,
+				Jobs:          jobs,
+				VMs:           []string{},
+				Colocated:     len(jobs) > 1,
+			})
+		}
+		groups[i].VMs = append(groups[i].VMs, vm.VMCID)
+	}
+	return groups, nil
+}
+
+// IPInventory lists every IP held by a VM across deployments, sorted by
+// address, flagging any held by more than one VM.
+func (s *State) IPInventory() IPInventory {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	inventory := IPInventory{IPs: []IPAllocation{}, Duplicates: []string{}}
+	holders := make(map[string]int)
+	for deployment, vms := range s.data.VMs {
+		for _, vm := range vms {
+			for _, ip := range vm.IPs {
+				holders[ip]++
+				inventory.IPs = append(inventory.IPs, IPAllocation{
+					IP:         ip,
+					Deployment: deployment,
+					Instance:   s.naming.instanceName(vm.Job, vm.ID, vm.Index),
+					VMCID:      vm.VMCID,
+				})
+			}
+		}
+	}
+
+	for i := range inventory.IPs {
+		inventory.IPs[i].Duplicate = holders[inventory.IPs[i].IP] > 1
+	}
+	for ip, n := range holders {
+		if n > 1 {
+			inventory.Duplicates = append(inventory.Duplicates, ip)
+		}
+	}
+
+	sort.Slice(inventory.IPs, func(i, j int) bool {
+		a, b := inventory.IPs[i], inventory.IPs[j]
+		if c := compareIPs(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		return a.Deployment+"/"+a.Instance < b.Deployment+"/"+b.Instance
+	})
+	sort.Slice(inventory.Duplicates, func(i, j int) bool {
+		return compareIPs(inventory.Duplicates[i], inventory.Duplicates[j]) < 0
+	})
+	return inventory
+}
+
+// compareIPs orders addresses numerically, falling back to string order for
+// anything that does not parse.
+func compareIPs(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return strings.Compare(a, b)
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16())
+}
+
+// GetInstances returns instances for a deployment.
+func (s *State) GetInstances(deployment string) ([]Instance, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	instances := s.data.Instances[deployment]
+	result := make([]Instance, len(instances))
+	copy(result, instances)
+	return result, nil
+}
+
+// GetVariables returns variables for a deployment.
+func (s *State) GetVariables(deployment string) ([]Variable, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	vars := s.data.Variables[deployment]
+	result := make([]Variable, len(vars))
+	copy(result, vars)
+	return result, nil
+}
+
+// GetAllVariables returns every deployment's variables, ordered by
+// deployment name and then newest ID first.
+func (s *State) GetAllVariables() []VariableWithDeployment {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]VariableWithDeployment, 0)
+	for deployment, vars := range s.data.Variables {
+		for _, v := range vars {
+			result = append(result, VariableWithDeployment{Variable: v, Deployment: deployment})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Deployment != result[j].Deployment {
+			return result[i].Deployment < result[j].Deployment
+		}
+		return variableIDNumber(result[i].ID) > variableIDNumber(result[j].ID)
+	})
+	return result
+}
+
+// variableIDNumber returns N from a var-N ID, or 0 for other IDs.
+func variableIDNumber(id string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(id, "var-"))
+	return n
+}
+
+// RotateVariable simulates rotating a deployment's variable: it gets the
+// next free var-N ID and a new value, and an event records the rotation.
+func (s *State) RotateVariable(deployment, id, user string) (Variable, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return Variable{}, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	vars := s.data.Variables[deployment]
+	for i := range vars {
+		if vars[i].ID != id {
+			continue
+		}
+		next := 0
+		for _, dvars := range s.data.Variables {
+			for _, v := range dvars {
+				if n := variableIDNumber(v.ID); n > next {
+					next = n
+				}
+			}
+		}
+		vars[i].ID = fmt.Sprintf("var-%d", next+1)
+		vars[i].Value = syntheticVariableValue(deployment, vars[i].Name+"@"+vars[i].ID)
+		s.recordEvent(Event{
+			User:           user,
+			Action:         "rotate",
+			ObjectType:     "variable",
+			ObjectName:     vars[i].Name,
+			DeploymentName: deployment,
+			Context:        map[string]string{"old_id": id, "new_id": vars[i].ID},
+		})
+		return vars[i], nil
+	}
+	return Variable{}, fmt.Errorf("variable '%s' not found in deployment '%s'", id, deployment)
+}
+
+// GetVariableUsage returns each of a deployment's variables with the job
+// properties that reference it, sorted by name. Declared variables that
+// nothing references are listed with no references.
+func (s *State) GetVariableUsage(deployment string) ([]VariableUsage, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	d, ok := s.data.Deployments[deployment]
+	if !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	refs := variableReferences(d.Manifest)
+	for _, v := range s.data.Variables[deployment] {
+		if _, ok := refs[v.Name]; !ok {
+			refs[v.Name] = []VariableReference{}
+		}
+	}
+
+	result := make([]VariableUsage, 0, len(refs))
+	for name, references := range refs {
+		result = append(result, VariableUsage{Name: name, References: references})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// GetErrands returns the distinct errand instance groups in a deployment.
+func (s *State) GetErrands(deployment string) ([]Errand, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	result := make([]Errand, 0)
+	seen := make(map[string]bool)
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Lifecycle != LifecycleErrand || seen[inst.Job] {
+			continue
+		}
+		seen[inst.Job] = true
+		result = append(result, Errand{Name: inst.Job})
+	}
+	return result, nil
+}
+
+// GetSnapshots returns the disk snapshots for a deployment.
+func (s *State) GetSnapshots(deployment string) ([]Snapshot, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	result := make([]Snapshot, len(s.data.Snapshots[deployment]))
+	copy(result, s.data.Snapshots[deployment])
+	return result, nil
+}
+
+// CreateSnapshots takes a snapshot of every persistent disk in a deployment
+// and returns how many were created.
+func (s *State) CreateSnapshots(deployment string) (int, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return 0, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	now := time.Now().UTC().Format(snapshotTimeFormat)
+	created := 0
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Disk == "" {
+			continue
+		}
+		s.data.Snapshots[deployment] = append(s.data.Snapshots[deployment], Snapshot{
+			Job:         inst.Job,
+			Index:       inst.Index,
+			SnapshotCID: fmt.Sprintf("snap-%s-%d", inst.Disk, s.nextSnapshotSeq()),
+			CreatedAt:   now,
+			Clean:       true,
+		})
+		created++
+	}
+	return created, nil
+}
+
+// nextSnapshotSeq returns the next snapshot sequence number, one past the
+// highest ever used, so a deleted snapshot's CID isn't reused. Caller must
+// hold the write lock.
+func (s *State) nextSnapshotSeq() int {
+	highest := s.data.lastSnapshotSeq
+	for _, snapshots := range s.data.Snapshots {
+		for _, snap := range snapshots {
+			suffix := snap.SnapshotCID[strings.LastIndex(snap.SnapshotCID, "-")+1:]
+			if n, err := strconv.Atoi(suffix); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	s.data.lastSnapshotSeq = highest + 1
+	return s.data.lastSnapshotSeq
+}
+
+// DeleteSnapshots removes all snapshots for a deployment.
+func (s *State) DeleteSnapshots(deployment string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	delete(s.data.Snapshots, deployment)
+	return nil
+}
+
+// GetInstance returns a single instance by job and index.
+func (s *State) GetInstance(deployment, job string, index int) (*Instance, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Job == job && inst.Index == index {
+			copy := inst
+			return &copy, nil
+		}
+	}
+	return nil, fmt.Errorf("instance '%s/%d' not found in deployment '%s'", job, index, deployment)
+}
+
+// GetHealthURL returns the synthetic health URL for an instance, or an empty
+// string if its job has no health check or the instance has no IP.
+func (s *State) GetHealthURL(inst Instance) string {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	hc, ok := s.data.HealthChecks[inst.Job]
+	if !ok || len(inst.IPs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://%s:%d%s", inst.IPs[0], hc.Port, hc.Path)
+}
+
+// GetInstanceLinks returns the links each instance group in a deployment
+// provides and consumes, keyed by instance group. Consumed links are resolved
+// against the deployment's providers; unresolved links carry no type.
+func (s *State) GetInstanceLinks(deployment string) (map[string]InstanceLinks, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	jobs := s.data.Links[deployment]
+
+	providers := make(map[string]InstanceLink)
+	for job, links := range jobs {
+		for _, p := range links.Provides {
+			providers[p.Name] = InstanceLink{Name: p.Name, Type: p.Type, InstanceGroup: job}
+		}
+	}
+
+	result := make(map[string]InstanceLinks, len(jobs))
+	for job, links := range jobs {
+		il := InstanceLinks{
+			Provides: make([]InstanceLink, 0, len(links.Provides)),
+			Consumes: make([]InstanceLink, 0, len(links.Consumes)),
+		}
+		for _, p := range links.Provides {
+			il.Provides = append(il.Provides, InstanceLink{Name: p.Name, Type: p.Type, InstanceGroup: job})
+		}
+		for _, name := range links.Consumes {
+			if p, ok := providers[name]; ok {
+				il.Consumes = append(il.Consumes, p)
+			} else {
+				il.Consumes = append(il.Consumes, InstanceLink{Name: name})
+			}
+		}
+		result[job] = il
+	}
+	return result, nil
+}
+
+// GetTasks returns tasks matching the filter, leaving out tasks above the
+// verbose level.
+func (s *State) GetTasks(state, deployment, contextID string, verbose, limit int) []Task {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]Task, 0)
+	for _, t := range s.data.Tasks {
+		if state != "" && t.State != state {
+			continue
+		}
+		if deployment != "" && t.Deployment != deployment {
+			continue
+		}
+		if contextID != "" && t.ContextID != contextID {
+			continue
+		}
+		if t.Verbose > verbose {
+			continue
+		}
+		result = append(result, *t)
+	}
+
+	// Sort by ID descending (newest first)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result
+}
+
+// GetTask returns a task by ID.
+func (s *State) GetTask(id int) (*Task, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return nil, fmt.Errorf("task %d not found", id)
+	}
+	copy := *t
+	copy.QueuePosition = s.data.queuePosition(id)
+	return &copy, nil
+}
+
+// HasTask reports whether a task exists.
+func (s *State) HasTask(id int) bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+	_, ok := s.data.Tasks[id]
+	return ok
+}
+
+// DeleteTask removes a task, its events, and any lock it holds.
+func (s *State) DeleteTask(id int) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Tasks[id]; !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	delete(s.data.Tasks, id)
+	delete(s.data.TaskEvents, id)
+	s.data.dequeueTask(id)
+	s.data.releaseTaskLocks(id)
+	return nil
+}
+
+// releaseTaskLocks removes the locks held by task id. Callers must hold the
+// state lock.
+func (d *StateData) releaseTaskLocks(id int) {
+	holder := strconv.Itoa(id)
+	locks := make([]Lock, 0, len(d.Locks))
+	for _, l := range d.Locks {
+		if l.TaskID != holder {
+			locks = append(locks, l)
+		}
+	}
+	d.Locks = locks
+}
+
+// CreateTask creates a new task and returns its ID.
+func (s *State) CreateTask(description, deployment, user string) *Task {
+	return s.CreateTaskInContext(description, deployment, user, "")
+}
+
+// CreateTaskInContext creates a new task carrying a client's context ID, so
+// the client can find the tasks it submitted together.
+func (s *State) CreateTaskInContext(description, deployment, user, contextID string) *Task {
+	return s.addTask(&Task{Description: description, User: user, Deployment: deployment, ContextID: contextID})
+}
+
+// CreateLockedTask creates a task in a client's context that holds the
+// deployment lock from the start, so no other mutation of the deployment can
+// be submitted while it's queued or running. It fails if another task holds
+// the lock.
+func (s *State) CreateLockedTask(description, deployment, user, contextID string) (*Task, error) {
+	return s.addLockedTask(&Task{Description: description, User: user, Deployment: deployment, ContextID: contextID})
+}
+
+// CreateLockedInternalTask is CreateLockedTask for a task the director starts
+// on its own, listed by /tasks only at verbose=2.
+func (s *State) CreateLockedInternalTask(description, deployment, user string) (*Task, error) {
+	return s.addLockedTask(&Task{Description: description, User: user, Deployment: deployment, Verbose: 2})
+}
+
+// addLockedTask stores a new task and takes its deployment's lock for it in
+// one step. The lock is released when the task ends or is deleted.
+func (s *State) addLockedTask(task *Task) (*Task, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, l := range s.data.Locks {
+		if l.Resource == task.Deployment {
+			return nil, fmt.Errorf("deployment %s is locked", task.Deployment)
+		}
+	}
+	s.storeTask(task)
+	s.data.Locks = append(s.data.Locks, Lock{
+		Type:     "deployment",
+		Resource: task.Deployment,
+		Timeout:  deploymentLockTimeout.String(),
+		TaskID:   strconv.Itoa(task.ID),
+	})
+	return task, nil
+}
+
+// addTask numbers a new task and stores it queued.
+func (s *State) addTask(task *Task) *Task {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+	return s.storeTask(task)
+}
+
+// storeTask numbers a new task and stores it queued. Caller must hold the
+// write lock.
+func (s *State) storeTask(task *Task) *Task {
+	s.data.nextTaskID++
+	task.ID = s.data.nextTaskID
+	task.State = "queued"
+	task.Timestamp = time.Now().Unix()
+	s.data.Tasks[task.ID] = task
+	s.recordTaskEvent(task, "create", nil)
+	return task
+}
+
+// CreateChildTask creates a task that runs on behalf of a parent task, sharing
+// its deployment, user, and context ID. A parent without a context ID is given
+// one so its children can be linked to it.
+func (s *State) CreateChildTask(parentID int, description string) (*Task, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	parent, ok := s.data.Tasks[parentID]
+	if !ok {
+		return nil, fmt.Errorf("task %d not found", parentID)
+	}
+	if parent.ContextID == "" {
+		parent.ContextID = fmt.Sprintf("task-%d", parent.ID)
+	}
+
+	s.data.nextTaskID++
+	task := &Task{
+		ID:          s.data.nextTaskID,
+		State:       "queued",
+		Description: description,
+		Timestamp:   time.Now().Unix(),
+		User:        parent.User,
+		Deployment:  parent.Deployment,
+		ContextID:   parent.ContextID,
+	}
+	s.data.Tasks[task.ID] = task
+	s.recordTaskEvent(task, "create", nil)
+	return task, nil
+}
+
+// UpdateTaskState updates a task's state, stamping when it starts
+// processing and when it ends.
+func (s *State) UpdateTaskState(id int, state, result string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	s.setTaskState(t, state, result)
+	return nil
+}
+
+// CompleteTask marks a task done with result, or cancelled if a cancel was
+// requested before it got there. It returns the state the task ended in.
+func (s *State) CompleteTask(id int, result string) (string, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return "", fmt.Errorf("task %d not found", id)
+	}
+	if t.State == "cancelling" {
+		s.setTaskState(t, "cancelled", "Task cancelled")
+	} else {
+		s.setTaskState(t, "done", result)
+	}
+	return t.State, nil
+}
+
+// setTaskState moves a task to state, stamping its start or finish time and
+// releasing its locks once it ends. Caller must hold the write lock.
+func (s *State) setTaskState(t *Task, state, result string) {
+	t.State = state
+	if result != "" {
+		t.Result = result
+	}
+	switch {
+	case state == "processing" && t.StartedAt == 0:
+		t.StartedAt = time.Now().Unix()
+	case isTerminalTaskState(state):
+		t.FinishedAt = time.Now().Unix()
+		s.data.releaseTaskLocks(t.ID)
+		if state == "done" {
+			t.ProgressPercent = 100
+		}
+	}
+	s.recordTaskEvent(t, "update", map[string]string{"state": state})
+}
+
+// SetTaskProgress records how far through its work a task is.
+func (s *State) SetTaskProgress(id, percent int) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	t.ProgressPercent = percent
+	return nil
+}
+
+// recordTaskEvent records an event about a task and counts the state it
+// entered. Caller must hold the write lock.
+func (s *State) recordTaskEvent(t *Task, action string, context map[string]string) {
+	s.metrics.countTask(t.State)
+	id := fmt.Sprintf("%d", t.ID)
+	s.recordEvent(Event{
+		User:           t.User,
+		Action:         action,
+		ObjectType:     "task",
+		ObjectName:     id,
+		DeploymentName: t.Deployment,
+		TaskID:         id,
+		Context:        context,
+	})
+}
+
+// recordEvent appends an event, assigning its ID and timestamp. Caller must
+// hold the write lock.
+func (s *State) recordEvent(e Event) {
+	e.ID = 1
+	if n := len(s.data.Events); n > 0 {
+		e.ID = s.data.Events[n-1].ID + 1
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = time.Now().Unix()
+	}
+	s.data.Events = append(s.data.Events, e)
+}
+
+// lockHolder returns the user of the task holding a deployment's lock, or ""
+// if none. Caller must hold the lock.
+func (s *State) lockHolder(deployment string) string {
+	for _, l := range s.data.Locks {
+		if l.Resource != deployment {
+			continue
+		}
+		if id, err := strconv.Atoi(l.TaskID); err == nil {
+			if t, ok := s.data.Tasks[id]; ok {
+				return t.User
+			}
+		}
+	}
+	return ""
+}
+
+// eventsPageSize caps how many events GetEvents returns.
+const eventsPageSize = 200
+
+// GetEvents returns events matching the filter, newest first.
+func (s *State) GetEvents(filter EventFilter) []Event {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]Event, 0)
+	for i := len(s.data.Events) - 1; i >= 0 && len(result) < eventsPageSize; i-- {
+		e := s.data.Events[i]
+		if filter.BeforeID > 0 && e.ID >= filter.BeforeID {
+			continue
+		}
+		if filter.Deployment != "" && e.DeploymentName != filter.Deployment {
+			continue
+		}
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		if filter.ObjectType != "" && e.ObjectType != filter.ObjectType {
+			continue
+		}
+		if filter.TaskID != "" && e.TaskID != filter.TaskID {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// SetTaskResult sets a task's result without changing its state.
+func (s *State) SetTaskResult(id int, result string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	t.Result = result
+	return nil
+}
+
+// AppendTaskEvent records an event line for a task, assigning its byte offset
+// within the task's event output.
+func (s *State) AppendTaskEvent(id int, event TaskEvent) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Tasks[id]; !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+
+	event.Offset = 0
+	if events := s.data.TaskEvents[id]; len(events) > 0 {
+		last := events[len(events)-1]
+		line, err := json.Marshal(last)
+		if err != nil {
+			return err
+		}
+		event.Offset = last.Offset + int64(len(line)) + 1
+	}
+	if event.Tags == nil {
+		event.Tags = []string{}
+	}
+
+	s.data.TaskEvents[id] = append(s.data.TaskEvents[id], event)
+	s.stream.publish(TaskStreamEvent{TaskID: id, TaskEvent: event})
+	return nil
+}
+
+// SubscribeTaskEvents returns a channel receiving every task event appended
+// from now on, and a function to unsubscribe.
+func (s *State) SubscribeTaskEvents() (<-chan TaskStreamEvent, func()) {
+	return s.stream.subscribe()
+}
+
+// GetTaskEvents returns a task's events starting at or after sinceOffset.
+func (s *State) GetTaskEvents(id int, sinceOffset int64) []TaskEvent {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]TaskEvent, 0)
+	for _, e := range s.data.TaskEvents[id] {
+		if e.Offset >= sinceOffset {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// isTerminalTaskState reports whether a task in this state can no longer change.
+func isTerminalTaskState(state string) bool {
+	switch state {
+	case "done", "error", "cancelled":
+		return true
+	}
+	return false
+}
+
+// CancelTask marks a running or queued task as cancelling. The simulator moves
+// it to cancelled at its next step boundary.
+func (s *State) CancelTask(id int) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	t, ok := s.data.Tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	if isTerminalTaskState(t.State) {
+		return fmt.Errorf("task %d is already %s", id, t.State)
+	}
+	t.State = "cancelling"
+	s.recordTaskEvent(t, "update", map[string]string{"state": t.State})
+	return nil
+}
+
+// GetStemcells returns all stemcells.
+func (s *State) GetStemcells() []Stemcell {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]Stemcell, len(s.data.Stemcells))
+	copy(result, s.data.Stemcells)
+	return result
+}
+
+// GetOrphanedDisks returns all orphaned disks.
+func (s *State) GetOrphanedDisks() []OrphanedDisk {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	result := make([]OrphanedDisk, len(s.data.Disks))
+	copy(result, s.data.Disks)
+	return result
+}
+
+// HasOrphanedDisk checks if an orphaned disk exists.
+func (s *State) HasOrphanedDisk(cid string) bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	for _, d := range s.data.Disks {
+		if d.DiskCID == cid {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteOrphanedDisk removes an orphaned disk by CID.
+func (s *State) DeleteOrphanedDisk(cid string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for i, d := range s.data.Disks {
+		if d.DiskCID == cid {
+			s.data.Disks = append(s.data.Disks[:i:i], s.data.Disks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("disk '%s' not found", cid)
+}
+
+// packageCompilation is one release package that must be compiled against a
+// stemcell before a deploy can proceed.
+type packageCompilation struct {
+	Release  string
+	Version  string
+	Package  string
+	Stemcell string // "os/version"
+}
+
+// PendingCompilations returns the packages of releases referenced by a
+// manifest that have not been compiled for its stemcell.
+func (s *State) PendingCompilations(manifest string) []packageCompilation {
+	summary := parseManifest(manifest)
+	if len(summary.Stemcells) == 0 {
+		return nil
+	}
+
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	ms := summary.Stemcells[0]
+	stemcellOS := ms.OS
+	for _, sc := range s.data.Stemcells {
+		if stemcellOS == "" && sc.Name == ms.Name && sc.Version == ms.Version {
+			stemcellOS = sc.OperatingSystem
+		}
+	}
+	stemcell := fmt.Sprintf("%s/%s", stemcellOS, ms.Version)
+
+	var result []packageCompilation
+	for _, ref := range summary.Releases {
+		for _, rel := range s.data.Releases {
+			if rel.Name != ref.Name || rel.Version != ref.Version || containsString(rel.CompiledFor, stemcell) {
+				continue
+			}
+			for _, pkg := range rel.Packages {
+				result = append(result, packageCompilation{
+					Release:  rel.Name,
+					Version:  rel.Version,
+					Package:  pkg,
+					Stemcell: stemcell,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// MarkCompiled records that the given compilations' releases are compiled
+// for their stemcells.
+func (s *State) MarkCompiled(compilations []packageCompilation) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, c := range compilations {
+		for i := range s.data.Releases {
+			rel := &s.data.Releases[i]
+			if rel.Name == c.Release && rel.Version == c.Version && !containsString(rel.CompiledFor, c.Stemcell) {
+				rel.CompiledFor = append(rel.CompiledFor, c.Stemcell)
+			}
+		}
+	}
+}
+
+// cleanupKeepVersions is how many unused versions of each release and stemcell
+// a cleanup without remove_all keeps, matching the director's default.
+const cleanupKeepVersions = 2
+
+// Cleanup removes unused releases and stemcells and all orphaned disks. A
+// release is in use if a deployment or runtime config references it, and a
+// stemcell if any deployment uses it. Unless removeAll is set, the newest
+// unused versions of each name are kept.
+func (s *State) Cleanup(removeAll bool) CleanupSummary {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	summary := CleanupSummary{
+		Releases:      []NameVersion{},
+		Stemcells:     []NameVersion{},
+		OrphanedDisks: []string{},
+	}
+
+	inUse := make(map[NameVersion]bool)
+	for _, d := range s.data.Deployments {
+		for _, rel := range d.Releases {
+			inUse[rel] = true
+		}
+	}
+	for _, rc := range latestRuntimeConfigs(s.data.RuntimeConfigs) {
+		for _, rel := range parseManifest(rc.Properties).Releases {
+			inUse[rel] = true
+		}
+	}
+
+	releases := make([]NameVersion, len(s.data.Releases))
+	for i, rel := range s.data.Releases {
+		releases[i] = NameVersion{Name: rel.Name, Version: rel.Version}
+	}
+	removeReleases := unusedVersions(releases, func(i int) bool { return inUse[releases[i]] }, removeAll)
+	keptReleases := make([]Release, 0, len(s.data.Releases))
+	for i, rel := range s.data.Releases {
+		if removeReleases[i] {
+			summary.Releases = append(summary.Releases, releases[i])
+			continue
+		}
+		keptReleases = append(keptReleases, rel)
+	}
+	s.data.Releases = keptReleases
+
+	stemcells := make([]NameVersion, len(s.data.Stemcells))
+	for i, sc := range s.data.Stemcells {
+		stemcells[i] = NameVersion{Name: sc.Name, Version: sc.Version}
+	}
+	removeStemcells := unusedVersions(stemcells, func(i int) bool { return len(s.data.Stemcells[i].Deployments) > 0 }, removeAll)
+	keptStemcells := make([]Stemcell, 0, len(s.data.Stemcells))
+	for i, sc := range s.data.Stemcells {
+		if removeStemcells[i] {
+			summary.Stemcells = append(summary.Stemcells, stemcells[i])
+			continue
+		}
+		keptStemcells = append(keptStemcells, sc)
+	}
+	s.data.Stemcells = keptStemcells
+
+	for _, d := range s.data.Disks {
+		summary.OrphanedDisks = append(summary.OrphanedDisks, d.DiskCID)
+	}
+	s.data.Disks = []OrphanedDisk{}
+
+	return summary
+}
+
+// unusedVersions returns the indexes of items to remove: those not in use,
+// except the newest cleanupKeepVersions unused versions of each name unless
+// removeAll is set.
+func unusedVersions(items []NameVersion, used func(i int) bool, removeAll bool) map[int]bool {
+	byName := make(map[string][]int)
+	for i, item := range items {
+		if !used(i) {
+			byName[item.Name] = append(byName[item.Name], i)
+		}
+	}
+
+	remove := make(map[int]bool)
+	for _, indexes := range byName {
+		sort.Slice(indexes, func(a, b int) bool {
+			return compareVersions(items[indexes[a]].Version, items[indexes[b]].Version) > 0
+		})
+		keep := cleanupKeepVersions
+		if removeAll {
+			keep = 0
+		}
+		for n, i := range indexes {
+			if n >= keep {
+				remove[i] = true
+			}
+		}
 	}
+	return remove
+}
 
-	return nil
+// compareVersions compares dotted version strings numerically where possible,
+// returning -1, 0, or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
 }
 
-// GetVMs returns VMs for a deployment.
-func (s *State) GetVMs(deployment string) ([]VM, error) {
+// GetReleases returns all releases.
+func (s *State) GetReleases() []Release {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	if _, ok := s.data.Deployments[deployment]; !ok {
-		return nil, fmt.Errorf("deployment '%s' not found", deployment)
-	}
-
-	vms := s.data.VMs[deployment]
-	result := make([]VM, len(vms))
-	copy(result, vms)
-	return result, nil
+	result := make([]Release, len(s.data.Releases))
+	copy(result, s.data.Releases)
+	return result
 }
 
-// GetInstances returns instances for a deployment.
-func (s *State) GetInstances(deployment string) ([]Instance, error) {
+// Config history slices are stored oldest first, so the last entry of each
+// type (or of each runtime config name) is the current version.
+
+// GetCloudConfig returns the current cloud config.
+func (s *State) GetCloudConfig() *CloudConfig {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	if _, ok := s.data.Deployments[deployment]; !ok {
-		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	if len(s.data.CloudConfigs) == 0 {
+		return nil
 	}
-
-	instances := s.data.Instances[deployment]
-	result := make([]Instance, len(instances))
-	copy(result, instances)
-	return result, nil
+	latest := s.data.CloudConfigs[len(s.data.CloudConfigs)-1]
+	return &latest
 }
 
-// GetVariables returns variables for a deployment.
-func (s *State) GetVariables(deployment string) ([]Variable, error) {
+// GetCloudConfigHistory returns every cloud config version, newest first.
+func (s *State) GetCloudConfigHistory() []CloudConfig {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	if _, ok := s.data.Deployments[deployment]; !ok {
-		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	result := make([]CloudConfig, 0, len(s.data.CloudConfigs))
+	for i := len(s.data.CloudConfigs) - 1; i >= 0; i-- {
+		result = append(result, s.data.CloudConfigs[i])
 	}
-
-	vars := s.data.Variables[deployment]
-	result := make([]Variable, len(vars))
-	copy(result, vars)
-	return result, nil
+	return result
 }
 
-// GetTasks returns tasks matching the filter.
-func (s *State) GetTasks(state, deployment string, limit int) []Task {
+// GetRuntimeConfigs returns the current version of each runtime config.
+func (s *State) GetRuntimeConfigs() []RuntimeConfig {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	result := make([]Task, 0)
-	for _, t := range s.data.Tasks {
-		if state != "" && t.State != state {
-			continue
-		}
-		if deployment != "" && t.Deployment != deployment {
-			continue
-		}
-		result = append(result, *t)
-	}
+	return latestRuntimeConfigs(s.data.RuntimeConfigs)
+}
 
-	// Sort by ID descending (newest first)
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].ID > result[j].ID
-	})
+// GetRuntimeConfigHistory returns every runtime config version, newest first.
+func (s *State) GetRuntimeConfigHistory() []RuntimeConfig {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
 
-	if limit > 0 && len(result) > limit {
-		result = result[:limit]
+	result := make([]RuntimeConfig, 0, len(s.data.RuntimeConfigs))
+	for i := len(s.data.RuntimeConfigs) - 1; i >= 0; i-- {
+		result = append(result, s.data.RuntimeConfigs[i])
 	}
-
 	return result
 }
 
-// GetTask returns a task by ID.
-func (s *State) GetTask(id int) (*Task, error) {
-	s.data.mu.RLock()
-	defer s.data.mu.RUnlock()
+// latestRuntimeConfigs returns the newest version of each named runtime
+// config, in the order the names were first created.
+func latestRuntimeConfigs(history []RuntimeConfig) []RuntimeConfig {
+	index := make(map[string]int)
+	result := make([]RuntimeConfig, 0)
+	for _, rc := range history {
+		if i, ok := index[rc.Name]; ok {
+			result[i] = rc
+			continue
+		}
+		index[rc.Name] = len(result)
+		result = append(result, rc)
+	}
+	return result
+}
 
-	t, ok := s.data.Tasks[id]
-	if !ok {
-		return nil, fmt.Errorf("task %d not found", id)
+// nextConfigID returns the next config ID, one past the highest ID of any
+// config type ever stored, so a deleted config's ID isn't reused. Caller must
+// hold the lock.
+func (s *State) nextConfigID() string {
+	highest := s.data.lastConfigID
+	consider := func(id string) {
+		if n, err := strconv.Atoi(id); err == nil && n > highest {
+			highest = n
+		}
 	}
-	copy := *t
-	return &copy, nil
+	for _, c := range s.data.CloudConfigs {
+		consider(c.ID)
+	}
+	for _, c := range s.data.RuntimeConfigs {
+		consider(c.ID)
+	}
+	for _, c := range s.data.CPIConfigs {
+		consider(c.ID)
+	}
+	s.data.lastConfigID = highest + 1
+	return strconv.Itoa(s.data.lastConfigID)
 }
 
-// CreateTask creates a new task and returns its ID.
-func (s *State) CreateTask(description, deployment, user string) *Task {
+// AddCloudConfig stores a new cloud config version and returns it.
+func (s *State) AddCloudConfig(content string) CloudConfig {
 	s.data.mu.Lock()
 	defer s.data.mu.Unlock()
 
-	s.data.nextTaskID++
-	task := &Task{
-		ID:          s.data.nextTaskID,
-		State:       "queued",
-		Description: description,
-		Timestamp:   time.Now().Unix(),
-		User:        user,
-		Deployment:  deployment,
+	config := CloudConfig{
+		ID:         s.nextConfigID(),
+		Properties: content,
+		CreatedAt:  time.Now().Format(time.RFC3339),
 	}
-	s.data.Tasks[task.ID] = task
-	return task
+	s.data.CloudConfigs = append(s.data.CloudConfigs, config)
+	return config
 }
 
-// UpdateTaskState updates a task's state.
-func (s *State) UpdateTaskState(id int, state, result string) error {
+// AddRuntimeConfig stores a new version of a named runtime config and
+// returns it.
+func (s *State) AddRuntimeConfig(name, content string) RuntimeConfig {
 	s.data.mu.Lock()
 	defer s.data.mu.Unlock()
 
-	t, ok := s.data.Tasks[id]
-	if !ok {
-		return fmt.Errorf("task %d not found", id)
-	}
-	t.State = state
-	if result != "" {
-		t.Result = result
+	config := RuntimeConfig{
+		ID:         s.nextConfigID(),
+		Name:       name,
+		Properties: content,
+		CreatedAt:  time.Now().Format(time.RFC3339),
 	}
-	return nil
+	s.data.RuntimeConfigs = append(s.data.RuntimeConfigs, config)
+	return config
 }
 
-// GetStemcells returns all stemcells.
-func (s *State) GetStemcells() []Stemcell {
-	s.data.mu.RLock()
-	defer s.data.mu.RUnlock()
+// AddCPIConfig stores a new CPI config version and returns it.
+func (s *State) AddCPIConfig(content string) CPIConfig {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
 
-	result := make([]Stemcell, len(s.data.Stemcells))
-	copy(result, s.data.Stemcells)
-	return result
+	config := CPIConfig{
+		ID:         s.nextConfigID(),
+		Properties: content,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+	}
+	s.data.CPIConfigs = append(s.data.CPIConfigs, config)
+	return config
 }
 
-// GetReleases returns all releases.
-func (s *State) GetReleases() []Release {
-	s.data.mu.RLock()
-	defer s.data.mu.RUnlock()
+// DeleteConfig removes every version of a config. For runtime configs only
+// the named config is removed; cloud and CPI configs are cleared entirely.
+func (s *State) DeleteConfig(configType, name string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
 
-	result := make([]Release, len(s.data.Releases))
-	copy(result, s.data.Releases)
-	return result
+	switch configType {
+	case "cloud":
+		if len(s.data.CloudConfigs) == 0 {
+			return fmt.Errorf("cloud config not found")
+		}
+		s.data.CloudConfigs = []CloudConfig{}
+	case "cpi":
+		if len(s.data.CPIConfigs) == 0 {
+			return fmt.Errorf("cpi config not found")
+		}
+		s.data.CPIConfigs = []CPIConfig{}
+	case "runtime":
+		kept := make([]RuntimeConfig, 0, len(s.data.RuntimeConfigs))
+		for _, rc := range s.data.RuntimeConfigs {
+			if rc.Name != name {
+				kept = append(kept, rc)
+			}
+		}
+		if len(kept) == len(s.data.RuntimeConfigs) {
+			return fmt.Errorf("runtime config '%s' not found", name)
+		}
+		s.data.RuntimeConfigs = kept
+	default:
+		return fmt.Errorf("unknown config type: %s", configType)
+	}
+	return nil
 }
 
-// GetCloudConfig returns the cloud config.
-func (s *State) GetCloudConfig() *CloudConfig {
+// GetCPIConfig returns the current CPI config.
+func (s *State) GetCPIConfig() *CPIConfig {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	if s.data.CloudConfig == nil {
+	if len(s.data.CPIConfigs) == 0 {
 		return nil
 	}
-	copy := *s.data.CloudConfig
-	return &copy
+	latest := s.data.CPIConfigs[len(s.data.CPIConfigs)-1]
+	return &latest
 }
 
-// GetRuntimeConfigs returns all runtime configs.
-func (s *State) GetRuntimeConfigs() []RuntimeConfig {
+// GetCPIConfigHistory returns every CPI config version, newest first.
+func (s *State) GetCPIConfigHistory() []CPIConfig {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	result := make([]RuntimeConfig, len(s.data.RuntimeConfigs))
-	copy(result, s.data.RuntimeConfigs)
+	result := make([]CPIConfig, 0, len(s.data.CPIConfigs))
+	for i := len(s.data.CPIConfigs) - 1; i >= 0; i-- {
+		result = append(result, s.data.CPIConfigs[i])
+	}
 	return result
 }
 
-// GetCPIConfig returns the CPI config.
-func (s *State) GetCPIConfig() *CPIConfig {
+// GetConfigVersion returns the content of one stored version of a config.
+// Cloud and CPI configs have a single name, so name only applies to runtime
+// configs.
+func (s *State) GetConfigVersion(configType, name, id string) (string, error) {
 	s.data.mu.RLock()
 	defer s.data.mu.RUnlock()
 
-	if s.data.CPIConfig == nil {
-		return nil
+	switch configType {
+	case "cloud":
+		for _, c := range s.data.CloudConfigs {
+			if c.ID == id {
+				return c.Properties, nil
+			}
+		}
+	case "runtime":
+		for _, c := range s.data.RuntimeConfigs {
+			if c.ID == id && c.Name == name {
+				return c.Properties, nil
+			}
+		}
+	case "cpi":
+		for _, c := range s.data.CPIConfigs {
+			if c.ID == id {
+				return c.Properties, nil
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown config type: %s", configType)
 	}
-	copy := *s.data.CPIConfig
-	return &copy
+	return "", fmt.Errorf("%s config '%s' version '%s' not found", configType, name, id)
 }
 
 // GetLocks returns all locks.
@@ -279,11 +2142,19 @@ func (s *State) GetLocks() []Lock {
 	return result
 }
 
-// AddLock adds a deployment lock.
+// deploymentLockTimeout is the timeout reported for deployment locks.
+const deploymentLockTimeout = 30 * time.Minute
+
+// AddLock adds a deployment lock, unless the task already holds it.
 func (s *State) AddLock(lockType, resource, taskID string, timeout time.Duration) {
 	s.data.mu.Lock()
 	defer s.data.mu.Unlock()
 
+	for _, l := range s.data.Locks {
+		if l.Resource == resource && l.TaskID == taskID {
+			return
+		}
+	}
 	s.data.Locks = append(s.data.Locks, Lock{
 		Type:     lockType,
 		Resource: resource,
@@ -292,6 +2163,19 @@ func (s *State) AddLock(lockType, resource, taskID string, timeout time.Duration
 	})
 }
 
+// IsLocked reports whether a lock is held on a resource.
+func (s *State) IsLocked(resource string) bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	for _, l := range s.data.Locks {
+		if l.Resource == resource {
+			return true
+		}
+	}
+	return false
+}
+
 // RemoveLock removes a lock for a resource.
 func (s *State) RemoveLock(resource string) {
 	s.data.mu.Lock()
@@ -314,8 +2198,11 @@ func (s *State) RecreateVMs(deployment, job, index string) error {
 	if _, ok := s.data.Deployments[deployment]; !ok {
 		return fmt.Errorf("deployment '%s' not found", deployment)
 	}
+	if err := s.unresponsiveAgentError(deployment, job); err != nil {
+		return err
+	}
 
-	// Update VMs
+	// Update VMs, mirroring each change onto its instance
 	vms := s.data.VMs[deployment]
 	for i := range vms {
 		if job != "" && vms[i].Job != job {
@@ -324,63 +2211,215 @@ func (s *State) RecreateVMs(deployment, job, index string) error {
 		if index != "" && fmt.Sprintf("%d", vms[i].Index) != index {
 			continue
 		}
-		// Simulate recreation by generating new VM CID
-		vms[i].VMCID = fmt.Sprintf("vm-%s-%s-%d-recreated", deployment, vms[i].Job, vms[i].Index)
+		if vms[i].Ignore {
+			continue
+		}
+		// Simulate recreation by generating new VM CID and agent
+		vms[i].VMCID = newVMCID()
+		vms[i].AgentID = nextAgentID(deployment, vms[i].Job, vms[i].Index, vms[i].AgentID)
+		s.syncInstanceFromVM(deployment, vms[i])
+	}
+
+	return nil
+}
+
+// syncInstanceFromVM mirrors a VM's CID, agent, and run state onto the
+// instance with its ID, so the VMs and Instances stores never drift. Errand
+// instances only run on demand and are left alone. The caller must hold the
+// write lock.
+func (s *State) syncInstanceFromVM(deployment string, vm VM) {
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		inst := &instances[i]
+		if inst.ID != vm.ID || inst.Lifecycle == LifecycleErrand {
+			continue
+		}
+		inst.VMCID = vm.VMCID
+		inst.AgentID = vm.AgentID
+		switch vm.State {
+		case "stopped":
+			inst.State = "stopped"
+			inst.Processes = processesInState(inst.Processes, "stopped")
+		case "detached":
+			inst.State = "detached"
+			inst.Expects = false
+			inst.Processes = processesInState(inst.Processes, "stopped")
+		case "started":
+			inst.State = "running"
+			inst.Expects = true
+			inst.Processes = processesInState(inst.Processes, "running")
+		}
+		return
+	}
+}
+
+// SetIgnore marks an instance and its VM as ignored, or not. Recreates and
+// state changes skip ignored VMs, as BOSH skips them during deploys.
+func (s *State) SetIgnore(deployment, job, id string, ignore bool) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
 	}
 
+	found := false
+	vms := s.data.VMs[deployment]
+	for i := range vms {
+		if vms[i].Job == job && vms[i].ID == id {
+			vms[i].Ignore = ignore
+			found = true
+		}
+	}
+	instances := s.data.Instances[deployment]
+	for i := range instances {
+		if instances[i].Job == job && instances[i].ID == id {
+			instances[i].Ignore = ignore
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("instance '%s/%s' not found", job, id)
+	}
 	return nil
 }
 
-// ChangeJobState changes the state of jobs in a deployment.
-func (s *State) ChangeJobState(deployment, job, newState string) error {
+// SSHTargets returns a deployment's non-errand VMs matching an ssh target.
+func (s *State) SSHTargets(deployment string, target SSHTarget) ([]VM, error) {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return nil, fmt.Errorf("deployment '%s' not found", deployment)
+	}
+
+	selectors := append(append([]string{}, target.Indexes...), target.IDs...)
+	var result []VM
+	for _, vm := range s.data.VMs[deployment] {
+		if vm.Lifecycle == LifecycleErrand {
+			continue
+		}
+		if target.Job != "" && vm.Job != target.Job {
+			continue
+		}
+		if len(selectors) > 0 && !containsString(selectors, vm.ID) && !containsString(selectors, strconv.Itoa(vm.Index)) {
+			continue
+		}
+		result = append(result, vm)
+	}
+	return result, nil
+}
+
+// InstanceTaskNames returns the names task events use for a deployment's VM
+// instances, in "job/id (index)" form, optionally filtered by job and index.
+func (s *State) InstanceTaskNames(deployment, job, index string) []string {
+	var names []string
+	for _, inst := range s.InstanceTargets(deployment, job, index) {
+		names = append(names, s.naming.taskName(inst.Job, inst.ID, inst.Index))
+	}
+	return names
+}
+
+// InstanceTargets returns a deployment's VM instances, optionally filtered by
+// job and index, in the order tasks update them.
+func (s *State) InstanceTargets(deployment, job, index string) []Instance {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	var instances []Instance
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Lifecycle == LifecycleErrand {
+			continue
+		}
+		if job != "" && inst.Job != job {
+			continue
+		}
+		if index != "" && fmt.Sprintf("%d", inst.Index) != index {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// CheckAgents returns the error a director reports before touching a
+// deployment, or one job of it, with an unresponsive agent.
+func (s *State) CheckAgents(deployment, job string) error {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+
+	if _, ok := s.data.Deployments[deployment]; !ok {
+		return fmt.Errorf("deployment '%s' not found", deployment)
+	}
+	return s.unresponsiveAgentError(deployment, job)
+}
+
+// ChangeJobState changes the state of jobs in a deployment, or of one
+// instance when index is set. A hard stop deletes the VM but keeps the
+// instance, like bosh stop --hard; starting again creates a new VM.
+func (s *State) ChangeJobState(deployment, job, index, newState string, hard bool) error {
 	s.data.mu.Lock()
 	defer s.data.mu.Unlock()
 
 	if _, ok := s.data.Deployments[deployment]; !ok {
 		return fmt.Errorf("deployment '%s' not found", deployment)
 	}
+	if err := s.unresponsiveAgentError(deployment, job); err != nil {
+		return err
+	}
 
 	// Determine process state based on job state
 	processState := "running"
-	vmProcessState := "running"
-	switch newState {
-	case "stopped":
+	if newState == "stopped" {
 		processState = "stopped"
-		vmProcessState = "stopped"
-	case "started", "restart":
-		processState = "running"
-		vmProcessState = "running"
 	}
 
-	// Update VMs
+	// Update VMs, mirroring each change onto its instance
 	vms := s.data.VMs[deployment]
 	for i := range vms {
 		if job != "" && vms[i].Job != job {
 			continue
 		}
-		vms[i].ProcessState = vmProcessState
-		if newState == "stopped" {
-			vms[i].State = "stopped"
-		} else {
-			vms[i].State = "started"
+		if index != "" && fmt.Sprintf("%d", vms[i].Index) != index {
+			continue
 		}
-	}
-
-	// Update instances and their processes
-	instances := s.data.Instances[deployment]
-	for i := range instances {
-		if job != "" && instances[i].Job != job {
+		if vms[i].Ignore {
 			continue
 		}
-		instances[i].State = processState
-		for j := range instances[i].Processes {
-			instances[i].Processes[j].State = processState
+		vms[i].ProcessState = processState
+		switch {
+		case newState == "stopped" && hard:
+			vms[i].State = "detached"
+			vms[i].VMCID = ""
+		case newState == "stopped":
+			vms[i].State = "stopped"
+		default:
+			if vms[i].VMCID == "" {
+				vms[i].VMCID = newVMCID()
+				vms[i].AgentID = nextAgentID(deployment, vms[i].Job, vms[i].Index, vms[i].AgentID)
+			}
+			vms[i].State = "started"
 		}
+		s.syncInstanceFromVM(deployment, vms[i])
 	}
 
 	return nil
 }
 
+// processesInState returns a copy of processes with every state set. It
+// copies because fixture instances may share one process slice.
+func processesInState(processes []Process, state string) []Process {
+	if processes == nil {
+		return nil
+	}
+	result := make([]Process, len(processes))
+	for i, p := range processes {
+		p.State = state
+		result[i] = p
+	}
+	return result
+}
+
 // HasDeployment checks if a deployment exists.
 func (s *State) HasDeployment(name string) bool {
 	s.data.mu.RLock()
@@ -388,3 +2427,20 @@ func (s *State) HasDeployment(name string) bool {
 	_, ok := s.data.Deployments[name]
 	return ok
 }
+
+// HasJob checks if a deployment has any VM or instance in the job.
+func (s *State) HasJob(deployment, job string) bool {
+	s.data.mu.RLock()
+	defer s.data.mu.RUnlock()
+	for _, vm := range s.data.VMs[deployment] {
+		if vm.Job == job {
+			return true
+		}
+	}
+	for _, inst := range s.data.Instances[deployment] {
+		if inst.Job == job {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,11 @@
 package mockbosh
 
 import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -143,17 +148,50 @@ func TestGetInstances(t *testing.T) {
 	}
 }
 
+func TestInstanceIPsInSubnets(t *testing.T) {
+	state := NewState()
+
+	// Scale redis up so AssignIPs allocates for a new instance
+	manifest := strings.Replace(redisManifestYAML(), "  instances: 2", "  instances: 3", 1)
+	if _, err := state.SaveDeployment("redis", manifest); err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+	state.AssignIPs("redis", []string{"redis-redis-2-id"})
+
+	cloud := parseCloudConfig(state.GetCloudConfig().Properties)
+	checked := 0
+	for _, d := range state.GetDeployments() {
+		instances, _ := state.GetInstances(d.Name)
+		for _, inst := range instances {
+			for _, ip := range inst.IPs {
+				checked++
+				inSubnet := false
+				for _, cidr := range cloud.subnetRanges(inst.AZ) {
+					_, network, _ := net.ParseCIDR(cidr)
+					inSubnet = inSubnet || network.Contains(net.ParseIP(ip))
+				}
+				if !inSubnet {
+					t.Errorf("%s/%s: IP %s is outside every %s subnet", d.Name, inst.ID, ip, inst.AZ)
+				}
+			}
+		}
+	}
+	if checked != 8 {
+		t.Errorf("Expected 8 instance IPs including the new redis node, got %d", checked)
+	}
+}
+
 func TestGetTasks(t *testing.T) {
 	state := NewState()
 
 	// Get all tasks
-	tasks := state.GetTasks("", "", 0)
+	tasks := state.GetTasks("", "", "", 2, 0)
 	if len(tasks) == 0 {
 		t.Error("Expected default tasks")
 	}
 
 	// Filter by state
-	doneTasks := state.GetTasks("done", "", 0)
+	doneTasks := state.GetTasks("done", "", "", 2, 0)
 	for _, task := range doneTasks {
 		if task.State != "done" {
 			t.Errorf("Expected state 'done', got '%s'", task.State)
@@ -161,7 +199,7 @@ func TestGetTasks(t *testing.T) {
 	}
 
 	// Filter by deployment
-	cfTasks := state.GetTasks("", "cf", 0)
+	cfTasks := state.GetTasks("", "cf", "", 2, 0)
 	for _, task := range cfTasks {
 		if task.Deployment != "cf" {
 			t.Errorf("Expected deployment 'cf', got '%s'", task.Deployment)
@@ -169,7 +207,7 @@ func TestGetTasks(t *testing.T) {
 	}
 
 	// Limit
-	limitedTasks := state.GetTasks("", "", 2)
+	limitedTasks := state.GetTasks("", "", "", 2, 2)
 	if len(limitedTasks) > 2 {
 		t.Errorf("Expected at most 2 tasks, got %d", len(limitedTasks))
 	}
@@ -288,7 +326,7 @@ func TestChangeJobState(t *testing.T) {
 	state := NewState()
 
 	// Stop jobs
-	err := state.ChangeJobState("cf", "router", "stopped")
+	err := state.ChangeJobState("cf", "router", "", "stopped", false)
 	if err != nil {
 		t.Fatalf("ChangeJobState failed: %v", err)
 	}
@@ -303,7 +341,7 @@ func TestChangeJobState(t *testing.T) {
 	}
 
 	// Start jobs
-	err = state.ChangeJobState("cf", "router", "started")
+	err = state.ChangeJobState("cf", "router", "", "started", false)
 	if err != nil {
 		t.Fatalf("ChangeJobState failed: %v", err)
 	}
@@ -317,12 +355,280 @@ func TestChangeJobState(t *testing.T) {
 		}
 	}
 
-	err = state.ChangeJobState("nonexistent", "", "stopped")
+	err = state.ChangeJobState("nonexistent", "", "", "stopped", false)
 	if err == nil {
 		t.Error("Expected error for nonexistent deployment")
 	}
 }
 
+func TestChangeJobStateHardStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		hard      bool
+		vmState   string
+		keepsCID  bool
+		expectsVM bool
+	}{
+		{"soft stop", false, "stopped", true, true},
+		{"hard stop", true, "detached", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := NewState()
+			vmsBefore, _ := state.GetVMs("cf")
+			cids := make(map[string]string)
+			for _, vm := range vmsBefore {
+				cids[vm.ID] = vm.VMCID
+			}
+
+			if err := state.ChangeJobState("cf", "router", "0", "stopped", tt.hard); err != nil {
+				t.Fatalf("ChangeJobState failed: %v", err)
+			}
+
+			vms, _ := state.GetVMs("cf")
+			for _, vm := range vms {
+				if vm.Job != "router" {
+					continue
+				}
+				if vm.Index != 0 {
+					if vm.State != "started" || vm.VMCID != cids[vm.ID] {
+						t.Errorf("Expected router/%d untouched, got state %s cid %q", vm.Index, vm.State, vm.VMCID)
+					}
+					continue
+				}
+				if vm.State != tt.vmState {
+					t.Errorf("Expected state %s, got %s", tt.vmState, vm.State)
+				}
+				if (vm.VMCID == cids[vm.ID]) != tt.keepsCID {
+					t.Errorf("Expected CID kept=%v, got %q", tt.keepsCID, vm.VMCID)
+				}
+			}
+			instances, _ := state.GetInstances("cf")
+			for _, inst := range instances {
+				if inst.Job == "router" && inst.Index == 0 && inst.Expects != tt.expectsVM {
+					t.Errorf("Expected expects_vm=%v, got %v", tt.expectsVM, inst.Expects)
+				}
+			}
+
+			if err := state.ChangeJobState("cf", "router", "0", "started", false); err != nil {
+				t.Fatalf("ChangeJobState failed: %v", err)
+			}
+			vms, _ = state.GetVMs("cf")
+			for _, vm := range vms {
+				if vm.Job == "router" && vm.Index == 0 && (vm.State != "started" || vm.VMCID == "") {
+					t.Errorf("Expected a started VM with a CID, got state %s cid %q", vm.State, vm.VMCID)
+				}
+			}
+			instances, _ = state.GetInstances("cf")
+			for _, inst := range instances {
+				if inst.Job == "router" && inst.Index == 0 && (!inst.Expects || inst.VMCID == "") {
+					t.Errorf("Expected the instance to expect its new VM, got %+v", inst)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveDeploymentUpdatesChangedGroups(t *testing.T) {
+	state := NewStateWithData(EmptyFixtures())
+
+	manifest := `name: web
+
+instance_groups:
+- name: nginx
+  instances: 1
+  azs: [z1]
+  jobs:
+  - name: nginx
+    properties:
+      port: 80
+- name: worker
+  instances: 1
+  azs: [z1]
+`
+	if _, err := state.SaveDeployment("web", manifest); err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+
+	changes, err := state.SaveDeployment("web", manifest+"# unchanged\n")
+	if err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+	if len(changes.Created) != 0 || len(changes.Updated) != 0 || len(changes.Deleted) != 0 {
+		t.Errorf("Expected no changes redeploying the same manifest, got %+v", changes)
+	}
+
+	changes, err = state.SaveDeployment("web", strings.Replace(manifest, "port: 80", "port: 8080", 1))
+	if err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+	if len(changes.Updated) != 1 || changes.Updated[0].Job != "nginx" {
+		t.Errorf("Expected only nginx updated after a property change, got %+v", changes.Updated)
+	}
+}
+
+func TestRecreateVMsAgentIDs(t *testing.T) {
+	state := NewStateWithData(EmptyFixtures())
+
+	manifest := `name: web
+
+instance_groups:
+- name: nginx
+  instances: 1
+  azs: [z1]
+`
+	changes, err := state.SaveDeployment("web", manifest)
+	if err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+
+	agentOf := func() (string, string) {
+		instances, _ := state.GetInstances("web")
+		vms, _ := state.GetVMs("web")
+		if len(instances) != 1 || len(vms) != 1 || instances[0].ID != changes.Created[0].ID {
+			t.Fatalf("Expected one synthesized instance and VM, got %d and %d", len(instances), len(vms))
+		}
+		return instances[0].AgentID, vms[0].AgentID
+	}
+
+	if inst, vm := agentOf(); inst != "agent-web-nginx-0-0" || vm != inst {
+		t.Errorf("Expected agent-web-nginx-0-0 on instance and VM, got %s and %s", inst, vm)
+	}
+
+	for _, want := range []string{"agent-web-nginx-0-1", "agent-web-nginx-0-2"} {
+		if err := state.RecreateVMs("web", "nginx", "0"); err != nil {
+			t.Fatalf("RecreateVMs failed: %v", err)
+		}
+		if inst, vm := agentOf(); inst != want || vm != want {
+			t.Errorf("Expected %s after recreate, got %s and %s", want, inst, vm)
+		}
+	}
+
+	// Fixture agent IDs outside the scheme restart at generation 1
+	if got := nextAgentID("cf", "router", 0, "agent-cf-r0"); got != "agent-cf-router-0-1" {
+		t.Errorf("Expected agent-cf-router-0-1, got %s", got)
+	}
+}
+
+func TestRecreateVMsUniqueCIDs(t *testing.T) {
+	state := NewState()
+	wellFormed := regexp.MustCompile(`^vm-[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	original, _ := state.GetVMs("redis")
+	seen := map[string]bool{original[0].VMCID: true}
+	for i := 0; i < 2; i++ {
+		if err := state.RecreateVMs("redis", "redis", "0"); err != nil {
+			t.Fatalf("RecreateVMs failed: %v", err)
+		}
+		vms, _ := state.GetVMs("redis")
+		vm := vms[0]
+		if !wellFormed.MatchString(vm.VMCID) {
+			t.Errorf("Expected a vm-<uuid> CID, got %s", vm.VMCID)
+		}
+		if seen[vm.VMCID] {
+			t.Errorf("Expected a fresh CID on recreate %d, got repeated %s", i+1, vm.VMCID)
+		}
+		seen[vm.VMCID] = true
+		if vm.Job != original[0].Job || vm.Index != original[0].Index || vm.AZ != original[0].AZ {
+			t.Errorf("Expected job, index, and az preserved, got %s/%d in %s", vm.Job, vm.Index, vm.AZ)
+		}
+		if vms[1].VMCID != original[1].VMCID {
+			t.Errorf("Expected redis/1 untouched, got %s", vms[1].VMCID)
+		}
+
+		instances, _ := state.GetInstances("redis")
+		if instances[0].VMCID != vm.VMCID {
+			t.Errorf("Expected instance VM CID %s, got %s", vm.VMCID, instances[0].VMCID)
+		}
+	}
+}
+
+func TestRecreateVMsSyncsInstances(t *testing.T) {
+	state := NewState()
+
+	if err := state.RecreateVMs("cf", "", ""); err != nil {
+		t.Fatalf("RecreateVMs failed: %v", err)
+	}
+
+	vms, _ := state.GetVMs("cf")
+	vmCIDs := make(map[string]string)
+	for _, vm := range vms {
+		vmCIDs[fmt.Sprintf("%s/%d", vm.Job, vm.Index)] = vm.VMCID
+	}
+	instances, _ := state.GetInstances("cf")
+	for _, inst := range instances {
+		if inst.Lifecycle == LifecycleErrand {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", inst.Job, inst.Index)
+		if inst.VMCID != vmCIDs[key] {
+			t.Errorf("Expected %s instance VM CID %s to match its VM, got %s", key, vmCIDs[key], inst.VMCID)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	state := NewState()
+	state.data.Releases = append(state.data.Releases,
+		Release{Name: "haproxy", Version: "9.0.0"},
+		Release{Name: "haproxy", Version: "11.0.0"},
+		Release{Name: "haproxy", Version: "10.0.0"},
+	)
+
+	// Default cleanup keeps the two newest unused versions of each release
+	summary := state.Cleanup(false)
+	if len(summary.Releases) != 1 || summary.Releases[0] != (NameVersion{Name: "haproxy", Version: "9.0.0"}) {
+		t.Errorf("Expected only haproxy/9.0.0 removed, got %+v", summary.Releases)
+	}
+	if len(summary.Stemcells) != 0 {
+		t.Errorf("Expected no stemcells removed, got %+v", summary.Stemcells)
+	}
+	if len(summary.OrphanedDisks) != 2 {
+		t.Errorf("Expected 2 orphaned disks removed, got %+v", summary.OrphanedDisks)
+	}
+	if disks := state.GetOrphanedDisks(); len(disks) != 0 {
+		t.Errorf("Expected no orphaned disks left, got %d", len(disks))
+	}
+
+	summary = state.Cleanup(true)
+	removed := make(map[NameVersion]bool)
+	for _, rel := range summary.Releases {
+		removed[rel] = true
+	}
+	for _, want := range []NameVersion{
+		{Name: "haproxy", Version: "10.0.0"},
+		{Name: "haproxy", Version: "11.0.0"},
+		{Name: "cf-deployment", Version: "39.0.0"},
+	} {
+		if !removed[want] {
+			t.Errorf("Expected %s/%s removed with remove_all", want.Name, want.Version)
+		}
+	}
+	if len(summary.Stemcells) != 2 {
+		t.Errorf("Expected 2 unused stemcells removed, got %+v", summary.Stemcells)
+	}
+
+	// Releases used by deployments or runtime configs survive
+	kept := make(map[NameVersion]bool)
+	for _, rel := range state.GetReleases() {
+		kept[NameVersion{Name: rel.Name, Version: rel.Version}] = true
+	}
+	for _, want := range []NameVersion{
+		{Name: "cf-deployment", Version: "40.0.0"},
+		{Name: "os-conf", Version: "22.0.0"},
+	} {
+		if !kept[want] {
+			t.Errorf("Expected %s/%s kept", want.Name, want.Version)
+		}
+	}
+	for _, sc := range state.GetStemcells() {
+		if len(sc.Deployments) == 0 {
+			t.Errorf("Expected unused stemcell %s/%s removed", sc.Name, sc.Version)
+		}
+	}
+}
+
 func TestConcurrentAccess(t *testing.T) {
 	state := NewState()
 
@@ -333,9 +639,151 @@ func TestConcurrentAccess(t *testing.T) {
 			defer wg.Done()
 			state.GetDeployments()
 			state.GetVMs("cf")
-			state.GetTasks("", "", 0)
+			state.GetTasks("", "", "", 2, 0)
 			state.CreateTask("concurrent test", "cf", "admin")
 		}()
 	}
 	wg.Wait()
 }
+
+func TestSaveAndLoadStateFile(t *testing.T) {
+	state := NewState()
+	state.CreateTask("saved task", "cf", "admin")
+	if err := state.DeleteDeployment("redis"); err != nil {
+		t.Fatalf("DeleteDeployment failed: %v", err)
+	}
+	// The newest config is deleted, so only the counter remembers its ID
+	added := state.AddRuntimeConfig("scratch", "releases: []\n")
+	if err := state.DeleteConfig("runtime", "scratch"); err != nil {
+		t.Fatalf("DeleteConfig failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := state.SaveStateToFile(path); err != nil {
+		t.Fatalf("SaveStateToFile failed: %v", err)
+	}
+
+	data, err := LoadStateFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadStateFromFile failed: %v", err)
+	}
+	loaded := NewStateWithData(data)
+
+	if loaded.HasDeployment("redis") {
+		t.Error("Expected redis deployment to stay deleted")
+	}
+	if !loaded.HasDeployment("cf") {
+		t.Error("Expected cf deployment to be loaded")
+	}
+
+	// Task IDs must continue from where the saved state left off
+	task := loaded.CreateTask("after load", "cf", "admin")
+	if task.ID != 102 {
+		t.Errorf("Expected task ID 102, got %d", task.ID)
+	}
+
+	// Config IDs never reuse a deleted config's
+	if next := loaded.AddCPIConfig("cpis: []\n"); next.ID == added.ID || next.ID != "8" {
+		t.Errorf("Expected config ID 8 after deleted %s, got %s", added.ID, next.ID)
+	}
+
+	_, err = LoadStateFromFile(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("Expected error for missing state file")
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	state := NewState()
+
+	task := state.CreateTask("test task", "cf", "admin")
+	if err := state.CancelTask(task.ID); err != nil {
+		t.Fatalf("CancelTask failed: %v", err)
+	}
+
+	updated, _ := state.GetTask(task.ID)
+	if updated.State != "cancelling" {
+		t.Errorf("Expected state 'cancelling', got '%s'", updated.State)
+	}
+
+	if err := state.CancelTask(1); err == nil {
+		t.Error("Expected error cancelling a done task")
+	}
+	if err := state.CancelTask(99999); err == nil {
+		t.Error("Expected error for nonexistent task")
+	}
+}
+
+func TestCompleteTask(t *testing.T) {
+	state := NewState()
+
+	task := state.CreateTask("test task", "cf", "admin")
+	if got, err := state.CompleteTask(task.ID, "finished"); err != nil || got != "done" {
+		t.Errorf("Expected done, got %q (%v)", got, err)
+	}
+
+	// A cancel requested before the task completes wins
+	task = state.CreateTask("test task", "cf", "admin")
+	state.CancelTask(task.ID)
+	if got, err := state.CompleteTask(task.ID, "finished"); err != nil || got != "cancelled" {
+		t.Errorf("Expected cancelled, got %q (%v)", got, err)
+	}
+	if updated, _ := state.GetTask(task.ID); updated.Result != "Task cancelled" || updated.FinishedAt == 0 {
+		t.Errorf("Expected a finished cancelled task, got %+v", updated)
+	}
+
+	if _, err := state.CompleteTask(99999, ""); err == nil {
+		t.Error("Expected error for nonexistent task")
+	}
+}
+
+func TestDeploymentResourceTotals(t *testing.T) {
+	state := NewState()
+
+	totals := func() ResourceTotals {
+		t.Helper()
+		for _, d := range state.GetDeployments() {
+			if d.Name == "cf" {
+				if d.Resources == nil {
+					t.Fatal("Expected resource totals for cf")
+				}
+				return *d.Resources
+			}
+		}
+		t.Fatal("Expected 'cf' deployment")
+		return ResourceTotals{}
+	}
+
+	before := totals()
+	// 3 large diego cells (4 CPU each), 4 medium (2 each), and 1 small doppler;
+	// errands have no VMs
+	if before.CPU != 3*4+4*2+1 {
+		t.Errorf("Expected %d CPUs, got %d", 3*4+4*2+1, before.CPU)
+	}
+
+	d, err := state.GetDeployment("cf")
+	if err != nil {
+		t.Fatalf("GetDeployment failed: %v", err)
+	}
+	scaled := strings.Replace(d.Manifest, "  instances: 3", "  instances: 5", 1)
+	if _, err := state.SaveDeployment("cf", scaled); err != nil {
+		t.Fatalf("SaveDeployment failed: %v", err)
+	}
+
+	after := totals()
+	if after.CPU != before.CPU+2*4 {
+		t.Errorf("Expected %d CPUs after adding 2 diego cells, got %d", before.CPU+2*4, after.CPU)
+	}
+	if after.MemoryMB != before.MemoryMB+2*4*3840 {
+		t.Errorf("Expected %d MB memory, got %d", before.MemoryMB+2*4*3840, after.MemoryMB)
+	}
+	if after.EphemeralDiskMB != before.EphemeralDiskMB+2*100*1024 {
+		t.Errorf("Expected %d MB ephemeral disk, got %d", before.EphemeralDiskMB+2*100*1024, after.EphemeralDiskMB)
+	}
+
+	for _, d := range state.GetDeployments() {
+		if d.Name == "redis" && d.Resources.PersistentDiskMB != 2*10*1024 {
+			t.Errorf("Expected redis persistent disk %d MB, got %d", 2*10*1024, d.Resources.PersistentDiskMB)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// ABOUTME: Live task event stream for the mock BOSH Director.
+// ABOUTME: Fans out task events to Server-Sent Events subscribers.
+
+package mockbosh
+
+import "sync"
+
+// taskStreamBuffer is how many events a slow subscriber may fall behind before
+// further events are dropped for it.
+const taskStreamBuffer = 256
+
+// TaskStreamEvent is a task event as published on the SSE stream.
+type TaskStreamEvent struct {
+	TaskID int `json:"task_id"`
+	TaskEvent
+}
+
+// taskEventBroker fans out task events to stream subscribers.
+type taskEventBroker struct {
+	mu   sync.Mutex
+	subs map[chan TaskStreamEvent]struct{}
+}
+
+func newTaskEventBroker() *taskEventBroker {
+	return &taskEventBroker{subs: make(map[chan TaskStreamEvent]struct{})}
+}
+
+// subscribe returns a channel of published events and a function that
+// unsubscribes and closes it.
+func (b *taskEventBroker) subscribe() (<-chan TaskStreamEvent, func()) {
+	ch := make(chan TaskStreamEvent, taskStreamBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish delivers an event to every subscriber without blocking.
+func (b *taskEventBroker) publish(e TaskStreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -4,8 +4,14 @@
 package mockbosh
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +20,38 @@ type TaskSimulator struct {
 	state *State
 	speed float64 // Simulation speed multiplier (1.0 = normal, 10.0 = 10x faster)
 	debug bool
+
+	// ipAssignDelay simulates slow DHCP/DNS: new instances report no IPs
+	// until this (scaled) delay has passed.
+	ipAssignDelay time.Duration
+
+	// durations holds how long each action's main work takes before scaling
+	durations TaskDurations
+
+	// failureRate is the chance (0-1) that a task fails once processing
+	// starts, before it changes anything
+	failureRate float64
+
+	// maxConcurrent caps how many tasks process at once; 0 means no limit.
+	// Tasks beyond it wait in the state's task queue.
+	maxConcurrent int
+
+	// jitter varies each scaled delay by up to this fraction either way
+	jitter float64
+
+	// rng drives random failures and jitter so a seed reproduces a run. rand.Rand
+	// isn't safe for concurrent use, so task goroutines share it under rngMu.
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	// outcomes holds the IDs of tasks with a forced outcome waiting to apply
+	outcomeMu sync.Mutex
+	outcomes  map[int]bool
+
+	// mu guards generation. Task goroutines hold a read lock while touching
+	// state so a Reset cannot interleave with a half-applied step.
+	mu         sync.RWMutex
+	generation int
 }
 
 // NewTaskSimulator creates a new task simulator.
@@ -22,15 +60,136 @@ func NewTaskSimulator(state *State, speed float64, debug bool) *TaskSimulator {
 		speed = 1.0
 	}
 	return &TaskSimulator{
-		state: state,
-		speed: speed,
-		debug: debug,
+		state:     state,
+		speed:     speed,
+		debug:     debug,
+		durations: DefaultTaskDurations(),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetSeed reseeds the simulator's random number generator. Two simulators
+// with the same seed given the same requests in the same order make the same
+// random choices.
+func (ts *TaskSimulator) SetSeed(seed int64) {
+	ts.rngMu.Lock()
+	defer ts.rngMu.Unlock()
+	ts.rng = rand.New(rand.NewSource(seed))
+}
+
+// randFloat64 returns a random number in [0, 1) from the seeded generator.
+func (ts *TaskSimulator) randFloat64() float64 {
+	ts.rngMu.Lock()
+	defer ts.rngMu.Unlock()
+	return ts.rng.Float64()
+}
+
+// randIntn returns a random number in [0, n) from the seeded generator.
+func (ts *TaskSimulator) randIntn(n int) int {
+	ts.rngMu.Lock()
+	defer ts.rngMu.Unlock()
+	return ts.rng.Intn(n)
+}
+
+// SetIPAssignDelay sets how long newly created instances wait for IPs.
+func (ts *TaskSimulator) SetIPAssignDelay(d time.Duration) {
+	ts.ipAssignDelay = d
+}
+
+// SetTaskDurations overrides the durations of the given actions, keeping the
+// defaults for the rest.
+func (ts *TaskSimulator) SetTaskDurations(overrides TaskDurations) {
+	durations := DefaultTaskDurations()
+	for action, d := range overrides {
+		durations[action] = d
+	}
+	ts.durations = durations
+}
+
+// SetFailureRate sets the chance (0-1) that each task fails at random.
+func (ts *TaskSimulator) SetFailureRate(rate float64) {
+	ts.failureRate = rate
+}
+
+// SetJitter varies each simulated delay by up to fraction (0-1) either way,
+// so concurrent tasks finish at staggered times. Zero turns jitter off.
+func (ts *TaskSimulator) SetJitter(fraction float64) {
+	ts.jitter = fraction
+}
+
+// SetMaxConcurrentTasks limits how many tasks process at once. Zero or less
+// removes the limit.
+func (ts *TaskSimulator) SetMaxConcurrentTasks(n int) {
+	ts.maxConcurrent = n
+}
+
+// injectedFailure rolls for a random task failure, returning the error
+// message to fail with, or "" to proceed. Deployment tasks blame an agent on
+// one of the deployment's VMs.
+func (ts *TaskSimulator) injectedFailure(deployment string) string {
+	if ts.failureRate <= 0 || ts.randFloat64() >= ts.failureRate {
+		return ""
+	}
+	if vms, err := ts.state.GetVMs(deployment); err == nil && len(vms) > 0 {
+		vm := vms[ts.randIntn(len(vms))]
+		return fmt.Sprintf("Error: unresponsive agent on %s", ts.state.naming.instanceName(vm.Job, vm.ID, vm.Index))
+	}
+	return "Error: CPI error 'Bosh::Clouds::CloudError' with message 'request timed out'"
+}
+
+// withInjectedFailure makes a task's first step roll for an injected failure
+// after its processing sleep and before it changes anything. A hit fails the
+// step, leaving state untouched.
+func (ts *TaskSimulator) withInjectedFailure(taskID int, deployment string, step taskStep) taskStep {
+	rolled := false
+	roll := func() error {
+		if rolled {
+			return nil
+		}
+		rolled = true
+		if msg := ts.injectedFailure(deployment); msg != "" {
+			ts.log("Task %d: Injected failure - %s", taskID, msg)
+			return errors.New(msg)
+		}
+		return nil
+	}
+
+	if len(step.targets) > 0 {
+		applyTarget := step.applyTarget
+		step.applyTarget = func(index int) error {
+			if err := roll(); err != nil || applyTarget == nil {
+				return err
+			}
+			return applyTarget(index)
+		}
+		return step
+	}
+	action := step.action
+	step.action = func() error {
+		if err := roll(); err != nil || action == nil {
+			return err
+		}
+		return action()
 	}
+	return step
 }
 
-// scaledDuration returns a duration scaled by the simulation speed.
+// actionDuration returns the unscaled duration of an action's main work.
+func (ts *TaskSimulator) actionDuration(action string) time.Duration {
+	return ts.durations[action]
+}
+
+// scaledDuration returns a duration scaled by the simulation speed, with
+// jitter applied. A positive duration always stays positive.
 func (ts *TaskSimulator) scaledDuration(d time.Duration) time.Duration {
-	return time.Duration(float64(d) / ts.speed)
+	scaled := float64(d) / ts.speed
+	if ts.jitter > 0 && d > 0 {
+		scaled *= 1 + ts.jitter*(2*ts.randFloat64()-1)
+		if scaled < 1 {
+			scaled = 1
+		}
+	}
+	return time.Duration(scaled)
 }
 
 // log prints debug messages if debug mode is enabled.
@@ -40,196 +199,838 @@ func (ts *TaskSimulator) log(format string, args ...interface{}) {
 	}
 }
 
-// ExecuteDelete simulates a deployment deletion.
-func (ts *TaskSimulator) ExecuteDelete(taskID int, deployment string, force bool) {
+// currentGeneration returns the generation new tasks should run under.
+func (ts *TaskSimulator) currentGeneration() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.generation
+}
+
+// apply runs fn against state if gen is still current. It returns false when
+// the simulator was reset since the task started, in which case the task
+// goroutine must exit without touching state.
+func (ts *TaskSimulator) apply(gen int, fn func()) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if gen != ts.generation {
+		return false
+	}
+	fn()
+	return true
+}
+
+// applyTask is apply for a task's goroutine: it also returns false, without
+// running fn, once the task has been deleted or has ended, such as by a
+// forced outcome.
+func (ts *TaskSimulator) applyTask(gen, taskID int, fn func()) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if gen != ts.generation {
+		return false
+	}
+	if task, err := ts.state.GetTask(taskID); err != nil || isTerminalTaskState(task.State) {
+		return false
+	}
+	fn()
+	return true
+}
+
+// DeleteTask removes a task and releases any lock it holds. If its goroutine
+// is still running, it stops at its next step without touching state.
+func (ts *TaskSimulator) DeleteTask(taskID int) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.dropOutcome(taskID)
+	return ts.state.DeleteTask(taskID)
+}
+
+// Reset replaces state with data and abandons all in-flight tasks.
+func (ts *TaskSimulator) Reset(data *StateData) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state.Reset(data)
+	ts.generation++
+	ts.outcomeMu.Lock()
+	ts.outcomes = nil
+	ts.outcomeMu.Unlock()
+	ts.log("Reset: state replaced, generation %d", ts.generation)
+}
+
+// taskStep is one unit of simulated work: a delay followed by a state change.
+// Its stage names the step in the task's event output. When targets is set,
+// the delay is spread across them and each gets its own started/finished
+// events, as the director reports per-instance progress. applyTarget, if
+// set, makes a target's change before its finished event; action, if set,
+// runs once the step's delay (and targets) are done. abort, if set, is called
+// with the task's final state and result when the task ends before the step
+// completes.
+type taskStep struct {
+	stage       string
+	delay       time.Duration
+	targets     []string
+	onTarget    func(index int, state string) // Called with each target event
+	applyTarget func(index int) error
+	action      func() error
+	abort       func(state, result string)
+}
+
+// run drives a task through queued → processing → done/error in a background
+// goroutine, holding the deployment lock while steps execute; tasks created
+// locked already hold it. Tasks not tied to a deployment pass "" and take no
+// lock. Between steps it checks whether
+// the task was cancelled and, if so, stops cleanly. Progress advances by an
+// equal share as each step finishes.
+func (ts *TaskSimulator) run(taskID int, deployment string, steps []taskStep, result string) {
+	gen := ts.currentGeneration()
+	limited := ts.maxConcurrent > 0
+	if limited {
+		ts.apply(gen, func() { ts.state.EnqueueTask(taskID) })
+	}
 	go func() {
-		ts.log("Task %d: Starting delete deployment %s (force=%v)", taskID, deployment, force)
+		if limited {
+			defer ts.apply(gen, func() { ts.state.FinishQueuedTask(taskID) })
+		}
+
+		// Steps from completed on never finished if the task ends early,
+		// whether cancelled, failed, forced, or deleted
+		completed := 0
+		defer func() {
+			if completed < len(steps) {
+				ts.apply(gen, func() { ts.abortSteps(taskID, steps[completed:]) })
+			}
+		}()
 
 		// Queue → Processing
 		time.Sleep(ts.scaledDuration(500 * time.Millisecond))
-		ts.state.UpdateTaskState(taskID, "processing", "")
+		if ts.cancelIfRequested(gen, taskID) {
+			return
+		}
+		if limited && !ts.waitForSlot(gen, taskID, deployment) {
+			return
+		}
+		if !ts.applyTask(gen, taskID, func() {
+			ts.state.UpdateTaskState(taskID, "processing", "")
+			if deployment != "" {
+				ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), deploymentLockTimeout)
+			}
+		}) {
+			return
+		}
 		ts.log("Task %d: Processing", taskID)
 
-		// Add lock
-		ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), 30*time.Minute)
+		for i, step := range steps {
+			if i == 0 {
+				step = ts.withInjectedFailure(taskID, deployment, step)
+			}
+			if len(step.targets) > 0 {
+				if !ts.runTargets(gen, taskID, deployment, step) {
+					return
+				}
+			} else {
+				if !ts.applyTask(gen, taskID, func() {
+					ts.event(taskID, step.stage, step.stage, nil, i+1, len(steps), "started", 0)
+				}) {
+					return
+				}
 
-		// Simulate deletion work
-		time.Sleep(ts.scaledDuration(2 * time.Second))
+				time.Sleep(ts.scaledDuration(step.delay))
+				if ts.cancelIfRequested(gen, taskID) {
+					return
+				}
+			}
 
-		// Perform deletion
-		err := ts.state.DeleteDeployment(deployment)
-		if err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
-			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
-			return
+			var err error
+			if !ts.applyTask(gen, taskID, func() {
+				if step.action != nil {
+					err = ts.trackAffected(taskID, deployment, step.action)
+				}
+				if err != nil {
+					ts.event(taskID, step.stage, step.stage, nil, i+1, len(steps), "failed", 100)
+					ts.finish(taskID, deployment, "error", err.Error())
+					return
+				}
+				if len(step.targets) == 0 {
+					ts.event(taskID, step.stage, step.stage, nil, i+1, len(steps), "finished", 100)
+				}
+				ts.state.SetTaskProgress(taskID, (i+1)*100/len(steps))
+			}) {
+				return
+			}
+			if err != nil {
+				ts.log("Task %d: Error - %s", taskID, err.Error())
+				return
+			}
+			completed = i + 1
 		}
 
-		// Remove lock and complete
-		ts.state.RemoveLock(deployment)
-		ts.state.UpdateTaskState(taskID, "done", fmt.Sprintf("Deleted deployment %s", deployment))
+		// Complete, releasing the lock, unless cancelled during the last step
+		state := ""
+		if !ts.applyTask(gen, taskID, func() {
+			state = ts.finish(taskID, deployment, "done", result)
+		}) {
+			return
+		}
+		if state == "cancelled" {
+			ts.log("Task %d: Cancelled", taskID)
+			return
+		}
 		ts.log("Task %d: Done", taskID)
 	}()
 }
 
-// ExecuteRecreate simulates VM recreation.
-func (ts *TaskSimulator) ExecuteRecreate(taskID int, deployment, job, index string) {
-	go func() {
-		ts.log("Task %d: Starting recreate %s/%s/%s", taskID, deployment, job, index)
+// abortSteps tells steps a task ended before they completed, passing the
+// state and result it ended with. A deleted task counts as cancelled.
+func (ts *TaskSimulator) abortSteps(taskID int, steps []taskStep) {
+	state, result := "cancelled", fmt.Sprintf("Task %d was deleted", taskID)
+	if task, err := ts.state.GetTask(taskID); err == nil {
+		state, result = task.State, fmt.Sprintf("Task %d ended with %s", taskID, task.State)
+		if !isTerminalTaskState(state) || state == "done" {
+			state = "cancelled"
+		}
+	}
+	for _, step := range steps {
+		if step.abort != nil {
+			step.abort(state, result)
+		}
+	}
+}
 
-		// Queue → Processing
-		time.Sleep(ts.scaledDuration(500 * time.Millisecond))
-		ts.state.UpdateTaskState(taskID, "processing", "")
-		ts.log("Task %d: Processing", taskID)
+// waitForSlot blocks a queued task until it reaches the front of the queue
+// and a slot is free. It returns false if the task goroutine should stop.
+func (ts *TaskSimulator) waitForSlot(gen, taskID int, deployment string) bool {
+	for {
+		started := false
+		if !ts.applyTask(gen, taskID, func() {
+			started = ts.state.StartQueuedTask(taskID, ts.maxConcurrent)
+		}) {
+			return false
+		}
+		if started {
+			return true
+		}
+		time.Sleep(ts.scaledDuration(100 * time.Millisecond))
+		if ts.cancelIfRequested(gen, taskID) {
+			return false
+		}
+	}
+}
 
-		// Add lock
-		ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), 30*time.Minute)
+// runTargets emits started/finished events for each of a step's targets,
+// sleeping an equal share of the step's delay on each and applying the
+// target's change before it reports finished. It returns false if the task
+// goroutine should stop.
+func (ts *TaskSimulator) runTargets(gen, taskID int, deployment string, step taskStep) bool {
+	share := step.delay / time.Duration(len(step.targets))
+	for j, target := range step.targets {
+		tags := []string{strings.SplitN(target, "/", 2)[0]}
+		if !ts.applyTask(gen, taskID, func() {
+			ts.event(taskID, step.stage, target, tags, j+1, len(step.targets), "started", 0)
+			if step.onTarget != nil {
+				step.onTarget(j, "started")
+			}
+		}) {
+			return false
+		}
 
-		// Simulate recreation work (longer for recreate)
-		time.Sleep(ts.scaledDuration(3 * time.Second))
+		time.Sleep(ts.scaledDuration(share))
+		if ts.cancelIfRequested(gen, taskID) {
+			return false
+		}
 
-		// Perform recreation
-		err := ts.state.RecreateVMs(deployment, job, index)
+		var err error
+		if !ts.applyTask(gen, taskID, func() {
+			if step.applyTarget != nil {
+				err = ts.trackAffected(taskID, deployment, func() error { return step.applyTarget(j) })
+			}
+			if err != nil {
+				ts.event(taskID, step.stage, target, tags, j+1, len(step.targets), "failed", 100)
+				ts.finish(taskID, deployment, "error", err.Error())
+				return
+			}
+			ts.event(taskID, step.stage, target, tags, j+1, len(step.targets), "finished", 100)
+			if step.onTarget != nil {
+				step.onTarget(j, "finished")
+			}
+		}) {
+			return false
+		}
 		if err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
 			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
+			return false
+		}
+	}
+	return true
+}
+
+// trackAffected runs fn, recording the VMs and instances it changed in a
+// deployment as the task's affected resources.
+func (ts *TaskSimulator) trackAffected(taskID int, deployment string, fn func() error) error {
+	if deployment == "" {
+		return fn()
+	}
+	before := ts.state.snapshotResources(deployment)
+	err := fn()
+	ts.state.RecordAffectedResources(taskID, affectedSince(before, ts.state.snapshotResources(deployment)))
+	return err
+}
+
+// event records a stage or per-instance transition in the task's event output.
+func (ts *TaskSimulator) event(taskID int, stage, task string, tags []string, index, total int, state string, progress int) {
+	if tags == nil {
+		tags = []string{}
+	}
+	ts.state.AppendTaskEvent(taskID, TaskEvent{
+		Time:     time.Now().Unix(),
+		Stage:    stage,
+		Tags:     tags,
+		Total:    total,
+		Task:     task,
+		Index:    index,
+		State:    state,
+		Progress: progress,
+	})
+}
+
+// cancelIfRequested finishes a cancelling task as cancelled, which releases
+// any lock it holds. It returns true if the task goroutine should stop,
+// either because it was cancelled, deleted, or the simulator was reset.
+func (ts *TaskSimulator) cancelIfRequested(gen, taskID int) bool {
+	cancelled := false
+	if !ts.applyTask(gen, taskID, func() {
+		task, err := ts.state.GetTask(taskID)
+		if err != nil || task.State != "cancelling" {
 			return
 		}
+		ts.state.UpdateTaskState(taskID, "cancelled", "Task cancelled")
+		cancelled = true
+	}) {
+		return true
+	}
+	if cancelled {
+		ts.log("Task %d: Cancelled", taskID)
+	}
+	return cancelled
+}
+
+// ExecuteDelete simulates a deployment deletion.
+func (ts *TaskSimulator) ExecuteDelete(taskID int, deployment string, force bool) {
+	ts.log("Task %d: Starting delete deployment %s (force=%v)", taskID, deployment, force)
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Deleting deployment", delay: ts.actionDuration("delete"), action: func() error {
+			return ts.state.DeleteDeployment(deployment)
+		}},
+	}, fmt.Sprintf("Deleted deployment %s", deployment))
+}
 
-		// Remove lock and complete
-		ts.state.RemoveLock(deployment)
+// ExecuteDeploy simulates creating or updating a deployment from a manifest.
+// If the deploy's compilation tasks can't be created, the task fails at once
+// and the error is returned.
+func (ts *TaskSimulator) ExecuteDeploy(taskID int, deployment, manifest string) error {
+	ts.log("Task %d: Starting deploy %s", taskID, deployment)
 
-		result := fmt.Sprintf("Recreated VMs for deployment %s", deployment)
-		if job != "" {
-			result = fmt.Sprintf("Recreated VMs for %s/%s", deployment, job)
-			if index != "" {
-				result = fmt.Sprintf("Recreated VM %s/%s/%s", deployment, job, index)
+	startedAt := time.Now()
+	reportID := deployReportID(taskID)
+	result := fmt.Sprintf("Deployed %s, report at /resources/%s", deployment, reportID)
+	var steps []taskStep
+	compile, err := ts.compileStep(taskID, manifest)
+	if err != nil {
+		ts.state.UpdateTaskState(taskID, "error", err.Error())
+		return err
+	}
+	if compile != nil {
+		steps = append(steps, *compile)
+	}
+	// Each instance is created or updated as its update finishes
+	targets := deployTargets(manifest)
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.name
+	}
+	stage := "Updating deployment"
+	if len(targets) > 0 {
+		stage = "Updating instance"
+	}
+	var changes DeployChanges
+	var changed map[string]bool
+	ts.run(taskID, deployment, append(steps, []taskStep{
+		{stage: "Preparing deployment", delay: 500 * time.Millisecond, action: func() error {
+			var err error
+			changes, changed, err = ts.state.prepareDeploy(deployment, manifest)
+			return err
+		}},
+		{stage: stage, delay: ts.actionDuration("deploy"), targets: names, applyTarget: func(i int) error {
+			c, err := ts.state.deployInstance(deployment, manifest, targets[i].group, targets[i].index, changed[targets[i].group])
+			changes.add(c)
+			return err
+		}, action: func() error {
+			created := make([]string, len(changes.Created))
+			for i, inst := range changes.Created {
+				created[i] = inst.ID
 			}
+			ts.assignIPs(deployment, created)
+			return ts.saveDeployReport(taskID, deployment, changes, startedAt)
+		}},
+	}...), result)
+	return nil
+}
+
+// deployReportID names the blob holding a deploy task's report.
+func deployReportID(taskID int) string {
+	return fmt.Sprintf("deploy-report-%d", taskID)
+}
+
+// saveDeployReport stores a deploy's report in the blobstore.
+func (ts *TaskSimulator) saveDeployReport(taskID int, deployment string, changes DeployChanges, startedAt time.Time) error {
+	d, err := ts.state.GetDeployment(deployment)
+	if err != nil {
+		return err
+	}
+
+	names := func(instances []Instance) []string {
+		result := make([]string, len(instances))
+		for i, inst := range instances {
+			result[i] = ts.state.naming.instanceName(inst.Job, inst.ID, inst.Index)
 		}
-		ts.state.UpdateTaskState(taskID, "done", result)
-		ts.log("Task %d: Done", taskID)
-	}()
+		return result
+	}
+	finishedAt := time.Now()
+	report := DeployReport{
+		Deployment:      deployment,
+		TaskID:          taskID,
+		Created:         names(changes.Created),
+		Updated:         names(changes.Updated),
+		Deleted:         names(changes.Deleted),
+		Releases:        d.Releases,
+		Stemcells:       d.Stemcells,
+		StartedAt:       startedAt.Unix(),
+		FinishedAt:      finishedAt.Unix(),
+		DurationSeconds: finishedAt.Sub(startedAt).Seconds(),
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	ts.state.PutBlob(deployReportID(taskID), string(content))
+	return nil
 }
 
-// ExecuteStart simulates starting jobs.
-func (ts *TaskSimulator) ExecuteStart(taskID int, deployment, job string) {
-	go func() {
-		ts.log("Task %d: Starting start %s/%s", taskID, deployment, job)
+// deployTarget is one instance a deploy updates, with its task event name.
+type deployTarget struct {
+	name  string
+	group string
+	index int
+}
 
-		// Queue → Processing
-		time.Sleep(ts.scaledDuration(500 * time.Millisecond))
-		ts.state.UpdateTaskState(taskID, "processing", "")
-		ts.log("Task %d: Processing", taskID)
+// deployTargets lists the instances a deploy updates, group by group in
+// manifest order, marking each group's first instances as canaries.
+func deployTargets(manifest string) []deployTarget {
+	summary := parseManifest(manifest)
 
-		// Add lock
-		ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), 30*time.Minute)
+	var targets []deployTarget
+	for _, g := range summary.InstanceGroups {
+		if g.Lifecycle == LifecycleErrand {
+			continue
+		}
+		canaries := g.Update.merge(summary.Update).settings().Canaries
+		for index := 0; index < g.Instances; index++ {
+			name := fmt.Sprintf("%s/%d", g.Name, index)
+			if index < canaries {
+				name += " (canary)"
+			}
+			targets = append(targets, deployTarget{name: name, group: g.Name, index: index})
+		}
+	}
+	return targets
+}
 
-		// Simulate start work
-		time.Sleep(ts.scaledDuration(1 * time.Second))
+// compileStep returns a step that compiles a manifest's uncompiled release
+// packages, or nil if there are none. Each package gets a child task, linked
+// to the deploy by context ID, that completes as its compilation finishes and
+// ends with the deploy if the deploy ends first.
+func (ts *TaskSimulator) compileStep(taskID int, manifest string) (*taskStep, error) {
+	compilations := ts.state.PendingCompilations(manifest)
+	if len(compilations) == 0 {
+		return nil, nil
+	}
 
-		// Perform state change
-		err := ts.state.ChangeJobState(deployment, job, "started")
+	targets := make([]string, len(compilations))
+	children := make([]int, 0, len(compilations))
+	endChildren := func(state, result string) {
+		for _, child := range children {
+			if task, err := ts.state.GetTask(child); err == nil && !isTerminalTaskState(task.State) {
+				ts.state.UpdateTaskState(child, state, result)
+			}
+		}
+	}
+	for i, c := range compilations {
+		targets[i] = fmt.Sprintf("%s/%s", c.Release, c.Package)
+		child, err := ts.state.CreateChildTask(taskID, fmt.Sprintf("compile package %s/%s stemcell %s", c.Release, c.Package, c.Stemcell))
 		if err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
-			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
-			return
+			endChildren("error", err.Error())
+			return nil, fmt.Errorf("failed to create compilation tasks: %w", err)
 		}
+		children = append(children, child.ID)
+	}
+
+	return &taskStep{
+		stage:   "Compiling packages",
+		delay:   time.Duration(len(compilations)) * time.Second,
+		targets: targets,
+		onTarget: func(index int, state string) {
+			if state == "started" {
+				ts.state.UpdateTaskState(children[index], "processing", "")
+				return
+			}
+			c := compilations[index]
+			ts.state.UpdateTaskState(children[index], "done", fmt.Sprintf("Compiled %s/%s for %s", c.Release, c.Package, c.Stemcell))
+		},
+		action: func() error {
+			ts.state.MarkCompiled(compilations)
+			return nil
+		},
+		abort: endChildren,
+	}, nil
+}
 
-		// Remove lock and complete
-		ts.state.RemoveLock(deployment)
+// assignIPs gives new instances their IPs, immediately or after the
+// configured delay. It runs inside a task step, which already holds ts.mu, so
+// the delayed path captures the generation here and re-checks it later.
+func (ts *TaskSimulator) assignIPs(deployment string, instanceIDs []string) {
+	if len(instanceIDs) == 0 {
+		return
+	}
+	if ts.ipAssignDelay <= 0 {
+		ts.state.AssignIPs(deployment, instanceIDs)
+		return
+	}
 
-		result := fmt.Sprintf("Started jobs in deployment %s", deployment)
-		if job != "" {
-			result = fmt.Sprintf("Started job %s in deployment %s", job, deployment)
+	gen := ts.generation
+	go func() {
+		time.Sleep(ts.scaledDuration(ts.ipAssignDelay))
+		if ts.apply(gen, func() {
+			ts.state.AssignIPs(deployment, instanceIDs)
+		}) {
+			ts.log("Assigned IPs to %d instances in %s", len(instanceIDs), deployment)
 		}
-		ts.state.UpdateTaskState(taskID, "done", result)
-		ts.log("Task %d: Done", taskID)
 	}()
 }
 
-// ExecuteStop simulates stopping jobs.
-func (ts *TaskSimulator) ExecuteStop(taskID int, deployment, job string) {
-	go func() {
-		ts.log("Task %d: Starting stop %s/%s", taskID, deployment, job)
+// ExecuteSSH simulates setting up or cleaning up ssh access. Setup results
+// list connection details per VM; cleanup has nothing to report.
+func (ts *TaskSimulator) ExecuteSSH(taskID int, deployment, command string, vms []VM) {
+	ts.log("Task %d: Starting ssh %s %s", taskID, command, deployment)
 
-		// Queue → Processing
-		time.Sleep(ts.scaledDuration(500 * time.Millisecond))
-		ts.state.UpdateTaskState(taskID, "processing", "")
-		ts.log("Task %d: Processing", taskID)
+	result := ""
+	if command == "setup" {
+		entries := make([]SSHResult, len(vms))
+		for i, vm := range vms {
+			ip := ""
+			if len(vm.IPs) > 0 {
+				ip = vm.IPs[0]
+			}
+			entries[i] = SSHResult{
+				Index:         vm.Index,
+				Job:           vm.Job,
+				ID:            vm.ID,
+				IP:            ip,
+				HostPublicKey: fmt.Sprintf("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ-mock-%s", vm.ID),
+				Status:        "success",
+			}
+		}
+		b, _ := json.Marshal(entries)
+		result = string(b)
+	}
 
-		// Add lock
-		ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), 30*time.Minute)
+	ts.run(taskID, "", []taskStep{
+		{stage: "Executing ssh command", delay: 500 * time.Millisecond, action: func() error {
+			return nil
+		}},
+	}, result)
+}
 
-		// Simulate stop work
-		time.Sleep(ts.scaledDuration(1 * time.Second))
+// ExecuteFetchLogs simulates bundling an instance's logs. The bundle is
+// stored in the blobstore and the task result is its blob ID.
+func (ts *TaskSimulator) ExecuteFetchLogs(taskID int, deployment, job string, index int, logType string) {
+	ts.log("Task %d: Starting fetch %s logs %s/%s/%d", taskID, logType, deployment, job, index)
 
-		// Perform state change
-		err := ts.state.ChangeJobState(deployment, job, "stopped")
-		if err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
-			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
-			return
-		}
+	id := ""
+	if inst, err := ts.state.GetInstance(deployment, job, index); err == nil {
+		id = inst.ID
+	}
+	name := ts.state.InstanceName(deployment, job, id)
+	blobID := fmt.Sprintf("logs-%s-%s-%d-%d", deployment, job, index, time.Now().Unix())
+	ts.run(taskID, "", []taskStep{
+		{stage: "Fetching logs", delay: time.Second, targets: []string{name}, applyTarget: func(int) error {
+			dir := "/var/vcap/sys/log"
+			if logType == "agent" {
+				dir = "/var/vcap/bosh/log"
+			}
+			ts.state.PutBlob(blobID, fmt.Sprintf("%s %s logs from %s\n", name, logType, dir))
+			return nil
+		}},
+	}, blobID)
+}
 
-		// Remove lock and complete
-		ts.state.RemoveLock(deployment)
+// ExecuteRecreate simulates VM recreation.
+func (ts *TaskSimulator) ExecuteRecreate(taskID int, deployment, job, index string) {
+	ts.log("Task %d: Starting recreate %s/%s/%s", taskID, deployment, job, index)
 
-		result := fmt.Sprintf("Stopped jobs in deployment %s", deployment)
-		if job != "" {
-			result = fmt.Sprintf("Stopped job %s in deployment %s", job, deployment)
+	result := fmt.Sprintf("Recreated VMs for deployment %s", deployment)
+	if job != "" {
+		result = fmt.Sprintf("Recreated VMs for %s/%s", deployment, job)
+		if index != "" {
+			result = fmt.Sprintf("Recreated VM %s/%s/%s", deployment, job, index)
 		}
-		ts.state.UpdateTaskState(taskID, "done", result)
-		ts.log("Task %d: Done", taskID)
-	}()
+	}
+
+	// Each instance's VM is replaced as its update finishes, after checking
+	// up front that every agent involved responds
+	instances := ts.state.InstanceTargets(deployment, job, index)
+	names := make([]string, len(instances))
+	for i, inst := range instances {
+		names[i] = ts.state.naming.taskName(inst.Job, inst.ID, inst.Index)
+	}
+	update := taskStep{stage: "Updating instance", delay: ts.actionDuration("recreate"), targets: names, applyTarget: func(i int) error {
+		return ts.state.RecreateVMs(deployment, instances[i].Job, strconv.Itoa(instances[i].Index))
+	}}
+	if len(instances) == 0 {
+		update.action = func() error {
+			return ts.state.RecreateVMs(deployment, job, index)
+		}
+	}
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Preparing deployment", delay: 500 * time.Millisecond, action: func() error {
+			return ts.state.CheckAgents(deployment, job)
+		}},
+		update,
+	}, result)
 }
 
-// ExecuteRestart simulates restarting jobs.
-func (ts *TaskSimulator) ExecuteRestart(taskID int, deployment, job string) {
-	go func() {
-		ts.log("Task %d: Starting restart %s/%s", taskID, deployment, job)
+// ExecuteMigrate simulates moving an instance to another AZ by recreating
+// its VM there.
+func (ts *TaskSimulator) ExecuteMigrate(taskID int, deployment, job, id, az string) {
+	ts.log("Task %d: Starting migrate %s/%s/%s to %s", taskID, deployment, job, id, az)
 
-		// Queue → Processing
-		time.Sleep(ts.scaledDuration(500 * time.Millisecond))
-		ts.state.UpdateTaskState(taskID, "processing", "")
-		ts.log("Task %d: Processing", taskID)
+	name := ts.state.InstanceName(deployment, job, id)
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Preparing deployment", delay: 500 * time.Millisecond, action: func() error {
+			return nil
+		}},
+		{stage: "Updating instance", delay: ts.actionDuration("migrate"), targets: []string{name}, applyTarget: func(int) error {
+			return ts.state.MigrateInstance(deployment, job, id, az)
+		}},
+	}, fmt.Sprintf("Migrated %s to %s", name, az))
+}
 
-		// Add lock
-		ts.state.AddLock("deployment", deployment, fmt.Sprintf("%d", taskID), 30*time.Minute)
+// ExecuteAttachDisk simulates attaching a persistent disk to an instance.
+func (ts *TaskSimulator) ExecuteAttachDisk(taskID int, deployment, job, id, diskCID string) {
+	ts.log("Task %d: Starting attach disk %s to %s/%s/%s", taskID, diskCID, deployment, job, id)
 
-		// Simulate stop
-		time.Sleep(ts.scaledDuration(1 * time.Second))
-		if err := ts.state.ChangeJobState(deployment, job, "stopped"); err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
-			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
-			return
-		}
+	name := ts.state.InstanceName(deployment, job, id)
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Attaching disk", delay: 2 * time.Second, targets: []string{name}, applyTarget: func(int) error {
+			return ts.state.AttachDisk(deployment, job, id, diskCID)
+		}},
+	}, fmt.Sprintf("Attached disk %s to %s", diskCID, name))
+}
 
-		// Simulate start
-		time.Sleep(ts.scaledDuration(1 * time.Second))
-		err := ts.state.ChangeJobState(deployment, job, "started")
-		if err != nil {
-			ts.state.UpdateTaskState(taskID, "error", err.Error())
-			ts.log("Task %d: Error - %s", taskID, err.Error())
-			ts.state.RemoveLock(deployment)
-			return
+// ExecuteDetachDisk simulates detaching a persistent disk from an instance.
+func (ts *TaskSimulator) ExecuteDetachDisk(taskID int, deployment, job, id, diskCID string) {
+	ts.log("Task %d: Starting detach disk %s from %s/%s/%s", taskID, diskCID, deployment, job, id)
+
+	name := ts.state.InstanceName(deployment, job, id)
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Detaching disk", delay: 1 * time.Second, targets: []string{name}, applyTarget: func(int) error {
+			return ts.state.DetachDisk(deployment, job, id, diskCID)
+		}},
+	}, fmt.Sprintf("Detached disk %s from %s", diskCID, name))
+}
+
+// ExecuteResolveProblems simulates applying cloud check resolutions.
+func (ts *TaskSimulator) ExecuteResolveProblems(taskID int, deployment string, resolutions map[int]string) {
+	ts.log("Task %d: Starting apply resolutions %s", taskID, deployment)
+
+	// Each problem is resolved as its target finishes
+	problems, _ := ts.state.GetProblems(deployment)
+	var targets []string
+	var resolving []Problem
+	for _, p := range problems {
+		resolution, ok := resolutions[p.ID]
+		if !ok {
+			continue
+		}
+		for _, r := range p.Resolutions {
+			if r.Name == resolution {
+				targets = append(targets, fmt.Sprintf("%s: %s", ts.state.InstanceName(deployment, p.InstanceGroup, p.InstanceID), r.Plan))
+				resolving = append(resolving, p)
+			}
 		}
+	}
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Applying problem resolutions", delay: 2 * time.Second, targets: targets, applyTarget: func(i int) error {
+			return ts.state.ResolveProblem(deployment, resolving[i], resolutions[resolving[i].ID])
+		}},
+	}, fmt.Sprintf("%d resolved", len(targets)))
+}
+
+// ExecuteScan simulates a cloud check scan. The task result is the JSON list
+// of problems found, which GET /deployments/:name/problems also returns.
+func (ts *TaskSimulator) ExecuteScan(taskID int, deployment string) {
+	ts.log("Task %d: Starting scan %s", taskID, deployment)
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Scanning VMs", delay: time.Second, action: func() error {
+			return nil
+		}},
+		{stage: "Scanning persistent disks", delay: 500 * time.Millisecond, action: func() error {
+			result, err := ts.state.ScanProblems(deployment)
+			if err != nil {
+				return err
+			}
+			return ts.state.SetTaskResult(taskID, result)
+		}},
+	}, "")
+}
+
+// ExecuteSnapshot simulates snapshotting a deployment's persistent disks.
+func (ts *TaskSimulator) ExecuteSnapshot(taskID int, deployment string) {
+	ts.log("Task %d: Starting snapshot %s", taskID, deployment)
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Taking snapshots", delay: 1 * time.Second, action: func() error {
+			_, err := ts.state.CreateSnapshots(deployment)
+			return err
+		}},
+	}, "Snapshot created")
+}
+
+// ExecuteDeleteSnapshots simulates deleting all of a deployment's snapshots.
+func (ts *TaskSimulator) ExecuteDeleteSnapshots(taskID int, deployment string) {
+	ts.log("Task %d: Starting delete snapshots %s", taskID, deployment)
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Deleting snapshots", delay: 1 * time.Second, action: func() error {
+			return ts.state.DeleteSnapshots(deployment)
+		}},
+	}, fmt.Sprintf("Deleted snapshots of deployment %s", deployment))
+}
+
+// ExecuteDeleteDisk simulates deleting an orphaned disk.
+func (ts *TaskSimulator) ExecuteDeleteDisk(taskID int, diskCID string) {
+	ts.log("Task %d: Starting delete orphaned disk %s", taskID, diskCID)
+
+	ts.run(taskID, "", []taskStep{
+		{stage: "Deleting orphaned disks", delay: 1 * time.Second, action: func() error {
+			return ts.state.DeleteOrphanedDisk(diskCID)
+		}},
+	}, fmt.Sprintf("Deleted orphaned disk %s", diskCID))
+}
+
+// ExecuteCleanup simulates removing unused releases, stemcells, and orphaned
+// disks. The task result is the JSON summary of what was removed.
+func (ts *TaskSimulator) ExecuteCleanup(taskID int, removeAll bool) {
+	ts.log("Task %d: Starting cleanup (remove_all=%v)", taskID, removeAll)
 
-		// Remove lock and complete
-		ts.state.RemoveLock(deployment)
+	ts.run(taskID, "", []taskStep{
+		{stage: "Deleting unused resources", delay: 2 * time.Second, action: func() error {
+			summary := ts.state.Cleanup(removeAll)
+			result, err := json.Marshal(summary)
+			if err != nil {
+				return err
+			}
+			return ts.state.SetTaskResult(taskID, string(result))
+		}},
+	}, "")
+}
+
+// ExecuteStart simulates starting jobs, or one instance when index is set.
+func (ts *TaskSimulator) ExecuteStart(taskID int, deployment, job, index string) {
+	ts.log("Task %d: Starting start %s/%s/%s", taskID, deployment, job, index)
+
+	result := fmt.Sprintf("Started jobs in deployment %s", deployment)
+	if job != "" {
+		result = fmt.Sprintf("Started job %s in deployment %s", job, deployment)
+	}
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Starting instances", delay: ts.actionDuration("start"), action: func() error {
+			return ts.state.ChangeJobState(deployment, job, index, "started", false)
+		}},
+	}, result)
+}
+
+// ExecuteStop simulates stopping jobs, or one instance when index is set. A
+// hard stop also deletes the VMs.
+func (ts *TaskSimulator) ExecuteStop(taskID int, deployment, job, index string, hard bool) {
+	ts.log("Task %d: Starting stop %s/%s/%s (hard=%v)", taskID, deployment, job, index, hard)
+
+	result := fmt.Sprintf("Stopped jobs in deployment %s", deployment)
+	if job != "" {
+		result = fmt.Sprintf("Stopped job %s in deployment %s", job, deployment)
+	}
+
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Stopping instances", delay: ts.actionDuration("stop"), action: func() error {
+			return ts.state.ChangeJobState(deployment, job, index, "stopped", hard)
+		}},
+	}, result)
+}
+
+// ExecuteRestart simulates restarting jobs, or one instance when index is set.
+func (ts *TaskSimulator) ExecuteRestart(taskID int, deployment, job, index string) {
+	ts.log("Task %d: Starting restart %s/%s/%s", taskID, deployment, job, index)
+
+	result := fmt.Sprintf("Restarted jobs in deployment %s", deployment)
+	if job != "" {
+		result = fmt.Sprintf("Restarted job %s in deployment %s", job, deployment)
+	}
+
+	half := ts.actionDuration("restart") / 2
+	ts.run(taskID, deployment, []taskStep{
+		{stage: "Stopping instances", delay: half, action: func() error {
+			return ts.state.ChangeJobState(deployment, job, index, "stopped", false)
+		}},
+		{stage: "Starting instances", delay: half, action: func() error {
+			return ts.state.ChangeJobState(deployment, job, index, "started", false)
+		}},
+	}, result)
+}
 
-		result := fmt.Sprintf("Restarted jobs in deployment %s", deployment)
-		if job != "" {
-			result = fmt.Sprintf("Restarted job %s in deployment %s", job, deployment)
+// ExecuteRestartAll restarts deployments[i] under taskIDs[i] one after
+// another, starting each task once the one before it ends.
+func (ts *TaskSimulator) ExecuteRestartAll(taskIDs []int, deployments []string) {
+	gen := ts.currentGeneration()
+	go func() {
+		for i, taskID := range taskIDs {
+			ts.ExecuteRestart(taskID, deployments[i], "", "")
+			if !ts.waitForTaskEnd(gen, taskID) {
+				return
+			}
 		}
-		ts.state.UpdateTaskState(taskID, "done", result)
-		ts.log("Task %d: Done", taskID)
 	}()
 }
 
+// waitForTaskEnd blocks until a task ends or is deleted. It returns false if
+// the simulator was reset.
+func (ts *TaskSimulator) waitForTaskEnd(gen, taskID int) bool {
+	for {
+		time.Sleep(ts.scaledDuration(100 * time.Millisecond))
+		ended := false
+		if !ts.apply(gen, func() {
+			task, err := ts.state.GetTask(taskID)
+			ended = err != nil || isTerminalTaskState(task.State)
+		}) {
+			return false
+		}
+		if ended {
+			return true
+		}
+	}
+}
+
 // GetTaskOutput returns simulated task output.
 func (ts *TaskSimulator) GetTaskOutput(task *Task, outputType string) string {
 	if outputType == "" {
@@ -243,13 +1044,42 @@ func (ts *TaskSimulator) GetTaskOutput(task *Task, outputType string) string {
 		}
 		return fmt.Sprintf("Task %d: %s", task.ID, task.Description)
 	case "debug":
-		return fmt.Sprintf("DEBUG: Task %d started at %d\nDEBUG: State: %s\nDEBUG: Deployment: %s",
-			task.ID, task.Timestamp, task.State, task.Deployment)
+		return ts.taskDebugLog(task)
 	case "cpi":
 		return fmt.Sprintf("CPI: No CPI operations for task %d", task.ID)
 	case "event":
-		return fmt.Sprintf("EVENT: Task %d %s at %d", task.ID, task.State, task.Timestamp)
+		return ts.GetTaskEventOutput(task, 0)
 	default:
 		return task.Result
 	}
 }
+
+// GetTaskEventOutput returns a task's events as newline-delimited JSON,
+// starting at the line whose byte offset is at or after sinceOffset. Tasks
+// with no recorded events get a single summary event.
+func (ts *TaskSimulator) GetTaskEventOutput(task *Task, sinceOffset int64) string {
+	events := ts.state.GetTaskEvents(task.ID, sinceOffset)
+	if len(events) == 0 && sinceOffset == 0 {
+		events = []TaskEvent{{
+			Time:     task.Timestamp,
+			Stage:    task.Description,
+			Tags:     []string{},
+			Total:    1,
+			Task:     task.Description,
+			Index:    1,
+			State:    task.State,
+			Progress: 100,
+		}}
+	}
+
+	var b strings.Builder
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
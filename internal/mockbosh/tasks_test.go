@@ -0,0 +1,76 @@
+// ABOUTME: Tests for the task simulator's random choices.
+// ABOUTME: Verifies a seed reproduces injected failures and jitter bounds.
+
+package mockbosh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTaskSimulatorSeed(t *testing.T) {
+	rolls := func(seed int64) []string {
+		simulator := NewTaskSimulator(NewState(), 10.0, false)
+		simulator.SetFailureRate(0.5)
+		simulator.SetSeed(seed)
+		var failures []string
+		for i := 0; i < 20; i++ {
+			failures = append(failures, simulator.injectedFailure("cf"))
+		}
+		return failures
+	}
+
+	first, second := rolls(42), rolls(42)
+	failed := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Roll %d differs with the same seed: %q vs %q", i, first[i], second[i])
+		}
+		if first[i] != "" {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Errorf("Expected a mix of failures at rate 0.5, got %d of %d", failed, len(first))
+	}
+
+	other := rolls(43)
+	same := true
+	for i := range first {
+		same = same && first[i] == other[i]
+	}
+	if same {
+		t.Error("Expected a different seed to roll differently")
+	}
+}
+
+func TestTaskSimulatorJitter(t *testing.T) {
+	simulator := NewTaskSimulator(NewState(), 2.0, false)
+	simulator.SetSeed(1)
+	if got := simulator.scaledDuration(time.Second); got != 500*time.Millisecond {
+		t.Errorf("Expected no jitter by default, got %s", got)
+	}
+
+	simulator.SetJitter(0.2)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 50; i++ {
+		got := simulator.scaledDuration(time.Second)
+		if got < 400*time.Millisecond || got > 600*time.Millisecond {
+			t.Fatalf("Expected 500ms ±20%%, got %s", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("Expected jittered durations to vary")
+	}
+
+	simulator.SetJitter(0.99)
+	for i := 0; i < 50; i++ {
+		if got := simulator.scaledDuration(time.Nanosecond); got <= 0 {
+			t.Fatalf("Expected a positive duration, got %s", got)
+		}
+	}
+	if got := simulator.scaledDuration(0); got != 0 {
+		t.Errorf("Expected no delay to stay zero, got %s", got)
+	}
+}
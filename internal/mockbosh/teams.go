@@ -0,0 +1,96 @@
+// ABOUTME: Team scoping for multi-tenant clients: users map to teams and
+// ABOUTME: only see or change deployments one of their teams owns.
+
+package mockbosh
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// UserTeams maps each team-scoped user to the teams they belong to. The
+// director's own user is never scoped and sees every deployment.
+type UserTeams map[string][]string
+
+// ParseUserTeams parses USER:TEAM pairs separated by commas, e.g.
+// "admin:cf,dev:redis". A user listed more than once belongs to each team.
+func ParseUserTeams(spec string) (UserTeams, error) {
+	teams := UserTeams{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		user, team, ok := strings.Cut(pair, ":")
+		if !ok || user == "" || team == "" {
+			return nil, fmt.Errorf("invalid team %q: expected USER:TEAM", pair)
+		}
+		if !containsString(teams[user], team) {
+			teams[user] = append(teams[user], team)
+		}
+	}
+	return teams, nil
+}
+
+func (t UserTeams) String() string {
+	users := make([]string, 0, len(t))
+	for user := range t {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var pairs []string
+	for _, user := range users {
+		for _, team := range t[user] {
+			pairs = append(pairs, user+":"+team)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// SetUserTeams scopes the listed users to their teams. Team users log in
+// with the director's password.
+func (h *Handlers) SetUserTeams(teams UserTeams) {
+	h.userTeams = teams
+}
+
+// requestUser returns the user a request authenticated as. Bearer tokens
+// are always the director's own client.
+func (h *Handlers) requestUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && h.tokens == nil {
+		return user
+	}
+	return h.username
+}
+
+// canAccess reports whether the request's user may see a deployment owned
+// by teams. Unscoped users can see everything.
+func (h *Handlers) canAccess(r *http.Request, teams []string) bool {
+	user := h.requestUser(r)
+	userTeams, scoped := h.userTeams[user]
+	if !scoped || user == h.username {
+		return true
+	}
+	for _, team := range userTeams {
+		if containsString(teams, team) {
+			return true
+		}
+	}
+	return false
+}
+
+// teamsMiddleware rejects mutating requests against deployments none of
+// the user's teams own.
+func (s *Server) teamsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/")
+		if isMutating(r) && strings.HasPrefix(r.URL.Path, "/deployments/") && name != "" {
+			if d, err := s.state.GetDeployment(name); err == nil && !s.handlers.canAccess(r, d.Teams) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("user '%s' is not authorized to change deployment '%s'", s.handlers.requestUser(r), name))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
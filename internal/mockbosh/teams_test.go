@@ -0,0 +1,114 @@
+// ABOUTME: Tests for team scoping.
+// ABOUTME: Verifies listing and mutation access per user and -teams parsing.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTeamScoping(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Speed = 10.0
+	config.Teams = UserTeams{"dev": {"admin"}}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	server.registerRoutes(mux)
+	handler := server.authMiddleware(server.teamsMiddleware(mux))
+
+	do := func(user, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth(user, "admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	listed := func(user string) []string {
+		var deployments []Deployment
+		json.Unmarshal(do(user, http.MethodGet, "/deployments").Body.Bytes(), &deployments)
+		var names []string
+		for _, d := range deployments {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+	if names := listed("dev"); len(names) != 1 || names[0] != "cf" {
+		t.Errorf("Expected dev to see only cf, got %v", names)
+	}
+	if names := listed("admin"); len(names) != 3 {
+		t.Errorf("Expected admin to see every deployment, got %v", names)
+	}
+
+	if w := do("dev", http.MethodPut, "/deployments/redis/jobs/redis?state=restart"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for another team's deployment, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := do("dev", http.MethodGet, "/deployments/redis/vms"); w.Code != http.StatusOK {
+		t.Errorf("Expected reads to pass, got %d", w.Code)
+	}
+
+	w := do("dev", http.MethodPut, "/deployments/cf/jobs/router?state=restart")
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d for the team's deployment, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+	var task Task
+	json.Unmarshal(do("dev", http.MethodGet, w.Header().Get("Location")).Body.Bytes(), &task)
+	if task.User != "dev" {
+		t.Errorf("Expected the task to record user dev, got %q", task.User)
+	}
+	// The restart holds cf's lock until it finishes
+	waitForTask(t, server.state, task.ID, 5*time.Second)
+
+	deploy := func(user, manifest string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/deployments", strings.NewReader(manifest))
+		req.SetBasicAuth(user, "admin")
+		req.Header.Set("Content-Type", "text/yaml")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	redis := "name: redis\ninstance_groups:\n- name: redis\n  instances: 1\n"
+	if w := deploy("dev", redis); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d deploying another team's deployment by manifest name, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := deploy("dev", redis[len("name: redis\n"):]+"name: redis\n"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d wherever the name appears, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := deploy("dev", "name: cf\ninstance_groups:\n- name: router\n  instances: 2\n"); w.Code != http.StatusFound {
+		t.Errorf("Expected dev to deploy its team's deployment, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("admin", http.MethodPut, "/deployments/redis/jobs/redis?state=restart"); w.Code != http.StatusFound {
+		t.Errorf("Expected admin to change any deployment, got %d", w.Code)
+	}
+	if w := do("mallory", http.MethodGet, "/deployments"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an unknown user, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestParseUserTeams(t *testing.T) {
+	teams, err := ParseUserTeams("admin:cf, dev:redis,dev:mysql")
+	if err != nil {
+		t.Fatalf("ParseUserTeams failed: %v", err)
+	}
+	if len(teams["dev"]) != 2 || teams["admin"][0] != "cf" {
+		t.Errorf("Unexpected teams %v", teams)
+	}
+	if got := teams.String(); got != "admin:cf,dev:redis,dev:mysql" {
+		t.Errorf("Expected the pairs back, got %q", got)
+	}
+
+	for _, spec := range []string{"dev", "dev:", ":redis"} {
+		if _, err := ParseUserTeams(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -19,24 +19,83 @@ type VM struct {
 	State        string   `json:"state"`
 	VMType       string   `json:"vm_type"`
 	Ignore       bool     `json:"ignore"`
+	Lifecycle    string   `json:"lifecycle"`
+	Jobs         []string `json:"jobs,omitempty"`
 }
 
+// Instance group lifecycles.
+const (
+	LifecycleService = "service"
+	LifecycleErrand  = "errand"
+)
+
 // Instance represents a BOSH instance with process details.
 type Instance struct {
-	AgentID    string    `json:"agent_id"`
-	AZ         string    `json:"az"`
-	Bootstrap  bool      `json:"bootstrap"`
-	Deployment string    `json:"deployment"`
-	Disk       string    `json:"disk_cid,omitempty"`
-	Expects    bool      `json:"expects_vm"`
-	ID         string    `json:"id"`
-	IPs        []string  `json:"ips"`
-	Job        string    `json:"job"`
-	Index      int       `json:"index"`
-	State      string    `json:"state"`
-	VMType     string    `json:"vm_type"`
-	VMCID      string    `json:"vm_cid"`
-	Processes  []Process `json:"processes,omitempty"`
+	AgentID    string         `json:"agent_id"`
+	AZ         string         `json:"az"`
+	Bootstrap  bool           `json:"bootstrap"`
+	Deployment string         `json:"deployment"`
+	Disk       string         `json:"disk_cid,omitempty"`
+	Expects    bool           `json:"expects_vm"`
+	ID         string         `json:"id"`
+	IPs        []string       `json:"ips"`
+	Job        string         `json:"job"`
+	Index      int            `json:"index"`
+	State      string         `json:"state"`
+	VMType     string         `json:"vm_type"`
+	VMCID      string         `json:"vm_cid"`
+	Processes  []Process      `json:"processes,omitempty"`
+	Links      *InstanceLinks `json:"links,omitempty"`
+	HealthURL  string         `json:"health_url,omitempty"`
+	Lifecycle  string         `json:"lifecycle"`
+	Jobs       []string       `json:"jobs,omitempty"`
+	Ignore     bool           `json:"ignore,omitempty"`
+}
+
+// Errand represents an errand instance group from /deployments/:name/errands.
+type Errand struct {
+	Name string `json:"name"`
+}
+
+// LinkDefinition is a named, typed link provided by an instance group.
+type LinkDefinition struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// JobLinks describes the links an instance group provides and consumes.
+// Consumed links are referenced by name and resolved against providers.
+type JobLinks struct {
+	Provides []LinkDefinition `json:"provides"`
+	Consumes []string         `json:"consumes"`
+}
+
+// InstanceLink is a link resolved to the instance group that provides it.
+type InstanceLink struct {
+	Name          string `json:"name"`
+	Type          string `json:"type,omitempty"`
+	InstanceGroup string `json:"instance_group,omitempty"`
+}
+
+// InstanceLinks lists the links an instance provides and consumes.
+type InstanceLinks struct {
+	Provides []InstanceLink `json:"provides"`
+	Consumes []InstanceLink `json:"consumes"`
+}
+
+// HealthCheck describes the synthetic health endpoint a job exposes.
+type HealthCheck struct {
+	Port int    `json:"port"`
+	Path string `json:"path"`
+}
+
+// ProbeResult reports the synthetic health of a single instance.
+type ProbeResult struct {
+	Target    string    `json:"target"`
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	State     string    `json:"state"`
+	Processes []Process `json:"processes"`
 }
 
 // Process represents a process running on a BOSH instance.
@@ -64,6 +123,18 @@ type CPUUsage struct {
 	Total float64 `json:"total"`
 }
 
+// VitalsUsage is CPU and memory summed across processes.
+type VitalsUsage struct {
+	CPU   float64 `json:"cpu"`
+	MemKB int     `json:"mem_kb"`
+}
+
+// DeploymentVitals is the response body for GET /deployments/:name/vitals.
+type DeploymentVitals struct {
+	Jobs  map[string]VitalsUsage `json:"jobs"`
+	Total VitalsUsage            `json:"total"`
+}
+
 // Task represents a BOSH task.
 type Task struct {
 	ID          int    `json:"id"`
@@ -74,14 +145,252 @@ type Task struct {
 	User        string `json:"user"`
 	Deployment  string `json:"deployment,omitempty"`
 	ContextID   string `json:"context_id,omitempty"`
+
+	// Verbose is the /tasks verbosity level a task first shows at: 0 or 1
+	// for user tasks, 2 for internal ones such as scheduled scans
+	Verbose int `json:"verbose,omitempty"`
+
+	// QueuePosition is the task's place among tasks waiting for a slot
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	// ProgressPercent rises as the simulator completes a task's steps;
+	// StartedAt and FinishedAt mark when it began processing and ended
+	ProgressPercent int   `json:"progress_percent,omitempty"`
+	StartedAt       int64 `json:"started_at,omitempty"`
+	FinishedAt      int64 `json:"finished_at,omitempty"`
+
+	// AffectedResources lists what the task's steps changed; GET
+	// /tasks/:id only includes it with ?verbose=1
+	AffectedResources *AffectedResources `json:"affected_resources,omitempty"`
+}
+
+// AffectedResources is the VMs a task created and deleted and the instances
+// it changed.
+type AffectedResources struct {
+	VMsCreated []string `json:"vm_cids_created"`
+	VMsDeleted []string `json:"vm_cids_deleted"`
+	Instances  []string `json:"instances"`
+}
+
+// TaskEvent is one line of a task's type=event output. Offset is the byte
+// position of the line within the task's event output.
+type TaskEvent struct {
+	Time     int64    `json:"time"`
+	Stage    string   `json:"stage"`
+	Tags     []string `json:"tags"`
+	Total    int      `json:"total"`
+	Task     string   `json:"task"`
+	Index    int      `json:"index"`
+	State    string   `json:"state"`
+	Progress int      `json:"progress"`
+	Offset   int64    `json:"offset"`
 }
 
 // Deployment represents a BOSH deployment.
 type Deployment struct {
-	Name        string        `json:"name"`
-	CloudConfig string        `json:"cloud_config"`
-	Releases    []NameVersion `json:"releases"`
-	Stemcells   []NameVersion `json:"stemcells"`
+	Name           string                 `json:"name"`
+	CloudConfig    string                 `json:"cloud_config"`
+	Releases       []NameVersion          `json:"releases"`
+	Stemcells      []NameVersion          `json:"stemcells"`
+	Teams          []string               `json:"teams"`
+	InstanceGroups []InstanceGroupSummary `json:"instance_groups,omitempty"`
+	Resources      *ResourceTotals        `json:"resources,omitempty"`
+	Manifest       string                 `json:"manifest,omitempty"`
+
+	// ResurrectionPaused stops resurrection for this deployment alone
+	ResurrectionPaused bool `json:"resurrection_paused,omitempty"`
+}
+
+// ResourceTotals sums the compute and disk a deployment's VMs use, sized from
+// the cloud config's vm_types and disk types.
+type ResourceTotals struct {
+	CPU              int `json:"cpu"`
+	MemoryMB         int `json:"memory_mb"`
+	EphemeralDiskMB  int `json:"ephemeral_disk_mb"`
+	PersistentDiskMB int `json:"persistent_disk_mb"`
+}
+
+// InstanceGroupSummary describes an instance group in the deployment list.
+type InstanceGroupSummary struct {
+	Name   string         `json:"name"`
+	Update UpdateSettings `json:"update"`
+}
+
+// UpdateSettings is an instance group's effective rollout strategy.
+type UpdateSettings struct {
+	Canaries    int    `json:"canaries"`
+	MaxInFlight string `json:"max_in_flight"`
+	Serial      bool   `json:"serial"`
+}
+
+// DeployChanges records the instances a deploy created, updated, and deleted.
+type DeployChanges struct {
+	Created []Instance
+	Updated []Instance
+	Deleted []Instance
+}
+
+// DeployReport is the archived summary of a deploy, stored as a blob and
+// downloadable from /resources/:id.
+type DeployReport struct {
+	Deployment      string        `json:"deployment"`
+	TaskID          int           `json:"task_id"`
+	Created         []string      `json:"created"`
+	Updated         []string      `json:"updated"`
+	Deleted         []string      `json:"deleted"`
+	Releases        []NameVersion `json:"releases"`
+	Stemcells       []NameVersion `json:"stemcells"`
+	StartedAt       int64         `json:"started_at"`
+	FinishedAt      int64         `json:"finished_at"`
+	DurationSeconds float64       `json:"duration_seconds"`
+}
+
+// Blob is an object in the director's blobstore.
+type Blob struct {
+	ID        string `json:"id"`
+	SHA1      string `json:"sha1"`
+	Content   string `json:"content"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// DeploymentManifest is the response body for GET /deployments/:name.
+type DeploymentManifest struct {
+	Manifest           string `json:"manifest"`
+	ResurrectionPaused bool   `json:"resurrection_paused"`
+}
+
+// DeploymentDeletion is the response body for DELETE /deployments/:name with
+// ?dry_run=true: what deleting the deployment would remove. Stemcells lists
+// the stemcells, as name/version, that would stop being used by it.
+type DeploymentDeletion struct {
+	Deployment string   `json:"deployment"`
+	VMs        int      `json:"vms"`
+	Instances  int      `json:"instances"`
+	Variables  int      `json:"variables"`
+	Stemcells  []string `json:"stemcells"`
+}
+
+// DeploymentDiff is the response body for POST /deployments/:name/diff. Each
+// diff entry is a [line, state] pair where state is "added" or "removed".
+type DeploymentDiff struct {
+	Diff    [][]string  `json:"diff"`
+	Context DiffContext `json:"context"`
+}
+
+// DiffContext identifies the configs a diff was computed against.
+type DiffContext struct {
+	CloudConfigID    string   `json:"cloud_config_id,omitempty"`
+	RuntimeConfigIDs []string `json:"runtime_config_ids"`
+}
+
+// Problem is a cloud check problem from /deployments/:name/problems.
+type Problem struct {
+	ID            int                 `json:"id"`
+	Type          string              `json:"type"`
+	Description   string              `json:"description"`
+	Data          map[string]string   `json:"data"`
+	Resolutions   []ProblemResolution `json:"resolutions"`
+	InstanceGroup string              `json:"instance_group"`
+	InstanceID    string              `json:"instance_id"`
+}
+
+// ProblemResolution is a way to resolve a problem. Name is what clients
+// submit; Plan describes it.
+type ProblemResolution struct {
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+}
+
+// ProblemsResolveRequest is the body of PUT /deployments/:name/problems,
+// mapping problem IDs to resolution names.
+type ProblemsResolveRequest struct {
+	Resolutions map[string]string `json:"resolutions"`
+}
+
+// SSHRequest is the body of POST /deployments/:name/ssh.
+type SSHRequest struct {
+	Command        string    `json:"command"`
+	DeploymentName string    `json:"deployment_name,omitempty"`
+	Target         SSHTarget `json:"target"`
+	Params         SSHParams `json:"params"`
+}
+
+// SSHTarget selects instances by group and by index or ID. An empty job
+// targets every instance; empty indexes target every instance in the job.
+type SSHTarget struct {
+	Job     string   `json:"job"`
+	Indexes []string `json:"indexes"`
+	IDs     []string `json:"ids"`
+}
+
+// SSHParams carries the user and key to set up for ssh.
+type SSHParams struct {
+	User      string `json:"user"`
+	PublicKey string `json:"public_key"`
+}
+
+// SSHResult is one instance's entry in an ssh setup task's result.
+type SSHResult struct {
+	Index         int    `json:"index"`
+	Job           string `json:"job"`
+	ID            string `json:"id"`
+	IP            string `json:"ip"`
+	HostPublicKey string `json:"host_public_key"`
+	Status        string `json:"status"`
+}
+
+// StuckDeployScenario describes the state set up by
+// POST /_internal/scenario/stuck-deploy.
+type StuckDeployScenario struct {
+	Deployment string `json:"deployment"`
+	Instance   string `json:"instance"`
+	TaskID     int    `json:"task_id"`
+}
+
+// ConfigDiff is the response body for GET /configs/diff. Diff entries are
+// [line, state] pairs as in DeploymentDiff.
+type ConfigDiff struct {
+	From string     `json:"from"`
+	To   string     `json:"to"`
+	Diff [][]string `json:"diff"`
+}
+
+// ConfigValidation is the response body for POST /configs/validate.
+type ConfigValidation struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// IPAllocation is one IP held by a VM, from GET /_internal/ips.
+type IPAllocation struct {
+	IP         string `json:"ip"`
+	Deployment string `json:"deployment"`
+	Instance   string `json:"instance"`
+	VMCID      string `json:"vm_cid"`
+	Duplicate  bool   `json:"duplicate"`
+}
+
+// IPInventory is the response body for GET /_internal/ips. Duplicates lists
+// IPs held by more than one VM.
+type IPInventory struct {
+	IPs        []IPAllocation `json:"ips"`
+	Duplicates []string       `json:"duplicates"`
+}
+
+// ColocationGroup lists the jobs colocated on an instance group's VMs, from
+// GET /deployments/:name/colocation.
+type ColocationGroup struct {
+	InstanceGroup string   `json:"instance_group"`
+	Jobs          []string `json:"jobs"`
+	VMs           []string `json:"vms"`
+	Colocated     bool     `json:"colocated"`
+}
+
+// HealthStatus is the response body for GET /health.
+type HealthStatus struct {
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
 }
 
 // NameVersion represents a name/version pair.
@@ -101,35 +410,113 @@ type Stemcell struct {
 
 // Release represents an uploaded release.
 type Release struct {
-	Name               string `json:"name"`
-	Version            string `json:"version"`
-	CommitHash         string `json:"commit_hash"`
-	UncommittedChanges bool   `json:"uncommitted_changes"`
+	Name               string   `json:"name"`
+	Version            string   `json:"version"`
+	CommitHash         string   `json:"commit_hash"`
+	UncommittedChanges bool     `json:"uncommitted_changes"`
+	Packages           []string `json:"packages,omitempty"`
+	CompiledFor        []string `json:"compiled_for,omitempty"` // Stemcells as "os/version"
 }
 
-// CloudConfig represents a cloud config.
+// CloudConfig represents one version of the cloud config.
 type CloudConfig struct {
+	ID         string `json:"id"`
 	Properties string `json:"properties"`
 	CreatedAt  string `json:"created_at"`
 }
 
-// RuntimeConfig represents a runtime config.
+// RuntimeConfig represents one version of a named runtime config.
 type RuntimeConfig struct {
+	ID         string `json:"id"`
 	Name       string `json:"name"`
 	Properties string `json:"properties"`
 	CreatedAt  string `json:"created_at"`
 }
 
-// CPIConfig represents a CPI config.
+// CPIConfig represents one version of the CPI config.
 type CPIConfig struct {
+	ID         string `json:"id"`
 	Properties string `json:"properties"`
 	CreatedAt  string `json:"created_at"`
 }
 
 // Variable represents a deployment variable.
 type Variable struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// VariableWithDeployment is a variable from GET /variables, annotated with
+// the deployment that owns it.
+type VariableWithDeployment struct {
+	Variable
+	Deployment string `json:"deployment"`
+}
+
+// VariableUsage lists where a deployment's manifest references a variable,
+// from GET /deployments/:name/variables/usage.
+type VariableUsage struct {
+	Name       string              `json:"name"`
+	References []VariableReference `json:"references"`
+}
+
+// VariableReference is a job property whose value uses a variable.
+type VariableReference struct {
+	InstanceGroup string `json:"instance_group"`
+	Job           string `json:"job"`
+	Property      string `json:"property"`
+}
+
+// Snapshot represents a persistent disk snapshot from /deployments/:name/snapshots.
+type Snapshot struct {
+	Job         string `json:"job"`
+	Index       int    `json:"index"`
+	SnapshotCID string `json:"snapshot_cid"`
+	CreatedAt   string `json:"created_at"`
+	Clean       bool   `json:"clean"`
+}
+
+// snapshotTimeFormat is the layout of Snapshot.CreatedAt.
+const snapshotTimeFormat = "2006-01-02 15:04:05 UTC"
+
+// OrphanedDisk represents a detached persistent disk from /disks.
+type OrphanedDisk struct {
+	DiskCID      string `json:"disk_cid"`
+	Size         int    `json:"size"`
+	Deployment   string `json:"deployment_name"`
+	InstanceName string `json:"instance_name"`
+	AZ           string `json:"az"`
+	OrphanedAt   string `json:"orphaned_at"`
+}
+
+// Event represents an audit event from /events.
+type Event struct {
+	ID             int               `json:"id"`
+	Timestamp      int64             `json:"timestamp"`
+	User           string            `json:"user"`
+	Action         string            `json:"action"`
+	ObjectType     string            `json:"object_type"`
+	ObjectName     string            `json:"object_name"`
+	DeploymentName string            `json:"deployment,omitempty"`
+	TaskID         string            `json:"task,omitempty"`
+	Context        map[string]string `json:"context,omitempty"`
+}
+
+// EventFilter selects events from /events. Zero values match everything.
+type EventFilter struct {
+	Deployment string
+	Action     string
+	ObjectType string
+	TaskID     string
+	BeforeID   int
+}
+
+// CleanupSummary lists what a cleanup task removed.
+type CleanupSummary struct {
+	Releases      []NameVersion `json:"releases"`
+	Stemcells     []NameVersion `json:"stemcells"`
+	OrphanedDisks []string      `json:"orphaned_disks"`
 }
 
 // Lock represents a deployment lock.
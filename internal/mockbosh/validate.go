@@ -0,0 +1,105 @@
+// ABOUTME: Config validation for the mock BOSH Director.
+// ABOUTME: Checks cloud, runtime, and CPI configs before they're stored.
+
+package mockbosh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// configTypes are the config types the director stores.
+var configTypes = []string{"cloud", "runtime", "cpi"}
+
+// isConfigType reports whether t is a config type the director stores.
+func isConfigType(t string) bool {
+	return containsString(configTypes, t)
+}
+
+// ValidateConfig checks a config for structural problems (errors, which
+// uploads reject) and dangling references (warnings) without storing it.
+// Runtime config releases are checked against uploaded releases.
+func (s *State) ValidateConfig(configType, content string) ConfigValidation {
+	result := ConfigValidation{Errors: make([]string, 0), Warnings: make([]string, 0)}
+	if !isConfigType(configType) {
+		result.Errors = append(result.Errors, fmt.Sprintf("unknown config type: %s", configType))
+	}
+	if strings.TrimSpace(content) == "" {
+		result.Errors = append(result.Errors, "config content must not be empty")
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	for i, line := range strings.Split(content, "\n") {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, "\t") {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: tabs are not allowed in indentation", i+1))
+		}
+	}
+
+	switch configType {
+	case "cloud":
+		validateCloudConfig(content, &result)
+	case "runtime":
+		s.validateRuntimeConfig(content, &result)
+	case "cpi":
+		if !hasTopLevelKey(content, "cpis") {
+			result.Errors = append(result.Errors, "cpi config must define cpis")
+		}
+	}
+
+	result.Valid = len(result.Errors) == 0
+	return result
+}
+
+// validateCloudConfig checks subnet ranges and that every AZ a subnet uses
+// is defined.
+func validateCloudConfig(content string, result *ConfigValidation) {
+	cloud := parseCloudConfig(content)
+	if len(cloud.VMTypes) == 0 {
+		result.Warnings = append(result.Warnings, "cloud config defines no vm_types")
+	}
+	if !hasTopLevelKey(content, "networks") {
+		result.Warnings = append(result.Warnings, "cloud config defines no networks")
+	}
+	for _, subnet := range cloud.Subnets {
+		if _, _, err := net.ParseCIDR(subnet.Range); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("subnet range '%s' is not a valid CIDR", subnet.Range))
+		}
+		for _, az := range subnet.AZs {
+			if !cloud.hasAZ(az) {
+				result.Errors = append(result.Errors, fmt.Sprintf("subnet %s references undefined az '%s'", subnet.Range, az))
+			}
+		}
+	}
+}
+
+// validateRuntimeConfig checks that each release a runtime config references
+// has a version and has been uploaded.
+func (s *State) validateRuntimeConfig(content string, result *ConfigValidation) {
+	uploaded := make(map[NameVersion]bool)
+	for _, rel := range s.GetReleases() {
+		uploaded[NameVersion{Name: rel.Name, Version: rel.Version}] = true
+	}
+
+	for _, rel := range parseManifest(content).Releases {
+		switch {
+		case rel.Version == "":
+			result.Errors = append(result.Errors, fmt.Sprintf("release '%s' has no version", rel.Name))
+		case !uploaded[rel]:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("release '%s/%s' has not been uploaded", rel.Name, rel.Version))
+		}
+	}
+}
+
+// hasTopLevelKey reports whether content has an unindented "key:" line.
+func hasTopLevelKey(content, key string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, key+":") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// ABOUTME: BOSH version modes that switch several behaviors at once so the
+// ABOUTME: mock can emulate distinctly older or newer directors.
+
+package mockbosh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// BoshVersionMode selects a set of director behaviors by era.
+type BoshVersionMode string
+
+// Supported version modes. The default mode keeps the mock's usual behavior.
+const (
+	BoshVersionModeDefault BoshVersionMode = ""
+	BoshVersionModeLegacy  BoshVersionMode = "legacy"
+	BoshVersionModeModern  BoshVersionMode = "modern"
+)
+
+// versionBehavior is the set of behaviors a version mode switches.
+type versionBehavior struct {
+	jobsRouting           bool           // PUT /deployments/:name/jobs/:job changes job state
+	instanceGroupsRouting bool           // PUT /deployments/:name/instance_groups/:group does
+	inlineTasks           bool           // Task-starting requests return 202 and the task, not a 302
+	namedErrors           bool           // Error bodies carry the error code's name
+	infoVersion           string         // /info version unless one is configured
+	instanceNaming        InstanceNaming // Naming unless one is configured
+}
+
+// ParseBoshVersionMode validates a version mode.
+func ParseBoshVersionMode(s string) (BoshVersionMode, error) {
+	switch mode := BoshVersionMode(s); mode {
+	case BoshVersionModeDefault, BoshVersionModeLegacy, BoshVersionModeModern:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown bosh version mode %q (want legacy or modern)", s)
+}
+
+// behavior returns the behaviors the mode switches on.
+func (m BoshVersionMode) behavior() versionBehavior {
+	switch m {
+	case BoshVersionModeLegacy:
+		return versionBehavior{
+			jobsRouting:    true,
+			infoVersion:    "262.3.0 (00000000)",
+			instanceNaming: InstanceNamingIndex,
+		}
+	case BoshVersionModeModern:
+		return versionBehavior{
+			instanceGroupsRouting: true,
+			inlineTasks:           true,
+			namedErrors:           true,
+			infoVersion:           "282.1.0 (00000000)",
+			instanceNaming:        InstanceNamingID,
+		}
+	}
+	return versionBehavior{jobsRouting: true}
+}
+
+// namedErrorsMiddleware adds the error code's name to JSON error bodies when
+// the version mode asks for it.
+func (s *Server) namedErrorsMiddleware(next http.Handler) http.Handler {
+	if !s.behavior.namedErrors {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := &namedErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(nw, r)
+		nw.finish()
+	})
+}
+
+// namedError is an error body with the name of its code.
+type namedError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	Name        string `json:"name"`
+}
+
+// namedErrorWriter holds back error bodies so finish can rewrite them;
+// everything else passes straight through.
+type namedErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (nw *namedErrorWriter) WriteHeader(code int) {
+	nw.status = code
+	if code < http.StatusBadRequest {
+		nw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (nw *namedErrorWriter) Write(b []byte) (int, error) {
+	if nw.status == 0 {
+		nw.WriteHeader(http.StatusOK)
+	}
+	if nw.status >= http.StatusBadRequest {
+		return nw.body.Write(b)
+	}
+	return nw.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (nw *namedErrorWriter) Flush() {
+	if f, ok := nw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes a held-back error, naming its code if the body is an
+// ErrorResponse.
+func (nw *namedErrorWriter) finish() {
+	if nw.status < http.StatusBadRequest {
+		return
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(nw.body.Bytes(), &resp); err != nil {
+		nw.ResponseWriter.WriteHeader(nw.status)
+		nw.ResponseWriter.Write(nw.body.Bytes())
+		return
+	}
+
+	named := namedError{Code: resp.Code, Description: resp.Description, Name: http.StatusText(resp.Code)}
+	for _, code := range ErrorCatalog() {
+		if code.Code == resp.Code {
+			named.Name = code.Name
+			break
+		}
+	}
+	writeJSON(nw.ResponseWriter, nw.status, named)
+}
@@ -0,0 +1,87 @@
+// ABOUTME: Tests for BOSH version modes.
+// ABOUTME: Verifies routing, task responses, error bodies, and /info per mode.
+
+package mockbosh
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBoshVersionMode(t *testing.T) {
+	tests := []struct {
+		mode          string
+		stopPath      string
+		unroutedPath  string
+		status        int
+		version       string
+		errorHasNames bool
+	}{
+		{"legacy", "/deployments/redis/jobs/redis?state=stopped", "/deployments/redis/instance_groups/redis?state=stopped", http.StatusFound, "262.3.0 (00000000)", false},
+		{"modern", "/deployments/redis/instance_groups/redis?state=stopped", "/deployments/redis/jobs/redis?state=stopped", http.StatusAccepted, "282.1.0 (00000000)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config := DefaultServerConfig()
+			config.Speed = 10.0
+			config.BoshVersionMode = tt.mode
+			server, err := NewServer(config)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			mux := http.NewServeMux()
+			server.registerRoutes(mux)
+			handler := server.namedErrorsMiddleware(mux)
+
+			do := func(method, path string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, nil)
+				req.SetBasicAuth("admin", "admin")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			if w := do(http.MethodPut, tt.unroutedPath); w.Code != http.StatusNotFound {
+				t.Errorf("Expected %s to be unrouted, got %d", tt.unroutedPath, w.Code)
+			}
+
+			w := do(http.MethodPut, tt.stopPath)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if w.Header().Get("Location") == "" {
+				t.Error("Expected a Location header")
+			}
+			if tt.status == http.StatusAccepted {
+				var task Task
+				if err := json.Unmarshal(w.Body.Bytes(), &task); err != nil || task.ID == 0 {
+					t.Errorf("Expected the task in the body, got %s", w.Body.String())
+				}
+			}
+
+			var info map[string]interface{}
+			json.Unmarshal(do(http.MethodGet, "/info").Body.Bytes(), &info)
+			if info["version"] != tt.version {
+				t.Errorf("Expected version %q, got %v", tt.version, info["version"])
+			}
+
+			var body map[string]interface{}
+			json.Unmarshal(do(http.MethodGet, "/deployments/missing").Body.Bytes(), &body)
+			if _, named := body["name"]; named != tt.errorHasNames {
+				t.Errorf("Expected error name present=%v, got %v", tt.errorHasNames, body)
+			}
+			if tt.errorHasNames && body["name"] != "DeploymentNotFound" {
+				t.Errorf("Expected DeploymentNotFound, got %v", body["name"])
+			}
+		})
+	}
+
+	config := DefaultServerConfig()
+	config.BoshVersionMode = "ancient"
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected an error for an unknown version mode")
+	}
+}
@@ -0,0 +1,554 @@
+// ABOUTME: A small YAML reader for hand-written fixture files: block maps and
+// ABOUTME: lists, flow lists and maps, quoted and block scalars, and comments.
+
+package mockbosh
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses a YAML document into maps, slices, strings, and nils.
+// Scalars stay strings until decodeYAML converts them for their field. It
+// covers what fixture files need and is not a general YAML parser: there are
+// no anchors, tags, or multi-document streams.
+func parseYAML(src string) (interface{}, error) {
+	p := &yamlParser{lines: strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")}
+	for i, line := range p.lines {
+		if strings.TrimSpace(line) == "---" {
+			p.lines[i] = ""
+		}
+	}
+	node, err := p.parseBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, p.errorf("expected end of document")
+	}
+	return node, nil
+}
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// skipBlank moves past blank and comment-only lines.
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		trimmed := strings.TrimSpace(p.lines[p.pos])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+// current returns the indentation and comment-free text of the current line.
+func (p *yamlParser) current() (int, string, error) {
+	line := p.lines[p.pos]
+	text := strings.TrimLeft(line, " ")
+	if strings.HasPrefix(text, "\t") {
+		return 0, "", p.errorf("tabs are not allowed in indentation")
+	}
+	return len(line) - len(text), strings.TrimSpace(stripYAMLComment(text)), nil
+}
+
+// parseBlock parses the map or list starting at the next line indented at
+// least minIndent, or returns nil if there is none.
+func (p *yamlParser) parseBlock(minIndent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	indent, text, err := p.current()
+	if err != nil || indent < minIndent {
+		return nil, err
+	}
+	if isYAMLItem(text) {
+		return p.parseList(indent)
+	}
+	if _, _, ok := splitYAMLEntry(text); !ok {
+		node, err := parseYAMLScalar(text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseMap(indent)
+}
+
+// parseList parses "- item" lines at indent.
+func (p *yamlParser) parseList(indent int) (interface{}, error) {
+	list := []interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		lineIndent, text, err := p.current()
+		if err != nil {
+			return nil, err
+		}
+		if lineIndent < indent {
+			break
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if !isYAMLItem(text) {
+			break
+		}
+
+		rest := strings.TrimLeft(text[1:], " ")
+		var item interface{}
+		switch {
+		case rest == "":
+			p.pos++
+			item, err = p.parseBlock(indent + 1)
+		case isYAMLItem(rest) || yamlEntry(rest):
+			// The item is a nested block starting on the dash's line, so
+			// reread the line with the dash as indentation
+			column := indent + len(text) - len(rest)
+			p.lines[p.pos] = strings.Repeat(" ", column) + p.lines[p.pos][column:]
+			item, err = p.parseBlock(column)
+		default:
+			item, err = parseYAMLScalar(rest)
+			if err != nil {
+				err = p.errorf("%v", err)
+			}
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+// parseMap parses "key: value" lines at indent.
+func (p *yamlParser) parseMap(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		lineIndent, text, err := p.current()
+		if err != nil {
+			return nil, err
+		}
+		if lineIndent < indent || (lineIndent == indent && isYAMLItem(text)) {
+			break
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		key, rest, ok := splitYAMLEntry(text)
+		if !ok {
+			return nil, p.errorf("expected key: value, got %q", text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		var value interface{}
+		switch {
+		case rest == "":
+			p.pos++
+			value, err = p.parseNested(indent)
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			value, err = p.parseBlockScalar(indent, rest)
+		default:
+			value, err = parseYAMLScalar(rest)
+			if err != nil {
+				err = p.errorf("%v", err)
+			}
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// parseNested parses the value under a key with nothing after its colon.
+// Lists may sit at the key's own indentation.
+func (p *yamlParser) parseNested(indent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		next, text, err := p.current()
+		if err != nil {
+			return nil, err
+		}
+		if next == indent && isYAMLItem(text) {
+			return p.parseList(indent)
+		}
+	}
+	return p.parseBlock(indent + 1)
+}
+
+// parseBlockScalar reads the literal (|) or folded (>) text indented under
+// the current line.
+func (p *yamlParser) parseBlockScalar(indent int, header string) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, p.errorf("unsupported block scalar header %q", header)
+	}
+	p.pos++
+
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		if lineIndent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = lineIndent
+		}
+		if lineIndent < blockIndent {
+			break
+		}
+		lines = append(lines, line[blockIndent:])
+	}
+
+	// Trailing blank lines belong to the next key unless kept with +
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	trailing := len(lines) - end
+	lines = lines[:end]
+
+	text := strings.Join(lines, "\n")
+	if folded {
+		text = foldYAMLLines(lines)
+	}
+	switch {
+	case chomp == "-" || text == "":
+	case chomp == "+":
+		text += strings.Repeat("\n", trailing+1)
+	default:
+		text += "\n"
+	}
+	return text, nil
+}
+
+// foldYAMLLines joins lines with spaces, keeping blank lines as newlines.
+func foldYAMLLines(lines []string) string {
+	var b strings.Builder
+	for i, line := range lines {
+		switch {
+		case line == "":
+			b.WriteString("\n")
+			continue
+		case i > 0 && lines[i-1] != "":
+			b.WriteString(" ")
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// isYAMLItem reports whether text is a block list item.
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlEntry reports whether text is a "key: value" entry.
+func yamlEntry(text string) bool {
+	_, _, ok := splitYAMLEntry(text)
+	return ok
+}
+
+// splitYAMLEntry splits "key: value" at the first colon outside quotes and
+// brackets that ends the text or is followed by a space.
+func splitYAMLEntry(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if unquoted, err := parseYAMLScalar(key); err == nil {
+				if s, ok := unquoted.(string); ok {
+					key = s
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment drops a trailing " # comment" outside quotes.
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || text[i-1] == ' ' || text[i-1] == '[' || text[i-1] == '{' || text[i-1] == ',' || text[i-1] == ':' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// parseYAMLScalar parses an inline value: a quoted or plain string, a null,
+// or a flow list or map.
+func parseYAMLScalar(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "~" || s == "null" || s == "Null" || s == "NULL":
+		return nil, nil
+	case s[0] == '"':
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return unquoted, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated single-quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, fmt.Errorf("unterminated flow list %s", s)
+		}
+		list := []interface{}{}
+		for _, part := range splitYAMLFlow(s[1 : len(s)-1]) {
+			item, err := parseYAMLScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case s[0] == '{':
+		if s[len(s)-1] != '}' {
+			return nil, fmt.Errorf("unterminated flow map %s", s)
+		}
+		m := map[string]interface{}{}
+		for _, part := range splitYAMLFlow(s[1 : len(s)-1]) {
+			key, rest, ok := splitYAMLEntry(part)
+			if !ok {
+				return nil, fmt.Errorf("expected key: value in flow map, got %q", part)
+			}
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return s, nil
+}
+
+// splitYAMLFlow splits the inside of a flow collection at top-level commas.
+func splitYAMLFlow(s string) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(parts) > 0 {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// decodeYAML stores a parsed node in target, a pointer, matching map keys to
+// struct fields by their json tags and converting scalars to each field's
+// type. Unknown keys are errors so typos in hand-written files surface.
+func decodeYAML(node interface{}, target interface{}) error {
+	return decodeYAMLValue(node, reflect.ValueOf(target).Elem(), "")
+}
+
+func decodeYAMLValue(node interface{}, v reflect.Value, path string) error {
+	if node == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	describe := func() string {
+		if path == "" {
+			return "document"
+		}
+		return path
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeYAMLValue(node, elem.Elem(), path); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return fmt.Errorf("%s: cannot decode into %s", describe(), v.Type())
+		}
+		v.Set(reflect.ValueOf(node))
+		return nil
+	case reflect.Slice:
+		list, ok := node.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a list", describe())
+		}
+		slice := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := decodeYAMLValue(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Map:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a map", describe())
+		}
+		out := reflect.MakeMapWithSize(v.Type(), len(m))
+		for key, item := range m {
+			k := reflect.New(v.Type().Key()).Elem()
+			if err := decodeYAMLValue(key, k, describe()+" key"); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeYAMLValue(item, elem, yamlPath(path, key)); err != nil {
+				return err
+			}
+			out.SetMapIndex(k, elem)
+		}
+		v.Set(out)
+		return nil
+	case reflect.Struct:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a map", describe())
+		}
+		fields := yamlFields(v.Type())
+		for key, item := range m {
+			i, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("%s: unknown field %q", describe(), key)
+			}
+			if err := decodeYAMLValue(item, v.Field(i), yamlPath(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	s, ok := node.(string)
+	if !ok {
+		return fmt.Errorf("%s: expected a scalar", describe())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: expected true or false, got %q", describe(), s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return fmt.Errorf("%s: expected an integer, got %q", describe(), s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return fmt.Errorf("%s: expected a non-negative integer, got %q", describe(), s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%s: expected a number, got %q", describe(), s)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("%s: cannot decode into %s", describe(), v.Type())
+	}
+	return nil
+}
+
+// yamlFields maps a struct's json names to field indexes.
+func yamlFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+func yamlPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,82 @@
+// ABOUTME: Tests for the fixture YAML reader.
+// ABOUTME: Covers collections, quoting, block scalars, nesting, and errors.
+
+package mockbosh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	type m = map[string]interface{}
+	type l = []interface{}
+
+	tests := []struct {
+		name string
+		src  string
+		want interface{}
+	}{
+		{"flow list", "tags: [a, 'b, c', [d]]", m{"tags": l{"a", "b, c", l{"d"}}}},
+		{"flow map", "sc: {name: ubuntu, version: \"1.0\"}", m{"sc": m{"name": "ubuntu", "version": "1.0"}}},
+		{"empty flow", "a: []\nb: {}", m{"a": l{}, "b": m{}}},
+		{"flow list of maps", "- [{a: 1}, {b: ~}]", l{l{m{"a": "1"}, m{"b": nil}}}},
+		{"double-quoted hash", `url: "http://x/#frag" # comment`, m{"url": "http://x/#frag"}},
+		{"single-quoted colon", "cmd: 'a: b' # comment", m{"cmd": "a: b"}},
+		{"single-quoted escape", "who: 'it''s'", m{"who": "it's"}},
+		{"quoted key", `"a: b": c`, m{"a: b": "c"}},
+		{"plain hash", "channel: a#b", m{"channel": "a#b"}},
+		{"plain colon", "addr: 10.0.0.1:80", m{"addr": "10.0.0.1:80"}},
+		{"literal clip", "text: |\n  a\n  b\n\nnext: x", m{"text": "a\nb\n", "next": "x"}},
+		{"literal strip", "text: |-\n  a\n  b\n\nnext: x", m{"text": "a\nb", "next": "x"}},
+		{"literal keep", "text: |+\n  a\n\n\nnext: x", m{"text": "a\n\n\n", "next": "x"}},
+		{"folded", "text: >\n  a\n  b\n\n  c\n", m{"text": "a b\nc\n"}},
+		{"folded strip", "text: >-\n  a\n  b\n", m{"text": "a b"}},
+		{"literal indentation", "text: |\n  a\n    b\n", m{"text": "a\n  b\n"}},
+		{"dash map", "- name: a\n  version: 1\n- name: b", l{m{"name": "a", "version": "1"}, m{"name": "b"}}},
+		{"dash nested map", "- name: a\n  jobs:\n  - name: j\n    props:\n      x: 1", l{m{"name": "a", "jobs": l{m{"name": "j", "props": m{"x": "1"}}}}}},
+		{"dash nested list", "- - a\n  - b\n- c", l{l{"a", "b"}, "c"}},
+		{"dash on own line", "-\n  name: a", l{m{"name": "a"}}},
+		{"list at key indentation", "jobs:\n- a\n- b\nname: x", m{"jobs": l{"a", "b"}, "name": "x"}},
+		{"nulls", "a:\nb: ~\nc: null", m{"a": nil, "b": nil, "c": nil}},
+		{"document marker", "---\n# only a comment\na: 1", m{"a": "1"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseYAML(tt.src)
+		if err != nil {
+			t.Errorf("%s: parseYAML failed: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"over-indented key", "a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"over-indented item", "- a\n\n# note\n   - b", "line 4: unexpected indentation"},
+		{"tab", "a:\n\tb: 1", "line 2: tabs are not allowed"},
+		{"duplicate key", "a: 1\nb: 2\na: 3", `line 3: duplicate key "a"`},
+		{"missing colon", "a: 1\nb", `line 2: expected key: value, got "b"`},
+		{"bad double quote", "a: 1\nb: \"x\\q\"", "line 2: invalid double-quoted string"},
+		{"unterminated single quote", "- 'x", "line 1: unterminated single-quoted string"},
+		{"unterminated flow list", "a:\n  b: [1, 2", "line 2: unterminated flow list"},
+		{"flow map entry", "a: {b}", `line 1: expected key: value in flow map, got "b"`},
+		{"block scalar header", "a: |2\n  x", `line 1: unsupported block scalar header "|2"`},
+	}
+
+	for _, tt := range tests {
+		_, err := parseYAML(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}